@@ -1,7 +1,7 @@
 #!/bin/bash
 echo "Running all provider tests..."
 
-for script in test-s3.sh test-r2.sh test-b2.sh test-b2s3.sh test-sftp.sh; do
+for script in test-s3.sh test-r2.sh test-b2.sh test-b2s3.sh test-s3compat.sh test-azure.sh test-gcs.sh test-webdav.sh test-ftp.sh test-sftp.sh test-local.sh; do
     echo "Running $script..."
     ./$script
     echo "----------------------------------------"
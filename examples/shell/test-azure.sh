@@ -0,0 +1,9 @@
+#!/bin/bash
+# Runs against a local Azurite emulator by default, e.g.:
+#   docker run -p 10000:10000 mcr.microsoft.com/azure-storage/azurite azurite-blob --blobHost 0.0.0.0
+# Create the container first (for example with Azure Storage Explorer or the az CLI).
+export RUN_INTEGRATION_TESTS=true
+export AZURE_CONTAINER=your-container
+export AZURE_STORAGE_CONNECTION_STRING="DefaultEndpointsProtocol=http;AccountName=devstoreaccount1;AccountKey=Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw==;BlobEndpoint=http://127.0.0.1:10000/devstoreaccount1;"
+
+go test -v ./test/integration -run ".*Azure.*"
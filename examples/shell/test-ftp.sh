@@ -0,0 +1,11 @@
+#!/bin/bash
+export RUN_INTEGRATION_TESTS=true
+export FTP_HOST=your-ftp-server
+export FTP_USER=your-username
+export FTP_PASSWORD=your-password
+export FTP_PATH=/path/on/server
+# Choose one TLS mode: none, explicit or implicit
+export FTP_TLS=explicit
+# export FTP_INSECURE=true  # accept a self-signed certificate
+
+go test -v ./test/integration -run ".*/FTP.*"
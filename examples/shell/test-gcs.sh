@@ -0,0 +1,10 @@
+#!/bin/bash
+# Runs against a local fake-gcs-server by default, e.g.:
+#   docker run -p 4443:4443 fsouza/fake-gcs-server -scheme http -external-url http://localhost:4443
+# For real GCS, unset GCS_ENDPOINT and set GOOGLE_APPLICATION_CREDENTIALS instead.
+export RUN_INTEGRATION_TESTS=true
+export GCS_BUCKET=your-bucket
+export GCS_ENDPOINT=http://localhost:4443
+# export GOOGLE_APPLICATION_CREDENTIALS=/path/to/service-account.json
+
+go test -v ./test/integration -run ".*GCS.*"
@@ -0,0 +1,5 @@
+#!/bin/bash
+export RUN_INTEGRATION_TESTS=true
+export LOCAL_PATH=/tmp/baxfer-local-test
+
+go test -v ./test/integration -run ".*Local.*"
@@ -0,0 +1,11 @@
+#!/bin/bash
+# Runs against a local MinIO instance, e.g.:
+#   docker run -p 9000:9000 minio/minio server /data
+export RUN_INTEGRATION_TESTS=true
+export S3COMPAT_ENDPOINT=http://localhost:9000
+export S3COMPAT_BUCKET=your-bucket
+export S3COMPAT_ACCESS_KEY=minioadmin
+export S3COMPAT_SECRET_KEY=minioadmin
+export S3COMPAT_PATH_STYLE=true
+
+go test -v ./test/integration -run ".*S3Compat.*"
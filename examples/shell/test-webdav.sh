@@ -0,0 +1,9 @@
+#!/bin/bash
+# Runs against any WebDAV server, e.g. a local Nextcloud:
+#   docker run -p 8080:80 nextcloud
+export RUN_INTEGRATION_TESTS=true
+export WEBDAV_URL=http://localhost:8080/remote.php/dav/files/your-user/baxfer-test
+export WEBDAV_USER=your-user
+export WEBDAV_PASSWORD=your-app-password
+
+go test -v ./test/integration -run ".*WebDAV.*"
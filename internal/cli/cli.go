@@ -2,9 +2,13 @@ package cli
 
 import (
 	"errors"
+	"flag"
 	"fmt"
+	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/ngns-io/baxfer/internal/config"
 	"github.com/ngns-io/baxfer/pkg/logger"
 	"github.com/ngns-io/baxfer/pkg/storage"
 	"github.com/urfave/cli/v2"
@@ -24,6 +28,10 @@ func NewApp() *cli.App {
 			newUploadCommand(),
 			newDownloadCommand(),
 			newPruneCommand(),
+			newListCommand(),
+			newVerifyCommand(),
+			newHistoryCommand(),
+			newRunCommand(),
 		},
 	}
 	return app
@@ -43,18 +51,18 @@ func newUploadCommand() *cli.Command {
 			&cli.StringFlag{
 				Name:    "provider",
 				Aliases: []string{"p"},
-				Usage:   "Storage provider (s3, b2, b2s3, r2, or sftp)",
+				Usage:   "Storage provider (s3, b2, b2s3, r2, s3compat, azure, gcs, webdav, ftp, sftp, or local); a comma-separated list uploads to each, e.g. s3:bucket-a,sftp",
 				Value:   "s3",
 			},
 			&cli.StringFlag{
 				Name:    "region",
 				Aliases: []string{"r"},
-				Usage:   "AWS region (for S3 and b2s3 only)",
+				Usage:   "AWS region (for s3, b2s3, and s3compat only)",
 			},
 			&cli.StringFlag{
 				Name:    "bucket",
 				Aliases: []string{"b"},
-				Usage:   "Storage bucket name (required for s3, b2, b2s3, r2)",
+				Usage:   "Storage bucket or container name (required for s3, b2, b2s3, r2, s3compat, azure, gcs)",
 			},
 			&cli.StringFlag{
 				Name:    "keyprefix",
@@ -67,10 +75,67 @@ func newUploadCommand() *cli.Command {
 				Usage:   "File extension for backup files",
 				Value:   ".bak",
 			},
-			&cli.BoolFlag{
+			&cli.GenericFlag{
 				Name:    "compress",
 				Aliases: []string{"c"},
-				Usage:   "Compress files before uploading",
+				Usage:   "Compress files before uploading: --compress=zip, gzip, zstd or none (a bare --compress means zip)",
+				Value:   &compressionValue{},
+			},
+			&cli.IntFlag{
+				Name:  "compress-level",
+				Usage: "Compression level: 1-9 for zip and gzip, 1-22 for zstd (default: the format's default)",
+			},
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "Report the files that would be uploaded without uploading them",
+			},
+			&cli.IntFlag{
+				Name:  "parallel",
+				Usage: "Number of files to check and upload at once",
+				Value: 1,
+			},
+			&cli.BoolFlag{
+				Name:  "continue-on-error",
+				Usage: "Keep uploading the other files when one fails, and exit with an error at the end",
+			},
+			&cli.StringFlag{
+				Name:    "bwlimit",
+				Usage:   "Limit upload bandwidth to a rate such as 20M, or a schedule such as 08:00-18:00=5M,off-hours=unlimited",
+				EnvVars: []string{"BAXFER_BWLIMIT"},
+			},
+			&cli.BoolFlag{
+				Name:  "stdin",
+				Usage: "Upload standard input to --key instead of the files under a root directory, e.g. from pg_dump",
+			},
+			&cli.StringFlag{
+				Name:  "key",
+				Usage: "Key to upload standard input to with --stdin, under --keyprefix",
+			},
+			&cli.BoolFlag{
+				Name:  "checksum",
+				Usage: "Store a SHA-256 checksum with each uploaded file, for verify and download --verify. Stored files without one are uploaded again",
+			},
+			&cli.StringFlag{
+				Name:  "compare",
+				Usage: "How stored files are checked for changes: mtime, size or checksum",
+				Value: "mtime",
+			},
+			&cli.BoolFlag{
+				Name:  "encrypt",
+				Usage: "Encrypt files with age before uploading (adds .age to keys)",
+			},
+			&cli.StringSliceFlag{
+				Name:    "recipient",
+				Usage:   "age public key (age1...) to encrypt to; may be repeated",
+				EnvVars: []string{"BAXFER_RECIPIENT"},
+			},
+			&cli.StringFlag{
+				Name:  "recipients-file",
+				Usage: "File of age public keys to encrypt to, one per line",
+			},
+			&cli.StringFlag{
+				Name:  "passphrase-file",
+				Usage: "File whose first line is the passphrase to encrypt with, instead of public keys",
 			},
 		},
 		Action: func(c *cli.Context) error {
@@ -80,14 +145,21 @@ func newUploadCommand() *cli.Command {
 			}
 			defer log.Close()
 
-			uploader, err := getUploader(c, log)
+			uploader, err := getFanoutUploader(c, log)
 			if err != nil {
 				return cli.Exit(err.Error(), 1)
 			}
 			return storage.Upload(c, uploader, log)
 		},
 	}
+	cmd.Flags = append(cmd.Flags, s3compatFlags()...)
+	cmd.Flags = append(cmd.Flags, gcsFlags()...)
+	cmd.Flags = append(cmd.Flags, webdavFlags()...)
+	cmd.Flags = append(cmd.Flags, ftpFlags()...)
 	cmd.Flags = append(cmd.Flags, sftpFlags()...)
+	cmd.Flags = append(cmd.Flags, localFlags()...)
+	cmd.Flags = append(cmd.Flags, uploadStateFlags()...)
+	cmd.Flags = append(cmd.Flags, retryFlags()...)
 	cmd.Flags = append(cmd.Flags, loggingFlags()...)
 	return cmd
 }
@@ -102,24 +174,56 @@ func newDownloadCommand() *cli.Command {
 			&cli.StringFlag{
 				Name:    "provider",
 				Aliases: []string{"p"},
-				Usage:   "Storage provider (s3, b2, b2s3, r2, or sftp)",
+				Usage:   "Storage provider (s3, b2, b2s3, r2, s3compat, azure, gcs, webdav, ftp, sftp, or local)",
 				Value:   "s3",
 			},
 			&cli.StringFlag{
 				Name:    "region",
 				Aliases: []string{"r"},
-				Usage:   "AWS region (for S3 and b2s3 only)",
+				Usage:   "AWS region (for s3, b2s3, and s3compat only)",
 			},
 			&cli.StringFlag{
 				Name:    "bucket",
 				Aliases: []string{"b"},
-				Usage:   "Storage bucket name (required for s3, b2, b2s3, r2)",
+				Usage:   "Storage bucket or container name (required for s3, b2, b2s3, r2, s3compat, azure, gcs)",
 			},
 			&cli.StringFlag{
 				Name:    "output",
 				Aliases: []string{"o"},
 				Usage:   "Output file name",
 			},
+			&cli.BoolFlag{
+				Name:  "resume",
+				Usage: "Append to a partial output file, downloading only the rest (s3, b2, b2s3, r2, s3compat, sftp and local)",
+			},
+			&cli.IntFlag{
+				Name:  "parallel",
+				Usage: "Number of 32 MiB byte ranges of a large file to download at once",
+				Value: 1,
+			},
+			&cli.StringFlag{
+				Name:    "bwlimit",
+				Usage:   "Limit download bandwidth to a rate such as 20M, or a schedule such as 08:00-18:00=5M,off-hours=unlimited",
+				EnvVars: []string{"BAXFER_BWLIMIT"},
+			},
+			&cli.BoolFlag{
+				Name:  "verify",
+				Usage: "Check the download against the checksum stored when it was uploaded",
+			},
+			&cli.BoolFlag{
+				Name:  "decompress",
+				Usage: "Decompress files uploaded with --compress (.zip, .gz, .zst) to their original name",
+			},
+			&cli.StringFlag{
+				Name:    "identity",
+				Aliases: []string{"i"},
+				Usage:   "age identity file (AGE-SECRET-KEY-...) to decrypt .age files with",
+				EnvVars: []string{"BAXFER_IDENTITY"},
+			},
+			&cli.StringFlag{
+				Name:  "passphrase-file",
+				Usage: "File whose first line is the passphrase to decrypt .age files with",
+			},
 		},
 		Action: func(c *cli.Context) error {
 			log, err := initLogger(c)
@@ -146,7 +250,13 @@ func newDownloadCommand() *cli.Command {
 			return nil
 		},
 	}
+	cmd.Flags = append(cmd.Flags, s3compatFlags()...)
+	cmd.Flags = append(cmd.Flags, gcsFlags()...)
+	cmd.Flags = append(cmd.Flags, webdavFlags()...)
+	cmd.Flags = append(cmd.Flags, ftpFlags()...)
 	cmd.Flags = append(cmd.Flags, sftpFlags()...)
+	cmd.Flags = append(cmd.Flags, localFlags()...)
+	cmd.Flags = append(cmd.Flags, retryFlags()...)
 	cmd.Flags = append(cmd.Flags, loggingFlags()...)
 	return cmd
 }
@@ -160,18 +270,18 @@ func newPruneCommand() *cli.Command {
 			&cli.StringFlag{
 				Name:    "provider",
 				Aliases: []string{"p"},
-				Usage:   "Storage provider (s3, b2, b2s3, r2, or sftp)",
+				Usage:   "Storage provider (s3, b2, b2s3, r2, s3compat, azure, gcs, webdav, ftp, sftp, or local)",
 				Value:   "s3",
 			},
 			&cli.StringFlag{
 				Name:    "region",
 				Aliases: []string{"r"},
-				Usage:   "AWS region (for S3 and b2s3 only)",
+				Usage:   "AWS region (for s3, b2s3, and s3compat only)",
 			},
 			&cli.StringFlag{
 				Name:    "bucket",
 				Aliases: []string{"b"},
-				Usage:   "Storage bucket name (required for s3, b2, b2s3, r2)",
+				Usage:   "Storage bucket or container name (required for s3, b2, b2s3, r2, s3compat, azure, gcs)",
 			},
 			&cli.StringFlag{
 				Name:    "keyprefix",
@@ -179,10 +289,46 @@ func newPruneCommand() *cli.Command {
 				Usage:   "Prefix for storage keys",
 			},
 			&cli.DurationFlag{
-				Name:     "age",
-				Aliases:  []string{"a"},
-				Usage:    "Age of files to prune (e.g., 720h for 30 days)",
-				Required: true,
+				Name:    "age",
+				Aliases: []string{"a"},
+				Usage:   "Age of files to prune (e.g., 720h for 30 days); with a retention policy, only older files are pruned",
+			},
+			&cli.IntFlag{
+				Name:  "keep-last",
+				Usage: "Keep the N most recent backups in each series",
+			},
+			&cli.IntFlag{
+				Name:  "keep-daily",
+				Usage: "Keep the newest backup of each of the last N days with backups",
+			},
+			&cli.IntFlag{
+				Name:  "keep-weekly",
+				Usage: "Keep the newest backup of each of the last N weeks with backups",
+			},
+			&cli.IntFlag{
+				Name:  "keep-monthly",
+				Usage: "Keep the newest backup of each of the last N months with backups",
+			},
+			&cli.IntFlag{
+				Name:  "keep-yearly",
+				Usage: "Keep the newest backup of each of the last N years with backups",
+			},
+			&cli.StringFlag{
+				Name:  "series",
+				Usage: "How backups are grouped for the retention policy: dir (per directory) or name (per directory and database name)",
+				Value: storage.SeriesByDir,
+			},
+			&cli.IntFlag{
+				Name:  "min-keep",
+				Usage: "Always keep the N most recent backups in each series, whatever their age",
+			},
+			&cli.StringFlag{
+				Name:  "max-delete",
+				Usage: "Abort without deleting anything if more than this many files (e.g. 50) or this percentage of the files under the prefix (e.g. 25%) would be deleted",
+			},
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "Report the files that would be deleted without deleting them",
 			},
 		},
 		Action: func(c *cli.Context) error {
@@ -192,40 +338,565 @@ func newPruneCommand() *cli.Command {
 			}
 			defer log.Close()
 
-			uploader, err := getUploader(c, log)
+			p, err := singleProfile(c)
 			if err != nil {
 				return cli.Exit(err.Error(), 1)
 			}
+			uploader, err := newUploader(p, nil, log)
+			if err != nil {
+				return cli.Exit(err.Error(), 1)
+			}
+			// Named as upload names it, so the files deleted are removed from
+			// the state database too
+			uploader = storage.Named(storage.WithRetry(uploader, storage.RetryPolicyFromFlags(c), log), stateID(p))
 			return storage.Prune(c, uploader, log)
 		},
 	}
+	cmd.Flags = append(cmd.Flags, s3compatFlags()...)
+	cmd.Flags = append(cmd.Flags, gcsFlags()...)
+	cmd.Flags = append(cmd.Flags, webdavFlags()...)
+	cmd.Flags = append(cmd.Flags, ftpFlags()...)
 	cmd.Flags = append(cmd.Flags, sftpFlags()...)
+	cmd.Flags = append(cmd.Flags, localFlags()...)
+	cmd.Flags = append(cmd.Flags, stateFlags()...)
+	cmd.Flags = append(cmd.Flags, retryFlags()...)
 	cmd.Flags = append(cmd.Flags, loggingFlags()...)
 	return cmd
 }
 
-func sftpFlags() []cli.Flag {
+func newListCommand() *cli.Command {
+	cmd := &cli.Command{
+		Name:    "list",
+		Aliases: []string{"ls"},
+		Usage:   "List backup files in cloud storage",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "provider",
+				Aliases: []string{"p"},
+				Usage:   "Storage provider (s3, b2, b2s3, r2, s3compat, azure, gcs, webdav, ftp, sftp, or local)",
+				Value:   "s3",
+			},
+			&cli.StringFlag{
+				Name:    "region",
+				Aliases: []string{"r"},
+				Usage:   "AWS region (for s3, b2s3, and s3compat only)",
+			},
+			&cli.StringFlag{
+				Name:    "bucket",
+				Aliases: []string{"b"},
+				Usage:   "Storage bucket or container name (required for s3, b2, b2s3, r2, s3compat, azure, gcs)",
+			},
+			&cli.StringFlag{
+				Name:  "prefix",
+				Usage: "Only list keys starting with this prefix",
+			},
+			&cli.StringFlag{
+				Name:    "format",
+				Aliases: []string{"f"},
+				Usage:   "Output format: table, json or csv",
+				Value:   "table",
+			},
+			&cli.StringFlag{
+				Name:  "sort",
+				Usage: "Sort by key, size or time",
+				Value: "key",
+			},
+			&cli.BoolFlag{
+				Name:  "reverse",
+				Usage: "Reverse the sort order",
+			},
+			&cli.StringFlag{
+				Name:  "since",
+				Usage: "Only list files modified at or after this time (RFC 3339, 2006-01-02, or a duration ago such as 168h)",
+			},
+			&cli.StringFlag{
+				Name:  "until",
+				Usage: "Only list files modified at or before this time (RFC 3339, 2006-01-02, or a duration ago such as 168h)",
+			},
+			&cli.BoolFlag{
+				Name:  "recursive",
+				Usage: "List every key; with --recursive=false, keys below the next / are grouped into directories",
+				Value: true,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			log, err := initLogger(c)
+			if err != nil {
+				return cli.Exit(err.Error(), 1)
+			}
+			defer log.Close()
+
+			uploader, err := getUploader(c, log)
+			if err != nil {
+				return cli.Exit(err.Error(), 1)
+			}
+			return storage.List(c, uploader, log)
+		},
+	}
+	cmd.Flags = append(cmd.Flags, s3compatFlags()...)
+	cmd.Flags = append(cmd.Flags, gcsFlags()...)
+	cmd.Flags = append(cmd.Flags, webdavFlags()...)
+	cmd.Flags = append(cmd.Flags, ftpFlags()...)
+	cmd.Flags = append(cmd.Flags, sftpFlags()...)
+	cmd.Flags = append(cmd.Flags, localFlags()...)
+	cmd.Flags = append(cmd.Flags, retryFlags()...)
+	cmd.Flags = append(cmd.Flags, loggingFlags()...)
+	return cmd
+}
+
+func newVerifyCommand() *cli.Command {
+	cmd := &cli.Command{
+		Name:      "verify",
+		Usage:     "Check stored backup files against the checksums stored when they were uploaded",
+		ArgsUsage: "[key...]",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "provider",
+				Aliases: []string{"p"},
+				Usage:   "Storage provider (s3, b2, b2s3, r2, s3compat, azure, gcs, webdav, ftp, sftp, or local)",
+				Value:   "s3",
+			},
+			&cli.StringFlag{
+				Name:    "region",
+				Aliases: []string{"r"},
+				Usage:   "AWS region (for s3, b2s3, and s3compat only)",
+			},
+			&cli.StringFlag{
+				Name:    "bucket",
+				Aliases: []string{"b"},
+				Usage:   "Storage bucket or container name (required for s3, b2, b2s3, r2, s3compat, azure, gcs)",
+			},
+			&cli.StringFlag{
+				Name:  "prefix",
+				Usage: "Verify every file under this key prefix when no keys are given",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			log, err := initLogger(c)
+			if err != nil {
+				return cli.Exit(err.Error(), 1)
+			}
+			defer log.Close()
+
+			uploader, err := getUploader(c, log)
+			if err != nil {
+				return cli.Exit(err.Error(), 1)
+			}
+			return storage.Verify(c, uploader, log)
+		},
+	}
+	cmd.Flags = append(cmd.Flags, s3compatFlags()...)
+	cmd.Flags = append(cmd.Flags, gcsFlags()...)
+	cmd.Flags = append(cmd.Flags, webdavFlags()...)
+	cmd.Flags = append(cmd.Flags, ftpFlags()...)
+	cmd.Flags = append(cmd.Flags, sftpFlags()...)
+	cmd.Flags = append(cmd.Flags, localFlags()...)
+	cmd.Flags = append(cmd.Flags, retryFlags()...)
+	cmd.Flags = append(cmd.Flags, loggingFlags()...)
+	return cmd
+}
+
+func newHistoryCommand() *cli.Command {
+	cmd := &cli.Command{
+		Name:  "history",
+		Usage: "Show the uploads recorded in the state database",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "state-file",
+				Usage: "State database to read (default: " + defaultStateUsage + ")",
+			},
+			&cli.StringFlag{
+				Name:  "prefix",
+				Usage: "Only show keys starting with this prefix",
+			},
+			&cli.StringFlag{
+				Name:  "destination",
+				Usage: "Only show uploads to this destination, as shown in the DESTINATION column",
+			},
+			&cli.StringFlag{
+				Name:    "format",
+				Aliases: []string{"f"},
+				Usage:   "Output format: table, json or csv",
+				Value:   "table",
+			},
+			&cli.StringFlag{
+				Name:  "since",
+				Usage: "Only show uploads at or after this time (RFC 3339, 2006-01-02, or a duration ago such as 168h)",
+			},
+			&cli.StringFlag{
+				Name:  "until",
+				Usage: "Only show uploads at or before this time (RFC 3339, 2006-01-02, or a duration ago such as 168h)",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			log, err := initLogger(c)
+			if err != nil {
+				return cli.Exit(err.Error(), 1)
+			}
+			defer log.Close()
+
+			return storage.History(c, log)
+		},
+	}
+	cmd.Flags = append(cmd.Flags, loggingFlags()...)
+	return cmd
+}
+
+func newRunCommand() *cli.Command {
+	cmd := &cli.Command{
+		Name:      "run",
+		Usage:     "Run a backup job defined in the config file",
+		ArgsUsage: "[job]",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "config",
+				Usage:   "Config file (YAML, or TOML with a .toml extension)",
+				Value:   config.DefaultPath(),
+				EnvVars: []string{"BAXFER_CONFIG"},
+			},
+			&cli.BoolFlag{
+				Name:  "non-interactive",
+				Usage: "Run in non-interactive mode (no progress bars)",
+			},
+			&cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "Report the files the job would upload and delete without changing anything",
+			},
+			&cli.IntFlag{
+				Name:  "parallel",
+				Usage: "Number of files to check and upload at once (overrides the job's parallel setting)",
+				Value: 1,
+			},
+			&cli.BoolFlag{
+				Name:  "continue-on-error",
+				Usage: "Keep uploading the other files when one fails, and exit with an error at the end (overrides the job's continue_on_error setting)",
+			},
+			&cli.StringFlag{
+				Name:    "bwlimit",
+				Usage:   "Limit upload bandwidth to a rate such as 20M, or a schedule such as 08:00-18:00=5M,off-hours=unlimited (overrides the job's bwlimit setting)",
+				EnvVars: []string{"BAXFER_BWLIMIT"},
+			},
+			&cli.BoolFlag{
+				Name:  "checksum",
+				Usage: "Store a SHA-256 checksum with each uploaded file (overrides the job's checksum setting)",
+			},
+			&cli.StringFlag{
+				Name:  "compare",
+				Usage: "How stored files are checked for changes: mtime, size or checksum (overrides the job's compare setting)",
+				Value: "mtime",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			cfg, err := config.Load(c.String("config"))
+			if err != nil {
+				return cli.Exit(err.Error(), 1)
+			}
+
+			name := c.Args().First()
+			job, ok := cfg.Jobs[name]
+			if !ok {
+				available := strings.Join(cfg.JobNames(), ", ")
+				if name == "" {
+					return cli.Exit(fmt.Sprintf("No job specified. Available jobs: %s", available), 1)
+				}
+				return cli.Exit(fmt.Sprintf("Unknown job %q. Available jobs: %s", name, available), 1)
+			}
+
+			log, err := initLogger(c)
+			if err != nil {
+				return cli.Exit(err.Error(), 1)
+			}
+			defer log.Close()
+
+			return runJob(c, cfg, name, job, log)
+		},
+	}
+	cmd.Flags = append(cmd.Flags, uploadStateFlags()...)
+	cmd.Flags = append(cmd.Flags, retryFlags()...)
+	cmd.Flags = append(cmd.Flags, loggingFlags()...)
+	return cmd
+}
+
+// runJob uploads a job's backups to each of its destinations and then prunes
+// each destination if the job has a retention age or policy
+func runJob(c *cli.Context, cfg *config.Config, name string, job config.Job, log logger.Logger) error {
+	age, err := job.Retention.MaxAge()
+	if err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+
+	targets := make([]storage.Destination, 0, len(job.Destinations))
+	for _, profile := range job.Destinations {
+		uploader, err := newProfileUploader(cfg.Profiles[profile], log)
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("profile %s: %v", profile, err), 1)
+		}
+		uploader = storage.Named(storage.WithRetry(uploader, storage.RetryPolicyFromFlags(c), log), stateID(cfg.Profiles[profile]))
+		targets = append(targets, storage.Destination{Name: profile, Uploader: uploader})
+	}
+
+	var uploader storage.Uploader = targets[0].Uploader
+	if len(targets) > 1 {
+		if uploader, err = storage.NewMultiUploader(targets, log); err != nil {
+			return cli.Exit(err.Error(), 1)
+		}
+	}
+
+	jobCtx, err := jobContext(c, job, age)
+	if err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+
+	log.Info("Running job", "job", name, "root", job.Root, "destinations", job.Destinations)
+	if err := storage.Upload(jobCtx, uploader, log); err != nil {
+		return err
+	}
+
+	retention := job.Retention
+	if !retention.Enabled() {
+		return nil
+	}
+	for _, t := range targets {
+		log.Info("Pruning destination", "job", name, "destination", t.Name, "age", age,
+			"keepLast", retention.KeepLast, "keepDaily", retention.KeepDaily, "keepWeekly", retention.KeepWeekly,
+			"keepMonthly", retention.KeepMonthly, "keepYearly", retention.KeepYearly)
+		if err := storage.Prune(jobCtx, t.Uploader, log); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jobContext returns a context carrying a job's settings in the flags read by
+// storage.Upload and storage.Prune, with the job's root directory as its
+// argument. Flags the job does not set, such as --non-interactive, are looked
+// up on the run command.
+func jobContext(c *cli.Context, job config.Job, age time.Duration) (*cli.Context, error) {
+	backupExt := job.BackupExt
+	if backupExt == "" {
+		backupExt = ".bak"
+	}
+
+	set := flag.NewFlagSet(c.Command.Name, flag.ContinueOnError)
+	set.String("keyprefix", job.KeyPrefix, "")
+	set.String("backupext", backupExt, "")
+	set.String("compress", string(job.Compress), "")
+	set.Int("compress-level", job.CompressLevel, "")
+	set.Bool("encrypt", job.Encryption.Enabled(), "")
+	set.Var(cli.NewStringSlice(job.Encryption.Recipients...), "recipient", "")
+	set.String("recipients-file", job.Encryption.RecipientsFile, "")
+	set.String("passphrase-file", job.Encryption.PassphraseFile, "")
+	if job.Parallel > 0 && !c.IsSet("parallel") {
+		set.Int("parallel", job.Parallel, "")
+	}
+	if job.Compare != "" && !c.IsSet("compare") {
+		set.String("compare", job.Compare, "")
+	}
+	if job.Checksum && !c.IsSet("checksum") {
+		set.Bool("checksum", true, "")
+	}
+	if job.State && !c.IsSet("state") {
+		set.Bool("state", true, "")
+	}
+	if job.StateFile != "" && !c.IsSet("state-file") {
+		set.String("state-file", job.StateFile, "")
+	}
+	if job.StateCheck && !c.IsSet("state-check") {
+		set.Bool("state-check", true, "")
+	}
+	if job.ContinueOnError && !c.IsSet("continue-on-error") {
+		set.Bool("continue-on-error", true, "")
+	}
+	if job.BwLimit != "" && !c.IsSet("bwlimit") {
+		set.String("bwlimit", job.BwLimit, "")
+	}
+	set.Duration("age", age, "")
+	set.Int("keep-last", job.Retention.KeepLast, "")
+	set.Int("keep-daily", job.Retention.KeepDaily, "")
+	set.Int("keep-weekly", job.Retention.KeepWeekly, "")
+	set.Int("keep-monthly", job.Retention.KeepMonthly, "")
+	set.Int("keep-yearly", job.Retention.KeepYearly, "")
+	set.String("series", job.Retention.Series, "")
+	set.Int("min-keep", job.Retention.MinKeep, "")
+	set.String("max-delete", job.Retention.MaxDelete, "")
+	if err := set.Parse([]string{"--", job.Root}); err != nil {
+		return nil, err
+	}
+	return cli.NewContext(c.App, set, c), nil
+}
+
+// compressionValue is the value of --compress. It is a boolean flag to the
+// flag package, so a bare --compress still means zip and a format must be
+// given as --compress=gzip.
+type compressionValue struct {
+	format string
+}
+
+func (v *compressionValue) Set(value string) error {
+	v.format = value
+	return nil
+}
+
+func (v *compressionValue) String() string {
+	return v.format
+}
+
+// IsBoolFlag lets --compress be given without a value
+func (v *compressionValue) IsBoolFlag() bool {
+	return true
+}
+
+func s3compatFlags() []cli.Flag {
 	return []cli.Flag{
 		&cli.StringFlag{
-			Name:    "sftp-host",
-			Usage:   "SFTP server hostname",
-			EnvVars: []string{"SFTP_HOST"},
+			Name:    "endpoint",
+			Usage:   "Endpoint URL of the S3-compatible service (for s3compat only)",
+			EnvVars: []string{"S3COMPAT_ENDPOINT"},
+		},
+		&cli.BoolFlag{
+			Name:    "path-style",
+			Usage:   "Use path-style addressing instead of virtual-hosted buckets (for s3compat only)",
+			EnvVars: []string{"S3COMPAT_PATH_STYLE"},
+		},
+		&cli.StringFlag{
+			Name:    "access-key",
+			Usage:   "Access key ID (for s3compat only)",
+			EnvVars: []string{"S3COMPAT_ACCESS_KEY"},
+		},
+		&cli.StringFlag{
+			Name:    "secret-key",
+			Usage:   "Secret access key (for s3compat only)",
+			EnvVars: []string{"S3COMPAT_SECRET_KEY"},
+		},
+		&cli.StringFlag{
+			Name:    "ca-bundle",
+			Usage:   "PEM file with additional CA certificates to trust (for s3compat only)",
+			EnvVars: []string{"S3COMPAT_CA_BUNDLE"},
+		},
+	}
+}
+
+func gcsFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    "gcs-endpoint",
+			Usage:   "Override the GCS API endpoint, e.g. for fake-gcs-server (for gcs only)",
+			EnvVars: []string{"GCS_ENDPOINT", "STORAGE_EMULATOR_HOST"},
+		},
+	}
+}
+
+func webdavFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    "webdav-url",
+			Usage:   "WebDAV collection URL, e.g. https://cloud.example.com/remote.php/dav/files/user/backups",
+			EnvVars: []string{"WEBDAV_URL"},
+		},
+		&cli.StringFlag{
+			Name:    "webdav-user",
+			Usage:   "WebDAV username (password is read from WEBDAV_PASSWORD)",
+			EnvVars: []string{"WEBDAV_USER"},
+		},
+	}
+}
+
+// serverFlags returns the host, port, user and path flags shared by the
+// server-based providers, e.g. --sftp-host with the SFTP_HOST env var
+func serverFlags(provider, label string, defaultPort int) []cli.Flag {
+	envPrefix := strings.ToUpper(provider)
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    provider + "-host",
+			Usage:   label + " server hostname",
+			EnvVars: []string{envPrefix + "_HOST"},
 		},
 		&cli.IntFlag{
-			Name:    "sftp-port",
-			Usage:   "SFTP server port",
-			Value:   22,
-			EnvVars: []string{"SFTP_PORT"},
+			Name:    provider + "-port",
+			Usage:   label + " server port",
+			Value:   defaultPort,
+			EnvVars: []string{envPrefix + "_PORT"},
 		},
 		&cli.StringFlag{
-			Name:    "sftp-user",
-			Usage:   "SFTP username",
-			EnvVars: []string{"SFTP_USER"},
+			Name:    provider + "-user",
+			Usage:   label + " username",
+			EnvVars: []string{envPrefix + "_USER"},
 		},
 		&cli.StringFlag{
-			Name:    "sftp-path",
-			Usage:   "Base path on SFTP server",
-			EnvVars: []string{"SFTP_PATH"},
+			Name:    provider + "-path",
+			Usage:   "Base path on " + label + " server",
+			EnvVars: []string{envPrefix + "_PATH"},
+		},
+	}
+}
+
+func ftpFlags() []cli.Flag {
+	return append(serverFlags("ftp", "FTP", 21),
+		&cli.StringFlag{
+			Name:    "ftp-tls",
+			Usage:   "FTPS mode: none, explicit (AUTH TLS) or implicit (port 990 unless --ftp-port is set)",
+			Value:   storage.FTPTLSNone,
+			EnvVars: []string{"FTP_TLS"},
+		},
+		&cli.BoolFlag{
+			Name:    "ftp-insecure",
+			Usage:   "Skip FTPS certificate verification, e.g. for self-signed certificates",
+			EnvVars: []string{"FTP_INSECURE"},
+		},
+	)
+}
+
+func sftpFlags() []cli.Flag {
+	return serverFlags("sftp", "SFTP", 22)
+}
+
+func localFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    "local-path",
+			Usage:   "Base directory (or file:// URL) for local storage",
+			EnvVars: []string{"LOCAL_PATH"},
+		},
+	}
+}
+
+// defaultStateUsage describes the default --state-file in flag usage
+const defaultStateUsage = `~/.local/state/baxfer/baxfer-state.db, or %ProgramData%\baxfer\baxfer-state.db on Windows`
+
+func stateFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "state",
+			Usage: "Record uploads in the state database, so unchanged files are skipped with fewer storage requests and prune forgets the files it deletes",
+		},
+		&cli.StringFlag{
+			Name:  "state-file",
+			Usage: "State database used with --state (default: " + defaultStateUsage + ")",
+		},
+	}
+}
+
+// uploadStateFlags are the state flags of the commands that upload
+func uploadStateFlags() []cli.Flag {
+	return append(stateFlags(), &cli.BoolFlag{
+		Name:  "state-check",
+		Usage: "With --state, still check that each file recorded as uploaded is in storage, in case something other than prune deleted it",
+	})
+}
+
+func retryFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.IntFlag{
+			Name:    "retries",
+			Usage:   "Number of times to retry a storage request that fails with a transient error (timeout, dropped connection, 5xx); 0 disables retries",
+			Value:   3,
+			EnvVars: []string{"BAXFER_RETRIES"},
+		},
+		&cli.DurationFlag{
+			Name:    "retry-backoff",
+			Usage:   "Delay before the first retry, doubled for each one after, with random jitter",
+			Value:   time.Second,
+			EnvVars: []string{"BAXFER_RETRY_BACKOFF"},
 		},
 	}
 }
@@ -283,43 +954,247 @@ func initLogger(c *cli.Context) (logger.Logger, error) {
 	return logger.New(logConfig, c.Bool("quiet"))
 }
 
+// destination is a provider named on the command line, with an optional
+// bucket overriding --bucket
+type destination struct {
+	provider string
+	bucket   string
+}
+
+func (d destination) String() string {
+	if d.bucket == "" {
+		return d.provider
+	}
+	return d.provider + ":" + d.bucket
+}
+
+// parseDestinations splits --provider into its destinations. Each is a
+// provider name, optionally followed by a bucket, e.g. "s3:prod-backups,sftp".
+func parseDestinations(c *cli.Context) ([]destination, error) {
+	var destinations []destination
+	for _, item := range strings.Split(c.String("provider"), ",") {
+		provider, bucket, found := strings.Cut(strings.TrimSpace(item), ":")
+		if provider == "" {
+			return nil, fmt.Errorf("invalid provider list: %q", c.String("provider"))
+		}
+		if !found {
+			bucket = c.String("bucket")
+		}
+		destinations = append(destinations, destination{provider: provider, bucket: bucket})
+	}
+	return destinations, nil
+}
+
+// singleProfile returns the profile of the single provider given by --provider
+func singleProfile(c *cli.Context) (config.Profile, error) {
+	destinations, err := parseDestinations(c)
+	if err != nil {
+		return config.Profile{}, err
+	}
+	if len(destinations) > 1 {
+		return config.Profile{}, fmt.Errorf("%s supports a single provider; multiple destinations are only supported by upload", c.Command.Name)
+	}
+	return profileFromFlags(c, destinations[0].provider, destinations[0].bucket), nil
+}
+
+// getUploader returns the uploader for the single provider given by --provider
 func getUploader(c *cli.Context, log logger.Logger) (storage.Uploader, error) {
-	provider := c.String("provider")
-	bucket := c.String("bucket")
+	p, err := singleProfile(c)
+	if err != nil {
+		return nil, err
+	}
+	uploader, err := newUploader(p, nil, log)
+	if err != nil {
+		return nil, err
+	}
+	return storage.WithRetry(uploader, storage.RetryPolicyFromFlags(c), log), nil
+}
+
+// getFanoutUploader returns an uploader that sends each file to every
+// destination given by --provider
+func getFanoutUploader(c *cli.Context, log logger.Logger) (storage.Uploader, error) {
+	destinations, err := parseDestinations(c)
+	if err != nil {
+		return nil, err
+	}
+	if len(destinations) == 1 {
+		p := profileFromFlags(c, destinations[0].provider, destinations[0].bucket)
+		uploader, err := newUploader(p, nil, log)
+		if err != nil {
+			return nil, err
+		}
+		return storage.Named(storage.WithRetry(uploader, storage.RetryPolicyFromFlags(c), log), stateID(p)), nil
+	}
+
+	targets := make([]storage.Destination, 0, len(destinations))
+	for _, d := range destinations {
+		p := profileFromFlags(c, d.provider, d.bucket)
+		uploader, err := newUploader(p, nil, log)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", d, err)
+		}
+		uploader = storage.WithRetry(uploader, storage.RetryPolicyFromFlags(c), log)
+		targets = append(targets, storage.Destination{Name: d.String(), Uploader: storage.Named(uploader, stateID(p))})
+	}
+	return storage.NewMultiUploader(targets, log)
+}
+
+// stateID returns the name uploads to a profile's storage are recorded under
+// in the state database. It identifies the storage itself rather than the
+// profile or flags naming it, so upload and run share their records.
+func stateID(p config.Profile) string {
+	switch p.Provider {
+	case "s3compat":
+		return fmt.Sprintf("s3compat:%s/%s", p.Endpoint, p.Bucket)
+	case "gcs":
+		if p.GCSEndpoint != "" {
+			return fmt.Sprintf("gcs:%s/%s", p.GCSEndpoint, p.Bucket)
+		}
+	case "webdav":
+		return "webdav:" + p.URL
+	case "ftp", "sftp":
+		port := p.Port
+		if port == 0 && p.Provider == "sftp" {
+			port = 22
+		}
+		return fmt.Sprintf("%s:%s@%s:%d/%s", p.Provider, p.User, p.Host, port, strings.TrimPrefix(p.Path, "/"))
+	case "local":
+		if path, err := filepath.Abs(p.Path); err == nil {
+			return "local:" + path
+		}
+		return "local:" + p.Path
+	}
+	return p.Provider + ":" + p.Bucket
+}
+
+// profileFromFlags builds the profile for a provider named on the command
+// line from its flags
+func profileFromFlags(c *cli.Context, provider, bucket string) config.Profile {
+	p := config.Profile{
+		Provider:    provider,
+		Bucket:      bucket,
+		Region:      c.String("region"),
+		Endpoint:    c.String("endpoint"),
+		PathStyle:   c.Bool("path-style"),
+		AccessKey:   c.String("access-key"),
+		SecretKey:   c.String("secret-key"),
+		CABundle:    c.String("ca-bundle"),
+		GCSEndpoint: c.String("gcs-endpoint"),
+		URL:         c.String("webdav-url"),
+	}
 
 	switch provider {
+	case "webdav":
+		p.User = c.String("webdav-user")
+	case "ftp", "sftp":
+		p.Host = c.String(provider + "-host")
+		p.Port = c.Int(provider + "-port")
+		p.User = c.String(provider + "-user")
+		p.Path = c.String(provider + "-path")
+		if provider == "ftp" && !c.IsSet("ftp-port") {
+			p.Port = 0 // let the TLS mode pick 21 or 990
+		}
+		p.TLS = c.String("ftp-tls")
+		p.Insecure = c.Bool("ftp-insecure")
+	case "local":
+		p.Path = c.String("local-path")
+	}
+	return p
+}
+
+// newProfileUploader creates the uploader for a config file profile. Its
+// credentials are passed to the provider in place of the environment
+// variables they are named after.
+func newProfileUploader(p config.Profile, log logger.Logger) (storage.Uploader, error) {
+	p, env, err := p.ResolveCredentials()
+	if err != nil {
+		return nil, err
+	}
+	return newUploader(p, storage.Credentials(env), log)
+}
+
+func newUploader(p config.Profile, creds storage.Credentials, log logger.Logger) (storage.Uploader, error) {
+	bucket := p.Bucket
+	switch p.Provider {
 	case "s3":
 		if bucket == "" {
 			return nil, fmt.Errorf("bucket is required for s3 provider")
 		}
-		region := c.String("region")
-		return storage.NewS3Uploader(region, bucket, log)
+		return storage.NewS3Uploader(p.Region, bucket, creds, log)
 	case "b2":
 		if bucket == "" {
 			return nil, fmt.Errorf("bucket is required for b2 provider")
 		}
-		return storage.NewB2Uploader(bucket, log)
+		return storage.NewB2Uploader(bucket, creds, log)
 	case "b2s3":
 		if bucket == "" {
 			return nil, fmt.Errorf("bucket is required for b2s3 provider")
 		}
-		region := c.String("region")
-		return storage.NewB2S3Uploader(region, bucket, log)
+		return storage.NewB2S3Uploader(p.Region, bucket, creds, log)
 	case "r2":
 		if bucket == "" {
 			return nil, fmt.Errorf("bucket is required for r2 provider")
 		}
-		return storage.NewR2Uploader(bucket, log)
+		return storage.NewR2Uploader(bucket, creds, log)
+	case "s3compat":
+		if bucket == "" {
+			return nil, fmt.Errorf("bucket is required for s3compat provider")
+		}
+		if p.Endpoint == "" {
+			return nil, fmt.Errorf("s3compat provider requires --endpoint")
+		}
+		return storage.NewGenericS3Uploader(storage.S3CompatConfig{
+			Endpoint:  p.Endpoint,
+			Region:    p.Region,
+			Bucket:    bucket,
+			AccessKey: p.AccessKey,
+			SecretKey: p.SecretKey,
+			PathStyle: p.PathStyle,
+			CABundle:  p.CABundle,
+		}, creds, log)
+	case "azure":
+		if bucket == "" {
+			return nil, fmt.Errorf("bucket (container name) is required for azure provider")
+		}
+		return storage.NewAzureUploader(bucket, creds, log)
+	case "gcs":
+		if bucket == "" {
+			return nil, fmt.Errorf("bucket is required for gcs provider")
+		}
+		return storage.NewGCSUploader(bucket, p.GCSEndpoint, creds, log)
+	case "webdav":
+		if p.URL == "" {
+			return nil, fmt.Errorf("webdav provider requires --webdav-url")
+		}
+		return storage.NewWebDAVUploader(p.URL, p.User, creds, log)
+	case "ftp":
+		cfg := storage.FTPConfig{
+			Host:               p.Host,
+			Port:               p.Port,
+			Username:           p.User,
+			BasePath:           p.Path,
+			TLSMode:            p.TLS,
+			InsecureSkipVerify: p.Insecure,
+		}
+		if cfg.Host == "" || cfg.Username == "" {
+			return nil, fmt.Errorf("FTP provider requires --ftp-host and --ftp-user")
+		}
+		return storage.NewFTPUploader(cfg, creds, log)
 	case "sftp":
-		host := c.String("sftp-host")
-		port := c.Int("sftp-port")
-		user := c.String("sftp-user")
-		path := c.String("sftp-path")
-		if host == "" || user == "" || path == "" {
+		port := p.Port
+		if port == 0 {
+			port = 22
+		}
+		if p.Host == "" || p.User == "" || p.Path == "" {
 			return nil, fmt.Errorf("SFTP provider requires --sftp-host, --sftp-user, and --sftp-path")
 		}
-		return storage.NewSFTPUploader(host, port, user, path, log)
+		return storage.NewSFTPUploader(p.Host, port, p.User, p.Path, creds, log)
+	case "local":
+		if p.Path == "" {
+			return nil, fmt.Errorf("local provider requires --local-path")
+		}
+		return storage.NewLocalUploader(p.Path, log)
 	default:
-		return nil, fmt.Errorf("unsupported storage provider: %s", provider)
+		return nil, fmt.Errorf("unsupported storage provider: %s", p.Provider)
 	}
 }
@@ -3,9 +3,18 @@
 package cli
 
 import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/ngns-io/baxfer/internal/config"
+	"github.com/ngns-io/baxfer/pkg/logger"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/urfave/cli/v2"
 )
 
@@ -16,7 +25,7 @@ func TestNewApp(t *testing.T) {
 	assert.Equal(t, "CLI to help manage storage for database backups", app.Usage)
 
 	// Test that all expected commands are present
-	commandNames := []string{"upload", "download", "prune"}
+	commandNames := []string{"upload", "download", "prune", "list", "verify", "history", "run"}
 	for _, name := range commandNames {
 		command := findCommand(app.Commands, name)
 		assert.NotNil(t, command, "Command %s should exist", name)
@@ -34,8 +43,12 @@ func TestUploadCommand(t *testing.T) {
 	// Test that all expected flags are present
 	flagNames := []string{
 		"provider", "region", "bucket", "keyprefix", "backupext",
-		"compress", "non-interactive",
+		"compress", "compress-level", "non-interactive", "dry-run", "parallel",
+		"checksum", "compare", "encrypt", "recipient", "recipients-file", "passphrase-file",
 		"sftp-host", "sftp-port", "sftp-user", "sftp-path",
+		"ftp-host", "ftp-port", "ftp-user", "ftp-path", "ftp-tls", "ftp-insecure",
+		"endpoint", "path-style", "access-key", "secret-key", "ca-bundle",
+		"gcs-endpoint", "webdav-url", "webdav-user", "local-path",
 	}
 	for _, name := range flagNames {
 		flag := findFlag(uploadCmd.Flags, name)
@@ -48,6 +61,56 @@ func TestUploadCommand(t *testing.T) {
 
 	sftpHostFlag := findFlag(uploadCmd.Flags, "sftp-host").(*cli.StringFlag)
 	assert.Contains(t, sftpHostFlag.EnvVars, "SFTP_HOST")
+
+	// FTP shares the server flag pattern with its own defaults
+	ftpPortFlag := findFlag(uploadCmd.Flags, "ftp-port").(*cli.IntFlag)
+	assert.Equal(t, 21, ftpPortFlag.Value)
+	assert.Contains(t, ftpPortFlag.EnvVars, "FTP_PORT")
+
+	ftpTLSFlag := findFlag(uploadCmd.Flags, "ftp-tls").(*cli.StringFlag)
+	assert.Equal(t, "none", ftpTLSFlag.Value)
+}
+
+func TestUploadCommand_CompressFlag(t *testing.T) {
+	tests := []struct {
+		args []string
+		key  string
+	}{
+		{[]string{"--compress"}, "full.zip"},
+		{[]string{"-c"}, "full.zip"},
+		{[]string{"--compress=gzip"}, "full.bak.gz"},
+		{[]string{"--compress=zstd", "--compress-level", "3"}, "full.bak.zst"},
+		{[]string{"--compress=none"}, "full.bak"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.args[0], func(t *testing.T) {
+			rootDir := t.TempDir()
+			storeDir := t.TempDir()
+			require.NoError(t, os.WriteFile(filepath.Join(rootDir, "full.bak"), []byte("backup data"), 0644))
+
+			args := []string{"baxfer", "upload", "--provider", "local", "--local-path", storeDir,
+				"--logfile", filepath.Join(t.TempDir(), "baxfer.log"), "--non-interactive"}
+			args = append(append(args, tt.args...), rootDir)
+			require.NoError(t, NewApp().Run(args))
+
+			assert.FileExists(t, filepath.Join(storeDir, tt.key))
+		})
+	}
+}
+
+func TestListCommand(t *testing.T) {
+	app := NewApp()
+	listCmd := findCommand(app.Commands, "list")
+	assert.NotNil(t, listCmd)
+	assert.Contains(t, listCmd.Aliases, "ls")
+
+	for _, name := range []string{"provider", "bucket", "prefix", "format", "sort", "reverse", "since", "until", "recursive"} {
+		assert.NotNil(t, findFlag(listCmd.Flags, name), "Flag %s should exist", name)
+	}
+
+	recursiveFlag := findFlag(listCmd.Flags, "recursive").(*cli.BoolFlag)
+	assert.True(t, recursiveFlag.Value)
 }
 
 func TestProviderFlags(t *testing.T) {
@@ -58,6 +121,159 @@ func TestProviderFlags(t *testing.T) {
 	providerFlag := findFlag(uploadCmd.Flags, "provider").(*cli.StringFlag)
 	assert.Equal(t, "s3", providerFlag.Value)
 	assert.Contains(t, providerFlag.Usage, "sftp")
+	assert.Contains(t, providerFlag.Usage, "local")
+	assert.Contains(t, providerFlag.Usage, "s3compat")
+	assert.Contains(t, providerFlag.Usage, "webdav")
+	assert.Contains(t, providerFlag.Usage, "ftp")
+
+	endpointFlag := findFlag(uploadCmd.Flags, "endpoint").(*cli.StringFlag)
+	assert.Contains(t, endpointFlag.EnvVars, "S3COMPAT_ENDPOINT")
+
+	webdavURLFlag := findFlag(uploadCmd.Flags, "webdav-url").(*cli.StringFlag)
+	assert.Contains(t, webdavURLFlag.EnvVars, "WEBDAV_URL")
+
+	localPathFlag := findFlag(uploadCmd.Flags, "local-path").(*cli.StringFlag)
+	assert.Contains(t, localPathFlag.EnvVars, "LOCAL_PATH")
+}
+
+func TestParseDestinations(t *testing.T) {
+	tests := []struct {
+		provider string
+		bucket   string
+		expected []destination
+		wantErr  bool
+	}{
+		{"s3", "backups", []destination{{"s3", "backups"}}, false},
+		{"s3,sftp", "backups", []destination{{"s3", "backups"}, {"sftp", "backups"}}, false},
+		{"s3:prod, b2:offsite", "", []destination{{"s3", "prod"}, {"b2", "offsite"}}, false},
+		{"s3,", "backups", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.provider, func(t *testing.T) {
+			set := flag.NewFlagSet("test", 0)
+			set.String("provider", tt.provider, "doc")
+			set.String("bucket", tt.bucket, "doc")
+			c := cli.NewContext(&cli.App{}, set, nil)
+
+			destinations, err := parseDestinations(c)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, destinations)
+		})
+	}
+}
+
+func TestStateID(t *testing.T) {
+	// Upload flags and a run profile naming the same storage share records
+	fromFlags := config.Profile{Provider: "sftp", Host: "backup.example.com", Port: 22, User: "baxfer", Path: "/srv/backups"}
+	fromConfig := config.Profile{Provider: "sftp", Host: "backup.example.com", User: "baxfer", Path: "srv/backups"}
+	assert.Equal(t, stateID(fromFlags), stateID(fromConfig))
+
+	assert.Equal(t, "s3:prod", stateID(config.Profile{Provider: "s3", Bucket: "prod", Region: "us-east-1"}))
+	assert.NotEqual(t, stateID(config.Profile{Provider: "s3compat", Endpoint: "https://a.example.com", Bucket: "prod"}),
+		stateID(config.Profile{Provider: "s3compat", Endpoint: "https://b.example.com", Bucket: "prod"}))
+}
+
+func TestHistoryCommand(t *testing.T) {
+	rootDir := t.TempDir()
+	storeDir := t.TempDir()
+	logDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "full.bak"), []byte("backup data"), 0644))
+
+	logfile := filepath.Join(logDir, "baxfer.log")
+	statePath := filepath.Join(t.TempDir(), "state", "baxfer-state.db")
+	require.NoError(t, NewApp().Run([]string{"baxfer", "upload", "--provider", "local", "--local-path", t.TempDir(),
+		"--logfile", logfile, "--non-interactive", rootDir}))
+	assert.NoFileExists(t, filepath.Join(logDir, "baxfer-state.db"), "the state database is only used with --state")
+
+	require.NoError(t, NewApp().Run([]string{"baxfer", "upload", "--provider", "local", "--local-path", storeDir,
+		"--logfile", logfile, "--non-interactive", "--state", "--state-file", statePath, rootDir}))
+	assert.FileExists(t, statePath)
+
+	var out bytes.Buffer
+	app := NewApp()
+	app.Writer = &out
+	require.NoError(t, app.Run([]string{"baxfer", "history", "--format", "csv", "--logfile", logfile, "--state-file", statePath}))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.Contains(t, lines[1], ",full.bak,"+filepath.Join(rootDir, "full.bak")+",11,")
+}
+
+func TestGetUploader_RejectsMultipleDestinations(t *testing.T) {
+	set := flag.NewFlagSet("test", 0)
+	set.String("provider", "local,local:other", "doc")
+	c := cli.NewContext(&cli.App{}, set, nil)
+	c.Command = &cli.Command{Name: "download"}
+
+	_, err := getUploader(c, nil)
+	assert.ErrorContains(t, err, "multiple destinations are only supported by upload")
+}
+
+func TestRunCommand(t *testing.T) {
+	rootDir := t.TempDir()
+	storeDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "full.bak"), []byte("backup data"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "notes.txt"), []byte("not a backup"), 0644))
+
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	configYAML := fmt.Sprintf(`
+profiles:
+  disk:
+    provider: local
+    path: %q
+jobs:
+  nightly:
+    root: %q
+    destinations: [disk]
+    keyprefix: sql/
+    retention:
+      age: 720h
+`, storeDir, rootDir)
+	require.NoError(t, os.WriteFile(configPath, []byte(configYAML), 0600))
+
+	app := NewApp()
+	err := app.Run([]string{"baxfer", "run",
+		"--config", configPath,
+		"--logfile", filepath.Join(t.TempDir(), "baxfer.log"),
+		"--non-interactive",
+		"nightly"})
+	require.NoError(t, err)
+
+	stored, err := os.ReadFile(filepath.Join(storeDir, "sql", "full.bak"))
+	require.NoError(t, err)
+	assert.Equal(t, "backup data", string(stored))
+	assert.NoFileExists(t, filepath.Join(storeDir, "sql", "notes.txt"))
+}
+
+func TestNewProfileUploader_Credentials(t *testing.T) {
+	t.Setenv("BAXFER_TEST_CONNECTION", "DefaultEndpointsProtocol=http;AccountName=devstoreaccount1;"+
+		"AccountKey=Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw==;"+
+		"BlobEndpoint=http://127.0.0.1:10000/devstoreaccount1;")
+	t.Setenv("AZURE_STORAGE_CONNECTION_STRING", "")
+
+	// The profile's credentials reach the provider without being exported
+	log, err := logger.New(logger.LogConfig{Filename: filepath.Join(t.TempDir(), "baxfer.log")}, true)
+	require.NoError(t, err)
+	defer log.Close()
+
+	_, err = newProfileUploader(config.Profile{
+		Provider:    "azure",
+		Bucket:      "backups",
+		Credentials: map[string]string{"AZURE_STORAGE_CONNECTION_STRING": "env:BAXFER_TEST_CONNECTION"},
+	}, log)
+	require.NoError(t, err)
+	assert.Empty(t, os.Getenv("AZURE_STORAGE_CONNECTION_STRING"))
+
+	_, err = newProfileUploader(config.Profile{
+		Provider:    "ftp",
+		Credentials: map[string]string{"FTP_PASSWORD": "plaintext"},
+	}, nil)
+	assert.ErrorContains(t, err, "invalid credential reference")
 }
 
 // Helper function to find a command by name
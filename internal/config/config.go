@@ -0,0 +1,351 @@
+// Package config loads baxfer configuration files, which define named
+// destination profiles and the backup jobs that upload to them.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the contents of a configuration file
+type Config struct {
+	Profiles map[string]Profile `yaml:"profiles" toml:"profiles"`
+	Jobs     map[string]Job     `yaml:"jobs" toml:"jobs"`
+}
+
+// Profile describes a storage destination. Only the fields used by its
+// provider need to be set.
+type Profile struct {
+	Provider string `yaml:"provider" toml:"provider"`
+	Bucket   string `yaml:"bucket" toml:"bucket"`
+	Region   string `yaml:"region" toml:"region"`
+
+	// s3compat
+	Endpoint  string `yaml:"endpoint" toml:"endpoint"`
+	PathStyle bool   `yaml:"path_style" toml:"path_style"`
+	AccessKey string `yaml:"access_key" toml:"access_key"` // credential reference
+	SecretKey string `yaml:"secret_key" toml:"secret_key"` // credential reference
+	CABundle  string `yaml:"ca_bundle" toml:"ca_bundle"`
+
+	// gcs
+	GCSEndpoint string `yaml:"gcs_endpoint" toml:"gcs_endpoint"`
+
+	// webdav
+	URL string `yaml:"url" toml:"url"`
+
+	// sftp, ftp and webdav; path is also the base directory for local
+	Host string `yaml:"host" toml:"host"`
+	Port int    `yaml:"port" toml:"port"`
+	User string `yaml:"user" toml:"user"`
+	Path string `yaml:"path" toml:"path"`
+
+	// ftp
+	TLS      string `yaml:"tls" toml:"tls"`
+	Insecure bool   `yaml:"insecure" toml:"insecure"`
+
+	// Credentials maps the environment variables a provider reads, such as
+	// SFTP_PASSWORD or B2_APP_KEY, to credential references
+	Credentials map[string]string `yaml:"credentials" toml:"credentials"`
+}
+
+// Job is a named backup run: the files under Root are uploaded to each of
+// Destinations, then old backups are pruned if Retention is set.
+type Job struct {
+	Root            string      `yaml:"root" toml:"root"`
+	Destinations    []string    `yaml:"destinations" toml:"destinations"` // profile names
+	KeyPrefix       string      `yaml:"keyprefix" toml:"keyprefix"`
+	BackupExt       string      `yaml:"backupext" toml:"backupext"`
+	Compress        Compression `yaml:"compress" toml:"compress"`
+	CompressLevel   int         `yaml:"compress_level" toml:"compress_level"`       // 0 for the format's default
+	Parallel        int         `yaml:"parallel" toml:"parallel"`                   // files uploaded at once
+	Compare         string      `yaml:"compare" toml:"compare"`                     // mtime, size or checksum
+	Checksum        bool        `yaml:"checksum" toml:"checksum"`                   // store a SHA-256 checksum with each upload
+	State           bool        `yaml:"state" toml:"state"`                         // record uploads in the state database
+	StateFile       string      `yaml:"state_file" toml:"state_file"`               // state database, as for --state-file
+	StateCheck      bool        `yaml:"state_check" toml:"state_check"`             // look for recorded uploads in storage too
+	ContinueOnError bool        `yaml:"continue_on_error" toml:"continue_on_error"` // upload the other files when one fails
+	BwLimit         string      `yaml:"bwlimit" toml:"bwlimit"`                     // rate or time-of-day schedule, as for --bwlimit
+	Encryption      Encryption  `yaml:"encryption" toml:"encryption"`
+	Retention       Retention   `yaml:"retention" toml:"retention"`
+}
+
+// Compression is a job's compress setting: zip, gzip, zstd or none. For
+// compatibility with earlier configs, true means zip and false means none.
+type Compression string
+
+// UnmarshalYAML accepts a format name or a boolean
+func (c *Compression) UnmarshalYAML(node *yaml.Node) error {
+	var enabled bool
+	if node.Tag == "!!bool" && node.Decode(&enabled) == nil {
+		*c = compressionFromBool(enabled)
+		return nil
+	}
+	var format string
+	if err := node.Decode(&format); err != nil {
+		return err
+	}
+	*c = Compression(format)
+	return nil
+}
+
+// UnmarshalTOML accepts a format name or a boolean
+func (c *Compression) UnmarshalTOML(value any) error {
+	switch v := value.(type) {
+	case bool:
+		*c = compressionFromBool(v)
+	case string:
+		*c = Compression(v)
+	default:
+		return fmt.Errorf("invalid compress value %v: must be zip, gzip, zstd, none, true or false", value)
+	}
+	return nil
+}
+
+func compressionFromBool(enabled bool) Compression {
+	if enabled {
+		return "zip"
+	}
+	return "none"
+}
+
+func (c Compression) validate() error {
+	switch strings.ToLower(string(c)) {
+	case "", "none", "zip", "gzip", "zstd":
+		return nil
+	}
+	return fmt.Errorf("invalid compress %q: must be zip, gzip, zstd or none", string(c))
+}
+
+// Encryption encrypts a job's uploads with age when any recipient or a
+// passphrase file is set. A passphrase cannot be combined with recipients.
+type Encryption struct {
+	Recipients     []string `yaml:"recipients" toml:"recipients"` // age1... public keys
+	RecipientsFile string   `yaml:"recipients_file" toml:"recipients_file"`
+	PassphraseFile string   `yaml:"passphrase_file" toml:"passphrase_file"`
+}
+
+// Enabled reports whether the job's uploads are encrypted
+func (e Encryption) Enabled() bool {
+	return len(e.Recipients) > 0 || e.RecipientsFile != "" || e.PassphraseFile != ""
+}
+
+// Retention controls pruning after a job's upload. The keep_* counts form a
+// grandfather-father-son policy applied to each backup series; with both a
+// policy and an age, only files older than the age that no rule keeps are
+// deleted.
+type Retention struct {
+	Age         string `yaml:"age" toml:"age"` // e.g. 720h for 30 days
+	KeepLast    int    `yaml:"keep_last" toml:"keep_last"`
+	KeepDaily   int    `yaml:"keep_daily" toml:"keep_daily"`
+	KeepWeekly  int    `yaml:"keep_weekly" toml:"keep_weekly"`
+	KeepMonthly int    `yaml:"keep_monthly" toml:"keep_monthly"`
+	KeepYearly  int    `yaml:"keep_yearly" toml:"keep_yearly"`
+	Series      string `yaml:"series" toml:"series"` // dir (default) or name
+
+	// Safety floor: the newest MinKeep backups of each series are never
+	// pruned, and pruning aborts if it would delete more than MaxDelete
+	// files (a count, or a percentage such as "25%")
+	MinKeep   int    `yaml:"min_keep" toml:"min_keep"`
+	MaxDelete string `yaml:"max_delete" toml:"max_delete"`
+}
+
+// Enabled reports whether the job prunes after uploading
+func (r Retention) Enabled() bool {
+	return r.Age != "" || r.KeepLast > 0 || r.KeepDaily > 0 || r.KeepWeekly > 0 ||
+		r.KeepMonthly > 0 || r.KeepYearly > 0
+}
+
+func (r Retention) validate() error {
+	if _, err := r.MaxAge(); err != nil {
+		return err
+	}
+	for _, n := range []int{r.KeepLast, r.KeepDaily, r.KeepWeekly, r.KeepMonthly, r.KeepYearly, r.MinKeep} {
+		if n < 0 {
+			return fmt.Errorf("invalid retention: keep counts cannot be negative")
+		}
+	}
+	switch r.Series {
+	case "", "dir", "name":
+	default:
+		return fmt.Errorf("invalid retention series %q: must be dir or name", r.Series)
+	}
+	return nil
+}
+
+// MaxAge returns the retention age, or zero if the job does not prune
+func (r Retention) MaxAge() (time.Duration, error) {
+	if r.Age == "" {
+		return 0, nil
+	}
+	age, err := time.ParseDuration(r.Age)
+	if err != nil {
+		return 0, fmt.Errorf("invalid retention age %q: %w", r.Age, err)
+	}
+	if age <= 0 {
+		return 0, fmt.Errorf("invalid retention age %q: must be positive", r.Age)
+	}
+	return age, nil
+}
+
+// DefaultPath returns the configuration file used when --config is not given:
+// %ProgramData%\baxfer\config.yaml on Windows and ~/.config/baxfer/config.yaml
+// elsewhere
+func DefaultPath() string {
+	if runtime.GOOS == "windows" {
+		programData := os.Getenv("ProgramData")
+		if programData == "" {
+			programData = `C:\ProgramData`
+		}
+		return filepath.Join(programData, "baxfer", "config.yaml")
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(".config", "baxfer", "config.yaml")
+	}
+	return filepath.Join(home, ".config", "baxfer", "config.yaml")
+}
+
+// Load reads a configuration file. Files ending in .toml are parsed as TOML
+// and anything else as YAML. Unknown keys are rejected so that typos do not
+// silently change a job.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var cfg Config
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		meta, err := toml.Decode(string(data), &cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return nil, fmt.Errorf("failed to parse config file %s: unknown key %q", path, undecoded[0].String())
+		}
+	} else {
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		// An empty file decodes to io.EOF; it is caught by validate below
+		if err := decoder.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+		}
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+func (c *Config) validate() error {
+	if len(c.Jobs) == 0 {
+		return fmt.Errorf("no jobs defined")
+	}
+
+	for name, p := range c.Profiles {
+		if p.Provider == "" {
+			return fmt.Errorf("profile %q: provider is required", name)
+		}
+	}
+
+	for _, name := range c.JobNames() {
+		job := c.Jobs[name]
+		if job.Root == "" {
+			return fmt.Errorf("job %q: root is required", name)
+		}
+		if len(job.Destinations) == 0 {
+			return fmt.Errorf("job %q: at least one destination is required", name)
+		}
+		for _, dest := range job.Destinations {
+			if _, ok := c.Profiles[dest]; !ok {
+				return fmt.Errorf("job %q: unknown profile %q", name, dest)
+			}
+		}
+		if err := job.Compress.validate(); err != nil {
+			return fmt.Errorf("job %q: %w", name, err)
+		}
+		switch job.Compare {
+		case "", "mtime", "size", "checksum":
+		default:
+			return fmt.Errorf("job %q: invalid compare %q: must be mtime, size or checksum", name, job.Compare)
+		}
+		if err := job.Retention.validate(); err != nil {
+			return fmt.Errorf("job %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// JobNames returns the names of the configured jobs in sorted order
+func (c *Config) JobNames() []string {
+	names := make([]string, 0, len(c.Jobs))
+	for name := range c.Jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ResolveSecret returns the value of a credential reference, which is either
+// env:NAME to read an environment variable or file:PATH to read the first
+// line of a file. Secrets cannot be written into the config file directly.
+func ResolveSecret(ref string) (string, error) {
+	kind, target, _ := strings.Cut(ref, ":")
+	switch kind {
+	case "env":
+		value := os.Getenv(target)
+		if value == "" {
+			return "", fmt.Errorf("environment variable %s is not set", target)
+		}
+		return value, nil
+	case "file":
+		data, err := os.ReadFile(target)
+		if err != nil {
+			return "", fmt.Errorf("failed to read credential file: %w", err)
+		}
+		line, _, _ := strings.Cut(string(data), "\n")
+		return strings.TrimSpace(line), nil
+	default:
+		return "", fmt.Errorf("invalid credential reference %q: use env:NAME or file:PATH", ref)
+	}
+}
+
+// ResolveCredentials returns a copy of the profile with its access and secret
+// keys resolved, along with the environment variables to set from its
+// credentials
+func (p Profile) ResolveCredentials() (Profile, map[string]string, error) {
+	var err error
+	if p.AccessKey != "" {
+		if p.AccessKey, err = ResolveSecret(p.AccessKey); err != nil {
+			return p, nil, fmt.Errorf("access_key: %w", err)
+		}
+	}
+	if p.SecretKey != "" {
+		if p.SecretKey, err = ResolveSecret(p.SecretKey); err != nil {
+			return p, nil, fmt.Errorf("secret_key: %w", err)
+		}
+	}
+
+	env := make(map[string]string, len(p.Credentials))
+	for name, ref := range p.Credentials {
+		value, err := ResolveSecret(ref)
+		if err != nil {
+			return p, nil, fmt.Errorf("%s: %w", name, err)
+		}
+		env[name] = value
+	}
+	return p, env, nil
+}
@@ -0,0 +1,159 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testYAML = `
+profiles:
+  offsite:
+    provider: s3
+    bucket: prod-backups
+    region: us-east-1
+  nas:
+    provider: sftp
+    host: nas.example.com
+    user: backup
+    path: /volume1/backups
+    credentials:
+      SFTP_PASSWORD: env:NAS_PASSWORD
+jobs:
+  nightly:
+    root: /var/backups/sql
+    destinations: [offsite, nas]
+    keyprefix: sql/
+    compress: true
+    encryption:
+      recipients: [age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p]
+    retention:
+      age: 720h
+      keep_daily: 7
+      keep_monthly: 12
+      series: name
+`
+
+const testTOML = `
+[profiles.offsite]
+provider = "s3"
+bucket = "prod-backups"
+
+[jobs.nightly]
+root = "/var/backups/sql"
+destinations = ["offsite"]
+backupext = ".trn"
+compress = "zstd"
+compress_level = 19
+compare = "checksum"
+checksum = true
+state = true
+state_file = "/var/lib/baxfer/nightly.db"
+state_check = true
+continue_on_error = true
+bwlimit = "08:00-18:00=5M,off-hours=unlimited"
+`
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoad_YAML(t *testing.T) {
+	cfg, err := Load(writeConfig(t, "config.yaml", testYAML))
+	require.NoError(t, err)
+
+	assert.Equal(t, "s3", cfg.Profiles["offsite"].Provider)
+	assert.Equal(t, "nas.example.com", cfg.Profiles["nas"].Host)
+	assert.Equal(t, "env:NAS_PASSWORD", cfg.Profiles["nas"].Credentials["SFTP_PASSWORD"])
+
+	job := cfg.Jobs["nightly"]
+	assert.Equal(t, []string{"offsite", "nas"}, job.Destinations)
+	assert.Equal(t, "sql/", job.KeyPrefix)
+	assert.Equal(t, Compression("zip"), job.Compress)
+	assert.True(t, job.Encryption.Enabled())
+
+	age, err := job.Retention.MaxAge()
+	require.NoError(t, err)
+	assert.Equal(t, 720*time.Hour, age)
+	assert.Equal(t, 7, job.Retention.KeepDaily)
+	assert.Equal(t, 12, job.Retention.KeepMonthly)
+	assert.Equal(t, "name", job.Retention.Series)
+	assert.True(t, job.Retention.Enabled())
+}
+
+func TestLoad_TOML(t *testing.T) {
+	cfg, err := Load(writeConfig(t, "config.toml", testTOML))
+	require.NoError(t, err)
+
+	assert.Equal(t, "prod-backups", cfg.Profiles["offsite"].Bucket)
+	assert.Equal(t, ".trn", cfg.Jobs["nightly"].BackupExt)
+	assert.Equal(t, Compression("zstd"), cfg.Jobs["nightly"].Compress)
+	assert.Equal(t, 19, cfg.Jobs["nightly"].CompressLevel)
+	assert.Equal(t, "checksum", cfg.Jobs["nightly"].Compare)
+	assert.True(t, cfg.Jobs["nightly"].Checksum)
+	assert.True(t, cfg.Jobs["nightly"].State)
+	assert.Equal(t, "/var/lib/baxfer/nightly.db", cfg.Jobs["nightly"].StateFile)
+	assert.True(t, cfg.Jobs["nightly"].StateCheck)
+	assert.True(t, cfg.Jobs["nightly"].ContinueOnError)
+	assert.Equal(t, "08:00-18:00=5M,off-hours=unlimited", cfg.Jobs["nightly"].BwLimit)
+	assert.Equal(t, []string{"nightly"}, cfg.JobNames())
+	assert.False(t, cfg.Jobs["nightly"].Retention.Enabled())
+	assert.False(t, cfg.Jobs["nightly"].Encryption.Enabled())
+}
+
+func TestLoad_Invalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		content  string
+		expected string
+	}{
+		{"unknown YAML key", "config.yaml", "jobs:\n  nightly:\n    rot: /backups\n", "field rot not found"},
+		{"unknown TOML key", "config.toml", "[jobs.nightly]\nrot = \"/backups\"\n", `unknown key "jobs.nightly.rot"`},
+		{"no jobs", "config.yaml", "", "no jobs defined"},
+		{"unknown profile", "config.yaml", "jobs:\n  nightly:\n    root: /backups\n    destinations: [missing]\n", `unknown profile "missing"`},
+		{"bad retention", "config.yaml", "profiles:\n  p:\n    provider: local\njobs:\n  nightly:\n    root: /backups\n    destinations: [p]\n    retention:\n      age: 30d\n", "invalid retention age"},
+		{"bad compress", "config.yaml", "profiles:\n  p:\n    provider: local\njobs:\n  nightly:\n    root: /backups\n    destinations: [p]\n    compress: rar\n", `invalid compress "rar"`},
+		{"bad compare", "config.yaml", "profiles:\n  p:\n    provider: local\njobs:\n  nightly:\n    root: /backups\n    destinations: [p]\n    compare: hash\n", `invalid compare "hash"`},
+		{"bad series", "config.yaml", "profiles:\n  p:\n    provider: local\njobs:\n  nightly:\n    root: /backups\n    destinations: [p]\n    retention:\n      keep_last: 3\n      series: db\n", "invalid retention series"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(writeConfig(t, tt.file, tt.content))
+			assert.ErrorContains(t, err, tt.expected)
+		})
+	}
+}
+
+func TestResolveSecret(t *testing.T) {
+	t.Setenv("BAXFER_TEST_SECRET", "from-env")
+	secretFile := writeConfig(t, "secret", "from-file\n")
+
+	value, err := ResolveSecret("env:BAXFER_TEST_SECRET")
+	require.NoError(t, err)
+	assert.Equal(t, "from-env", value)
+
+	value, err = ResolveSecret("file:" + secretFile)
+	require.NoError(t, err)
+	assert.Equal(t, "from-file", value)
+
+	_, err = ResolveSecret("hunter2")
+	assert.ErrorContains(t, err, "invalid credential reference")
+
+	_, err = ResolveSecret("env:BAXFER_TEST_UNSET")
+	assert.Error(t, err)
+}
+
+func TestDefaultPath(t *testing.T) {
+	path := DefaultPath()
+	assert.Equal(t, "config.yaml", filepath.Base(path))
+	assert.Equal(t, "baxfer", filepath.Base(filepath.Dir(path)))
+}
@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/ngns-io/baxfer/pkg/logger"
+)
+
+type AzureUploader struct {
+	client    *azblob.Client
+	container string
+	log       logger.Logger
+}
+
+func NewAzureUploader(container string, creds Credentials, log logger.Logger) (*AzureUploader, error) {
+	connectionString := creds.Get("AZURE_STORAGE_CONNECTION_STRING")
+	account := creds.Get("AZURE_STORAGE_ACCOUNT")
+	accountKey := creds.Get("AZURE_STORAGE_KEY")
+
+	var (
+		client *azblob.Client
+		err    error
+	)
+
+	// A connection string takes precedence since it can also point at the
+	// Azurite emulator or a sovereign cloud endpoint
+	switch {
+	case connectionString != "":
+		client, err = azblob.NewClientFromConnectionString(connectionString, nil)
+	case account != "" && accountKey != "":
+		var cred *azblob.SharedKeyCredential
+		cred, err = azblob.NewSharedKeyCredential(account, accountKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Azure storage account key: %w", err)
+		}
+		serviceURL := fmt.Sprintf("https://%s.blob.core.windows.net/", account)
+		client, err = azblob.NewClientWithSharedKeyCredential(serviceURL, cred, nil)
+	default:
+		return nil, fmt.Errorf("Azure credentials not found: set AZURE_STORAGE_CONNECTION_STRING or AZURE_STORAGE_ACCOUNT and AZURE_STORAGE_KEY")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	uploader := &AzureUploader{
+		client:    client,
+		container: container,
+		log:       log,
+	}
+
+	log.Info("Initialized storage provider",
+		"provider", "Azure Blob Storage",
+		"url", client.URL(),
+		"container", container)
+
+	return uploader, nil
+}
+
+// Upload stages the stream as blocks and commits the block list once all
+// blocks are written, so readers never see a partially uploaded blob.
+func (u *AzureUploader) Upload(ctx context.Context, key string, reader io.Reader, size int64) error {
+	_, err := u.client.UploadStream(ctx, u.container, key, reader, &azblob.UploadStreamOptions{
+		BlockSize:   100 * 1024 * 1024, // 100MB blocks allow blobs up to ~4.7TB
+		Concurrency: 5,
+		Metadata:    azureMetadata(uploadMetadataFrom(ctx)),
+	})
+	return err
+}
+
+// azureMetadata returns metadata with the names Azure accepts, which must be
+// C# identifiers, so dashes become underscores
+func azureMetadata(metadata map[string]string) map[string]*string {
+	if len(metadata) == 0 {
+		return nil
+	}
+	converted := make(map[string]*string, len(metadata))
+	for name, value := range metadata {
+		converted[strings.ReplaceAll(name, "-", "_")] = &value
+	}
+	return converted
+}
+
+func (u *AzureUploader) Download(ctx context.Context, key string, writer io.Writer) error {
+	resp, err := u.client.DownloadStream(ctx, u.container, key, nil)
+	if err != nil {
+		return formatDownloadError("azure", key, err)
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(writer, resp.Body)
+	if err != nil {
+		return &UserError{
+			Message: fmt.Sprintf("Error reading file content: %s", key),
+			Cause:   err,
+		}
+	}
+	return nil
+}
+
+func (u *AzureUploader) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	pager := u.client.NewListBlobsFlatPager(u.container, &azblob.ListBlobsFlatOptions{
+		Prefix: &prefix,
+	})
+
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, blob := range page.Segment.BlobItems {
+			keys = append(keys, *blob.Name)
+		}
+	}
+
+	return keys, nil
+}
+
+func (u *AzureUploader) Delete(ctx context.Context, key string) error {
+	_, err := u.client.DeleteBlob(ctx, u.container, key, nil)
+	return err
+}
+
+func (u *AzureUploader) FileExists(ctx context.Context, key string) (bool, error) {
+	_, err := u.blobClient(key).GetProperties(ctx, nil)
+	if err != nil {
+		if bloberror.HasCode(err, bloberror.BlobNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (u *AzureUploader) GetFileInfo(ctx context.Context, key string) (*FileInfo, error) {
+	props, err := u.blobClient(key).GetProperties(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if props.LastModified == nil || props.ContentLength == nil {
+		return nil, fmt.Errorf("incomplete response from Azure GetProperties for key: %s", key)
+	}
+
+	// Metadata names come back in the case Azure or the HTTP client chose
+	metadata := make(map[string]string, len(props.Metadata))
+	for name, value := range props.Metadata {
+		if value != nil {
+			metadata[strings.ReplaceAll(strings.ToLower(name), "_", "-")] = *value
+		}
+	}
+
+	// Blobs uploaded in blocks only have an MD5 if the uploader set one
+	checksums := make(map[string]string)
+	if len(props.ContentMD5) == md5.Size {
+		checksums[ChecksumMD5] = hex.EncodeToString(props.ContentMD5)
+	}
+
+	return &FileInfo{
+		LastModified: *props.LastModified,
+		Size:         *props.ContentLength,
+		Metadata:     metadata,
+		Checksums:    checksums,
+	}, nil
+}
+
+// storesMetadata marks Azure as keeping user metadata
+func (u *AzureUploader) storesMetadata() {}
+
+func (u *AzureUploader) blobClient(key string) *blob.Client {
+	return u.client.ServiceClient().NewContainerClient(u.container).NewBlobClient(key)
+}
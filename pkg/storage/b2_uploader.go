@@ -1,24 +1,48 @@
 package storage
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
 	"io"
-	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/Backblaze/blazer/b2"
+	"github.com/Backblaze/blazer/base"
 	"github.com/ngns-io/baxfer/pkg/logger"
 )
 
+// b2PartSize is the size of each part of a large file upload
+const b2PartSize = 100 * 1024 * 1024
+
+// b2Concurrency is the number of parts uploaded at once
+const b2Concurrency = 5
+
+// b2PartRetries is how many times a part is sent again when B2 asks for it,
+// as it does to move uploads away from busy servers
+var b2PartRetries = RetryPolicy{Retries: 4, Backoff: time.Second}
+
 type B2Uploader struct {
 	client *b2.Client
 	bucket string
+	log    logger.Logger
+
+	// Credentials for the large file API, used to resume uploads, and the
+	// bucket it returns, authorized once for all of them
+	keyID       string
+	appKey      string
+	largeMu     sync.Mutex
+	largeBucket *base.Bucket
 }
 
-func NewB2Uploader(bucket string, log logger.Logger) (*B2Uploader, error) {
+func NewB2Uploader(bucket string, creds Credentials, log logger.Logger) (*B2Uploader, error) {
 	ctx := context.Background()
-	client, err := b2.NewClient(ctx, os.Getenv("B2_KEY_ID"), os.Getenv("B2_APP_KEY"))
+	keyID, appKey := creds.Get("B2_KEY_ID"), creds.Get("B2_APP_KEY")
+	client, err := b2.NewClient(ctx, keyID, appKey)
 	if err != nil {
 		return nil, err
 	}
@@ -26,6 +50,9 @@ func NewB2Uploader(bucket string, log logger.Logger) (*B2Uploader, error) {
 	uploader := &B2Uploader{
 		client: client,
 		bucket: bucket,
+		log:    log,
+		keyID:  keyID,
+		appKey: appKey,
 	}
 
 	// Log the provider initialization
@@ -36,14 +63,28 @@ func NewB2Uploader(bucket string, log logger.Logger) (*B2Uploader, error) {
 	return uploader, nil
 }
 
-func (u *B2Uploader) Upload(ctx context.Context, key string, reader io.Reader, size int64) (err error) {
+// Upload writes the file with the B2 client or, when the upload is to be
+// resumable, as a large file that a later run can resume if it is interrupted
+func (u *B2Uploader) Upload(ctx context.Context, key string, reader io.Reader, size int64) error {
+	if store := multipartStoreFrom(ctx); store != nil {
+		target := &b2Multipart{uploader: u, key: key}
+		return resumableUpload(ctx, target, store, key, reader, size, b2PartSize, b2Concurrency, u.log)
+	}
+	return u.write(ctx, key, reader)
+}
+
+func (u *B2Uploader) write(ctx context.Context, key string, reader io.Reader) (err error) {
 	b, err := u.client.Bucket(ctx, u.bucket)
 	if err != nil {
 		return err
 	}
 
-	w := b.Object(key).NewWriter(ctx)
-	w.ConcurrentUploads = 5 // Number of concurrent upload threads
+	var opts []b2.WriterOption
+	if metadata := uploadMetadataFrom(ctx); metadata != nil {
+		opts = append(opts, b2.WithAttrsOption(&b2.Attrs{Info: metadata}))
+	}
+	w := b.Object(key).NewWriter(ctx, opts...)
+	w.ConcurrentUploads = b2Concurrency
 	defer func() {
 		if closeErr := w.Close(); closeErr != nil && err == nil {
 			err = fmt.Errorf("failed to close writer: %w", closeErr)
@@ -55,12 +96,16 @@ func (u *B2Uploader) Upload(ctx context.Context, key string, reader io.Reader, s
 }
 
 func (u *B2Uploader) Download(ctx context.Context, key string, writer io.Writer) error {
+	return u.DownloadRange(ctx, key, 0, -1, writer)
+}
+
+func (u *B2Uploader) DownloadRange(ctx context.Context, key string, offset, length int64, writer io.Writer) error {
 	b, err := u.client.Bucket(ctx, u.bucket)
 	if err != nil {
 		return formatDownloadError("b2", key, err)
 	}
 
-	r := b.Object(key).NewReader(ctx)
+	r := b.Object(key).NewRangeReader(ctx, offset, length)
 	defer r.Close()
 
 	// B2 reader automatically handles concurrent downloads
@@ -128,8 +173,146 @@ func (u *B2Uploader) GetFileInfo(ctx context.Context, key string) (*FileInfo, er
 		return nil, err
 	}
 
+	// B2's own checksum is a SHA-1, and only of files uploaded in one request,
+	// so it is not one of those compared
 	return &FileInfo{
 		LastModified: attrs.UploadTimestamp,
 		Size:         attrs.Size,
+		Metadata:     attrs.Info,
 	}, nil
 }
+
+// storesMetadata marks B2 as keeping user metadata, as file info
+func (u *B2Uploader) storesMetadata() {}
+
+// b2Multipart is the large file API of B2, for one key. The B2 client hides
+// the IDs of large files, so uploads that may need resuming use the lower
+// level API, which authorizes separately.
+type b2Multipart struct {
+	uploader *B2Uploader
+	key      string
+}
+
+// largeFiles returns the bucket for the large file API, authorizing on first
+// use
+func (u *B2Uploader) largeFiles(ctx context.Context) (*base.Bucket, error) {
+	u.largeMu.Lock()
+	defer u.largeMu.Unlock()
+	if u.largeBucket != nil {
+		return u.largeBucket, nil
+	}
+
+	account, err := base.AuthorizeAccount(ctx, u.keyID, u.appKey)
+	if err != nil {
+		return nil, err
+	}
+	buckets, err := account.ListBuckets(ctx, u.bucket)
+	if err != nil {
+		return nil, err
+	}
+	if len(buckets) == 0 {
+		return nil, fmt.Errorf("B2 bucket %s not found", u.bucket)
+	}
+	u.largeBucket = buckets[0]
+	return u.largeBucket, nil
+}
+
+func (m *b2Multipart) put(ctx context.Context, data []byte) error {
+	return m.uploader.write(ctx, m.key, bytes.NewReader(data))
+}
+
+func (m *b2Multipart) start(ctx context.Context) (string, error) {
+	bucket, err := m.uploader.largeFiles(ctx)
+	if err != nil {
+		return "", err
+	}
+	file, err := bucket.StartLargeFile(ctx, m.key, "application/octet-stream", uploadMetadataFrom(ctx))
+	if err != nil {
+		return "", err
+	}
+	return file.ID, nil
+}
+
+func (m *b2Multipart) listParts(ctx context.Context, uploadID string) (map[int]string, error) {
+	bucket, err := m.uploader.largeFiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make(map[int]string)
+	file := bucket.File(uploadID, m.key)
+	for next := 1; next != 0; {
+		parts, n, err := file.ListParts(ctx, next, 1000)
+		if err != nil {
+			// B2 answers 400 for a file ID that is not an unfinished large file
+			if code, _ := base.Code(err); code == 400 || code == 404 {
+				return nil, errUploadGone
+			}
+			return nil, err
+		}
+		for _, p := range parts {
+			tags[p.Number] = p.SHA1
+		}
+		if len(parts) == 0 {
+			break
+		}
+		next = n
+	}
+	return tags, nil
+}
+
+func (m *b2Multipart) uploadPart(ctx context.Context, uploadID string, number int, data []byte) (multipartPart, error) {
+	bucket, err := m.uploader.largeFiles(ctx)
+	if err != nil {
+		return multipartPart{}, err
+	}
+
+	sum := sha1.Sum(data)
+	tag := hex.EncodeToString(sum[:])
+	file := bucket.File(uploadID, m.key).CompileParts(0, nil)
+	for attempt := 0; ; attempt++ {
+		chunk, err := file.GetUploadPartURL(ctx)
+		if err == nil {
+			_, err = chunk.UploadPart(ctx, bytes.NewReader(data), tag, len(data), number)
+		}
+		if err == nil {
+			return multipartPart{Tag: tag}, nil
+		}
+
+		action := base.Action(err)
+		if attempt >= b2PartRetries.Retries || (action != base.AttemptNewUpload && action != base.Retry) {
+			return multipartPart{}, err
+		}
+		if err := b2PartRetries.wait(ctx, attempt); err != nil {
+			return multipartPart{}, err
+		}
+	}
+}
+
+func (m *b2Multipart) complete(ctx context.Context, uploadID string, parts []multipartPart) error {
+	bucket, err := m.uploader.largeFiles(ctx)
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	hashes := make(map[int]string, len(parts))
+	for _, p := range parts {
+		hashes[p.Number] = p.Tag
+		size += p.Size
+	}
+	_, err = bucket.File(uploadID, m.key).CompileParts(size, hashes).FinishLargeFile(ctx)
+	return err
+}
+
+func (m *b2Multipart) abort(ctx context.Context, uploadID string) error {
+	bucket, err := m.uploader.largeFiles(ctx)
+	if err != nil {
+		return err
+	}
+	err = bucket.File(uploadID, m.key).AsLargeFile().CancelLargeFile(ctx)
+	if code, _ := base.Code(err); code == 400 || code == 404 {
+		return errUploadGone
+	}
+	return err
+}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"os"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -18,9 +17,9 @@ type B2S3Uploader struct {
 	*S3CompatibleUploader
 }
 
-func NewB2S3Uploader(region, bucket string, log logger.Logger) (*B2S3Uploader, error) {
-	keyID := os.Getenv("B2_KEY_ID")
-	appKey := os.Getenv("B2_APP_KEY")
+func NewB2S3Uploader(region, bucket string, creds Credentials, log logger.Logger) (*B2S3Uploader, error) {
+	keyID := creds.Get("B2_KEY_ID")
+	appKey := creds.Get("B2_APP_KEY")
 
 	if keyID == "" || appKey == "" {
 		return nil, fmt.Errorf("Backblaze B2 credentials not found in environment variables")
@@ -28,7 +27,7 @@ func NewB2S3Uploader(region, bucket string, log logger.Logger) (*B2S3Uploader, e
 
 	// Use provided region, or AWS_REGION env var, or default to us-west-002
 	if region == "" {
-		region = os.Getenv("AWS_REGION")
+		region = creds.Get("AWS_REGION")
 		if region == "" {
 			region = "us-west-002"
 		}
@@ -78,6 +77,5 @@ func (u *B2S3Uploader) Upload(ctx context.Context, key string, reader io.Reader,
 		ChecksumAlgorithm: types.ChecksumAlgorithmCrc32,
 	}
 
-	_, err := u.Uploader.Upload(ctx, input)
-	return err
+	return u.upload(ctx, input)
 }
@@ -0,0 +1,273 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bandwidthChunk is the most data read or written before waiting for the
+// bandwidth limit, so that large reads such as multipart buffers are paced
+// evenly instead of in bursts
+const bandwidthChunk = 64 * 1024
+
+// bandwidthWindow is a time of day with its own transfer rate. Windows whose
+// end is before their start wrap past midnight.
+type bandwidthWindow struct {
+	start, end int   // minutes since midnight
+	rate       int64 // bytes per second, zero for unlimited
+}
+
+func (w bandwidthWindow) contains(minute int) bool {
+	if w.start < w.end {
+		return minute >= w.start && minute < w.end
+	}
+	return minute >= w.start || minute < w.end
+}
+
+// bandwidthSchedule is a parsed --bwlimit: the rate during each window, and
+// the rate at other times
+type bandwidthSchedule struct {
+	windows   []bandwidthWindow
+	otherwise int64
+}
+
+// parseBandwidth parses a --bwlimit value. It is either a single rate, such
+// as 20M, or a comma-separated schedule of HH:MM-HH:MM=RATE windows with an
+// optional off-hours=RATE for the rest of the day, which is unlimited
+// otherwise. It returns nil when there is no limit.
+func parseBandwidth(value string) (*bandwidthSchedule, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+
+	schedule := &bandwidthSchedule{}
+	hasDefault := false
+	for _, entry := range strings.Split(value, ",") {
+		when, rateValue, windowed := strings.Cut(strings.TrimSpace(entry), "=")
+		if !windowed {
+			rateValue, when = when, "off-hours"
+		}
+
+		rate, err := parseRate(rateValue)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --bwlimit %q: %w", value, err)
+		}
+
+		if strings.EqualFold(strings.TrimSpace(when), "off-hours") {
+			if hasDefault {
+				return nil, fmt.Errorf("invalid --bwlimit %q: only one rate may apply outside the windows", value)
+			}
+			schedule.otherwise, hasDefault = rate, true
+			continue
+		}
+
+		window, err := parseWindow(when)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --bwlimit %q: %w", value, err)
+		}
+		window.rate = rate
+		schedule.windows = append(schedule.windows, window)
+	}
+	return schedule, nil
+}
+
+// parseWindow parses a HH:MM-HH:MM time of day
+func parseWindow(value string) (bandwidthWindow, error) {
+	from, to, ok := strings.Cut(strings.TrimSpace(value), "-")
+	if !ok {
+		return bandwidthWindow{}, fmt.Errorf("%q is not a time window such as 08:00-18:00", value)
+	}
+	start, err := parseTimeOfDay(from)
+	if err != nil {
+		return bandwidthWindow{}, err
+	}
+	end, err := parseTimeOfDay(to)
+	if err != nil {
+		return bandwidthWindow{}, err
+	}
+	if start == end {
+		return bandwidthWindow{}, fmt.Errorf("time window %q is empty", value)
+	}
+	return bandwidthWindow{start: start, end: end}, nil
+}
+
+// parseTimeOfDay returns the minutes since midnight of a HH:MM time
+func parseTimeOfDay(value string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a time of day such as 08:00", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// parseRate returns the bytes per second of a rate such as 512K, 20M or 1.5G,
+// where the suffixes are powers of 1024, or zero for off, unlimited or 0
+func parseRate(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	switch strings.ToLower(value) {
+	case "off", "unlimited", "0":
+		return 0, nil
+	}
+
+	number, unit := value, int64(1)
+	if n := len(value); n > 0 {
+		switch value[n-1] {
+		case 'k', 'K':
+			number, unit = value[:n-1], 1<<10
+		case 'm', 'M':
+			number, unit = value[:n-1], 1<<20
+		case 'g', 'G':
+			number, unit = value[:n-1], 1<<30
+		}
+	}
+	f, err := strconv.ParseFloat(number, 64)
+	rate := int64(f * float64(unit))
+	if err != nil || rate < 1 {
+		return 0, fmt.Errorf("%q is not a rate such as 20M or unlimited", value)
+	}
+	return rate, nil
+}
+
+// rate returns the bytes per second allowed at t, or zero for unlimited. The
+// first window containing t applies.
+func (s *bandwidthSchedule) rate(t time.Time) int64 {
+	minute := t.Hour()*60 + t.Minute()
+	for _, w := range s.windows {
+		if w.contains(minute) {
+			return w.rate
+		}
+	}
+	return s.otherwise
+}
+
+// bandwidthLimiter paces the data of every transfer in a run to the rate of
+// its schedule at the time, so parallel transfers share the limit
+type bandwidthLimiter struct {
+	schedule *bandwidthSchedule
+
+	mu   sync.Mutex
+	next time.Time // when the data already allowed has been sent at the rate
+}
+
+// newBandwidthLimiter returns a limiter for a --bwlimit value, or nil if the
+// value sets no limit
+func newBandwidthLimiter(value string) (*bandwidthLimiter, error) {
+	schedule, err := parseBandwidth(value)
+	if schedule == nil || err != nil {
+		return nil, err
+	}
+	return &bandwidthLimiter{schedule: schedule}, nil
+}
+
+// wait blocks until n more bytes may be sent
+func (l *bandwidthLimiter) wait(ctx context.Context, n int) error {
+	now := time.Now()
+	rate := l.schedule.rate(now)
+	if rate == 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	// Time spent idle is not saved up for a burst later
+	if l.next.Before(now) {
+		l.next = now
+	}
+	start := l.next
+	l.next = l.next.Add(time.Duration(float64(n) / float64(rate) * float64(time.Second)))
+	l.mu.Unlock()
+
+	delay := start.Sub(now)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// reader returns r paced by the limiter, or r itself if l is nil
+func (l *bandwidthLimiter) reader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &limitedReader{ctx: ctx, r: r, limiter: l}
+}
+
+// writer returns w paced by the limiter, or w itself if l is nil
+func (l *bandwidthLimiter) writer(ctx context.Context, w io.Writer) io.Writer {
+	if l == nil {
+		return w
+	}
+	return &limitedWriter{ctx: ctx, w: w, limiter: l}
+}
+
+type bandwidthLimitKey struct{}
+
+// withBandwidthLimit returns a context whose fan-out uploads pace the data
+// sent to each destination with l
+func withBandwidthLimit(ctx context.Context, l *bandwidthLimiter) context.Context {
+	if l == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, bandwidthLimitKey{}, l)
+}
+
+// bandwidthLimitFrom returns the limiter of an upload made with ctx, or nil
+// if it is not limited
+func bandwidthLimitFrom(ctx context.Context) *bandwidthLimiter {
+	l, _ := ctx.Value(bandwidthLimitKey{}).(*bandwidthLimiter)
+	return l
+}
+
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *bandwidthLimiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > bandwidthChunk {
+		p = p[:bandwidthChunk]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if waitErr := r.limiter.wait(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+type limitedWriter struct {
+	ctx     context.Context
+	w       io.Writer
+	limiter *bandwidthLimiter
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), bandwidthChunk)]
+		if err := w.limiter.wait(w.ctx, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := w.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
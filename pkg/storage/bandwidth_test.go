@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		value string
+		rate  int64
+	}{
+		{"20M", 20 << 20},
+		{"512k", 512 << 10},
+		{"1.5G", 3 << 29},
+		{"1000", 1000},
+		{"unlimited", 0},
+		{"off", 0},
+		{"0", 0},
+	}
+	for _, tt := range tests {
+		rate, err := parseRate(tt.value)
+		require.NoError(t, err, tt.value)
+		assert.Equal(t, tt.rate, rate, tt.value)
+	}
+
+	for _, value := range []string{"", "fast", "-5M", "0.1", "20X"} {
+		_, err := parseRate(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestParseBandwidth(t *testing.T) {
+	at := func(clock string) time.Time {
+		tm, err := time.ParseInLocation("15:04", clock, time.Local)
+		require.NoError(t, err)
+		return tm
+	}
+
+	schedule, err := parseBandwidth("")
+	require.NoError(t, err)
+	assert.Nil(t, schedule, "no limit")
+
+	schedule, err = parseBandwidth("20M")
+	require.NoError(t, err)
+	assert.Equal(t, int64(20<<20), schedule.rate(at("03:00")))
+	assert.Equal(t, int64(20<<20), schedule.rate(at("12:00")))
+
+	schedule, err = parseBandwidth("08:00-18:00=5M,off-hours=unlimited")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), schedule.rate(at("07:59")))
+	assert.Equal(t, int64(5<<20), schedule.rate(at("08:00")))
+	assert.Equal(t, int64(5<<20), schedule.rate(at("17:59")))
+	assert.Equal(t, int64(0), schedule.rate(at("18:00")))
+
+	// Windows may wrap past midnight, and times outside them are unlimited
+	schedule, err = parseBandwidth("22:00-06:00=50M, 12:00-13:00=10M")
+	require.NoError(t, err)
+	assert.Equal(t, int64(50<<20), schedule.rate(at("23:30")))
+	assert.Equal(t, int64(50<<20), schedule.rate(at("05:00")))
+	assert.Equal(t, int64(10<<20), schedule.rate(at("12:30")))
+	assert.Equal(t, int64(0), schedule.rate(at("09:00")))
+
+	// A bare rate applies outside the windows
+	schedule, err = parseBandwidth("08:00-18:00=5M,20M")
+	require.NoError(t, err)
+	assert.Equal(t, int64(20<<20), schedule.rate(at("20:00")))
+
+	for _, value := range []string{
+		"08:00=5M",
+		"08:00-25:00=5M",
+		"08:00-08:00=5M",
+		"08:00-18:00=fast",
+		"20M,off-hours=unlimited",
+	} {
+		_, err := parseBandwidth(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestBandwidthLimiter(t *testing.T) {
+	limiter, err := newBandwidthLimiter("1M")
+	require.NoError(t, err)
+
+	// The first chunk goes at once and the other three wait 1/16s each
+	data := bytes.Repeat([]byte("x"), 4*bandwidthChunk)
+	var out bytes.Buffer
+	start := time.Now()
+	_, err = io.Copy(&out, limiter.reader(context.Background(), bytes.NewReader(data)))
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+	assert.Equal(t, data, out.Bytes())
+
+	// Writes are split into chunks and paced the same way
+	out.Reset()
+	start = time.Now()
+	n, err := limiter.writer(context.Background(), &out).Write(data)
+	require.NoError(t, err)
+	assert.Equal(t, len(data), n)
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+}
+
+func TestBandwidthLimiter_Canceled(t *testing.T) {
+	limiter, err := newBandwidthLimiter("1K")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = io.Copy(io.Discard, limiter.reader(ctx, bytes.NewReader(make([]byte, 2*bandwidthChunk))))
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestBandwidthLimiter_Unlimited(t *testing.T) {
+	limiter, err := newBandwidthLimiter("off")
+	require.NoError(t, err)
+	require.NotNil(t, limiter)
+	assert.NoError(t, limiter.wait(context.Background(), 1<<30))
+
+	limiter, err = newBandwidthLimiter("")
+	require.NoError(t, err)
+	r := bytes.NewReader(nil)
+	assert.Same(t, r, limiter.reader(context.Background(), r), "a nil limiter leaves readers as they are")
+}
+
+func TestBandwidthLimiter_FanOut(t *testing.T) {
+	limiter, err := newBandwidthLimiter("1M")
+	require.NoError(t, err)
+	first, _ := newTestLocalUploader(t)
+	second, _ := newTestLocalUploader(t)
+	multi := newTestMultiUploader(t,
+		Destination{Name: "first", Uploader: first},
+		Destination{Name: "second", Uploader: second},
+	)
+
+	// Each destination's copy counts, so the four chunks sent wait 1/16s each
+	// after the first
+	data := bytes.Repeat([]byte("x"), 2*bandwidthChunk)
+	start := time.Now()
+	ctx := withBandwidthLimit(context.Background(), limiter)
+	require.NoError(t, multi.Upload(ctx, "sales.bak", bytes.NewReader(data), int64(len(data))))
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+}
+
+func TestBandwidthLimiter_DownloadRanges(t *testing.T) {
+	limiter, err := newBandwidthLimiter("1M")
+	require.NoError(t, err)
+	local, _ := newTestLocalUploader(t)
+	ctx := context.Background()
+	data := bytes.Repeat([]byte("x"), 4*bandwidthChunk)
+	require.NoError(t, local.Upload(ctx, "sales.bak", bytes.NewReader(data), int64(len(data))))
+
+	// The ranges fetched at once share the limit
+	var buf bytes.Buffer
+	start := time.Now()
+	require.NoError(t, downloadRanges(ctx, local, "sales.bak", 0, int64(len(data)), bandwidthChunk, 4, limiter, &buf))
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+	assert.Equal(t, data, buf.Bytes())
+}
@@ -0,0 +1,434 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ngns-io/baxfer/pkg/logger"
+	"github.com/urfave/cli/v2"
+)
+
+// Checksums of files uploaded with --checksum are stored as metadata of the
+// file on providers that keep it: S3 and the S3-compatible providers, B2,
+// Azure and GCS. The SHA-256 has to be known before the upload starts, so it
+// is computed from the local file first; for compressed or encrypted files,
+// whose stored data is only known as it is sent, the local file's checksum
+// and size are stored instead. The data as stored is checked against the
+// checksums the provider computes itself.
+const (
+	metadataSHA256       = "baxfer-sha256"
+	metadataSourceSHA256 = "baxfer-source-sha256"
+	metadataSourceSize   = "baxfer-source-size"
+)
+
+// Checksum algorithms that providers compute natively, as reported in
+// FileInfo.Checksums
+const (
+	ChecksumMD5    = "md5"
+	ChecksumCRC32  = "crc32"
+	ChecksumCRC32C = "crc32c"
+)
+
+// checksumExt is appended to a key to name the object holding its SHA-256 on
+// providers without user metadata, since FTP, SFTP, WebDAV and local storage
+// have nowhere else to keep it
+const checksumExt = ".sha256"
+
+// isChecksumKey reports whether a key names a stored checksum
+func isChecksumKey(key string) bool {
+	return strings.HasSuffix(key, checksumExt)
+}
+
+// checksumKey returns the key of the checksum stored for key
+func checksumKey(key string) string {
+	return key + checksumExt
+}
+
+// checksumRecord holds the checksums of a stored file
+type checksumRecord struct {
+	Sum string // hex SHA-256 of the file as stored
+
+	// The local file before compression or encryption, for --compare. Not
+	// recorded when the file is stored as it is, since Sum then covers it.
+	SourceSum  string
+	SourceSize int64
+	SourceName string
+
+	// Native holds the checksums of the file as stored in the algorithms that
+	// providers compute themselves, hex encoded by algorithm
+	Native map[string]string
+}
+
+// verifiable reports whether the record has a checksum of the data as stored
+func (r *checksumRecord) verifiable() bool {
+	return r.Sum != "" || len(r.Native) > 0
+}
+
+// covers reports whether the record has the checksum of the local file, which
+// is the source's for files that were compressed or encrypted
+func (r *checksumRecord) covers(transformed bool) bool {
+	if r == nil {
+		return false
+	}
+	if transformed {
+		return r.SourceSum != ""
+	}
+	return r.Sum != ""
+}
+
+// mismatch compares the checksums computed from a file's data with the
+// record, and describes the first that differs, or returns "" if they match.
+// Algorithms missing from either side are not compared.
+func (r *checksumRecord) mismatch(actual *checksumRecord) string {
+	if r.Sum != "" && actual.Sum != "" && r.Sum != actual.Sum {
+		return fmt.Sprintf("expected %s, got %s", r.Sum, actual.Sum)
+	}
+	algorithms := make([]string, 0, len(r.Native))
+	for algorithm := range r.Native {
+		algorithms = append(algorithms, algorithm)
+	}
+	sort.Strings(algorithms)
+	for _, algorithm := range algorithms {
+		expected := r.Native[algorithm]
+		if got, ok := actual.Native[algorithm]; ok && got != expected {
+			return fmt.Sprintf("expected %s %s, got %s", algorithm, expected, got)
+		}
+	}
+	return ""
+}
+
+// checksumHashes hashes data with SHA-256 and each algorithm that providers
+// compute natively
+type checksumHashes map[string]hash.Hash
+
+const checksumSHA256 = "sha256"
+
+func newChecksumHashes() checksumHashes {
+	return checksumHashes{
+		checksumSHA256: sha256.New(),
+		ChecksumMD5:    md5.New(),
+		ChecksumCRC32:  crc32.NewIEEE(),
+		ChecksumCRC32C: crc32.New(crc32.MakeTable(crc32.Castagnoli)),
+	}
+}
+
+func (h checksumHashes) Write(p []byte) (int, error) {
+	for _, hasher := range h {
+		hasher.Write(p)
+	}
+	return len(p), nil
+}
+
+// record returns the checksums of the data written
+func (h checksumHashes) record() *checksumRecord {
+	record := &checksumRecord{Native: make(map[string]string, len(h)-1)}
+	for algorithm, hasher := range h {
+		sum := hex.EncodeToString(hasher.Sum(nil))
+		if algorithm == checksumSHA256 {
+			record.Sum = sum
+		} else {
+			record.Native[algorithm] = sum
+		}
+	}
+	return record
+}
+
+// checksumMetadata returns the metadata stored with a file uploaded with
+// --checksum, given the SHA-256 and size of the local file: its checksum when
+// it is stored as it is, or its checksum and size as the source of a
+// compressed or encrypted file
+func checksumMetadata(sum string, size int64, transformed bool) map[string]string {
+	if !transformed {
+		return map[string]string{metadataSHA256: sum}
+	}
+	return map[string]string{
+		metadataSourceSHA256: sum,
+		metadataSourceSize:   strconv.FormatInt(size, 10),
+	}
+}
+
+// checksumFromMetadata returns the checksums of a stored file on a provider
+// that keeps metadata, or nil if it has none
+func checksumFromMetadata(info *FileInfo) *checksumRecord {
+	record := &checksumRecord{Native: info.Checksums}
+	if sum := strings.ToLower(info.Metadata[metadataSHA256]); isSHA256(sum) {
+		record.Sum = sum
+	}
+	if sum := strings.ToLower(info.Metadata[metadataSourceSHA256]); isSHA256(sum) {
+		size, err := strconv.ParseInt(info.Metadata[metadataSourceSize], 10, 64)
+		if err == nil {
+			record.SourceSum, record.SourceSize = sum, size
+		}
+	}
+	if !record.verifiable() && record.SourceSum == "" {
+		return nil
+	}
+	return record
+}
+
+// formatChecksum returns the contents of a checksum object for key, in the
+// format of sha256sum so a downloaded pair can be checked with sha256sum -c.
+// The source file's checksum goes on a comment line, which sha256sum skips.
+func formatChecksum(record checksumRecord, key string) string {
+	content := fmt.Sprintf("%s  %s\n", record.Sum, path.Base(key))
+	if record.SourceSum != "" {
+		content += fmt.Sprintf("# source %s %d %s\n", record.SourceSum, record.SourceSize, record.SourceName)
+	}
+	return content
+}
+
+// parseChecksum parses the contents of a checksum object for key
+func parseChecksum(content, key string) (*checksumRecord, error) {
+	record := &checksumRecord{}
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+		case fields[0] == "#":
+			if len(fields) >= 5 && fields[1] == "source" {
+				size, err := strconv.ParseInt(fields[3], 10, 64)
+				if err != nil || !isSHA256(fields[2]) {
+					return nil, fmt.Errorf("checksum for %s has an invalid source line", key)
+				}
+				record.SourceSum = strings.ToLower(fields[2])
+				record.SourceSize = size
+				record.SourceName = strings.Join(fields[4:], " ")
+			}
+		case record.Sum == "":
+			if !isSHA256(fields[0]) {
+				return nil, fmt.Errorf("checksum for %s is not a SHA-256", key)
+			}
+			record.Sum = strings.ToLower(fields[0])
+		}
+	}
+	if record.Sum == "" {
+		return nil, fmt.Errorf("checksum for %s is empty", key)
+	}
+	return record, nil
+}
+
+func isSHA256(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil && len(s) == sha256.Size*2
+}
+
+// storeChecksum uploads the checksum record of a file stored on a provider
+// without user metadata, or whose metadata cannot hold the SHA-256 of the
+// data as stored
+func storeChecksum(ctx context.Context, uploader Uploader, key string, record checksumRecord) error {
+	content := formatChecksum(record, key)
+	return uploader.Upload(ctx, checksumKey(key), strings.NewReader(content), int64(len(content)))
+}
+
+// checkStored compares a file just uploaded to a provider that keeps metadata
+// with the checksums of the data sent. The SHA-256 in its metadata was taken
+// from the local file before the upload, so a difference means that the file
+// changed while it was read. It reports whether the metadata holds the
+// SHA-256 of the data as stored, which compressed, encrypted and streamed
+// uploads cannot put there, since it is only known once they are sent.
+func checkStored(ctx context.Context, uploader Uploader, key string, sent checksumRecord) (bool, error) {
+	info, err := uploader.GetFileInfo(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	stored := checksumFromMetadata(info)
+	if stored != nil {
+		if (stored.Sum != "" && stored.Sum != sent.Sum) || (stored.SourceSum != "" && stored.SourceSum != sent.SourceSum) {
+			return false, fmt.Errorf("the file stored as %s changed while it was uploaded", key)
+		}
+	}
+	if detail := sent.mismatch(&checksumRecord{Native: info.Checksums}); detail != "" {
+		return false, fmt.Errorf("%s was stored with different contents than were sent: %s", key, detail)
+	}
+	return stored != nil && stored.Sum != "", nil
+}
+
+// readChecksum returns the checksums stored for key, or nil if the file was
+// uploaded without them and the provider computes none. On providers that
+// keep metadata, the SHA-256 of a file whose metadata lacks it is read from
+// its checksum object.
+func readChecksum(ctx context.Context, uploader Uploader, key string) (*checksumRecord, error) {
+	if !storesMetadata(uploader) {
+		return readChecksumObject(ctx, uploader, key)
+	}
+
+	info, err := uploader.GetFileInfo(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	record := checksumFromMetadata(info)
+	if record != nil && record.Sum != "" {
+		return record, nil
+	}
+	stored, err := readChecksumObject(ctx, uploader, key)
+	if err != nil || stored == nil {
+		return record, err
+	}
+	if record == nil {
+		return stored, nil
+	}
+	record.Sum = stored.Sum
+	return record, nil
+}
+
+// readChecksumObject returns the checksum record stored beside key, or nil if
+// there is none
+func readChecksumObject(ctx context.Context, uploader Uploader, key string) (*checksumRecord, error) {
+	exists, err := uploader.FileExists(ctx, checksumKey(key))
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := uploader.Download(ctx, checksumKey(key), &buf); err != nil {
+		return nil, err
+	}
+	return parseChecksum(buf.String(), key)
+}
+
+// metadataStore is implemented by uploaders whose provider keeps user
+// metadata with each file. Their uploads store the metadata given with
+// withUploadMetadata, and GetFileInfo returns it with the checksums the
+// provider computes.
+type metadataStore interface {
+	storesMetadata()
+}
+
+// storesMetadata reports whether uploader keeps user metadata with its files,
+// looking through the wrappers added by WithRetry and Named. Destinations of
+// a fan-out are asked one by one, since they may differ.
+func storesMetadata(uploader Uploader) bool {
+	switch u := uploader.(type) {
+	case *retryUploader:
+		return storesMetadata(u.Uploader)
+	case *namedUploader:
+		return storesMetadata(u.Uploader)
+	case metadataStore:
+		return true
+	}
+	return false
+}
+
+type uploadMetadataKey struct{}
+
+// withUploadMetadata returns a context whose uploads store metadata with the
+// file, on providers that keep it
+func withUploadMetadata(ctx context.Context, metadata map[string]string) context.Context {
+	if len(metadata) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, uploadMetadataKey{}, metadata)
+}
+
+// uploadMetadataFrom returns the metadata to store with an upload made with
+// ctx, or nil if there is none
+func uploadMetadataFrom(ctx context.Context) map[string]string {
+	metadata, _ := ctx.Value(uploadMetadataKey{}).(map[string]string)
+	return metadata
+}
+
+// verifyResult is the outcome of verifying one stored file
+type verifyResult int
+
+const (
+	verifyOK verifyResult = iota
+	verifyFailed
+	verifyNoChecksum
+)
+
+// verifyKey downloads a stored file and compares its checksums with those
+// stored on upload and those the provider computed. The file's contents are
+// discarded.
+func verifyKey(ctx context.Context, uploader Uploader, key string) (verifyResult, string, error) {
+	record, err := readChecksum(ctx, uploader, key)
+	if err != nil {
+		return verifyFailed, "", err
+	}
+	if record == nil || !record.verifiable() {
+		return verifyNoChecksum, "", nil
+	}
+
+	hashes := newChecksumHashes()
+	if err := uploader.Download(ctx, key, hashes); err != nil {
+		return verifyFailed, "", err
+	}
+	if detail := record.mismatch(hashes.record()); detail != "" {
+		return verifyFailed, detail, nil
+	}
+	return verifyOK, "", nil
+}
+
+// Verify re-hashes stored files and compares them with the checksums stored
+// when they were uploaded. The keys given as arguments are verified, or every
+// file under --prefix if there are none.
+func Verify(c *cli.Context, uploader Uploader, log logger.Logger) error {
+	keys := c.Args().Slice()
+	if len(keys) == 0 {
+		listed, err := uploader.List(c.Context, c.String("prefix"))
+		if err != nil {
+			log.Error("Failed to list files", "prefix", c.String("prefix"), "error", err)
+			return err
+		}
+		for _, key := range listed {
+			if !isChecksumKey(key) {
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	out := outputWriter(c)
+	var ok, failed, missing int
+	for _, key := range keys {
+		result, detail, err := verifyKey(c.Context, uploader, key)
+		if err != nil {
+			detail = err.Error()
+		}
+
+		switch result {
+		case verifyOK:
+			ok++
+			fmt.Fprintf(out, "OK       %s\n", key)
+			log.Info("Checksum verified", "key", key)
+		case verifyNoChecksum:
+			missing++
+			fmt.Fprintf(out, "NO SUM   %s\n", key)
+			log.Info("No checksum stored", "key", key)
+		default:
+			failed++
+			fmt.Fprintf(out, "FAILED   %s (%s)\n", key, detail)
+			log.Error("Checksum verification failed", "key", key, "detail", detail)
+		}
+	}
+
+	fmt.Fprintf(out, "verified %d file(s): %d ok, %d failed, %d without checksum\n", len(keys), ok, failed, missing)
+	if failed > 0 {
+		return cli.Exit(fmt.Sprintf("%d file(s) failed verification", failed), 1)
+	}
+	return nil
+}
+
+// checkDownload compares the checksums of a downloaded file, as stored, with
+// those stored on upload and those the provider computed
+func checkDownload(ctx context.Context, uploader Uploader, key string, actual *checksumRecord) error {
+	record, err := readChecksum(ctx, uploader, key)
+	if err != nil {
+		return err
+	}
+	if record == nil || !record.verifiable() {
+		return &UserError{Message: fmt.Sprintf("Cannot verify %s: no checksum was stored with it", key)}
+	}
+	if detail := record.mismatch(actual); detail != "" {
+		return &UserError{Message: fmt.Sprintf("Checksum mismatch for %s: %s", key, detail)}
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+)
+
+// uploadWithChecksum stores sales.bak with --checksum and returns the
+// uploader and its base path
+func uploadWithChecksum(t *testing.T) (*LocalUploader, string) {
+	t.Helper()
+
+	uploader, basePath := newTestLocalUploader(t)
+	rootDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "sales.bak"), []byte("sales data"), 0644))
+
+	uploadFiles(t, uploader, "--keyprefix", "sql", "--checksum", rootDir)
+	return uploader, basePath
+}
+
+func runVerify(t *testing.T, uploader Uploader, args ...string) (string, error) {
+	t.Helper()
+
+	var out bytes.Buffer
+	mockLogger := NewMockLogger()
+	mockLogger.On("Info", mock.Anything, mock.Anything).Return()
+	mockLogger.On("Error", mock.Anything, mock.Anything).Return()
+
+	set := flag.NewFlagSet("test", 0)
+	set.String("prefix", "", "doc")
+	require.NoError(t, set.Parse(args))
+	ctx := cli.NewContext(&cli.App{Writer: &out}, set, nil)
+
+	err := Verify(ctx, uploader, mockLogger)
+	return out.String(), err
+}
+
+func TestUpload_StoresChecksum(t *testing.T) {
+	_, basePath := uploadWithChecksum(t)
+
+	sum := sha256.Sum256([]byte("sales data"))
+	stored, err := os.ReadFile(filepath.Join(basePath, "sql", "sales.bak.sha256"))
+	require.NoError(t, err)
+	assert.Equal(t, hex.EncodeToString(sum[:])+"  sales.bak\n", string(stored))
+}
+
+func TestUpload_StoresChecksumAsMetadata(t *testing.T) {
+	fake := newFakeGCS(t)
+	uploader := newTestGCSUploader(t, fake.server.URL)
+	rootDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "sales.bak"), []byte("sales data"), 0644))
+
+	upload := func() error {
+		mockLogger := NewMockLogger()
+		mockLogger.On("Info", mock.Anything, mock.Anything).Return()
+		mockLogger.On("Error", mock.Anything, mock.Anything).Return()
+
+		return Upload(newUploadContext(t, io.Discard, "--checksum", rootDir), uploader, mockLogger)
+	}
+	require.NoError(t, upload())
+
+	sum := sha256.Sum256([]byte("sales data"))
+	assert.Equal(t, map[string]string{metadataSHA256: hex.EncodeToString(sum[:])}, fake.metadata["sales.bak"])
+	assert.NotContains(t, fake.objects, "sales.bak.sha256")
+
+	result, _, err := verifyKey(context.Background(), uploader, "sales.bak")
+	require.NoError(t, err)
+	assert.Equal(t, verifyOK, result)
+
+	// Data the provider stored differently than it was sent fails the upload
+	fake.corrupt = true
+	later := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(rootDir, "sales.bak"), later, later))
+	assert.ErrorContains(t, upload(), "stored with different contents than were sent")
+
+	result, detail, err := verifyKey(context.Background(), uploader, "sales.bak")
+	require.NoError(t, err)
+	assert.Equal(t, verifyFailed, result)
+	assert.Contains(t, detail, "expected ")
+}
+
+func TestVerify_TransformedUploadWithMetadata(t *testing.T) {
+	fake := newFakeGCS(t)
+	fake.noHashes = true
+	uploader := newTestGCSUploader(t, fake.server.URL)
+	rootDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "sales.bak"), []byte("sales data"), 0644))
+
+	uploadFiles(t, uploader, "--checksum", "--compress=zip", rootDir)
+
+	// The SHA-256 of the compressed data is only known once it is sent, so it
+	// goes in a checksum object beside the source's metadata
+	assert.Contains(t, fake.metadata["sales.zip"], metadataSourceSHA256)
+	require.Contains(t, fake.objects, "sales.zip.sha256")
+	sum := sha256.Sum256(fake.objects["sales.zip"])
+	assert.True(t, strings.HasPrefix(string(fake.objects["sales.zip.sha256"]), hex.EncodeToString(sum[:])))
+
+	out, err := runVerify(t, uploader)
+	require.NoError(t, err)
+	assert.Contains(t, out, "OK       sales.zip\n")
+	assert.Contains(t, out, "verified 1 file(s): 1 ok, 0 failed, 0 without checksum")
+
+	// Simulate bit rot in the stored file
+	fake.objects["sales.zip"][0] ^= 1
+	out, err = runVerify(t, uploader, "sales.zip")
+	assert.ErrorContains(t, err, "1 file(s) failed verification")
+	assert.Contains(t, out, "FAILED   sales.zip (expected ")
+}
+
+func TestVerify(t *testing.T) {
+	uploader, basePath := uploadWithChecksum(t)
+	require.NoError(t, uploader.Upload(context.Background(), "sql/old.bak", strings.NewReader("no checksum"), 11))
+
+	out, err := runVerify(t, uploader)
+	require.NoError(t, err)
+	assert.Contains(t, out, "OK       sql/sales.bak\n")
+	assert.Contains(t, out, "NO SUM   sql/old.bak\n")
+	assert.Contains(t, out, "verified 2 file(s): 1 ok, 0 failed, 1 without checksum")
+
+	// Simulate bit rot in the stored file
+	require.NoError(t, os.WriteFile(filepath.Join(basePath, "sql", "sales.bak"), []byte("sales dat4"), 0644))
+
+	out, err = runVerify(t, uploader, "sql/sales.bak")
+	assert.ErrorContains(t, err, "1 file(s) failed verification")
+	assert.Contains(t, out, "FAILED   sql/sales.bak (expected ")
+}
+
+func TestDownload_Verify(t *testing.T) {
+	uploader, basePath := uploadWithChecksum(t)
+
+	download := func() error {
+		mockLogger := NewMockLogger()
+		mockLogger.On("Info", mock.Anything, mock.Anything).Return()
+		mockLogger.On("Error", mock.Anything, mock.Anything).Return()
+
+		set := flag.NewFlagSet("test", 0)
+		set.String("output", filepath.Join(t.TempDir(), "restored.bak"), "doc")
+		set.Bool("non-interactive", true, "doc")
+		set.Bool("verify", true, "doc")
+		require.NoError(t, set.Parse([]string{"sql/sales.bak"}))
+		return Download(cli.NewContext(&cli.App{}, set, nil), uploader, mockLogger)
+	}
+
+	require.NoError(t, download())
+
+	require.NoError(t, os.WriteFile(filepath.Join(basePath, "sql", "sales.bak"), []byte("sales dat4"), 0644))
+	err := download()
+	var userErr *UserError
+	require.True(t, errors.As(err, &userErr))
+	assert.True(t, strings.HasPrefix(userErr.Message, "Checksum mismatch for sql/sales.bak"))
+}
+
+func TestPrune_DeletesChecksums(t *testing.T) {
+	mockUploader := new(MockUploader)
+	mockLogger := NewMockLogger()
+
+	set := flag.NewFlagSet("test", 0)
+	set.Duration("age", 24*time.Hour, "doc")
+	set.String("max-delete", "1", "doc")
+	ctx := cli.NewContext(&cli.App{}, set, nil)
+
+	// The checksums are neither pruned on their own nor counted by --max-delete
+	keys := []string{"old.bak", "old.bak.sha256", "new.bak", "new.bak.sha256"}
+	mockUploader.On("List", mock.Anything, "").Return(keys, nil)
+	mockUploader.On("GetFileInfo", mock.Anything, "old.bak").Return(&FileInfo{LastModified: time.Now().Add(-48 * time.Hour)}, nil)
+	mockUploader.On("GetFileInfo", mock.Anything, "new.bak").Return(&FileInfo{LastModified: time.Now()}, nil)
+	mockUploader.On("Delete", mock.Anything, "old.bak").Return(nil)
+	mockUploader.On("Delete", mock.Anything, "old.bak.sha256").Return(nil)
+	mockLogger.On("Info", mock.Anything, mock.Anything).Return()
+
+	err := Prune(ctx, mockUploader, mockLogger)
+	require.NoError(t, err)
+
+	mockUploader.AssertExpectations(t)
+	mockUploader.AssertNumberOfCalls(t, "Delete", 2)
+	mockUploader.AssertNotCalled(t, "GetFileInfo", mock.Anything, "old.bak.sha256")
+}
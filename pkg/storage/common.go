@@ -8,4 +8,12 @@ import (
 type FileInfo struct {
 	LastModified time.Time
 	Size         int64
+
+	// Metadata is the user metadata stored with the file, on providers that
+	// keep it, with lower case keys
+	Metadata map[string]string
+	// Checksums are the checksums of the stored data that the provider
+	// computed itself, hex encoded by algorithm (ChecksumMD5, ChecksumCRC32
+	// or ChecksumCRC32C). Only those the provider reports are set.
+	Checksums map[string]string
 }
@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/ngns-io/baxfer/pkg/logger"
+)
+
+// Compare modes decide whether a file that is already stored has changed
+const (
+	CompareMtime    = "mtime"    // the local file is newer, or its size differs
+	CompareSize     = "size"     // the sizes differ
+	CompareChecksum = "checksum" // the SHA-256 of the local file differs
+)
+
+// parseCompare returns the mode named by a --compare value
+func parseCompare(value string) (string, error) {
+	switch strings.ToLower(value) {
+	case "", CompareMtime:
+		return CompareMtime, nil
+	case CompareSize:
+		return CompareSize, nil
+	case CompareChecksum:
+		return CompareChecksum, nil
+	}
+	return "", fmt.Errorf("invalid compare mode %q: must be mtime, size or checksum", value)
+}
+
+// localFile is a local file being compared with its stored copy
+type localFile struct {
+	info        os.FileInfo
+	transformed bool   // compressed or encrypted, so the stored copy differs
+	sum         string // hex SHA-256, computed for CompareChecksum only
+	checksum    bool   // --checksum is set, so stored copies need a checksum
+}
+
+// hashFile returns the hex SHA-256 of a file's contents
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// uploadEligible reports whether a local file should be uploaded to key,
+// comparing it with the stored copy according to mode. The size and
+// checksum modes use the checksum stored on upload for files that were
+// compressed or encrypted, and upload files that have none. With --checksum,
+// a stored copy without a checksum is uploaded again in every mode, since
+// storing the checksum may have failed after the upload itself succeeded.
+func uploadEligible(ctx context.Context, uploader Uploader, key string, local localFile, mode string, log logger.Logger) (bool, error) {
+	if mode == CompareMtime || mode == "" {
+		eligible, err := fileUploadEligible(ctx, uploader, key, local.info, local.transformed, log)
+		if err != nil || eligible || !local.checksum {
+			return eligible, err
+		}
+		record, err := readChecksum(ctx, uploader, key)
+		if err != nil {
+			log.Error("Error reading stored checksum", "key", key, "error", err)
+			return false, err
+		}
+		if !record.covers(local.transformed) {
+			log.Info("No stored checksum, uploading again", "key", key)
+			return true, nil
+		}
+		return false, nil
+	}
+
+	exists, err := uploader.FileExists(ctx, key)
+	if err != nil {
+		log.Error("Error checking if file exists", "key", key, "error", err)
+		return false, err
+	}
+	if !exists {
+		return true, nil
+	}
+
+	// Stored files only match the local file when uploaded as they are
+	var record *checksumRecord
+	if local.transformed || mode == CompareChecksum || local.checksum {
+		record, err = readChecksum(ctx, uploader, key)
+		if err != nil {
+			log.Error("Error reading stored checksum", "key", key, "error", err)
+			return false, err
+		}
+		if !record.covers(local.transformed) {
+			log.Info("No stored checksum to compare with", "key", key)
+			return true, nil
+		}
+	}
+
+	if mode == CompareChecksum {
+		remoteSum := record.Sum
+		if local.transformed {
+			remoteSum = record.SourceSum
+		}
+		if local.sum != remoteSum {
+			log.Info("File checksums differ", "key", key)
+			return true, nil
+		}
+		return false, nil
+	}
+
+	var remoteSize int64
+	if local.transformed {
+		remoteSize = record.SourceSize
+	} else {
+		remoteInfo, err := uploader.GetFileInfo(ctx, key)
+		if err != nil {
+			log.Error("Error getting remote file info", "key", key, "error", err)
+			return false, err
+		}
+		remoteSize = remoteInfo.Size
+	}
+	if local.info.Size() != remoteSize {
+		log.Info("File sizes differ", "key", key, "local_size", local.info.Size(), "remote_size", remoteSize)
+		return true, nil
+	}
+	return false, nil
+}
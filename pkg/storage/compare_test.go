@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCompare(t *testing.T) {
+	for value, expected := range map[string]string{"": CompareMtime, "mtime": CompareMtime, "SIZE": CompareSize, "checksum": CompareChecksum} {
+		mode, err := parseCompare(value)
+		require.NoError(t, err)
+		assert.Equal(t, expected, mode)
+	}
+
+	_, err := parseCompare("md5")
+	assert.ErrorContains(t, err, "invalid compare mode")
+}
+
+func TestUpload_CompareChecksum(t *testing.T) {
+	for _, compress := range []string{CompressNone, CompressZstd} {
+		t.Run(compress, func(t *testing.T) {
+			uploader, _ := newTestLocalUploader(t)
+			rootDir := t.TempDir()
+			same := filepath.Join(rootDir, "same.bak")
+			changed := filepath.Join(rootDir, "changed.bak")
+			require.NoError(t, os.WriteFile(same, []byte("sales data"), 0644))
+			require.NoError(t, os.WriteFile(changed, []byte("sales data"), 0644))
+
+			uploaded := uploadFiles(t, uploader, "--checksum", "--compare", CompareChecksum, "--compress", compress, rootDir)
+			assert.ElementsMatch(t, []string{"same.bak", "changed.bak"}, uploaded)
+
+			// A clock running ahead makes same.bak look newer, while changed.bak
+			// changes without its size or a newer modification time
+			future := time.Now().Add(24 * time.Hour)
+			require.NoError(t, os.Chtimes(same, future, future))
+			require.NoError(t, os.WriteFile(changed, []byte("sales dat4"), 0644))
+			past := time.Now().Add(-24 * time.Hour)
+			require.NoError(t, os.Chtimes(changed, past, past))
+
+			uploaded = uploadFiles(t, uploader, "--checksum", "--compare", CompareChecksum, "--compress", compress, rootDir)
+			assert.Equal(t, []string{"changed.bak"}, uploaded)
+		})
+	}
+}
+
+func TestUpload_CompareSize(t *testing.T) {
+	uploader, _ := newTestLocalUploader(t)
+	rootDir := t.TempDir()
+	file := filepath.Join(rootDir, "sales.bak")
+	require.NoError(t, os.WriteFile(file, []byte("sales data"), 0644))
+
+	assert.Equal(t, []string{"sales.bak"}, uploadFiles(t, uploader, "--checksum", "--compare", CompareSize, "--compress", CompressZip, rootDir))
+
+	// Compressed sizes cannot be compared, so the size recorded with the
+	// checksum is used
+	future := time.Now().Add(24 * time.Hour)
+	require.NoError(t, os.Chtimes(file, future, future))
+	assert.Empty(t, uploadFiles(t, uploader, "--checksum", "--compare", CompareSize, "--compress", CompressZip, rootDir))
+
+	require.NoError(t, os.WriteFile(file, []byte("more sales data"), 0644))
+	assert.Equal(t, []string{"sales.bak"}, uploadFiles(t, uploader, "--checksum", "--compare", CompareSize, "--compress", CompressZip, rootDir))
+}
+
+func TestUploadEligible_NoStoredChecksum(t *testing.T) {
+	mockUploader := new(MockUploader)
+	mockLogger := NewMockLogger()
+
+	mockUploader.On("FileExists", mock.Anything, "test.zip").Return(true, nil)
+	mockUploader.On("FileExists", mock.Anything, "test.zip.sha256").Return(false, nil)
+	mockLogger.On("Info", "No stored checksum to compare with", mock.Anything).Return()
+
+	local := localFile{info: &mockFileInfo{size: 100}, transformed: true, sum: "abc"}
+	eligible, err := uploadEligible(context.Background(), mockUploader, "test.zip", local, CompareChecksum, mockLogger)
+	require.NoError(t, err)
+	assert.True(t, eligible)
+	mockUploader.AssertExpectations(t)
+}
+
+func TestUpload_CompareChecksumNeedsChecksums(t *testing.T) {
+	c := newUploadContext(t, io.Discard, "--compare", CompareChecksum, t.TempDir())
+	err := Upload(c, new(MockUploader), NewMockLogger())
+	assert.ErrorContains(t, err, "--compare=checksum needs")
+}
+
+func TestUpload_CompareSizeOfTransformedFilesNeedsChecksums(t *testing.T) {
+	for _, transform := range []string{"--compress=zip", "--encrypt"} {
+		c := newUploadContext(t, io.Discard, "--compare", CompareSize, transform, t.TempDir())
+		err := Upload(c, new(MockUploader), NewMockLogger())
+		assert.ErrorContains(t, err, "--compare=size needs", transform)
+	}
+
+	// With --checksum, the size of the original file is recorded and compared
+	uploader, _ := newTestLocalUploader(t)
+	rootDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "sales.bak"), []byte("sales data"), 0644))
+	args := []string{"--compare", CompareSize, "--compress=zip", "--checksum", rootDir}
+	assert.Equal(t, []string{"sales.bak"}, uploadFiles(t, uploader, args...))
+	assert.Empty(t, uploadFiles(t, uploader, args...))
+}
+
+func TestUpload_MissingChecksumUploadedAgain(t *testing.T) {
+	uploader, _ := newTestLocalUploader(t)
+	rootDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "sales.bak"), []byte("sales data"), 0644))
+
+	assert.Equal(t, []string{"sales.bak"}, uploadFiles(t, uploader, "--checksum", "--compare", CompareMtime, "--compress", CompressNone, rootDir))
+	assert.Empty(t, uploadFiles(t, uploader, "--checksum", "--compare", CompareMtime, "--compress", CompressNone, rootDir))
+
+	// Storing the checksum may fail after the upload succeeded
+	require.NoError(t, uploader.Delete(context.Background(), checksumKey("sales.bak")))
+	assert.Equal(t, []string{"sales.bak"}, uploadFiles(t, uploader, "--checksum", "--compare", CompareMtime, "--compress", CompressNone, rootDir))
+	assert.Empty(t, uploadFiles(t, uploader, "--checksum", "--compare", CompareMtime, "--compress", CompressNone, rootDir))
+}
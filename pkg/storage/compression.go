@@ -0,0 +1,338 @@
+package storage
+
+import (
+	"archive/zip"
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression formats accepted by --compress
+const (
+	CompressNone = "none"
+	CompressZip  = "zip"
+	CompressGzip = "gzip"
+	CompressZstd = "zstd"
+)
+
+// parseCompression returns the format named by a --compress value. A bare
+// --compress (true) means zip, as before the format could be chosen.
+func parseCompression(value string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", "false", CompressNone:
+		return CompressNone, nil
+	case "true", CompressZip:
+		return CompressZip, nil
+	case CompressGzip, "gz":
+		return CompressGzip, nil
+	case CompressZstd, "zst":
+		return CompressZstd, nil
+	}
+	return "", fmt.Errorf("invalid compression %q: must be zip, gzip, zstd or none", value)
+}
+
+// validateCompressionLevel checks a --compress-level for a format. Zero
+// selects the format's default level.
+func validateCompressionLevel(format string, level int) error {
+	maxLevel := 9
+	if format == CompressZstd {
+		maxLevel = 22
+	}
+	if level < 0 || level > maxLevel {
+		return fmt.Errorf("invalid compression level %d for %s: must be between 1 and %d", level, format, maxLevel)
+	}
+	return nil
+}
+
+// compressedKey returns the key a file is stored under when compressed with
+// format. A zip archive replaces the file's extension, since the archive
+// keeps the original name; gzip and zstd append theirs.
+func compressedKey(key, format string) string {
+	switch format {
+	case CompressZip:
+		return strings.TrimSuffix(key, filepath.Ext(key)) + ".zip"
+	case CompressGzip:
+		return key + ".gz"
+	case CompressZstd:
+		return key + ".zst"
+	}
+	return key
+}
+
+// compressionFromKey returns the format a key was compressed with by
+// --compress, judged by its extension, or CompressNone
+func compressionFromKey(key string) string {
+	switch strings.ToLower(path.Ext(key)) {
+	case ".zip":
+		return CompressZip
+	case ".gz":
+		return CompressGzip
+	case ".zst":
+		return CompressZstd
+	}
+	return CompressNone
+}
+
+// isCompressedFile returns true if the file extension indicates an already-compressed format.
+func isCompressedFile(filename string) bool {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".gz", ".gzip", ".zip", ".bz2", ".xz", ".lz", ".lz4", ".zst", ".zstd",
+		".7z", ".rar", ".cab", ".lzma", ".br",
+		".jpg", ".jpeg", ".png", ".gif", ".webp", ".avif",
+		".mp3", ".mp4", ".mkv", ".avi", ".mov", ".flac", ".ogg", ".aac",
+		".woff", ".woff2":
+		return true
+	}
+	return false
+}
+
+// streamingCompress pipes compression of reader in the given format directly
+// to the returned reader, avoiding buffering the compressed file in memory.
+// A level of zero uses the format's default.
+func streamingCompress(reader io.Reader, filename, format string, level int) io.Reader {
+	if format == CompressZip {
+		return streamingZipCompress(reader, filename, level)
+	}
+
+	pr, pw := io.Pipe()
+
+	go func() {
+		var w io.WriteCloser
+		var err error
+		switch format {
+		case CompressGzip:
+			if level == 0 {
+				level = gzip.DefaultCompression
+			}
+			var gw *gzip.Writer
+			gw, err = gzip.NewWriterLevel(pw, level)
+			if err == nil {
+				// Recorded so that gunzip -N and download --decompress restore the name
+				gw.Name = filepath.Base(filename)
+				w = gw
+			}
+		case CompressZstd:
+			opts := []zstd.EOption{}
+			if level != 0 {
+				opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+			}
+			w, err = zstd.NewWriter(pw, opts...)
+		default:
+			err = fmt.Errorf("unsupported compression %q", format)
+		}
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		if _, err := io.Copy(w, reader); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		if err := w.Close(); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		pw.Close()
+	}()
+
+	return pr
+}
+
+// streamingZipCompress pipes zip compression directly to the returned reader,
+// avoiding buffering the entire archive in memory.
+func streamingZipCompress(reader io.Reader, filename string, level int) io.Reader {
+	pr, pw := io.Pipe()
+
+	go func() {
+		zw := zip.NewWriter(pw)
+		if level != 0 {
+			zw.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+				return flate.NewWriter(w, level)
+			})
+		}
+
+		header := &zip.FileHeader{
+			Name:   filepath.Base(filename),
+			Method: zip.Deflate,
+		}
+
+		writer, err := zw.CreateHeader(header)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		if _, err := io.Copy(writer, reader); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		if err := zw.Close(); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		pw.Close()
+	}()
+
+	return pr
+}
+
+// decompressReader returns the decompressed contents of r, and the name of the
+// original file if the format records it
+func decompressReader(r io.Reader, format string) (io.ReadCloser, string, error) {
+	switch format {
+	case CompressZip:
+		return newZipStreamReader(r)
+	case CompressGzip:
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, "", err
+		}
+		return gr, gr.Name, nil
+	case CompressZstd:
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, "", err
+		}
+		return zr.IOReadCloser(), "", nil
+	}
+	return nil, "", fmt.Errorf("unsupported compression %q", format)
+}
+
+const (
+	zipLocalHeaderSignature    = 0x04034b50
+	zipDataDescriptorSignature = 0x08074b50
+	zipFlagDataDescriptor      = 0x8
+)
+
+// zipStreamReader reads the file in a single-file zip archive, such as those
+// written by streamingZipCompress, as the archive streams in. archive/zip
+// needs the central directory at the end of the archive, so the local file
+// header is read directly instead.
+type zipStreamReader struct {
+	br    *bufio.Reader
+	data  io.Reader
+	flate io.ReadCloser // nil for stored entries
+	flags uint16
+	crc   uint32 // from the header, unless a data descriptor follows the data
+	hash  hash.Hash32
+	done  bool
+}
+
+func newZipStreamReader(r io.Reader) (io.ReadCloser, string, error) {
+	// flate reads a bufio.Reader byte by byte, leaving the data descriptor
+	// after the compressed data unread
+	br := bufio.NewReader(r)
+
+	var header [30]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return nil, "", fmt.Errorf("failed to read zip header: %w", err)
+	}
+	if binary.LittleEndian.Uint32(header[0:4]) != zipLocalHeaderSignature {
+		return nil, "", errors.New("not a zip archive")
+	}
+	flags := binary.LittleEndian.Uint16(header[6:8])
+	method := binary.LittleEndian.Uint16(header[8:10])
+	size := binary.LittleEndian.Uint32(header[18:22])
+	nameLen := binary.LittleEndian.Uint16(header[26:28])
+	extraLen := binary.LittleEndian.Uint16(header[28:30])
+
+	name := make([]byte, nameLen)
+	if _, err := io.ReadFull(br, name); err != nil {
+		return nil, "", fmt.Errorf("failed to read zip header: %w", err)
+	}
+	if _, err := br.Discard(int(extraLen)); err != nil {
+		return nil, "", fmt.Errorf("failed to read zip header: %w", err)
+	}
+
+	z := &zipStreamReader{
+		br:    br,
+		flags: flags,
+		crc:   binary.LittleEndian.Uint32(header[14:18]),
+		hash:  crc32.NewIEEE(),
+	}
+	switch method {
+	case zip.Deflate:
+		z.flate = flate.NewReader(br)
+		z.data = z.flate
+	case zip.Store:
+		// The size of a stored entry is needed to find its end
+		if flags&zipFlagDataDescriptor != 0 || size == 0xffffffff {
+			return nil, "", errors.New("stored zip entries of unknown size are not supported")
+		}
+		z.data = io.LimitReader(br, int64(size))
+	default:
+		return nil, "", fmt.Errorf("unsupported zip compression method %d", method)
+	}
+	return z, string(name), nil
+}
+
+func (z *zipStreamReader) Read(p []byte) (int, error) {
+	if z.done {
+		return 0, io.EOF
+	}
+	n, err := z.data.Read(p)
+	z.hash.Write(p[:n])
+	if err == io.EOF {
+		z.done = true
+		if verr := z.verify(); verr != nil {
+			return n, verr
+		}
+	}
+	return n, err
+}
+
+// verify checks the entry's checksum once its data has been read, and that
+// no other file follows it in the archive
+func (z *zipStreamReader) verify() error {
+	want := z.crc
+	nextHeader := []int{0}
+	if z.flags&zipFlagDataDescriptor != 0 {
+		var buf [4]byte
+		if _, err := io.ReadFull(z.br, buf[:]); err != nil {
+			return fmt.Errorf("failed to read zip data descriptor: %w", err)
+		}
+		// The descriptor's signature is optional
+		if binary.LittleEndian.Uint32(buf[:]) == zipDataDescriptorSignature {
+			if _, err := io.ReadFull(z.br, buf[:]); err != nil {
+				return fmt.Errorf("failed to read zip data descriptor: %w", err)
+			}
+		}
+		want = binary.LittleEndian.Uint32(buf[:])
+		// The sizes follow the checksum, 4 bytes each or 8 in zip64 archives
+		nextHeader = []int{8, 16}
+	}
+	if z.hash.Sum32() != want {
+		return errors.New("zip checksum mismatch")
+	}
+
+	for _, offset := range nextHeader {
+		next, err := z.br.Peek(offset + 4)
+		if err == nil && binary.LittleEndian.Uint32(next[offset:]) == zipLocalHeaderSignature {
+			return errors.New("zip archive contains more than one file")
+		}
+	}
+	return nil
+}
+
+func (z *zipStreamReader) Close() error {
+	if z.flate != nil {
+		return z.flate.Close()
+	}
+	return nil
+}
@@ -0,0 +1,278 @@
+package storage
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+)
+
+func TestParseCompression(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{"", CompressNone},
+		{"false", CompressNone},
+		{"none", CompressNone},
+		{"true", CompressZip},
+		{"zip", CompressZip},
+		{"GZIP", CompressGzip},
+		{"gz", CompressGzip},
+		{"zstd", CompressZstd},
+		{"zst", CompressZstd},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			format, err := parseCompression(tt.value)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, format)
+		})
+	}
+
+	_, err := parseCompression("bzip2")
+	assert.ErrorContains(t, err, "invalid compression")
+}
+
+func TestCompressedKey(t *testing.T) {
+	assert.Equal(t, "sql/sales.zip", compressedKey("sql/sales.bak", CompressZip))
+	assert.Equal(t, "sql/sales.bak.gz", compressedKey("sql/sales.bak", CompressGzip))
+	assert.Equal(t, "sql/sales.bak.zst", compressedKey("sql/sales.bak", CompressZstd))
+	assert.Equal(t, "sql/sales.bak", compressedKey("sql/sales.bak", CompressNone))
+}
+
+// decompress reads back data compressed in format
+func decompress(t *testing.T, format string, data []byte) string {
+	t.Helper()
+
+	var reader io.Reader
+	switch format {
+	case CompressZip:
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		require.NoError(t, err)
+		require.Len(t, zr.File, 1)
+		f, err := zr.File[0].Open()
+		require.NoError(t, err)
+		defer f.Close()
+		reader = f
+	case CompressGzip:
+		gr, err := gzip.NewReader(bytes.NewReader(data))
+		require.NoError(t, err)
+		reader = gr
+	case CompressZstd:
+		zr, err := zstd.NewReader(bytes.NewReader(data))
+		require.NoError(t, err)
+		defer zr.Close()
+		reader = zr
+	}
+
+	plain, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	return string(plain)
+}
+
+func TestUpload_CompressionFormats(t *testing.T) {
+	content := strings.Repeat("sales data ", 1000)
+
+	tests := []struct {
+		compress string
+		level    int
+		key      string
+		format   string
+	}{
+		{"true", 0, "sales.zip", CompressZip},
+		{"zip", 9, "sales.zip", CompressZip},
+		{"gzip", 1, "sales.bak.gz", CompressGzip},
+		{"zstd", 0, "sales.bak.zst", CompressZstd},
+		{"zstd", 19, "sales.bak.zst", CompressZstd},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.compress, func(t *testing.T) {
+			uploader, basePath := newTestLocalUploader(t)
+			rootDir := t.TempDir()
+			require.NoError(t, os.WriteFile(filepath.Join(rootDir, "sales.bak"), []byte(content), 0644))
+
+			mockLogger := NewMockLogger()
+			mockLogger.On("Info", mock.Anything, mock.Anything).Return()
+
+			ctx := newUploadContext(t, io.Discard, "--compress", tt.compress, "--compress-level", strconv.Itoa(tt.level), rootDir)
+
+			require.NoError(t, Upload(ctx, uploader, mockLogger))
+
+			keys, err := uploader.List(context.Background(), "")
+			require.NoError(t, err)
+			require.Equal(t, []string{tt.key}, keys)
+
+			stored, err := os.ReadFile(filepath.Join(basePath, tt.key))
+			require.NoError(t, err)
+			assert.Less(t, len(stored), len(content))
+			assert.Equal(t, content, decompress(t, tt.format, stored))
+		})
+	}
+}
+
+func TestUpload_InvalidCompression(t *testing.T) {
+	tests := []struct {
+		compress string
+		level    int
+		expected string
+	}{
+		{"rar", 0, "invalid compression"},
+		{"gzip", 10, "invalid compression level 10 for gzip"},
+		{"zstd", 23, "invalid compression level 23 for zstd"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expected, func(t *testing.T) {
+			mockUploader := new(MockUploader)
+
+			ctx := newUploadContext(t, io.Discard, "--compress", tt.compress, "--compress-level", strconv.Itoa(tt.level), t.TempDir())
+
+			err := Upload(ctx, mockUploader, NewMockLogger())
+			assert.ErrorContains(t, err, tt.expected)
+			mockUploader.AssertNotCalled(t, "FileExists", mock.Anything, mock.Anything)
+		})
+	}
+}
+
+// uploadCompressed stores sales.bak compressed with format and returns the key
+func uploadCompressed(t *testing.T, uploader Uploader, format, content string, extra ...string) string {
+	t.Helper()
+
+	rootDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "sales.bak"), []byte(content), 0644))
+
+	mockLogger := NewMockLogger()
+	mockLogger.On("Info", mock.Anything, mock.Anything).Return()
+
+	args := append([]string{"--compress", format}, extra...)
+	require.NoError(t, Upload(newUploadContext(t, io.Discard, append(args, rootDir)...), uploader, mockLogger))
+
+	keys, err := uploader.List(context.Background(), "")
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	return keys[0]
+}
+
+// downloadToDir downloads key into a new working directory without --output
+// and returns the names of the files it created
+func downloadToDir(t *testing.T, uploader Uploader, key string, args ...string) (string, []string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(dir))
+	t.Cleanup(func() { require.NoError(t, os.Chdir(wd)) })
+
+	mockLogger := NewMockLogger()
+	mockLogger.On("Info", mock.Anything, mock.Anything).Return()
+	mockLogger.On("Error", mock.Anything, mock.Anything).Return()
+
+	set := flag.NewFlagSet("test", 0)
+	set.String("output", "", "doc")
+	set.Bool("non-interactive", true, "doc")
+	set.Bool("decompress", false, "doc")
+	set.String("identity", "", "doc")
+	set.String("passphrase-file", "", "doc")
+	require.NoError(t, set.Parse(append(args, key)))
+	ctx := cli.NewContext(&cli.App{}, set, nil)
+	require.NoError(t, Download(ctx, uploader, mockLogger))
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return dir, names
+}
+
+func TestDownload_Decompress(t *testing.T) {
+	content := strings.Repeat("sales data ", 1000)
+
+	for _, format := range []string{CompressZip, CompressGzip, CompressZstd} {
+		t.Run(format, func(t *testing.T) {
+			uploader, _ := newTestLocalUploader(t)
+			key := uploadCompressed(t, uploader, format, content)
+
+			dir, names := downloadToDir(t, uploader, key, "--decompress")
+			require.Equal(t, []string{"sales.bak"}, names)
+
+			restored, err := os.ReadFile(filepath.Join(dir, "sales.bak"))
+			require.NoError(t, err)
+			assert.Equal(t, content, string(restored))
+		})
+	}
+}
+
+func TestDownload_WithoutDecompress(t *testing.T) {
+	uploader, _ := newTestLocalUploader(t)
+	key := uploadCompressed(t, uploader, CompressZstd, "sales data")
+
+	_, names := downloadToDir(t, uploader, key)
+	assert.Equal(t, []string{"sales.bak.zst"}, names)
+}
+
+func TestDownload_DecryptAndDecompress(t *testing.T) {
+	uploader, _ := newTestLocalUploader(t)
+	passphraseFile := writeSecret(t, "passphrase", "secret\n")
+	key := uploadCompressed(t, uploader, CompressZip, "sales data", "--encrypt", "--passphrase-file", passphraseFile)
+	require.Equal(t, "sales.zip.age", key)
+
+	dir, names := downloadToDir(t, uploader, key, "--decompress", "--passphrase-file", passphraseFile)
+	require.Equal(t, []string{"sales.bak"}, names)
+
+	restored, err := os.ReadFile(filepath.Join(dir, "sales.bak"))
+	require.NoError(t, err)
+	assert.Equal(t, "sales data", string(restored))
+}
+
+func TestZipStreamReader_Corrupt(t *testing.T) {
+	var archive bytes.Buffer
+	_, err := io.Copy(&archive, streamingZipCompress(strings.NewReader("sales data"), "sales.bak", 0))
+	require.NoError(t, err)
+
+	// Flip a bit in the stored checksum in the data descriptor
+	data := archive.Bytes()
+	descriptor := bytes.Index(data, []byte{0x50, 0x4b, 0x07, 0x08})
+	require.Positive(t, descriptor)
+	data[descriptor+4] ^= 0x01
+
+	reader, name, err := newZipStreamReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Equal(t, "sales.bak", name)
+	_, err = io.ReadAll(reader)
+	assert.ErrorContains(t, err, "zip checksum mismatch")
+
+	// Archives with more than one file cannot be restored to a single file
+	var multi bytes.Buffer
+	zw := zip.NewWriter(&multi)
+	for _, name := range []string{"a.bak", "b.bak"} {
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(name))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+
+	reader, _, err = newZipStreamReader(&multi)
+	require.NoError(t, err)
+	_, err = io.ReadAll(reader)
+	assert.ErrorContains(t, err, "more than one file")
+}
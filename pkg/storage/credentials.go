@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+)
+
+// Credentials holds the secrets a provider is initialized with, keyed by the
+// environment variable that supplies each one otherwise, such as B2_KEY_ID or
+// FTP_PASSWORD. A nil Credentials reads everything from the environment.
+type Credentials map[string]string
+
+// Get returns the named credential, or the environment variable of that name
+// when it is not set
+func (c Credentials) Get(name string) string {
+	if value, ok := c[name]; ok {
+		return value
+	}
+	return os.Getenv(name)
+}
+
+// awsOptions returns the AWS config options for the AWS_* credentials that
+// are set, so the SDK never has to find them in the environment later, for
+// example when it refreshes them
+func (c Credentials) awsOptions() []func(*config.LoadOptions) error {
+	var opts []func(*config.LoadOptions) error
+	if keyID, secret := c["AWS_ACCESS_KEY_ID"], c["AWS_SECRET_ACCESS_KEY"]; keyID != "" && secret != "" {
+		opts = append(opts, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
+			keyID, secret, c["AWS_SESSION_TOKEN"],
+		)))
+	}
+	if profile := c["AWS_PROFILE"]; profile != "" {
+		opts = append(opts, config.WithSharedConfigProfile(profile))
+	}
+	return opts
+}
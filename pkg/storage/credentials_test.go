@@ -0,0 +1,26 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCredentials_Get(t *testing.T) {
+	t.Setenv("FTP_PASSWORD", "from-env")
+	t.Setenv("FTP_USER", "backup")
+
+	creds := Credentials{"FTP_PASSWORD": "from-profile"}
+	assert.Equal(t, "from-profile", creds.Get("FTP_PASSWORD"))
+	assert.Equal(t, "backup", creds.Get("FTP_USER"), "unset credentials come from the environment")
+
+	var none Credentials
+	assert.Equal(t, "from-env", none.Get("FTP_PASSWORD"))
+}
+
+func TestCredentials_AWSOptions(t *testing.T) {
+	assert.Empty(t, Credentials(nil).awsOptions())
+	assert.Empty(t, Credentials{"AWS_ACCESS_KEY_ID": "key"}.awsOptions(), "a key ID without its secret is ignored")
+	assert.Len(t, Credentials{"AWS_ACCESS_KEY_ID": "key", "AWS_SECRET_ACCESS_KEY": "secret"}.awsOptions(), 1)
+	assert.Len(t, Credentials{"AWS_PROFILE": "backup"}.awsOptions(), 1)
+}
@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// encryptedExt is appended to the keys of files encrypted by --encrypt
+const encryptedExt = ".age"
+
+// isEncryptedKey reports whether a key names a file encrypted by --encrypt
+func isEncryptedKey(key string) bool {
+	return strings.HasSuffix(key, encryptedExt)
+}
+
+// readPassphrase returns the first line of a passphrase file
+func readPassphrase(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read passphrase file: %w", err)
+	}
+	line, _, _ := strings.Cut(string(data), "\n")
+	passphrase := strings.TrimRight(line, "\r")
+	if passphrase == "" {
+		return "", fmt.Errorf("passphrase file %s is empty", path)
+	}
+	return passphrase, nil
+}
+
+// loadRecipients returns the age recipients to encrypt to: X25519 public keys
+// (age1...) given directly or one per line in a recipients file, or a
+// passphrase read from a file. A passphrase cannot be combined with public keys.
+func loadRecipients(publicKeys []string, recipientsFile, passphraseFile string) ([]age.Recipient, error) {
+	var recipients []age.Recipient
+	for _, key := range publicKeys {
+		r, err := age.ParseX25519Recipient(strings.TrimSpace(key))
+		if err != nil {
+			return nil, fmt.Errorf("invalid recipient %q: %w", key, err)
+		}
+		recipients = append(recipients, r)
+	}
+
+	if recipientsFile != "" {
+		f, err := os.Open(recipientsFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open recipients file: %w", err)
+		}
+		defer f.Close()
+
+		parsed, err := age.ParseRecipients(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse recipients file %s: %w", recipientsFile, err)
+		}
+		recipients = append(recipients, parsed...)
+	}
+
+	if passphraseFile != "" {
+		if len(recipients) > 0 {
+			return nil, fmt.Errorf("a passphrase cannot be combined with public key recipients")
+		}
+		passphrase, err := readPassphrase(passphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		r, err := age.NewScryptRecipient(passphrase)
+		if err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, r)
+	}
+
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("encryption requires --recipient, --recipients-file or --passphrase-file")
+	}
+	return recipients, nil
+}
+
+// loadIdentities returns the age identities to decrypt with, read from an
+// identity file (AGE-SECRET-KEY-... lines, as written by age-keygen) and/or
+// a passphrase file
+func loadIdentities(identityFile, passphraseFile string) ([]age.Identity, error) {
+	var identities []age.Identity
+
+	if identityFile != "" {
+		f, err := os.Open(identityFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open identity file: %w", err)
+		}
+		defer f.Close()
+
+		parsed, err := age.ParseIdentities(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse identity file %s: %w", identityFile, err)
+		}
+		identities = append(identities, parsed...)
+	}
+
+	if passphraseFile != "" {
+		passphrase, err := readPassphrase(passphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		id, err := age.NewScryptIdentity(passphrase)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, id)
+	}
+
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("decryption requires --identity or --passphrase-file")
+	}
+	return identities, nil
+}
+
+// streamingEncrypt pipes age encryption of reader directly to the returned
+// reader, like streamingZipCompress, so the plaintext is never buffered
+func streamingEncrypt(reader io.Reader, recipients []age.Recipient) io.Reader {
+	pr, pw := io.Pipe()
+
+	go func() {
+		w, err := age.Encrypt(pw, recipients...)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		if _, err := io.Copy(w, reader); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		// Close writes the final chunk and authentication tag
+		if err := w.Close(); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		pw.Close()
+	}()
+
+	return pr
+}
+
+// decryptReader returns the plaintext of an age-encrypted stream. Errors
+// reading the plaintext are marked as decryption errors, so they are not
+// reported as failures of the steps that consume it.
+func decryptReader(r io.Reader, identities []age.Identity) (io.Reader, error) {
+	plaintext, err := age.Decrypt(r, identities...)
+	if err != nil {
+		return nil, &decryptError{err: err}
+	}
+	return &decryptingReader{r: plaintext}, nil
+}
+
+// decryptError is an error from decrypting a download
+type decryptError struct {
+	err error
+}
+
+func (e *decryptError) Error() string {
+	return e.err.Error()
+}
+
+func (e *decryptError) Unwrap() error {
+	return e.err
+}
+
+type decryptingReader struct {
+	r io.Reader
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = &decryptError{err: err}
+	}
+	return n, err
+}
+
+// decryptFailure returns the error reported for a key that failed to decrypt
+func decryptFailure(key string, err error) error {
+	var noMatch *age.NoIdentityMatchError
+	message := fmt.Sprintf("Failed to decrypt file: %s", key)
+	if errors.As(err, &noMatch) {
+		message = fmt.Sprintf("Failed to decrypt file: %s (no identity or passphrase matches)", key)
+	}
+	return &UserError{Message: message, Cause: err}
+}
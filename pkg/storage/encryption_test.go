@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+)
+
+// encryptedUpload uploads a single backup from a fresh root with the given
+// encryption flags and returns the stored keys
+func encryptedUpload(t *testing.T, uploader Uploader, args ...string) []string {
+	t.Helper()
+
+	rootDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "sales.bak"), []byte("sales data"), 0644))
+
+	mockLogger := NewMockLogger()
+	mockLogger.On("Info", mock.Anything, mock.Anything).Return()
+
+	ctx := newUploadContext(t, io.Discard, append(args, rootDir)...)
+
+	require.NoError(t, Upload(ctx, uploader, mockLogger))
+
+	keys, err := uploader.List(ctx.Context, "")
+	require.NoError(t, err)
+	return keys
+}
+
+// decryptedDownload downloads key with the given decryption flags and returns
+// the path of the downloaded file
+func decryptedDownload(t *testing.T, uploader Uploader, key string, args ...string) (string, error) {
+	t.Helper()
+
+	outFile := filepath.Join(t.TempDir(), "restored.bak")
+	mockLogger := NewMockLogger()
+	mockLogger.On("Info", mock.Anything, mock.Anything).Return()
+	mockLogger.On("Error", mock.Anything, mock.Anything).Return()
+
+	set := flag.NewFlagSet("test", 0)
+	set.String("output", outFile, "doc")
+	set.Bool("non-interactive", true, "doc")
+	set.String("identity", "", "doc")
+	set.String("passphrase-file", "", "doc")
+	require.NoError(t, set.Parse(append(args, key)))
+	ctx := cli.NewContext(&cli.App{}, set, nil)
+
+	return outFile, Download(ctx, uploader, mockLogger)
+}
+
+func writeSecret(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestEncryption_RecipientRoundTrip(t *testing.T) {
+	uploader, basePath := newTestLocalUploader(t)
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	keys := encryptedUpload(t, uploader, "--encrypt", "--compress=zip", "--recipient", identity.Recipient().String())
+	require.Equal(t, []string{"sales.zip.age"}, keys)
+
+	// The stored file is ciphertext
+	stored, err := os.ReadFile(filepath.Join(basePath, "sales.zip.age"))
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(stored), "age-encryption.org/v1"))
+
+	identityFile := writeSecret(t, "key.txt", "# test key\n"+identity.String()+"\n")
+	outFile, err := decryptedDownload(t, uploader, "sales.zip.age", "--identity", identityFile)
+	require.NoError(t, err)
+
+	// Decryption restores the zip archive that was encrypted
+	restored, err := os.ReadFile(outFile)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(restored), "PK"))
+}
+
+func TestEncryption_PassphraseRoundTrip(t *testing.T) {
+	uploader, _ := newTestLocalUploader(t)
+	passphraseFile := writeSecret(t, "passphrase", "correct horse battery staple\n")
+
+	keys := encryptedUpload(t, uploader, "--encrypt", "--passphrase-file", passphraseFile)
+	require.Equal(t, []string{"sales.bak.age"}, keys)
+
+	outFile, err := decryptedDownload(t, uploader, "sales.bak.age", "--passphrase-file", passphraseFile)
+	require.NoError(t, err)
+
+	restored, err := os.ReadFile(outFile)
+	require.NoError(t, err)
+	assert.Equal(t, "sales data", string(restored))
+}
+
+func TestEncryption_WrongIdentity(t *testing.T) {
+	uploader, _ := newTestLocalUploader(t)
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	other, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+
+	encryptedUpload(t, uploader, "--encrypt", "--recipient", identity.Recipient().String())
+
+	identityFile := writeSecret(t, "key.txt", other.String()+"\n")
+	_, err = decryptedDownload(t, uploader, "sales.bak.age", "--identity", identityFile)
+
+	var userErr *UserError
+	require.True(t, errors.As(err, &userErr))
+	assert.Equal(t, "Failed to decrypt file: sales.bak.age (no identity or passphrase matches)", userErr.Message)
+}
+
+func TestEncryption_DownloadNotFound(t *testing.T) {
+	uploader, _ := newTestLocalUploader(t)
+	passphraseFile := writeSecret(t, "passphrase", "secret\n")
+
+	_, err := decryptedDownload(t, uploader, "missing.bak.age", "--passphrase-file", passphraseFile)
+
+	// The download error is reported, not a failure to decrypt nothing
+	var userErr *UserError
+	require.True(t, errors.As(err, &userErr))
+	assert.Equal(t, "File not found: missing.bak.age", userErr.Message)
+}
+
+func TestLoadRecipients_Invalid(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	passphraseFile := writeSecret(t, "passphrase", "secret\n")
+
+	_, err = loadRecipients(nil, "", "")
+	assert.ErrorContains(t, err, "encryption requires")
+
+	_, err = loadRecipients([]string{"age1notakey"}, "", "")
+	assert.ErrorContains(t, err, "invalid recipient")
+
+	_, err = loadRecipients([]string{identity.Recipient().String()}, "", passphraseFile)
+	assert.ErrorContains(t, err, "cannot be combined")
+
+	_, err = loadRecipients(nil, "", writeSecret(t, "empty", "\n"))
+	assert.ErrorContains(t, err, "is empty")
+}
@@ -1,12 +1,23 @@
 package storage
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/textproto"
 	"strings"
+	"syscall"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Backblaze/blazer/base"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/aws/smithy-go"
+	"github.com/jlaffaye/ftp"
+	"github.com/pkg/sftp"
 )
 
 // UserError represents a user-friendly error message
@@ -35,6 +46,33 @@ func isNotFoundError(err error) bool {
 		return true
 	}
 
+	var azErr *azcore.ResponseError
+	if errors.As(err, &azErr) && azErr.StatusCode == 404 {
+		return true
+	}
+
+	var gcsErr *gcsError
+	if errors.As(err, &gcsErr) && gcsErr.StatusCode == 404 {
+		return true
+	}
+
+	var davErr *webdavError
+	if errors.As(err, &davErr) && davErr.StatusCode == 404 {
+		return true
+	}
+
+	// Local storage returns the filesystem's own errors
+	if errors.Is(err, fs.ErrNotExist) {
+		return true
+	}
+
+	// FTP uses 550 for any unavailable file, so only replies the FTP
+	// uploader confirmed to mean a missing file count
+	var ftpMissing *ftpNotFoundError
+	if errors.As(err, &ftpMissing) {
+		return true
+	}
+
 	if errors.As(err, &apiErr) {
 		code := apiErr.ErrorCode()
 		if code == "NoSuchKey" || code == "NotFound" || code == "404" {
@@ -49,6 +87,22 @@ func isNotFoundError(err error) bool {
 
 // isAccessDeniedError checks if the error represents an access denied condition
 func isAccessDeniedError(err error) bool {
+	var azErr *azcore.ResponseError
+	if errors.As(err, &azErr) && azErr.StatusCode == 403 &&
+		azErr.ErrorCode != "AuthenticationFailed" {
+		return true
+	}
+
+	var gcsErr *gcsError
+	if errors.As(err, &gcsErr) && gcsErr.StatusCode == 403 {
+		return true
+	}
+
+	var davErr *webdavError
+	if errors.As(err, &davErr) && davErr.StatusCode == 403 {
+		return true
+	}
+
 	var apiErr smithy.APIError
 	if errors.As(err, &apiErr) {
 		code := apiErr.ErrorCode()
@@ -62,6 +116,108 @@ func isAccessDeniedError(err error) bool {
 		strings.Contains(err.Error(), "status code: 403")
 }
 
+// isTransientError reports whether a failed request is worth repeating:
+// timeouts, dropped connections, throttling and server errors. Missing files,
+// denied access and other client errors are permanent.
+func isTransientError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var partial *partialDownloadError
+	if errors.As(err, &partial) {
+		return false
+	}
+
+	// A fan-out upload is repeated only if every failed destination may recover
+	var destErr *DestinationError
+	if errors.As(err, &destErr) {
+		for _, e := range destErr.Failed {
+			if !isTransientError(e) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if isNotFoundError(err) || isAccessDeniedError(err) {
+		return false
+	}
+
+	if status := httpStatusCode(err); status != 0 {
+		return status == http.StatusRequestTimeout || status == http.StatusTooManyRequests || status >= 500
+	}
+
+	// FTP replies in the 400s are transient negative completions, such as 421
+	// (service not available) and 426 (transfer aborted)
+	var ftpErr *textproto.Error
+	if errors.As(err, &ftpErr) {
+		return ftpErr.Code >= 400 && ftpErr.Code < 500
+	}
+
+	if isConnectionError(err) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	// Fallback to string matching for errors that lose their type, such as
+	// those from the B2 client
+	msg := strings.ToLower(err.Error())
+	for _, transient := range []string{"connection reset", "broken pipe", "timeout", "timed out", "temporarily unavailable"} {
+		if strings.Contains(msg, transient) {
+			return true
+		}
+	}
+	return false
+}
+
+// isConnectionError reports whether an error means the connection to the
+// server was dropped
+func isConnectionError(err error) bool {
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, sftp.ErrSSHFxConnectionLost) ||
+		errors.Is(err, sftp.ErrSSHFxNoConnection)
+}
+
+// httpStatusCode returns the HTTP status of a failed request, or 0 if the
+// error does not carry one
+func httpStatusCode(err error) int {
+	var azErr *azcore.ResponseError
+	if errors.As(err, &azErr) {
+		return azErr.StatusCode
+	}
+
+	var gcsErr *gcsError
+	if errors.As(err, &gcsErr) {
+		return gcsErr.StatusCode
+	}
+
+	var davErr *webdavError
+	if errors.As(err, &davErr) {
+		return davErr.StatusCode
+	}
+
+	// The B2 large file API
+	if code, _ := base.Code(err); code != 0 {
+		return code
+	}
+
+	// S3 and the S3-compatible providers
+	var httpErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &httpErr) {
+		return httpErr.HTTPStatusCode()
+	}
+	return 0
+}
+
 // formatDownloadError converts provider-specific errors into user-friendly messages
 func formatDownloadError(provider, key string, err error) error {
 	if err == nil {
@@ -94,6 +250,16 @@ func formatDownloadError(provider, key string, err error) error {
 		return formatB2Error(key, err)
 	case "b2s3":
 		return formatB2S3Error(key, err)
+	case "s3compat":
+		return formatS3CompatError(key, err)
+	case "azure":
+		return formatAzureError(key, err)
+	case "gcs":
+		return formatGCSError(key, err)
+	case "webdav":
+		return formatWebDAVError(key, err)
+	case "ftp":
+		return formatFTPError(key, err)
 	case "sftp":
 		return formatSFTPError(key, err)
 	default:
@@ -164,6 +330,101 @@ func formatB2S3Error(key string, err error) error {
 	}
 }
 
+func formatS3CompatError(key string, err error) error {
+	if strings.Contains(err.Error(), "InvalidAccessKeyId") ||
+		strings.Contains(err.Error(), "SignatureDoesNotMatch") {
+		return &UserError{
+			Message: "Invalid credentials for S3-compatible endpoint. Please check your access key and secret key.",
+			Cause:   err,
+		}
+	}
+	if strings.Contains(err.Error(), "certificate") {
+		return &UserError{
+			Message: "TLS certificate error connecting to S3-compatible endpoint. Please check --ca-bundle.",
+			Cause:   err,
+		}
+	}
+	return &UserError{
+		Message: fmt.Sprintf("Error downloading from S3-compatible endpoint: %s", key),
+		Cause:   err,
+	}
+}
+
+func formatAzureError(key string, err error) error {
+	var azErr *azcore.ResponseError
+	if errors.As(err, &azErr) {
+		switch azErr.ErrorCode {
+		case "AuthenticationFailed":
+			return &UserError{
+				Message: "Invalid Azure credentials. Please check your connection string or account key.",
+				Cause:   err,
+			}
+		case "ContainerNotFound":
+			return &UserError{
+				Message: "Azure container not found. Please check the --bucket value.",
+				Cause:   err,
+			}
+		}
+	}
+	return &UserError{
+		Message: fmt.Sprintf("Error downloading from Azure: %s", key),
+		Cause:   err,
+	}
+}
+
+func formatGCSError(key string, err error) error {
+	var gcsErr *gcsError
+	if errors.As(err, &gcsErr) && gcsErr.StatusCode == 401 {
+		return &UserError{
+			Message: "Invalid GCS credentials. Please check your service account key file.",
+			Cause:   err,
+		}
+	}
+	return &UserError{
+		Message: fmt.Sprintf("Error downloading from GCS: %s", key),
+		Cause:   err,
+	}
+}
+
+func formatWebDAVError(key string, err error) error {
+	var davErr *webdavError
+	if errors.As(err, &davErr) && davErr.StatusCode == 401 {
+		return &UserError{
+			Message: "Invalid WebDAV credentials. Please check --webdav-user and WEBDAV_PASSWORD.",
+			Cause:   err,
+		}
+	}
+	if strings.Contains(err.Error(), "certificate") {
+		return &UserError{
+			Message: "TLS certificate error connecting to WebDAV server. Please check --webdav-url.",
+			Cause:   err,
+		}
+	}
+	return &UserError{
+		Message: fmt.Sprintf("Error downloading from WebDAV: %s", key),
+		Cause:   err,
+	}
+}
+
+func formatFTPError(key string, err error) error {
+	if isFTPCode(err, ftp.StatusNotLoggedIn) {
+		return &UserError{
+			Message: "Not logged in to FTP server. Please check --ftp-user and FTP_PASSWORD.",
+			Cause:   err,
+		}
+	}
+	if strings.Contains(err.Error(), "certificate") {
+		return &UserError{
+			Message: "TLS certificate error connecting to FTP server. Use --ftp-insecure for self-signed certificates.",
+			Cause:   err,
+		}
+	}
+	return &UserError{
+		Message: fmt.Sprintf("Error downloading via FTP: %s", key),
+		Cause:   err,
+	}
+}
+
 func formatSFTPError(key string, err error) error {
 	if strings.Contains(err.Error(), "permission denied") {
 		return &UserError{
@@ -0,0 +1,604 @@
+package storage
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+	"github.com/ngns-io/baxfer/pkg/logger"
+)
+
+// FTP TLS modes
+const (
+	FTPTLSNone     = "none"
+	FTPTLSExplicit = "explicit" // AUTH TLS on the standard port
+	FTPTLSImplicit = "implicit" // TLS from the first byte, usually on port 990
+)
+
+// FTPConfig holds the connection settings for an FTP or FTPS server
+type FTPConfig struct {
+	Host               string
+	Port               int
+	Username           string
+	BasePath           string
+	TLSMode            string // none, explicit or implicit
+	InsecureSkipVerify bool   // accept self-signed certificates
+}
+
+// FTPUploader stores files on an FTP server, optionally over explicit or
+// implicit FTPS. Data connections always use passive mode (EPSV, falling back
+// to PASV), and listings use MLSD when the server supports it and LIST
+// otherwise. A dropped control connection is re-established by the next
+// request, so retries can succeed.
+type FTPUploader struct {
+	addr     string
+	options  []ftp.DialOption
+	username string
+	password string
+	dialer   *ftpDialer
+	basePath string
+	log      logger.Logger
+
+	// mu serializes commands, since an FTP control connection can only run
+	// one transfer at a time, and guards conn while reconnecting
+	mu   sync.Mutex
+	conn *ftp.ServerConn // nil until the next request reconnects
+
+	dirs map[string]bool // directories known to exist
+}
+
+// ftpDialer opens the connections of an FTPUploader, and keeps the latest
+// data connection so that a canceled transfer can be aborted by closing it
+type ftpDialer struct {
+	dialer    net.Dialer
+	tlsConfig *tls.Config // nil without TLS
+	implicit  bool        // TLS from the first byte of the control connection
+
+	mu      sync.Mutex
+	control bool // the control connection has been opened
+	data    net.Conn
+}
+
+func (d *ftpDialer) dial(network, address string) (net.Conn, error) {
+	conn, err := d.dialer.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.control {
+		// The first connection is the control connection, which the ftp
+		// package upgrades itself for explicit TLS
+		d.control = true
+		if d.implicit {
+			conn = tls.Client(conn, d.tlsConfig)
+		}
+		return conn, nil
+	}
+
+	if d.tlsConfig != nil {
+		conn = tls.Client(conn, d.tlsConfig)
+	}
+	d.data = conn
+	return conn, nil
+}
+
+// reset prepares the dialer for a new control connection
+func (d *ftpDialer) reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.control, d.data = false, nil
+}
+
+// abort closes the data connection, which ends a transfer blocked on it. The
+// server then fails the transfer on the control connection, which stays open.
+func (d *ftpDialer) abort() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.data != nil {
+		d.data.Close()
+	}
+}
+
+// contextReader fails reads once its context is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// ftpNotFoundError is a 550 reply confirmed to mean that a file or directory
+// does not exist
+type ftpNotFoundError struct {
+	err error
+}
+
+func (e *ftpNotFoundError) Error() string { return e.err.Error() }
+func (e *ftpNotFoundError) Unwrap() error { return e.err }
+
+// ftpMissingPhrases appear in the 550 replies of common servers for files
+// that do not exist
+var ftpMissingPhrases = []string{"no such", "not found", "not exist", "doesn't exist", "cannot find", "can't find"}
+
+func NewFTPUploader(cfg FTPConfig, creds Credentials, log logger.Logger) (*FTPUploader, error) {
+	if cfg.Host == "" {
+		return nil, fmt.Errorf("no host provided for FTP storage")
+	}
+
+	password := creds.Get("FTP_PASSWORD")
+	if password == "" {
+		return nil, fmt.Errorf("no authentication method provided: set FTP_PASSWORD")
+	}
+
+	if cfg.TLSMode == "" {
+		cfg.TLSMode = FTPTLSNone
+	}
+	if cfg.Port == 0 {
+		cfg.Port = 21
+		if cfg.TLSMode == FTPTLSImplicit {
+			cfg.Port = 990
+		}
+	}
+
+	dialer := &ftpDialer{dialer: net.Dialer{Timeout: 30 * time.Second}}
+	options := []ftp.DialOption{
+		ftp.DialWithDialFunc(dialer.dial),
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         cfg.Host,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+		// Many FTPS servers require data connections to resume the control
+		// connection's TLS session
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+	switch cfg.TLSMode {
+	case FTPTLSNone:
+	case FTPTLSExplicit:
+		options = append(options, ftp.DialWithExplicitTLS(tlsConfig))
+		dialer.tlsConfig = tlsConfig
+	case FTPTLSImplicit:
+		options = append(options, ftp.DialWithTLS(tlsConfig))
+		dialer.tlsConfig, dialer.implicit = tlsConfig, true
+	default:
+		return nil, fmt.Errorf("invalid FTP TLS mode %q: must be none, explicit or implicit", cfg.TLSMode)
+	}
+
+	uploader := &FTPUploader{
+		addr:     net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port)),
+		options:  options,
+		username: cfg.Username,
+		password: password,
+		dialer:   dialer,
+		basePath: cfg.BasePath,
+		log:      log,
+		dirs:     make(map[string]bool),
+	}
+	if err := uploader.connect(); err != nil {
+		return nil, err
+	}
+
+	// Create base directory if it doesn't exist
+	if cfg.BasePath != "" {
+		if err := uploader.mkdirAll(cfg.BasePath); err != nil {
+			return nil, errors.Join(fmt.Errorf("failed to create base directory: %w", err), uploader.conn.Quit())
+		}
+	}
+
+	log.Info("Initialized storage provider",
+		"provider", "FTP",
+		"host", cfg.Host,
+		"port", cfg.Port,
+		"tls", cfg.TLSMode,
+		"username", cfg.Username,
+		"basePath", cfg.BasePath,
+		"mlsd", uploader.conn.IsTimePreciseInList())
+
+	return uploader, nil
+}
+
+// connect connects and logs in to the server if there is no open control
+// connection. u.mu must be held.
+func (u *FTPUploader) connect() error {
+	if u.conn != nil {
+		return nil
+	}
+
+	u.dialer.reset()
+	conn, err := ftp.Dial(u.addr, u.options...)
+	if err != nil {
+		return fmt.Errorf("failed to connect to FTP server: %w", err)
+	}
+	if err := conn.Login(u.username, u.password); err != nil {
+		return errors.Join(fmt.Errorf("failed to log in to FTP server: %w", err), conn.Quit())
+	}
+	u.conn = conn
+	return nil
+}
+
+// checkConnection closes the control connection if err shows it was dropped,
+// or the server is closing it with a 421 reply, so the next request
+// reconnects. u.mu must be held.
+func (u *FTPUploader) checkConnection(err error) {
+	if err == nil || u.conn == nil || !(isConnectionError(err) || isFTPCode(err, ftp.StatusNotAvailable)) {
+		return
+	}
+
+	u.log.Warn("FTP connection lost, reconnecting on the next request", "addr", u.addr, "error", err)
+	if closeErr := u.conn.Quit(); closeErr != nil {
+		u.log.Debug("Error closing lost FTP connection", "error", closeErr)
+	}
+	u.conn = nil
+}
+
+func (u *FTPUploader) fullPath(key string) string {
+	return path.Join(u.basePath, key)
+}
+
+// mkdirAll creates dir and any missing parents. MKD fails for directories that
+// already exist, so errors are ignored here and surface on the following STOR.
+func (u *FTPUploader) mkdirAll(dir string) error {
+	if dir == "." || dir == "/" || dir == "" || u.dirs[dir] {
+		return nil
+	}
+	if err := u.mkdirAll(path.Dir(dir)); err != nil {
+		return err
+	}
+
+	if err := u.conn.MakeDir(dir); err != nil && !isFTPCode(err, ftp.StatusFileUnavailable) {
+		return err
+	}
+	u.dirs[dir] = true
+	return nil
+}
+
+// Upload stores the file under a temporary name and renames it into place
+// once complete, so an interrupted transfer never looks like a finished backup.
+func (u *FTPUploader) Upload(ctx context.Context, key string, reader io.Reader, size int64) (err error) {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err := u.connect(); err != nil {
+		return err
+	}
+	defer func() { u.checkConnection(err) }()
+
+	fullPath := u.fullPath(key)
+	dir := path.Dir(fullPath)
+
+	// Ensure directory exists
+	if err := u.mkdirAll(dir); err != nil {
+		return fmt.Errorf("failed to create directory structure: %w", err)
+	}
+
+	// The transfer cannot be interrupted otherwise, so cancellation closes
+	// its data connection
+	tmpPath := path.Join(dir, strings.Replace(localTempPattern, "*", strconv.FormatInt(time.Now().UnixNano(), 10), 1))
+	stop := context.AfterFunc(ctx, u.dialer.abort)
+	err = u.conn.Stor(tmpPath, &contextReader{ctx: ctx, r: reader})
+	stop()
+	if err != nil {
+		u.removeTemp(tmpPath)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		return err
+	}
+
+	if err := u.conn.Rename(tmpPath, fullPath); err != nil {
+		// Some servers refuse to rename over an existing file
+		if delErr := u.conn.Delete(fullPath); delErr == nil {
+			err = u.conn.Rename(tmpPath, fullPath)
+		}
+		if err != nil {
+			u.removeTemp(tmpPath)
+			return fmt.Errorf("failed to move file into place: %w", err)
+		}
+	}
+	return nil
+}
+
+func (u *FTPUploader) removeTemp(tmpPath string) {
+	if err := u.conn.Delete(tmpPath); err != nil {
+		u.log.Error("Failed to remove temporary file",
+			"path", tmpPath,
+			"error", err)
+	}
+}
+
+func (u *FTPUploader) Download(ctx context.Context, key string, writer io.Writer) (err error) {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err := u.connect(); err != nil {
+		return formatDownloadError("ftp", key, err)
+	}
+	defer func() { u.checkConnection(err) }()
+
+	fullPath := u.fullPath(key)
+
+	resp, err := u.conn.Retr(fullPath)
+	if err != nil {
+		u.log.Error("Failed to open remote file",
+			"path", fullPath,
+			"error", err)
+		return formatDownloadError("ftp", key, u.checkMissing(fullPath, err))
+	}
+	defer resp.Close()
+
+	stop := context.AfterFunc(ctx, u.dialer.abort)
+	_, err = io.Copy(writer, resp)
+	stop()
+	if ctxErr := ctx.Err(); err != nil && ctxErr != nil {
+		return ctxErr
+	}
+	if err != nil {
+		u.log.Error("Failed to copy file content",
+			"path", fullPath,
+			"error", err)
+
+		return &UserError{
+			Message: fmt.Sprintf("Error reading file content: %s", key),
+			Cause:   err,
+		}
+	}
+
+	// Closing reads the transfer status, which reports a failed transfer
+	if err := resp.Close(); err != nil {
+		return &UserError{
+			Message: fmt.Sprintf("Error reading file content: %s", key),
+			Cause:   err,
+		}
+	}
+	return nil
+}
+
+func (u *FTPUploader) List(ctx context.Context, prefix string) (keys []string, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err := u.connect(); err != nil {
+		return nil, err
+	}
+	defer func() { u.checkConnection(err) }()
+
+	// Prefixes are matched as strings like object storage keys, so start from
+	// the directory portion and filter the rest
+	dir := ""
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = prefix[:i+1]
+	}
+
+	if err := u.walk(ctx, dir, prefix, &keys); err != nil {
+		// Nothing has been stored under this prefix yet
+		if isNotFoundError(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error walking directory: %w", err)
+	}
+	return keys, nil
+}
+
+// walk lists dir (a key prefix ending in "/", or "" for the base path) and
+// descends into subdirectories that can contain keys matching prefix
+func (u *FTPUploader) walk(ctx context.Context, dir, prefix string, keys *[]string) error {
+	// Check for context cancellation during walk
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	listPath := u.fullPath(dir)
+	if listPath == "" {
+		listPath = "."
+	}
+
+	entries, err := u.conn.List(listPath)
+	if err != nil {
+		return u.checkMissing(listPath, err)
+	}
+
+	for _, entry := range entries {
+		// LIST on some servers returns the full path rather than the name
+		name := path.Base(entry.Name)
+		if name == "." || name == ".." {
+			continue
+		}
+
+		key := dir + name
+		switch entry.Type {
+		case ftp.EntryTypeFolder:
+			key += "/"
+			if strings.HasPrefix(key, prefix) || strings.HasPrefix(prefix, key) {
+				if err := u.walk(ctx, key, prefix, keys); err != nil {
+					return err
+				}
+			}
+		case ftp.EntryTypeFile:
+			if matched, _ := path.Match(localTempPattern, name); matched {
+				continue
+			}
+			if strings.HasPrefix(key, prefix) {
+				*keys = append(*keys, key)
+			}
+		}
+	}
+	return nil
+}
+
+func (u *FTPUploader) Delete(ctx context.Context, key string) (err error) {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err := u.connect(); err != nil {
+		return err
+	}
+	defer func() { u.checkConnection(err) }()
+
+	fullPath := u.fullPath(key)
+	if err := u.conn.Delete(fullPath); err != nil {
+		return u.checkMissing(fullPath, err)
+	}
+	return nil
+}
+
+func (u *FTPUploader) FileExists(ctx context.Context, key string) (bool, error) {
+	_, err := u.GetFileInfo(ctx, key)
+	if err != nil {
+		if isNotFoundError(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (u *FTPUploader) GetFileInfo(ctx context.Context, key string) (info *FileInfo, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err := u.connect(); err != nil {
+		return nil, err
+	}
+	defer func() { u.checkConnection(err) }()
+
+	entry, err := u.entry(u.fullPath(key))
+	if err != nil {
+		return nil, err
+	}
+	if entry.Type != ftp.EntryTypeFile {
+		return nil, fmt.Errorf("not a regular file: %s", key)
+	}
+
+	return &FileInfo{
+		LastModified: entry.Time,
+		Size:         int64(entry.Size),
+	}, nil
+}
+
+// entry returns the details of a single file, using MLST where the server
+// supports it and otherwise searching a LIST of its parent directory
+func (u *FTPUploader) entry(fullPath string) (*ftp.Entry, error) {
+	if u.conn.IsTimePreciseInList() {
+		entry, err := u.conn.GetEntry(fullPath)
+		if err != nil {
+			return nil, u.checkMissing(fullPath, err)
+		}
+		return entry, nil
+	}
+
+	entries, err := u.conn.List(path.Dir(fullPath))
+	if err != nil {
+		return nil, u.checkMissing(path.Dir(fullPath), err)
+	}
+
+	name := path.Base(fullPath)
+	for _, entry := range entries {
+		if path.Base(entry.Name) != name {
+			continue
+		}
+
+		// LIST times are only accurate to the minute (or day, for older
+		// files), so prefer MDTM when it is available
+		if entry.Type == ftp.EntryTypeFile && u.conn.IsGetTimeSupported() {
+			if modTime, err := u.conn.GetTime(fullPath); err == nil {
+				entry.Time = modTime
+			}
+		}
+		return entry, nil
+	}
+
+	return nil, &ftpNotFoundError{err: &textproto.Error{Code: ftp.StatusFileUnavailable, Msg: "No such file: " + fullPath}}
+}
+
+// checkMissing returns err as an ftpNotFoundError if it is a 550 reply to a
+// command on fullPath that means fullPath does not exist
+func (u *FTPUploader) checkMissing(fullPath string, err error) error {
+	if u.missing(fullPath, err) {
+		return &ftpNotFoundError{err: err}
+	}
+	return err
+}
+
+// missing reports whether err is a 550 reply meaning that fullPath does not
+// exist. Servers also reply 550 for files the user may not access, so a reply
+// that does not say the file is missing is checked against a listing of its
+// parent directory.
+func (u *FTPUploader) missing(fullPath string, err error) bool {
+	var ftpErr *textproto.Error
+	if !errors.As(err, &ftpErr) || ftpErr.Code != ftp.StatusFileUnavailable {
+		return false
+	}
+	msg := strings.ToLower(ftpErr.Msg)
+	for _, phrase := range ftpMissingPhrases {
+		if strings.Contains(msg, phrase) {
+			return true
+		}
+	}
+
+	parent := path.Dir(fullPath)
+	if parent == fullPath {
+		return false
+	}
+	entries, listErr := u.conn.List(parent)
+	if listErr != nil {
+		// The parent directory may be missing as well
+		return u.missing(parent, listErr)
+	}
+	name := path.Base(fullPath)
+	for _, entry := range entries {
+		if path.Base(entry.Name) == name {
+			return false
+		}
+	}
+	return true
+}
+
+func (u *FTPUploader) Close() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.conn == nil {
+		return nil
+	}
+	err := u.conn.Quit()
+	u.conn = nil
+	return err
+}
+
+// isFTPCode reports whether err is an FTP reply with the given status code
+func isFTPCode(err error, code int) bool {
+	var ftpErr *textproto.Error
+	return errors.As(err, &ftpErr) && ftpErr.Code == code
+}
@@ -0,0 +1,546 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/textproto"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeFTP implements the subset of an FTP server used by FTPUploader, with
+// passive data connections and optional explicit or implicit TLS
+type fakeFTP struct {
+	listener  net.Listener
+	tlsConfig *tls.Config
+	tlsMode   string
+	mlsd      bool
+
+	mu      sync.Mutex
+	files   map[string][]byte
+	modTime time.Time
+	dirs    map[string]bool
+
+	denied map[string]bool // files that exist but cannot be read
+	vague  bool            // reply to missing files without saying why
+	slow   bool            // read uploads slowly and keep none of them
+	hangUp bool            // close the control connection on the next command
+}
+
+func newFakeFTP(t *testing.T, tlsMode string, mlsd bool) *fakeFTP {
+	t.Helper()
+
+	f := &fakeFTP{
+		tlsMode: tlsMode,
+		mlsd:    mlsd,
+		files:   map[string][]byte{},
+		modTime: time.Now().UTC().Truncate(time.Second),
+		dirs:    map[string]bool{".": true},
+		denied:  map[string]bool{},
+	}
+
+	var err error
+	f.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	if tlsMode != FTPTLSNone {
+		f.tlsConfig = &tls.Config{Certificates: []tls.Certificate{selfSignedCert(t)}}
+	}
+	if tlsMode == FTPTLSImplicit {
+		f.listener = tls.NewListener(f.listener, f.tlsConfig)
+	}
+	t.Cleanup(func() { f.listener.Close() })
+
+	go func() {
+		for {
+			conn, err := f.listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeFTP) config() FTPConfig {
+	return FTPConfig{
+		Host:               "127.0.0.1",
+		Port:               f.listener.Addr().(*net.TCPAddr).Port,
+		Username:           "backup",
+		BasePath:           "backups",
+		TLSMode:            f.tlsMode,
+		InsecureSkipVerify: true,
+	}
+}
+
+func (f *fakeFTP) serve(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	reply := func(format string, args ...interface{}) {
+		_ = tp.PrintfLine(format, args...)
+	}
+	unavailable := func(reason string) {
+		if f.vague {
+			reason = "Requested action not taken"
+		}
+		reply("550 %s", reason)
+	}
+
+	var (
+		dataListener net.Listener
+		protected    = f.tlsMode == FTPTLSImplicit
+		renameFrom   string
+	)
+
+	reply("220 fake FTP ready")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd, arg, _ := strings.Cut(line, " ")
+		name := path.Clean(strings.TrimPrefix(arg, "/"))
+
+		f.mu.Lock()
+		if f.hangUp {
+			f.hangUp = false
+			f.mu.Unlock()
+			return
+		}
+		switch strings.ToUpper(cmd) {
+		case "AUTH":
+			if f.tlsMode != FTPTLSExplicit {
+				reply("502 TLS not configured")
+				break
+			}
+			reply("234 AUTH TLS OK")
+			conn = tls.Server(conn, f.tlsConfig)
+			tp = textproto.NewConn(conn)
+		case "USER":
+			reply("331 Password required")
+		case "PASS":
+			if arg != "secret" {
+				reply("530 Login incorrect")
+				break
+			}
+			reply("230 Logged in")
+		case "FEAT":
+			reply("211-Features:")
+			if f.mlsd {
+				reply(" MLST type*;size*;modify*;")
+			}
+			reply(" MDTM")
+			reply("211 End")
+		case "TYPE", "OPTS", "PBSZ":
+			reply("200 OK")
+		case "PROT":
+			protected = arg == "P"
+			reply("200 OK")
+		case "EPSV":
+			dataListener, err = net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				reply("425 Can't open data connection")
+				break
+			}
+			reply("229 Entering Extended Passive Mode (|||%d|)", dataListener.Addr().(*net.TCPAddr).Port)
+		case "MKD":
+			if f.dirs[name] || f.files[name] != nil {
+				reply("550 File exists")
+				break
+			}
+			f.dirs[name] = true
+			reply("257 Created")
+		case "STOR":
+			reply("150 Ok to send data")
+			if f.slow {
+				_, err := f.transfer(dataListener, protected, func(c net.Conn) ([]byte, error) {
+					buf := make([]byte, 32*1024)
+					for {
+						time.Sleep(10 * time.Millisecond)
+						if _, err := c.Read(buf); err != nil {
+							return nil, err
+						}
+					}
+				})
+				if !errors.Is(err, io.EOF) {
+					reply("426 Transfer aborted")
+					break
+				}
+				reply("226 Transfer complete")
+				break
+			}
+			data, err := f.transfer(dataListener, protected, func(c net.Conn) ([]byte, error) { return io.ReadAll(c) })
+			if err != nil {
+				reply("426 Transfer aborted")
+				break
+			}
+			f.files[name] = data
+			reply("226 Transfer complete")
+		case "RETR":
+			data, ok := f.files[name]
+			if !ok {
+				dataListener.Close()
+				reply("550 No such file")
+				break
+			}
+			reply("150 Opening data connection")
+			_, err := f.transfer(dataListener, protected, func(c net.Conn) ([]byte, error) {
+				_, err := c.Write(data)
+				return nil, err
+			})
+			if err != nil {
+				reply("426 Transfer aborted")
+				break
+			}
+			reply("226 Transfer complete")
+		case "MLSD", "LIST":
+			if !f.dirs[name] {
+				dataListener.Close()
+				reply("550 No such directory")
+				break
+			}
+			lines := f.listing(name, strings.ToUpper(cmd) == "MLSD")
+			reply("150 Here comes the listing")
+			_, err := f.transfer(dataListener, protected, func(c net.Conn) ([]byte, error) {
+				_, err := io.WriteString(c, strings.Join(lines, "\r\n")+"\r\n")
+				return nil, err
+			})
+			if err != nil {
+				reply("426 Transfer aborted")
+				break
+			}
+			reply("226 Transfer complete")
+		case "MLST":
+			data, ok := f.files[name]
+			if !ok {
+				unavailable("No such file")
+				break
+			}
+			if f.denied[name] {
+				unavailable("Permission denied")
+				break
+			}
+			reply("250-File details")
+			reply(" type=file;size=%d;modify=%s; %s", len(data), f.modTime.Format("20060102150405"), name)
+			reply("250 End")
+		case "MDTM":
+			if _, ok := f.files[name]; !ok {
+				reply("550 No such file")
+				break
+			}
+			reply("213 %s", f.modTime.Format("20060102150405"))
+		case "DELE":
+			if _, ok := f.files[name]; !ok {
+				reply("550 No such file")
+				break
+			}
+			delete(f.files, name)
+			reply("250 Deleted")
+		case "RNFR":
+			if _, ok := f.files[name]; !ok {
+				reply("550 No such file")
+				break
+			}
+			renameFrom = name
+			reply("350 Ready for RNTO")
+		case "RNTO":
+			f.files[name] = f.files[renameFrom]
+			delete(f.files, renameFrom)
+			reply("250 Renamed")
+		case "QUIT":
+			reply("221 Goodbye")
+			f.mu.Unlock()
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+		f.mu.Unlock()
+	}
+}
+
+// transfer accepts the passive data connection and runs fn on it
+func (f *fakeFTP) transfer(listener net.Listener, protected bool, fn func(net.Conn) ([]byte, error)) ([]byte, error) {
+	defer listener.Close()
+	conn, err := listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if protected {
+		tlsConn := tls.Server(conn, f.tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	return fn(conn)
+}
+
+func (f *fakeFTP) listing(dir string, mlsd bool) []string {
+	var lines []string
+	if mlsd {
+		lines = append(lines, "type=cdir;modify=20240102150405; .")
+	}
+
+	for name := range f.dirs {
+		if name != "." && path.Dir(name) == dir {
+			if mlsd {
+				lines = append(lines, fmt.Sprintf("type=dir;modify=20240102150405; %s", path.Base(name)))
+			} else {
+				lines = append(lines, fmt.Sprintf("drwxr-xr-x 2 ftp ftp 4096 Jan 02 15:04 %s", path.Base(name)))
+			}
+		}
+	}
+	for name, data := range f.files {
+		if path.Dir(name) == dir {
+			if mlsd {
+				lines = append(lines, fmt.Sprintf("type=file;size=%d;modify=%s; %s", len(data), f.modTime.Format("20060102150405"), path.Base(name)))
+			} else {
+				lines = append(lines, fmt.Sprintf("-rw-r--r-- 1 ftp ftp %d Jan 02 15:04 %s", len(data), path.Base(name)))
+			}
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func selfSignedCert(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "fake FTP"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func newTestFTPUploader(t *testing.T, server *fakeFTP) *FTPUploader {
+	t.Helper()
+	t.Setenv("FTP_PASSWORD", "secret")
+
+	mockLogger := NewMockLogger()
+	mockLogger.On("Info", mock.Anything, mock.Anything).Return()
+	mockLogger.On("Error", mock.Anything, mock.Anything).Return()
+
+	uploader, err := NewFTPUploader(server.config(), nil, mockLogger)
+	require.NoError(t, err)
+	t.Cleanup(func() { uploader.Close() })
+	return uploader
+}
+
+func TestFTPUploader_RoundTrip(t *testing.T) {
+	for _, mode := range []string{FTPTLSNone, FTPTLSExplicit, FTPTLSImplicit} {
+		t.Run("tls="+mode, func(t *testing.T) {
+			server := newFakeFTP(t, mode, true)
+			uploader := newTestFTPUploader(t, server)
+			ctx := context.Background()
+
+			data := []byte("ftp backup data")
+			err := uploader.Upload(ctx, "db/full.bak", bytes.NewReader(data), int64(len(data)))
+			require.NoError(t, err)
+			assert.Equal(t, data, server.files["backups/db/full.bak"])
+
+			exists, err := uploader.FileExists(ctx, "db/full.bak")
+			assert.NoError(t, err)
+			assert.True(t, exists)
+
+			info, err := uploader.GetFileInfo(ctx, "db/full.bak")
+			require.NoError(t, err)
+			assert.Equal(t, int64(len(data)), info.Size)
+			assert.True(t, server.modTime.Equal(info.LastModified))
+
+			var buf bytes.Buffer
+			err = uploader.Download(ctx, "db/full.bak", &buf)
+			assert.NoError(t, err)
+			assert.Equal(t, data, buf.Bytes())
+
+			err = uploader.Delete(ctx, "db/full.bak")
+			assert.NoError(t, err)
+
+			exists, err = uploader.FileExists(ctx, "db/full.bak")
+			assert.NoError(t, err)
+			assert.False(t, exists)
+		})
+	}
+}
+
+func TestFTPUploader_Reconnects(t *testing.T) {
+	server := newFakeFTP(t, FTPTLSExplicit, true)
+	t.Setenv("FTP_PASSWORD", "secret")
+	mockLogger := NewMockLogger()
+	mockLogger.On("Info", mock.Anything, mock.Anything).Return()
+	mockLogger.On("Error", mock.Anything, mock.Anything).Return()
+	mockLogger.On("Warn", mock.Anything, mock.Anything).Return()
+	mockLogger.On("Debug", mock.Anything, mock.Anything).Return()
+
+	uploader, err := NewFTPUploader(server.config(), nil, mockLogger)
+	require.NoError(t, err)
+	t.Cleanup(func() { uploader.Close() })
+	ctx := context.Background()
+	data := []byte("ftp backup data")
+	require.NoError(t, uploader.Upload(ctx, "db/full.bak", bytes.NewReader(data), int64(len(data))))
+
+	// The request the server hangs up on fails, and the next one reconnects
+	server.mu.Lock()
+	server.hangUp = true
+	server.mu.Unlock()
+	_, err = uploader.GetFileInfo(ctx, "db/full.bak")
+	require.Error(t, err)
+	assert.True(t, isTransientError(err))
+
+	var buf bytes.Buffer
+	require.NoError(t, uploader.Download(ctx, "db/full.bak", &buf))
+	assert.Equal(t, data, buf.Bytes())
+	mockLogger.AssertCalled(t, "Warn", "FTP connection lost, reconnecting on the next request", mock.Anything)
+}
+
+func TestFTPUploader_List(t *testing.T) {
+	for _, mlsd := range []bool{true, false} {
+		t.Run(fmt.Sprintf("mlsd=%v", mlsd), func(t *testing.T) {
+			server := newFakeFTP(t, FTPTLSNone, mlsd)
+			uploader := newTestFTPUploader(t, server)
+			ctx := context.Background()
+
+			for _, key := range []string{"a/one.bak", "a/two.bak", "a/deep/five.bak", "ab/three.bak", "b/four.bak"} {
+				err := uploader.Upload(ctx, key, strings.NewReader(key), int64(len(key)))
+				require.NoError(t, err)
+			}
+
+			// Leftover temporary files from an interrupted upload are not listed
+			server.files["backups/a/.baxfer-123.tmp"] = []byte("partial")
+
+			tests := []struct {
+				prefix   string
+				expected []string
+			}{
+				{"", []string{"a/one.bak", "a/two.bak", "a/deep/five.bak", "ab/three.bak", "b/four.bak"}},
+				{"a", []string{"a/one.bak", "a/two.bak", "a/deep/five.bak", "ab/three.bak"}},
+				{"a/", []string{"a/one.bak", "a/two.bak", "a/deep/five.bak"}},
+				{"a/t", []string{"a/two.bak"}},
+				{"missing/", nil},
+			}
+
+			for _, tt := range tests {
+				keys, err := uploader.List(ctx, tt.prefix)
+				assert.NoError(t, err, "prefix=%s", tt.prefix)
+				assert.ElementsMatch(t, tt.expected, keys, "prefix=%s", tt.prefix)
+			}
+
+			// Without MLST the file details come from LIST and MDTM
+			info, err := uploader.GetFileInfo(ctx, "a/one.bak")
+			require.NoError(t, err)
+			assert.Equal(t, int64(len("a/one.bak")), info.Size)
+			assert.True(t, server.modTime.Equal(info.LastModified))
+		})
+	}
+}
+
+func TestFTPUploader_UploadFailureLeavesNoFile(t *testing.T) {
+	server := newFakeFTP(t, FTPTLSNone, true)
+	uploader := newTestFTPUploader(t, server)
+
+	failing := &failingReader{err: errors.New("read failed")}
+	err := uploader.Upload(context.Background(), "broken.bak", failing, -1)
+	assert.Error(t, err)
+	assert.Empty(t, server.files, "no partial or temporary file should remain")
+}
+
+func TestFTPUploader_UploadCanceled(t *testing.T) {
+	server := newFakeFTP(t, FTPTLSNone, true)
+	server.slow = true
+	uploader := newTestFTPUploader(t, server)
+
+	// The server reads slowly, so the transfer is blocked writing to it
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := uploader.Upload(ctx, "endless.bak", &endlessReader{}, -1)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	// The control connection is still usable
+	server.mu.Lock()
+	server.slow = false
+	server.mu.Unlock()
+	data := []byte("ftp backup data")
+	require.NoError(t, uploader.Upload(context.Background(), "full.bak", bytes.NewReader(data), int64(len(data))))
+	assert.NotContains(t, server.files, "backups/endless.bak")
+}
+
+// endlessReader returns data forever
+type endlessReader struct{}
+
+func (endlessReader) Read(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func TestFTPUploader_FileExistsPermissionDenied(t *testing.T) {
+	server := newFakeFTP(t, FTPTLSNone, true)
+	uploader := newTestFTPUploader(t, server)
+	ctx := context.Background()
+
+	data := []byte("ftp backup data")
+	require.NoError(t, uploader.Upload(ctx, "full.bak", bytes.NewReader(data), int64(len(data))))
+
+	// A 550 that does not say the file is missing is checked against the
+	// directory listing, so a file that cannot be read is not reported missing
+	server.mu.Lock()
+	server.denied["backups/full.bak"] = true
+	server.vague = true
+	server.mu.Unlock()
+	_, err := uploader.FileExists(ctx, "full.bak")
+	assert.Error(t, err)
+	assert.False(t, isNotFoundError(err))
+
+	exists, err := uploader.FileExists(ctx, "missing.bak")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestFTPUploader_DownloadNotFound(t *testing.T) {
+	server := newFakeFTP(t, FTPTLSNone, true)
+	uploader := newTestFTPUploader(t, server)
+
+	var buf bytes.Buffer
+	err := uploader.Download(context.Background(), "missing.bak", &buf)
+
+	var userErr *UserError
+	require.True(t, errors.As(err, &userErr))
+	assert.Equal(t, "File not found: missing.bak", userErr.Message)
+}
+
+func TestFTPUploader_InvalidCredentials(t *testing.T) {
+	server := newFakeFTP(t, FTPTLSNone, true)
+	t.Setenv("FTP_PASSWORD", "wrong")
+
+	_, err := NewFTPUploader(server.config(), nil, NewMockLogger())
+	require.Error(t, err)
+	assert.True(t, isFTPCode(err, 530))
+}
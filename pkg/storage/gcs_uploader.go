@@ -0,0 +1,420 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ngns-io/baxfer/pkg/logger"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	gcsDefaultEndpoint = "https://storage.googleapis.com"
+	gcsScope           = "https://www.googleapis.com/auth/devstorage.read_write"
+
+	// gcsChunkSize must be a multiple of 256KiB
+	gcsChunkSize = 16 * 1024 * 1024
+)
+
+// GCSUploader talks to the Google Cloud Storage JSON API. Uploads use the
+// resumable upload protocol so large backups are sent in chunks rather than a
+// single request.
+type GCSUploader struct {
+	httpClient *http.Client
+	endpoint   string
+	bucket     string
+	chunkSize  int
+	log        logger.Logger
+}
+
+// gcsError is returned for any non-success response from the JSON API
+type gcsError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *gcsError) Error() string {
+	return fmt.Sprintf("gcs: status code %d: %s", e.StatusCode, e.Message)
+}
+
+// gcsObject is the subset of the object resource used by baxfer
+type gcsObject struct {
+	Name     string            `json:"name"`
+	Size     string            `json:"size"`
+	Updated  time.Time         `json:"updated"`
+	Metadata map[string]string `json:"metadata"`
+	MD5Hash  string            `json:"md5Hash"` // base64, absent for composite objects
+	CRC32C   string            `json:"crc32c"`  // base64
+}
+
+// checksums returns the checksums GCS computed for the object, hex encoded
+func (o *gcsObject) checksums() map[string]string {
+	checksums := make(map[string]string)
+	if sum, err := base64.StdEncoding.DecodeString(o.MD5Hash); err == nil && len(sum) == md5.Size {
+		checksums[ChecksumMD5] = hex.EncodeToString(sum)
+	}
+	if sum, err := base64.StdEncoding.DecodeString(o.CRC32C); err == nil && len(sum) == crc32.Size {
+		checksums[ChecksumCRC32C] = hex.EncodeToString(sum)
+	}
+	return checksums
+}
+
+func NewGCSUploader(bucket, endpoint string, creds Credentials, log logger.Logger) (*GCSUploader, error) {
+	ctx := context.Background()
+
+	emulated := endpoint != ""
+	if !emulated {
+		endpoint = gcsDefaultEndpoint
+	} else if !strings.Contains(endpoint, "://") {
+		// STORAGE_EMULATOR_HOST is conventionally given as host:port
+		endpoint = "http://" + endpoint
+	}
+
+	var httpClient *http.Client
+	credentialsFile := creds.Get("GOOGLE_APPLICATION_CREDENTIALS")
+	switch {
+	case credentialsFile != "":
+		data, err := os.ReadFile(credentialsFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read GCS credentials file: %w", err)
+		}
+		cred, err := google.CredentialsFromJSON(ctx, data, gcsScope)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse GCS credentials file: %w", err)
+		}
+		httpClient = oauth2.NewClient(ctx, cred.TokenSource)
+	case emulated:
+		// Emulators such as fake-gcs-server do not check credentials
+		httpClient = &http.Client{}
+	default:
+		// Fall back to application default credentials (gcloud login, GCE metadata server)
+		cred, err := google.FindDefaultCredentials(ctx, gcsScope)
+		if err != nil {
+			return nil, fmt.Errorf("GCS credentials not found: set GOOGLE_APPLICATION_CREDENTIALS to a service account JSON file: %w", err)
+		}
+		httpClient = oauth2.NewClient(ctx, cred.TokenSource)
+	}
+
+	uploader := &GCSUploader{
+		httpClient: httpClient,
+		endpoint:   strings.TrimSuffix(endpoint, "/"),
+		bucket:     bucket,
+		chunkSize:  gcsChunkSize,
+		log:        log,
+	}
+
+	log.Info("Initialized storage provider",
+		"provider", "Google Cloud Storage",
+		"endpoint", uploader.endpoint,
+		"bucket", bucket)
+
+	return uploader, nil
+}
+
+func (u *GCSUploader) objectURL(key string) string {
+	return fmt.Sprintf("%s/storage/v1/b/%s/o/%s", u.endpoint, url.PathEscape(u.bucket), url.PathEscape(key))
+}
+
+// do sends the request and converts non-2xx responses into a gcsError. The
+// caller must close the body of a successful response.
+func (u *GCSUploader) do(req *http.Request, okStatus ...int) (*http.Response, error) {
+	resp, err := u.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	for _, status := range okStatus {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+
+	defer resp.Body.Close()
+	var body struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	message := strings.TrimSpace(string(data))
+	if json.Unmarshal(data, &body) == nil && body.Error.Message != "" {
+		message = body.Error.Message
+	}
+	return nil, &gcsError{StatusCode: resp.StatusCode, Message: message}
+}
+
+func (u *GCSUploader) Upload(ctx context.Context, key string, reader io.Reader, size int64) error {
+	sessionURL, err := u.startResumableUpload(ctx, key, size)
+	if err != nil {
+		return fmt.Errorf("failed to start resumable upload: %w", err)
+	}
+
+	// Read ahead one byte after each chunk so the final chunk can be sent with
+	// the total size, which is what completes the upload
+	br := bufio.NewReader(reader)
+	buf := make([]byte, u.chunkSize)
+	var offset int64
+
+	for {
+		n, err := io.ReadFull(br, buf)
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+			return err
+		}
+		last := n < len(buf)
+		if !last {
+			if _, peekErr := br.Peek(1); errors.Is(peekErr, io.EOF) {
+				last = true
+			}
+		}
+
+		if err := u.uploadChunk(ctx, sessionURL, buf[:n], offset, last); err != nil {
+			return err
+		}
+		offset += int64(n)
+
+		if last {
+			return nil
+		}
+	}
+}
+
+func (u *GCSUploader) startResumableUpload(ctx context.Context, key string, size int64) (string, error) {
+	uploadURL := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?uploadType=resumable&name=%s",
+		u.endpoint, url.PathEscape(u.bucket), url.QueryEscape(key))
+
+	resource := map[string]any{"name": key}
+	if metadata := uploadMetadataFrom(ctx); metadata != nil {
+		resource["metadata"] = metadata
+	}
+	metadata, err := json.Marshal(resource)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uploadURL, bytes.NewReader(metadata))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Type", "application/octet-stream")
+	if size >= 0 {
+		req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(size, 10))
+	}
+
+	resp, err := u.do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return "", fmt.Errorf("no upload session URL returned for key: %s", key)
+	}
+	return location, nil
+}
+
+// uploadChunk sends one chunk of a resumable upload, resending any part of it
+// the server reports as not yet persisted.
+func (u *GCSUploader) uploadChunk(ctx context.Context, sessionURL string, chunk []byte, offset int64, last bool) error {
+	for {
+		total := "*"
+		if last {
+			total = strconv.FormatInt(offset+int64(len(chunk)), 10)
+		}
+
+		contentRange := fmt.Sprintf("bytes */%s", total)
+		if len(chunk) > 0 {
+			contentRange = fmt.Sprintf("bytes %d-%d/%s", offset, offset+int64(len(chunk))-1, total)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, sessionURL, bytes.NewReader(chunk))
+		if err != nil {
+			return err
+		}
+		req.ContentLength = int64(len(chunk))
+		req.Header.Set("Content-Range", contentRange)
+
+		// 308 Resume Incomplete acknowledges an intermediate chunk
+		resp, err := u.do(req, http.StatusPermanentRedirect)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusPermanentRedirect {
+			return nil
+		}
+
+		// The Range header reports how much the server has persisted, which
+		// may be less than what was sent, even for the last chunk
+		persisted := offset
+		if r := resp.Header.Get("Range"); r != "" {
+			if i := strings.LastIndex(r, "-"); i >= 0 {
+				end, err := strconv.ParseInt(r[i+1:], 10, 64)
+				if err != nil {
+					return fmt.Errorf("invalid Range header in upload response: %s", r)
+				}
+				persisted = end + 1
+			}
+		}
+
+		sent := persisted - offset
+		switch {
+		case sent < int64(len(chunk)):
+			chunk = chunk[sent:]
+		case !last:
+			return nil
+		case len(chunk) == 0:
+			return fmt.Errorf("upload not finalized after last chunk")
+		default:
+			// All of the last chunk was kept, so the total alone finalizes
+			// the upload
+			chunk = nil
+		}
+		offset = persisted
+	}
+}
+
+func (u *GCSUploader) Download(ctx context.Context, key string, writer io.Writer) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.objectURL(key)+"?alt=media", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := u.do(req)
+	if err != nil {
+		return formatDownloadError("gcs", key, err)
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(writer, resp.Body)
+	if err != nil {
+		return &UserError{
+			Message: fmt.Sprintf("Error reading file content: %s", key),
+			Cause:   err,
+		}
+	}
+	return nil
+}
+
+func (u *GCSUploader) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	pageToken := ""
+
+	for {
+		query := url.Values{}
+		query.Set("prefix", prefix)
+		query.Set("fields", "items(name),nextPageToken")
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+
+		listURL := fmt.Sprintf("%s/storage/v1/b/%s/o?%s", u.endpoint, url.PathEscape(u.bucket), query.Encode())
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, listURL, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := u.do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		var page struct {
+			Items         []gcsObject `json:"items"`
+			NextPageToken string      `json:"nextPageToken"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid list response from GCS: %w", err)
+		}
+
+		for _, item := range page.Items {
+			keys = append(keys, item.Name)
+		}
+
+		if page.NextPageToken == "" {
+			return keys, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+func (u *GCSUploader) Delete(ctx context.Context, key string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, u.objectURL(key), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := u.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (u *GCSUploader) FileExists(ctx context.Context, key string) (bool, error) {
+	_, err := u.GetFileInfo(ctx, key)
+	if err != nil {
+		if isNotFoundError(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (u *GCSUploader) GetFileInfo(ctx context.Context, key string) (*FileInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.objectURL(key), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := u.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var obj gcsObject
+	if err := json.NewDecoder(resp.Body).Decode(&obj); err != nil {
+		return nil, fmt.Errorf("invalid object metadata from GCS for key %s: %w", key, err)
+	}
+
+	size, err := strconv.ParseInt(obj.Size, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("incomplete response from GCS for key: %s", key)
+	}
+
+	return &FileInfo{
+		LastModified: obj.Updated,
+		Size:         size,
+		Metadata:     obj.Metadata,
+		Checksums:    obj.checksums(),
+	}, nil
+}
+
+// storesMetadata marks GCS as keeping user metadata
+func (u *GCSUploader) storesMetadata() {}
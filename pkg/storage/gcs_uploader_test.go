@@ -0,0 +1,266 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeGCS implements the subset of the GCS JSON API used by GCSUploader
+type fakeGCS struct {
+	mu       sync.Mutex
+	server   *httptest.Server
+	objects  map[string][]byte
+	sessions map[string]*bytes.Buffer
+	names    map[string]string
+	metadata map[string]map[string]string // by session, then by object
+	chunks   int
+
+	truncateFinal bool // keep only half of the next final chunk, answering 308
+	corrupt       bool // flip a bit of the next object stored
+	noHashes      bool // report no checksums of objects, as B2 does
+}
+
+func newFakeGCS(t *testing.T) *fakeGCS {
+	f := &fakeGCS{
+		objects:  map[string][]byte{},
+		sessions: map[string]*bytes.Buffer{},
+		names:    map[string]string{},
+		metadata: map[string]map[string]string{},
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.handle))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+func (f *fakeGCS) handle(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := r.URL.EscapedPath()
+	switch {
+	case r.Method == http.MethodPost && strings.HasPrefix(path, "/upload/storage/v1/b/backups/o"):
+		id := strconv.Itoa(len(f.sessions))
+		f.sessions[id] = &bytes.Buffer{}
+		f.names[id] = r.URL.Query().Get("name")
+		var resource struct {
+			Metadata map[string]string `json:"metadata"`
+		}
+		json.NewDecoder(r.Body).Decode(&resource)
+		f.metadata[id] = resource.Metadata
+		w.Header().Set("Location", f.server.URL+"/session/"+id)
+
+	case r.Method == http.MethodPut && strings.HasPrefix(path, "/session/"):
+		id := strings.TrimPrefix(path, "/session/")
+		f.chunks++
+		data, _ := io.ReadAll(r.Body)
+		final := !strings.HasSuffix(r.Header.Get("Content-Range"), "/*")
+		if final && f.truncateFinal && len(data) > 1 {
+			f.truncateFinal = false
+			data = data[:len(data)/2]
+			final = false
+		}
+		f.sessions[id].Write(data)
+		if !final {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", f.sessions[id].Len()-1))
+			w.WriteHeader(http.StatusPermanentRedirect)
+			return
+		}
+		data = f.sessions[id].Bytes()
+		if f.corrupt && len(data) > 0 {
+			f.corrupt = false
+			data[0] ^= 1
+		}
+		f.objects[f.names[id]] = data
+		f.metadata[f.names[id]] = f.metadata[id]
+
+	case r.Method == http.MethodGet && path == "/storage/v1/b/backups/o":
+		var names []string
+		for name := range f.objects {
+			if strings.HasPrefix(name, r.URL.Query().Get("prefix")) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+
+		// Serve one item per page to exercise pagination
+		start, _ := strconv.Atoi(r.URL.Query().Get("pageToken"))
+		resp := map[string]interface{}{}
+		if start < len(names) {
+			resp["items"] = []map[string]string{{"name": names[start]}}
+			if start+1 < len(names) {
+				resp["nextPageToken"] = strconv.Itoa(start + 1)
+			}
+		}
+		json.NewEncoder(w).Encode(resp)
+
+	case strings.HasPrefix(path, "/storage/v1/b/backups/o/"):
+		name, _ := url.PathUnescape(strings.TrimPrefix(path, "/storage/v1/b/backups/o/"))
+		data, ok := f.objects[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": map[string]string{"message": "No such object"}})
+			return
+		}
+		switch {
+		case r.Method == http.MethodDelete:
+			delete(f.objects, name)
+			w.WriteHeader(http.StatusNoContent)
+		case r.URL.Query().Get("alt") == "media":
+			w.Write(data)
+		default:
+			resource := map[string]interface{}{
+				"name":     name,
+				"size":     strconv.Itoa(len(data)),
+				"updated":  time.Now().UTC().Format(time.RFC3339),
+				"metadata": f.metadata[name],
+			}
+			if !f.noHashes {
+				md5Sum := md5.Sum(data)
+				crc := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+				crc.Write(data)
+				resource["md5Hash"] = base64.StdEncoding.EncodeToString(md5Sum[:])
+				resource["crc32c"] = base64.StdEncoding.EncodeToString(crc.Sum(nil))
+			}
+			json.NewEncoder(w).Encode(resource)
+		}
+
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func newTestGCSUploader(t *testing.T, endpoint string) *GCSUploader {
+	t.Helper()
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "")
+
+	mockLogger := NewMockLogger()
+	mockLogger.On("Info", mock.Anything, mock.Anything).Return()
+
+	uploader, err := NewGCSUploader("backups", endpoint, nil, mockLogger)
+	require.NoError(t, err)
+	return uploader
+}
+
+func TestGCSUploader_RoundTrip(t *testing.T) {
+	fake := newFakeGCS(t)
+	uploader := newTestGCSUploader(t, fake.server.URL)
+	uploader.chunkSize = 256 * 1024
+	ctx := context.Background()
+
+	// Spans several chunks, with a final partial chunk
+	data := bytes.Repeat([]byte("0123456789"), 60*1024)
+	err := uploader.Upload(ctx, "db/full backup.bak", bytes.NewReader(data), -1)
+	require.NoError(t, err)
+	assert.Equal(t, 3, fake.chunks)
+
+	exists, err := uploader.FileExists(ctx, "db/full backup.bak")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	info, err := uploader.GetFileInfo(ctx, "db/full backup.bak")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(data)), info.Size)
+
+	var buf bytes.Buffer
+	err = uploader.Download(ctx, "db/full backup.bak", &buf)
+	assert.NoError(t, err)
+	assert.Equal(t, data, buf.Bytes())
+
+	err = uploader.Delete(ctx, "db/full backup.bak")
+	assert.NoError(t, err)
+
+	exists, err = uploader.FileExists(ctx, "db/full backup.bak")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestGCSUploader_Metadata(t *testing.T) {
+	fake := newFakeGCS(t)
+	uploader := newTestGCSUploader(t, fake.server.URL)
+	ctx := withUploadMetadata(context.Background(), map[string]string{metadataSHA256: "abc"})
+
+	require.NoError(t, uploader.Upload(ctx, "sales.bak", strings.NewReader("sales data"), -1))
+	info, err := uploader.GetFileInfo(context.Background(), "sales.bak")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{metadataSHA256: "abc"}, info.Metadata)
+
+	hashes := newChecksumHashes()
+	hashes.Write([]byte("sales data"))
+	sent := hashes.record()
+	assert.Equal(t, sent.Native[ChecksumMD5], info.Checksums[ChecksumMD5])
+	assert.Equal(t, sent.Native[ChecksumCRC32C], info.Checksums[ChecksumCRC32C])
+	assert.True(t, storesMetadata(WithRetry(uploader, RetryPolicy{Retries: 1}, nil)))
+}
+
+func TestGCSUploader_UploadExactChunkMultiple(t *testing.T) {
+	fake := newFakeGCS(t)
+	uploader := newTestGCSUploader(t, fake.server.URL)
+	uploader.chunkSize = 256 * 1024
+
+	data := bytes.Repeat([]byte("x"), 2*256*1024)
+	err := uploader.Upload(context.Background(), "exact.bak", bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+	assert.Equal(t, 2, fake.chunks, "the second full chunk should finalize the upload")
+	assert.Equal(t, data, fake.objects["exact.bak"])
+
+	err = uploader.Upload(context.Background(), "empty.bak", bytes.NewReader(nil), 0)
+	require.NoError(t, err)
+	assert.Empty(t, fake.objects["empty.bak"])
+}
+
+func TestGCSUploader_UploadPartialFinalChunk(t *testing.T) {
+	fake := newFakeGCS(t)
+	fake.truncateFinal = true
+	uploader := newTestGCSUploader(t, fake.server.URL)
+	uploader.chunkSize = 256 * 1024
+
+	// The server keeps only part of the last chunk, so the rest is resent
+	data := bytes.Repeat([]byte("0123456789"), 30*1024)
+	err := uploader.Upload(context.Background(), "partial.bak", bytes.NewReader(data), -1)
+	require.NoError(t, err)
+	assert.Equal(t, 3, fake.chunks)
+	assert.Equal(t, data, fake.objects["partial.bak"])
+}
+
+func TestGCSUploader_ListAndErrors(t *testing.T) {
+	fake := newFakeGCS(t)
+	uploader := newTestGCSUploader(t, strings.TrimPrefix(fake.server.URL, "http://"))
+	ctx := context.Background()
+
+	for _, key := range []string{"a/one.bak", "a/two.bak", "b/three.bak"} {
+		err := uploader.Upload(ctx, key, strings.NewReader(key), int64(len(key)))
+		require.NoError(t, err)
+	}
+
+	keys, err := uploader.List(ctx, "a/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a/one.bak", "a/two.bak"}, keys)
+
+	var buf bytes.Buffer
+	err = uploader.Download(ctx, "missing.bak", &buf)
+	var userErr *UserError
+	assert.ErrorAs(t, err, &userErr)
+	assert.Equal(t, "File not found: missing.bak", userErr.Message)
+
+	_, err = uploader.GetFileInfo(ctx, "missing.bak")
+	assert.True(t, isNotFoundError(err))
+}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ngns-io/baxfer/pkg/logger"
+	"github.com/urfave/cli/v2"
+)
+
+// History prints the uploads recorded in the state database, oldest first,
+// as a table, JSON or CSV
+func History(c *cli.Context, log logger.Logger) error {
+	format := c.String("format")
+	switch format {
+	case "table", "json", "csv":
+	default:
+		return cli.Exit(fmt.Sprintf("Invalid format %q: must be table, json or csv", format), 1)
+	}
+
+	now := time.Now()
+	since, err := parseTimeBound(c.String("since"), now)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Invalid --since: %v", err), 1)
+	}
+	until, err := parseTimeBound(c.String("until"), now)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Invalid --until: %v", err), 1)
+	}
+	prefix := c.String("prefix")
+	destination := c.String("destination")
+
+	path, err := statePath(c)
+	if err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return &UserError{Message: fmt.Sprintf("No state database at %s; it is created by upload", path)}
+	}
+	state, err := openState(path, true)
+	if err != nil {
+		log.Error("Failed to open state database", "path", path, "error", err)
+		return err
+	}
+	defer state.Close()
+
+	var records []UploadRecord
+	err = state.history(func(record UploadRecord) error {
+		switch {
+		case !since.IsZero() && record.UploadedAt.Before(since):
+		case !until.IsZero() && record.UploadedAt.After(until):
+		case !strings.HasPrefix(record.Key, prefix):
+		case destination != "" && record.Destination != destination:
+		default:
+			records = append(records, record)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error("Failed to read state database", "path", path, "error", err)
+		return err
+	}
+
+	w := outputWriter(c)
+	switch format {
+	case "json":
+		return writeHistoryJSON(w, records)
+	case "csv":
+		return writeHistoryCSV(w, records)
+	default:
+		return writeHistoryTable(w, records)
+	}
+}
+
+func writeHistoryTable(w io.Writer, records []UploadRecord) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "UPLOADED\tDESTINATION\tKEY\tSIZE\tPATH")
+	for _, r := range records {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", r.UploadedAt.Local().Format("2006-01-02 15:04:05"),
+			r.Destination, r.Key, formatSize(r.Size), r.Path)
+	}
+	return tw.Flush()
+}
+
+func writeHistoryJSON(w io.Writer, records []UploadRecord) error {
+	if records == nil {
+		records = []UploadRecord{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(records)
+}
+
+func writeHistoryCSV(w io.Writer, records []UploadRecord) error {
+	cw := csv.NewWriter(w)
+	header := []string{"uploaded_at", "destination", "key", "path", "size", "mod_time", "sha256", "source_sha256"}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, r := range records {
+		record := []string{
+			r.UploadedAt.UTC().Format(time.RFC3339),
+			r.Destination,
+			r.Key,
+			r.Path,
+			strconv.FormatInt(r.Size, 10),
+			r.ModTime.UTC().Format(time.RFC3339),
+			r.SHA256,
+			r.SourceSHA256,
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,204 @@
+package storage
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ngns-io/baxfer/pkg/logger"
+	"github.com/urfave/cli/v2"
+)
+
+// ListEntry is one row of a listing: a stored file, or with --recursive=false
+// a common prefix ("directory") grouping the files below it
+type ListEntry struct {
+	Key          string     `json:"key"`
+	Size         int64      `json:"size"`
+	LastModified *time.Time `json:"last_modified,omitempty"` // nil for directories
+	Dir          bool       `json:"dir,omitempty"`
+}
+
+// List prints the files stored under --prefix with their size and last
+// modified time as a table, JSON or CSV
+func List(c *cli.Context, uploader Uploader, log logger.Logger) error {
+	prefix := c.String("prefix")
+	format := c.String("format")
+	sortBy := c.String("sort")
+	recursive := c.Bool("recursive")
+
+	// Check the options before making any requests
+	switch format {
+	case "table", "json", "csv":
+	default:
+		return cli.Exit(fmt.Sprintf("Invalid format %q: must be table, json or csv", format), 1)
+	}
+	switch sortBy {
+	case "key", "size", "time":
+	default:
+		return cli.Exit(fmt.Sprintf("Invalid sort %q: must be key, size or time", sortBy), 1)
+	}
+
+	now := time.Now()
+	since, err := parseTimeBound(c.String("since"), now)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Invalid --since: %v", err), 1)
+	}
+	until, err := parseTimeBound(c.String("until"), now)
+	if err != nil {
+		return cli.Exit(fmt.Sprintf("Invalid --until: %v", err), 1)
+	}
+
+	keys, err := uploader.List(c.Context, prefix)
+	if err != nil {
+		log.Error("Failed to list files", "prefix", prefix, "error", err)
+		return err
+	}
+
+	var entries []ListEntry
+	dirs := make(map[string]bool)
+	for _, key := range keys {
+		// Checksums stored alongside backups are checked by verify, not listed
+		if isChecksumKey(key) {
+			continue
+		}
+		if !recursive {
+			// Collapse everything below the next "/" into a directory entry
+			if i := strings.Index(key[len(prefix):], "/"); i >= 0 {
+				dir := key[:len(prefix)+i+1]
+				if !dirs[dir] {
+					dirs[dir] = true
+					entries = append(entries, ListEntry{Key: dir, Dir: true})
+				}
+				continue
+			}
+		}
+
+		info, err := uploader.GetFileInfo(c.Context, key)
+		if err != nil {
+			log.Error("Failed to get file info", "key", key, "error", err)
+			continue
+		}
+		if !since.IsZero() && info.LastModified.Before(since) {
+			continue
+		}
+		if !until.IsZero() && info.LastModified.After(until) {
+			continue
+		}
+		modified := info.LastModified
+		entries = append(entries, ListEntry{Key: key, Size: info.Size, LastModified: &modified})
+	}
+
+	sortEntries(entries, sortBy, c.Bool("reverse"))
+
+	w := outputWriter(c)
+	switch format {
+	case "json":
+		return writeListJSON(w, entries)
+	case "csv":
+		return writeListCSV(w, entries)
+	default:
+		return writeListTable(w, entries)
+	}
+}
+
+// parseTimeBound parses a --since or --until value: an RFC 3339 timestamp, a
+// date (2006-01-02), or a duration counted back from now (e.g. 168h)
+func parseTimeBound(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("%q is not a timestamp, date or duration", value)
+}
+
+func sortEntries(entries []ListEntry, sortBy string, reverse bool) {
+	less := func(a, b ListEntry) bool { return a.Key < b.Key }
+	switch sortBy {
+	case "size":
+		less = func(a, b ListEntry) bool { return a.Size < b.Size }
+	case "time":
+		// Directories have no time and sort first
+		less = func(a, b ListEntry) bool {
+			if a.LastModified == nil || b.LastModified == nil {
+				return a.LastModified == nil && b.LastModified != nil
+			}
+			return a.LastModified.Before(*b.LastModified)
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if reverse {
+			return less(entries[j], entries[i])
+		}
+		return less(entries[i], entries[j])
+	})
+}
+
+func writeListTable(w io.Writer, entries []ListEntry) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tSIZE\tLAST MODIFIED")
+	for _, e := range entries {
+		if e.Dir {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", e.Key, "DIR", "-")
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", e.Key, formatSize(e.Size), e.LastModified.Local().Format("2006-01-02 15:04:05"))
+	}
+	return tw.Flush()
+}
+
+func writeListJSON(w io.Writer, entries []ListEntry) error {
+	if entries == nil {
+		entries = []ListEntry{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(entries)
+}
+
+func writeListCSV(w io.Writer, entries []ListEntry) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"key", "size", "last_modified", "dir"}); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		modified := ""
+		if e.LastModified != nil {
+			modified = e.LastModified.UTC().Format(time.RFC3339)
+		}
+		record := []string{e.Key, strconv.FormatInt(e.Size, 10), modified, strconv.FormatBool(e.Dir)}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// formatSize returns a size in bytes as a human-readable string, e.g. 1.5 GiB
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
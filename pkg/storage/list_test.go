@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+)
+
+// newListFixture stores three backups with known sizes and modification times
+func newListFixture(t *testing.T) (*LocalUploader, time.Time) {
+	t.Helper()
+
+	uploader, basePath := newTestLocalUploader(t)
+	now := time.Now().Truncate(time.Second)
+
+	files := []struct {
+		key  string
+		data string
+		age  time.Duration
+	}{
+		{"sql/full/monday.bak", "full backup", 72 * time.Hour},
+		{"sql/full/tuesday.bak", "larger full backup", 48 * time.Hour},
+		{"sql/log/tuesday.trn", "log", 24 * time.Hour},
+	}
+	for _, f := range files {
+		err := uploader.Upload(context.Background(), f.key, strings.NewReader(f.data), int64(len(f.data)))
+		require.NoError(t, err)
+		modTime := now.Add(-f.age)
+		require.NoError(t, os.Chtimes(filepath.Join(basePath, filepath.FromSlash(f.key)), modTime, modTime))
+	}
+	return uploader, now
+}
+
+func runList(t *testing.T, uploader Uploader, args ...string) (string, error) {
+	t.Helper()
+
+	var out bytes.Buffer
+	app := &cli.App{Writer: &out}
+	set := flag.NewFlagSet("test", 0)
+	set.String("prefix", "", "doc")
+	set.String("format", "table", "doc")
+	set.String("sort", "key", "doc")
+	set.Bool("reverse", false, "doc")
+	set.String("since", "", "doc")
+	set.String("until", "", "doc")
+	set.Bool("recursive", true, "doc")
+	require.NoError(t, set.Parse(args))
+	ctx := cli.NewContext(app, set, nil)
+	ctx.Context = context.Background()
+
+	err := List(ctx, uploader, NewMockLogger())
+	return out.String(), err
+}
+
+func TestList_Table(t *testing.T) {
+	uploader, _ := newListFixture(t)
+
+	out, err := runList(t, uploader, "--prefix", "sql/full/")
+	require.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	require.Len(t, lines, 3)
+	assert.True(t, strings.HasPrefix(lines[0], "KEY"))
+	assert.Contains(t, lines[1], "sql/full/monday.bak")
+	assert.Contains(t, lines[1], "11 B")
+	assert.Contains(t, lines[2], "sql/full/tuesday.bak")
+}
+
+func TestList_JSONSortedBySize(t *testing.T) {
+	uploader, _ := newListFixture(t)
+
+	out, err := runList(t, uploader, "--format", "json", "--sort", "size", "--reverse")
+	require.NoError(t, err)
+
+	var entries []ListEntry
+	require.NoError(t, json.Unmarshal([]byte(out), &entries))
+	require.Len(t, entries, 3)
+	assert.Equal(t, "sql/full/tuesday.bak", entries[0].Key)
+	assert.Equal(t, int64(18), entries[0].Size)
+	assert.Equal(t, "sql/log/tuesday.trn", entries[2].Key)
+}
+
+func TestList_SinceUntil(t *testing.T) {
+	uploader, now := newListFixture(t)
+
+	out, err := runList(t, uploader, "--format", "csv", "--since", "60h",
+		"--until", now.Add(-36*time.Hour).Format(time.RFC3339))
+	require.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	require.Len(t, lines, 2)
+	assert.Equal(t, "key,size,last_modified,dir", lines[0])
+	assert.True(t, strings.HasPrefix(lines[1], "sql/full/tuesday.bak,18,"))
+}
+
+func TestList_NotRecursive(t *testing.T) {
+	uploader, _ := newListFixture(t)
+
+	out, err := runList(t, uploader, "--format", "json", "--prefix", "sql/", "--recursive=false")
+	require.NoError(t, err)
+
+	var entries []ListEntry
+	require.NoError(t, json.Unmarshal([]byte(out), &entries))
+	require.Len(t, entries, 2)
+	assert.Equal(t, ListEntry{Key: "sql/full/", Dir: true}, entries[0])
+	assert.Equal(t, ListEntry{Key: "sql/log/", Dir: true}, entries[1])
+}
+
+func TestList_InvalidOptions(t *testing.T) {
+	uploader := new(MockUploader)
+
+	_, err := runList(t, uploader, "--format", "xml")
+	assert.ErrorContains(t, err, "Invalid format")
+
+	_, err = runList(t, uploader, "--sort", "name")
+	assert.ErrorContains(t, err, "Invalid sort")
+
+	_, err = runList(t, uploader, "--since", "last week")
+	assert.ErrorContains(t, err, "Invalid --since")
+
+	// Nothing is listed when the options are invalid
+	uploader.AssertNotCalled(t, "List", mock.Anything, mock.Anything)
+}
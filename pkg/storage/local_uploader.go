@@ -0,0 +1,281 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ngns-io/baxfer/pkg/logger"
+)
+
+// localTempPattern is the name pattern for in-progress uploads. Files are
+// written under this name and renamed into place once complete, so a
+// partially written backup is never visible under its final key.
+const localTempPattern = ".baxfer-*.tmp"
+
+// LocalUploader stores files on a local or mounted filesystem such as a NAS,
+// USB disk or NFS share.
+type LocalUploader struct {
+	basePath string
+	log      logger.Logger
+}
+
+func NewLocalUploader(basePath string, log logger.Logger) (*LocalUploader, error) {
+	// Accept file:// URLs as well as plain paths
+	basePath = strings.TrimPrefix(basePath, "file://")
+	if basePath == "" {
+		return nil, fmt.Errorf("no base path provided for local storage")
+	}
+
+	// Create base directory if it doesn't exist
+	if err := os.MkdirAll(basePath, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create base directory: %w", err)
+	}
+
+	uploader := &LocalUploader{
+		basePath: basePath,
+		log:      log,
+	}
+
+	log.Info("Initialized storage provider",
+		"provider", "Local",
+		"basePath", basePath)
+
+	return uploader, nil
+}
+
+// fullPath returns the path key is stored at. Keys that would resolve
+// outside the base directory, such as absolute keys or those with .. in
+// them, are rejected.
+func (u *LocalUploader) fullPath(key string) (string, error) {
+	rel := filepath.FromSlash(key)
+	if !filepath.IsLocal(rel) {
+		return "", &UserError{Message: fmt.Sprintf("Invalid key %s: it is outside the storage directory", key)}
+	}
+	return filepath.Join(u.basePath, rel), nil
+}
+
+func (u *LocalUploader) Upload(ctx context.Context, key string, reader io.Reader, size int64) (err error) {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	fullPath, err := u.fullPath(key)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(fullPath)
+
+	// Ensure directory exists
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory structure: %w", err)
+	}
+
+	tmpFile, err := createTemp(dir)
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tmpFile.Close()
+			os.Remove(tmpFile.Name())
+		}
+	}()
+
+	if _, err = io.Copy(tmpFile, reader); err != nil {
+		return err
+	}
+
+	// Flush to disk before the rename so a crash cannot leave a truncated file
+	// under the final name
+	if err = tmpFile.Sync(); err != nil {
+		return fmt.Errorf("failed to sync file: %w", err)
+	}
+	if err = tmpFile.Close(); err != nil {
+		return fmt.Errorf("failed to close file: %w", err)
+	}
+
+	if err = os.Rename(tmpFile.Name(), fullPath); err != nil {
+		return fmt.Errorf("failed to move file into place: %w", err)
+	}
+	return nil
+}
+
+// createTemp creates a new file named after localTempPattern in dir. Unlike
+// os.CreateTemp, which always uses mode 0600, the file gets 0644 less the
+// umask, as cp would give it, so backups on a shared NAS or NFS mount stay
+// readable by other users.
+func createTemp(dir string) (*os.File, error) {
+	for i := 0; i < 10000; i++ {
+		name := strings.Replace(localTempPattern, "*", strconv.FormatUint(rand.Uint64(), 36), 1)
+		file, err := os.OpenFile(filepath.Join(dir, name), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+		return file, err
+	}
+	return nil, &fs.PathError{Op: "createtemp", Path: filepath.Join(dir, localTempPattern), Err: fs.ErrExist}
+}
+
+func (u *LocalUploader) Download(ctx context.Context, key string, writer io.Writer) error {
+	return u.DownloadRange(ctx, key, 0, -1, writer)
+}
+
+func (u *LocalUploader) DownloadRange(ctx context.Context, key string, offset, length int64, writer io.Writer) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	fullPath, err := u.fullPath(key)
+	if err != nil {
+		return err
+	}
+
+	srcFile, err := os.Open(fullPath)
+	if err != nil {
+		u.log.Error("Failed to open local file",
+			"path", fullPath,
+			"error", err)
+
+		if os.IsNotExist(err) {
+			return &UserError{
+				Message: fmt.Sprintf("File not found: %s", key),
+				Cause:   err,
+			}
+		}
+		if os.IsPermission(err) {
+			return &UserError{
+				Message: fmt.Sprintf("Permission denied accessing file: %s", key),
+				Cause:   err,
+			}
+		}
+		return &UserError{
+			Message: fmt.Sprintf("Error opening local file: %s", key),
+			Cause:   err,
+		}
+	}
+	defer srcFile.Close()
+
+	reader, err := seekRange(srcFile, offset, length)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, reader)
+	if err != nil {
+		return &UserError{
+			Message: fmt.Sprintf("Error reading file content: %s", key),
+			Cause:   err,
+		}
+	}
+
+	return nil
+}
+
+func (u *LocalUploader) List(ctx context.Context, prefix string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Prefixes are matched as strings like object storage keys, so only walk
+	// the directory portion and filter the rest.
+	searchDir := u.basePath
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		var err error
+		if searchDir, err = u.fullPath(prefix[:i]); err != nil {
+			return nil, err
+		}
+	}
+
+	var keys []string
+	err := filepath.WalkDir(searchDir, func(path string, d fs.DirEntry, err error) error {
+		// Check for context cancellation during walk
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil {
+			// Nothing has been stored under this prefix yet
+			if path == searchDir && errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if matched, _ := filepath.Match(localTempPattern, d.Name()); matched {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(u.basePath, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(relPath)
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error walking directory: %w", err)
+	}
+
+	return keys, nil
+}
+
+func (u *LocalUploader) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	fullPath, err := u.fullPath(key)
+	if err != nil {
+		return err
+	}
+	return os.Remove(fullPath)
+}
+
+func (u *LocalUploader) FileExists(ctx context.Context, key string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	fullPath, err := u.fullPath(key)
+	if err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(fullPath); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (u *LocalUploader) GetFileInfo(ctx context.Context, key string) (*FileInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	fullPath, err := u.fullPath(key)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := os.Stat(fullPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileInfo{
+		LastModified: stat.ModTime(),
+		Size:         stat.Size(),
+	}, nil
+}
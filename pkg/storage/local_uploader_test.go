@@ -0,0 +1,218 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestLocalUploader(t *testing.T) (*LocalUploader, string) {
+	t.Helper()
+
+	basePath := filepath.Join(t.TempDir(), "store")
+	mockLogger := NewMockLogger()
+	mockLogger.On("Info", mock.Anything, mock.Anything).Return()
+	mockLogger.On("Error", mock.Anything, mock.Anything).Return()
+
+	uploader, err := NewLocalUploader("file://"+basePath, mockLogger)
+	require.NoError(t, err)
+	return uploader, basePath
+}
+
+func TestLocalUploader_RoundTrip(t *testing.T) {
+	uploader, basePath := newTestLocalUploader(t)
+	ctx := context.Background()
+
+	data := []byte("local backup data")
+	err := uploader.Upload(ctx, "db/full.bak", bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+
+	// Stored under the base path using native separators
+	stored, err := os.ReadFile(filepath.Join(basePath, "db", "full.bak"))
+	require.NoError(t, err)
+	assert.Equal(t, data, stored)
+
+	exists, err := uploader.FileExists(ctx, "db/full.bak")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	info, err := uploader.GetFileInfo(ctx, "db/full.bak")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(data)), info.Size)
+
+	var buf bytes.Buffer
+	err = uploader.Download(ctx, "db/full.bak", &buf)
+	assert.NoError(t, err)
+	assert.Equal(t, data, buf.Bytes())
+
+	err = uploader.Delete(ctx, "db/full.bak")
+	assert.NoError(t, err)
+
+	exists, err = uploader.FileExists(ctx, "db/full.bak")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestLocalUploader_UploadPermissions(t *testing.T) {
+	uploader, basePath := newTestLocalUploader(t)
+	data := []byte("local backup data")
+	require.NoError(t, uploader.Upload(context.Background(), "full.bak", bytes.NewReader(data), int64(len(data))))
+
+	// Uploaded files get the same mode as any file created with 0644
+	reference := filepath.Join(basePath, "reference")
+	require.NoError(t, os.WriteFile(reference, data, 0644))
+	want, err := os.Stat(reference)
+	require.NoError(t, err)
+	got, err := os.Stat(filepath.Join(basePath, "full.bak"))
+	require.NoError(t, err)
+	assert.Equal(t, want.Mode(), got.Mode())
+}
+
+func TestLocalUploader_UploadFailureLeavesNoFile(t *testing.T) {
+	uploader, basePath := newTestLocalUploader(t)
+
+	failing := &failingReader{err: errors.New("read failed")}
+	err := uploader.Upload(context.Background(), "broken.bak", failing, -1)
+	assert.Error(t, err)
+
+	entries, err := os.ReadDir(basePath)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "no partial or temporary file should remain")
+}
+
+func TestLocalUploader_List(t *testing.T) {
+	uploader, basePath := newTestLocalUploader(t)
+	ctx := context.Background()
+
+	for _, key := range []string{"a/one.bak", "a/two.bak", "ab/three.bak", "b/four.bak"} {
+		err := uploader.Upload(ctx, key, strings.NewReader(key), int64(len(key)))
+		require.NoError(t, err)
+	}
+
+	// Leftover temporary files from an interrupted upload are not listed
+	err := os.WriteFile(filepath.Join(basePath, "a", ".baxfer-123.tmp"), []byte("partial"), 0644)
+	require.NoError(t, err)
+
+	tests := []struct {
+		prefix   string
+		expected []string
+	}{
+		{"", []string{"a/one.bak", "a/two.bak", "ab/three.bak", "b/four.bak"}},
+		{"a", []string{"a/one.bak", "a/two.bak", "ab/three.bak"}},
+		{"a/", []string{"a/one.bak", "a/two.bak"}},
+		{"a/t", []string{"a/two.bak"}},
+		{"missing/", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run("prefix="+tt.prefix, func(t *testing.T) {
+			keys, err := uploader.List(ctx, tt.prefix)
+			assert.NoError(t, err)
+			assert.ElementsMatch(t, tt.expected, keys)
+		})
+	}
+}
+
+func TestLocalUploader_DownloadNotFound(t *testing.T) {
+	uploader, _ := newTestLocalUploader(t)
+
+	var buf bytes.Buffer
+	err := uploader.Download(context.Background(), "missing.bak", &buf)
+
+	var userErr *UserError
+	assert.True(t, errors.As(err, &userErr))
+	assert.Equal(t, "File not found: missing.bak", userErr.Message)
+}
+
+func TestLocalUploader_GetFileInfoNotFound(t *testing.T) {
+	uploader, _ := newTestLocalUploader(t)
+
+	_, err := uploader.GetFileInfo(context.Background(), "missing.bak")
+	assert.True(t, isNotFoundError(err))
+}
+
+func TestLocalUploader_KeysOutsideBase(t *testing.T) {
+	uploader, basePath := newTestLocalUploader(t)
+	ctx := context.Background()
+
+	for _, key := range []string{"../escaped.bak", "sql/../../escaped.bak", "/etc/escaped.bak", ""} {
+		err := uploader.Upload(ctx, key, strings.NewReader("data"), 4)
+		assert.Error(t, err, key)
+		_, err = uploader.GetFileInfo(ctx, key)
+		assert.Error(t, err, key)
+		assert.Error(t, uploader.Delete(ctx, key), key)
+	}
+	_, err := os.Stat(filepath.Join(filepath.Dir(basePath), "escaped.bak"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Keys that stay inside the base directory are cleaned
+	require.NoError(t, uploader.Upload(ctx, "sql/../sales.bak", strings.NewReader("data"), 4))
+	_, err = os.Stat(filepath.Join(basePath, "sales.bak"))
+	assert.NoError(t, err)
+}
+
+func TestUpload_LocalBackend(t *testing.T) {
+	uploader, basePath := newTestLocalUploader(t)
+
+	rootDir := t.TempDir()
+	err := os.MkdirAll(filepath.Join(rootDir, "sales"), 0755)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(rootDir, "sales", "full.bak"), []byte("sales data"), 0644)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(rootDir, "sales", "notes.txt"), []byte("ignored"), 0644)
+	require.NoError(t, err)
+
+	mockLogger := NewMockLogger()
+	mockLogger.On("Info", mock.Anything, mock.Anything).Return()
+
+	ctx := newUploadContext(t, io.Discard, "--keyprefix", "nightly", rootDir)
+
+	err = Upload(ctx, uploader, mockLogger)
+	require.NoError(t, err)
+
+	stored, err := os.ReadFile(filepath.Join(basePath, "nightly", "sales", "full.bak"))
+	require.NoError(t, err)
+	assert.Equal(t, "sales data", string(stored))
+
+	keys, err := uploader.List(context.Background(), "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"nightly/sales/full.bak"}, keys)
+
+	// A second run finds the file already uploaded and skips it
+	mockLogger.On("Info", "Skipping file (already uploaded or not modified)", mock.Anything).Return()
+	err = Upload(ctx, uploader, mockLogger)
+	require.NoError(t, err)
+	mockLogger.AssertCalled(t, "Info", "Skipping file (already uploaded or not modified)", mock.Anything)
+}
+
+// failingReader returns err on every read
+type failingReader struct {
+	err error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+func TestLocalUploader_DownloadRange(t *testing.T) {
+	uploader, _ := newTestLocalUploader(t)
+	ctx := context.Background()
+	require.NoError(t, uploader.Upload(ctx, "sales.bak", strings.NewReader("0123456789"), 10))
+
+	var buf bytes.Buffer
+	require.NoError(t, uploader.DownloadRange(ctx, "sales.bak", 3, 4, &buf))
+	assert.Equal(t, "3456", buf.String())
+
+	buf.Reset()
+	require.NoError(t, uploader.DownloadRange(ctx, "sales.bak", 7, -1, &buf))
+	assert.Equal(t, "789", buf.String())
+}
@@ -0,0 +1,215 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/ngns-io/baxfer/pkg/logger"
+)
+
+// errDestinationStopped is reported for a destination whose upload returned
+// before consuming the whole stream
+var errDestinationStopped = errors.New("destination stopped reading before the end of the file")
+
+// Destination is one named target of a fan-out upload
+type Destination struct {
+	Name     string
+	Uploader Uploader
+}
+
+// MultiUploader sends each upload to several destinations at once, reading
+// the source stream a single time and teeing it into every destination's
+// Upload. A destination that fails is dropped from the fan-out so the others
+// still receive the complete file.
+//
+// Reads (Download, List, GetFileInfo) are served by the first destination.
+// FileExists reports whether the key exists at every destination.
+type MultiUploader struct {
+	destinations []Destination
+	log          logger.Logger
+}
+
+// DestinationError reports the destinations that failed during a fan-out upload
+type DestinationError struct {
+	Failed map[string]error
+}
+
+func (e *DestinationError) Error() string {
+	errs := make([]error, 0, len(e.Failed))
+	for _, name := range e.names() {
+		errs = append(errs, fmt.Errorf("%s: %w", name, e.Failed[name]))
+	}
+	return fmt.Sprintf("upload failed for %d destination(s): %v", len(e.Failed), errors.Join(errs...))
+}
+
+func (e *DestinationError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Failed))
+	for _, name := range e.names() {
+		errs = append(errs, e.Failed[name])
+	}
+	return errs
+}
+
+// names returns the failed destinations in sorted order, so errors read the
+// same from run to run
+func (e *DestinationError) names() []string {
+	names := make([]string, 0, len(e.Failed))
+	for name := range e.Failed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func NewMultiUploader(destinations []Destination, log logger.Logger) (*MultiUploader, error) {
+	if len(destinations) == 0 {
+		return nil, fmt.Errorf("no destinations provided for fan-out upload")
+	}
+
+	seen := make(map[string]bool, len(destinations))
+	for _, d := range destinations {
+		if seen[d.Name] {
+			return nil, fmt.Errorf("duplicate destination: %s", d.Name)
+		}
+		seen[d.Name] = true
+	}
+
+	return &MultiUploader{
+		destinations: destinations,
+		log:          log,
+	}, nil
+}
+
+// Destinations returns the destinations the uploader fans out to
+func (m *MultiUploader) Destinations() []Destination {
+	return m.destinations
+}
+
+// fanoutPipe feeds one destination; failed is set once writes to it fail
+type fanoutPipe struct {
+	name   string
+	pw     *io.PipeWriter
+	failed error
+}
+
+// fanoutWriter writes to every pipe that is still accepting data
+type fanoutWriter struct {
+	pipes []*fanoutPipe
+}
+
+func (w *fanoutWriter) Write(p []byte) (int, error) {
+	active := 0
+	for _, pipe := range w.pipes {
+		if pipe.failed != nil {
+			continue
+		}
+		if _, err := pipe.pw.Write(p); err != nil {
+			pipe.failed = err
+			continue
+		}
+		active++
+	}
+
+	// Stop reading the source once no destination is left
+	if active == 0 {
+		return 0, errors.New("all destinations failed")
+	}
+	return len(p), nil
+}
+
+func (m *MultiUploader) Upload(ctx context.Context, key string, reader io.Reader, size int64) error {
+	pipes := make([]*fanoutPipe, len(m.destinations))
+	uploadErrs := make([]error, len(m.destinations))
+
+	// Every destination is sent the whole stream, so each one's copy counts
+	// against the bandwidth limit
+	bwlimit := bandwidthLimitFrom(ctx)
+
+	var wg sync.WaitGroup
+	for i, d := range m.destinations {
+		pr, pw := io.Pipe()
+		pipes[i] = &fanoutPipe{name: d.Name, pw: pw}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			uploadErrs[i] = d.Uploader.Upload(ctx, key, bwlimit.reader(ctx, pr), size)
+			// Unblock the fan-out if the destination returned without reading
+			// the whole stream
+			if uploadErrs[i] != nil {
+				pr.CloseWithError(uploadErrs[i])
+			} else {
+				pr.CloseWithError(errDestinationStopped)
+			}
+		}()
+	}
+
+	_, copyErr := io.Copy(&fanoutWriter{pipes: pipes}, reader)
+	for _, pipe := range pipes {
+		if copyErr != nil {
+			pipe.pw.CloseWithError(copyErr)
+		} else {
+			pipe.pw.Close()
+		}
+	}
+	wg.Wait()
+
+	failed := make(map[string]error)
+	for i, pipe := range pipes {
+		err := uploadErrs[i]
+		if err == nil && pipe.failed != nil {
+			err = pipe.failed
+		}
+		if err == nil && copyErr != nil {
+			err = copyErr
+		}
+
+		if err != nil {
+			failed[pipe.name] = err
+			m.log.Error("Failed to upload file to destination", "destination", pipe.name, "key", key, "error", err)
+			continue
+		}
+		m.log.Info("File uploaded to destination", "destination", pipe.name, "key", key)
+	}
+
+	if len(failed) > 0 {
+		return &DestinationError{Failed: failed}
+	}
+	return nil
+}
+
+func (m *MultiUploader) Download(ctx context.Context, key string, writer io.Writer) error {
+	return m.destinations[0].Uploader.Download(ctx, key, writer)
+}
+
+func (m *MultiUploader) List(ctx context.Context, prefix string) ([]string, error) {
+	return m.destinations[0].Uploader.List(ctx, prefix)
+}
+
+func (m *MultiUploader) Delete(ctx context.Context, key string) error {
+	var errs []error
+	for _, d := range m.destinations {
+		if err := d.Uploader.Delete(ctx, key); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", d.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m *MultiUploader) FileExists(ctx context.Context, key string) (bool, error) {
+	for _, d := range m.destinations {
+		exists, err := d.Uploader.FileExists(ctx, key)
+		if err != nil || !exists {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (m *MultiUploader) GetFileInfo(ctx context.Context, key string) (*FileInfo, error) {
+	return m.destinations[0].Uploader.GetFileInfo(ctx, key)
+}
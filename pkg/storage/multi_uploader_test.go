@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestMultiUploader(t *testing.T, destinations ...Destination) *MultiUploader {
+	t.Helper()
+
+	mockLogger := NewMockLogger()
+	mockLogger.On("Info", mock.Anything, mock.Anything).Return()
+	mockLogger.On("Error", mock.Anything, mock.Anything).Return()
+
+	multi, err := NewMultiUploader(destinations, mockLogger)
+	require.NoError(t, err)
+	return multi
+}
+
+func TestMultiUploader_UploadToAll(t *testing.T) {
+	first, _ := newTestLocalUploader(t)
+	second, _ := newTestLocalUploader(t)
+	multi := newTestMultiUploader(t,
+		Destination{Name: "first", Uploader: first},
+		Destination{Name: "second", Uploader: second},
+	)
+	ctx := context.Background()
+
+	// Larger than the pipe and copy buffers so the stream is teed in pieces
+	data := bytes.Repeat([]byte("fan-out backup data "), 100000)
+	err := multi.Upload(ctx, "db/full.bak", bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+
+	for _, u := range []*LocalUploader{first, second} {
+		var buf bytes.Buffer
+		require.NoError(t, u.Download(ctx, "db/full.bak", &buf))
+		assert.Equal(t, data, buf.Bytes())
+	}
+
+	exists, err := multi.FileExists(ctx, "db/full.bak")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestMultiUploader_FailedDestinationDoesNotStopOthers(t *testing.T) {
+	good, _ := newTestLocalUploader(t)
+	failing := &rejectingUploader{err: errors.New("connection reset")}
+
+	multi := newTestMultiUploader(t,
+		Destination{Name: "sftp", Uploader: failing},
+		Destination{Name: "local", Uploader: good},
+	)
+	ctx := context.Background()
+
+	data := strings.Repeat("x", 1<<20)
+	err := multi.Upload(ctx, "full.bak", strings.NewReader(data), int64(len(data)))
+
+	var destErr *DestinationError
+	require.True(t, errors.As(err, &destErr))
+	assert.Len(t, destErr.Failed, 1)
+	assert.Contains(t, destErr.Failed, "sftp")
+
+	var buf bytes.Buffer
+	require.NoError(t, good.Download(ctx, "full.bak", &buf))
+	assert.Equal(t, data, buf.String())
+}
+
+func TestDestinationError_SortedByName(t *testing.T) {
+	err := &DestinationError{Failed: map[string]error{
+		"sftp":  errors.New("connection reset"),
+		"azure": errors.New("throttled"),
+		"s3":    errors.New("access denied"),
+	}}
+	assert.Equal(t, "upload failed for 3 destination(s): azure: throttled\ns3: access denied\nsftp: connection reset", err.Error())
+	assert.Equal(t, []error{err.Failed["azure"], err.Failed["s3"], err.Failed["sftp"]}, err.Unwrap())
+}
+
+func TestMultiUploader_DuplicateDestination(t *testing.T) {
+	local, _ := newTestLocalUploader(t)
+	_, err := NewMultiUploader([]Destination{
+		{Name: "local", Uploader: local},
+		{Name: "local", Uploader: local},
+	}, NewMockLogger())
+	assert.Error(t, err)
+}
+
+func TestUpload_FanOutSkipsUpToDateDestinations(t *testing.T) {
+	upToDate, _ := newTestLocalUploader(t)
+	missing, missingPath := newTestLocalUploader(t)
+
+	rootDir := t.TempDir()
+	err := os.WriteFile(filepath.Join(rootDir, "full.bak"), []byte("backup data"), 0644)
+	require.NoError(t, err)
+
+	// The first destination already has the current file
+	err = upToDate.Upload(context.Background(), "full.bak", strings.NewReader("backup data"), 11)
+	require.NoError(t, err)
+
+	multi := newTestMultiUploader(t,
+		Destination{Name: "up-to-date", Uploader: upToDate},
+		Destination{Name: "missing", Uploader: missing},
+	)
+
+	mockLogger := NewMockLogger()
+	mockLogger.On("Info", mock.Anything, mock.Anything).Return()
+
+	err = Upload(newUploadContext(t, io.Discard, rootDir), multi, mockLogger)
+	require.NoError(t, err)
+
+	stored, err := os.ReadFile(filepath.Join(missingPath, "full.bak"))
+	require.NoError(t, err)
+	assert.Equal(t, "backup data", string(stored))
+
+	mockLogger.AssertCalled(t, "Info", "Skipping destination (already uploaded or not modified)",
+		[]interface{}{"destination", "up-to-date", "key", "full.bak"})
+	mockLogger.AssertNotCalled(t, "Info", "Skipping destination (already uploaded or not modified)",
+		[]interface{}{"destination", "missing", "key", "full.bak"})
+}
+
+// rejectingUploader fails uploads without reading any of the stream
+type rejectingUploader struct {
+	MockUploader
+	err error
+}
+
+func (u *rejectingUploader) Upload(ctx context.Context, key string, reader io.Reader, size int64) error {
+	return u.err
+}
@@ -0,0 +1,448 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ngns-io/baxfer/pkg/logger"
+	bolt "go.etcd.io/bbolt"
+)
+
+// maxMultipartParts is the most parts S3 and B2 accept in one upload. The
+// part size of larger files is raised to fit.
+const maxMultipartParts = 10000
+
+// resumableSize is the smallest file uploaded as a resumable multipart upload
+// when the state database is in use. Smaller files are quick to send again,
+// so they are uploaded as they are without it, without the part buffers and
+// extra requests of a multipart upload.
+const resumableSize = 100 * 1024 * 1024
+
+// errUploadGone is returned by multipartTarget.listParts when the provider no
+// longer has the upload, because it was completed, canceled or expired
+var errUploadGone = errors.New("multipart upload no longer exists")
+
+// multipartTarget is a provider's API for uploading one key in parts
+type multipartTarget interface {
+	// put uploads a stream small enough for a single request
+	put(ctx context.Context, data []byte) error
+	// start begins a multipart upload and returns its ID
+	start(ctx context.Context) (string, error)
+	// listParts returns the provider's tag of each part it holds, by number
+	listParts(ctx context.Context, uploadID string) (map[int]string, error)
+	// uploadPart uploads a part and returns it with its tag and checksum set
+	uploadPart(ctx context.Context, uploadID string, number int, data []byte) (multipartPart, error)
+	complete(ctx context.Context, uploadID string, parts []multipartPart) error
+	abort(ctx context.Context, uploadID string) error
+}
+
+// multipartUpload is an unfinished multipart upload recorded in the state
+// database
+type multipartUpload struct {
+	UploadID  string    `json:"upload_id"` // the S3 upload ID or B2 large file ID
+	Size      int64     `json:"size"`      // -1 when not known in advance
+	PartSize  int64     `json:"part_size"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// multipartPart is a part of a multipart upload that the provider has stored
+type multipartPart struct {
+	Number   int    `json:"number"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256"`             // compared with the stream when resuming
+	Tag      string `json:"tag"`                // the ETag on S3, the SHA-1 on B2
+	Checksum string `json:"checksum,omitempty"` // the CRC32 S3 was sent, if any
+}
+
+// multipartStore records the progress of multipart uploads to one
+// destination, so that a later run can resume them
+type multipartStore struct {
+	state       *stateDB
+	destination string
+}
+
+type uploadStateKey struct{}
+
+type uploadDestinationKey struct{}
+
+// withUploadState returns a context whose uploads record their progress in
+// state, so they can be resumed
+func withUploadState(ctx context.Context, state *stateDB) context.Context {
+	if state == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, uploadStateKey{}, state)
+}
+
+// withUploadDestination returns a context whose uploads are recorded under
+// the given destination name
+func withUploadDestination(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, uploadDestinationKey{}, name)
+}
+
+// multipartStoreFrom returns where an upload made with ctx records its
+// progress, or nil if it cannot be resumed
+func multipartStoreFrom(ctx context.Context) *multipartStore {
+	state, _ := ctx.Value(uploadStateKey{}).(*stateDB)
+	destination, _ := ctx.Value(uploadDestinationKey{}).(string)
+	if state == nil || destination == "" {
+		return nil
+	}
+	return &multipartStore{state: state, destination: destination}
+}
+
+// resumableUpload uploads reader to key in parts, recording each part in
+// store as it completes. If an earlier upload of the key was interrupted, the
+// parts it stored are read from the stream and compared instead of being sent
+// again; any that differ, such as those of an encrypted stream, are replaced.
+// A stream that fits in a single part is uploaded with put.
+func resumableUpload(ctx context.Context, target multipartTarget, store *multipartStore, key string, reader io.Reader, size, partSize int64, concurrency int, log logger.Logger) error {
+	if size > partSize*maxMultipartParts {
+		partSize = (size + maxMultipartParts - 1) / maxMultipartParts
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	upload, stored, err := store.resume(ctx, target, key, size, partSize, log)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	buffers := newPartBuffers(partSize, concurrency)
+
+	buf, err := buffers.get(ctx)
+	if err != nil {
+		return err
+	}
+	// Read ahead one byte after the first part, so that a stream of exactly
+	// one part is put too: B2 refuses to finish a large file of one part
+	br := bufio.NewReader(reader)
+	n, err := io.ReadFull(br, buf)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return err
+	}
+	single := int64(n) < partSize
+	if !single {
+		_, peekErr := br.Peek(1)
+		if peekErr != nil && !errors.Is(peekErr, io.EOF) {
+			return peekErr
+		}
+		single = errors.Is(peekErr, io.EOF)
+	}
+	if single {
+		if upload != nil {
+			store.discard(ctx, target, key, upload, log)
+		}
+		return target.put(ctx, buf[:n])
+	}
+
+	if upload == nil {
+		id, err := target.start(ctx)
+		if err != nil {
+			return err
+		}
+		upload = &multipartUpload{UploadID: id, Size: size, PartSize: partSize, StartedAt: time.Now().UTC()}
+		if err := store.state.startMultipart(store.destination, key, upload); err != nil {
+			// The upload goes on, but cannot be resumed if it is interrupted
+			log.Error("Failed to record multipart upload", "key", key, "error", err)
+		}
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex // guards parts and firstErr
+		parts    []multipartPart
+		firstErr error
+		resent   int
+	)
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+
+	for number := 1; ; number++ {
+		data := buf[:n]
+		sum := sha256.Sum256(data)
+		part := multipartPart{Number: number, Size: int64(n), SHA256: hex.EncodeToString(sum[:])}
+
+		if p, ok := stored[number]; ok && p.SHA256 == part.SHA256 && p.Size == part.Size {
+			mu.Lock()
+			parts = append(parts, p)
+			mu.Unlock()
+			buffers.put(buf)
+		} else {
+			if ok {
+				resent++
+			}
+			wg.Add(1)
+			go func(buf []byte) {
+				defer wg.Done()
+				defer buffers.put(buf)
+
+				uploaded, err := target.uploadPart(ctx, upload.UploadID, part.Number, data)
+				if err != nil {
+					fail(err)
+					return
+				}
+				part.Tag, part.Checksum = uploaded.Tag, uploaded.Checksum
+				if err := store.state.saveMultipartPart(store.destination, key, part); err != nil {
+					log.Error("Failed to record uploaded part", "key", key, "part", part.Number, "error", err)
+				}
+				mu.Lock()
+				parts = append(parts, part)
+				mu.Unlock()
+			}(buf)
+		}
+
+		if int64(n) < partSize || ctx.Err() != nil {
+			break
+		}
+		if buf, err = buffers.get(ctx); err != nil {
+			fail(err)
+			break
+		}
+		n, err = io.ReadFull(br, buf)
+		if errors.Is(err, io.EOF) {
+			buffers.put(buf)
+			break
+		}
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			buffers.put(buf)
+			fail(err)
+			break
+		}
+	}
+	wg.Wait()
+
+	if resent > 0 {
+		log.Info("Replaced parts that changed since the upload was interrupted", "key", key, "parts", resent)
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Number < parts[j].Number })
+	if err := target.complete(ctx, upload.UploadID, parts); err != nil {
+		// An upload that cannot be completed would fail the same way if resumed
+		if !isTransientError(err) {
+			store.discard(ctx, target, key, upload, log)
+		}
+		return err
+	}
+	if err := store.state.deleteMultipart(store.destination, key); err != nil {
+		log.Error("Failed to remove finished multipart upload", "key", key, "error", err)
+	}
+	return nil
+}
+
+// resume returns the interrupted upload of key recorded in the store, with
+// the parts the provider still holds, or nil if there is none to resume
+func (s *multipartStore) resume(ctx context.Context, target multipartTarget, key string, size, partSize int64, log logger.Logger) (*multipartUpload, map[int]multipartPart, error) {
+	upload, parts, err := s.state.multipart(s.destination, key)
+	if err != nil {
+		log.Error("Failed to read state database", "key", key, "error", err)
+		return nil, nil, nil
+	}
+	if upload == nil {
+		return nil, nil, nil
+	}
+
+	// Parts of a different size cannot be matched up with the stream
+	if upload.Size != size || upload.PartSize != partSize {
+		s.discard(ctx, target, key, upload, log)
+		return nil, nil, nil
+	}
+
+	tags, err := target.listParts(ctx, upload.UploadID)
+	if errors.Is(err, errUploadGone) {
+		log.Info("Interrupted upload no longer exists; starting again", "key", key, "uploadID", upload.UploadID)
+		if err := s.state.deleteMultipart(s.destination, key); err != nil {
+			log.Error("Failed to remove multipart upload", "key", key, "error", err)
+		}
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stored := make(map[int]multipartPart, len(parts))
+	var done int64
+	for _, p := range parts {
+		if tag, ok := tags[p.Number]; ok && tag == p.Tag {
+			stored[p.Number] = p
+			done += p.Size
+		}
+	}
+	log.Info("Resuming interrupted upload", "key", key, "uploadID", upload.UploadID,
+		"parts", len(stored), "bytes", done, "started", upload.StartedAt)
+	return upload, stored, nil
+}
+
+// discard cancels an interrupted upload that cannot be resumed and forgets
+// it
+func (s *multipartStore) discard(ctx context.Context, target multipartTarget, key string, upload *multipartUpload, log logger.Logger) {
+	if err := target.abort(ctx, upload.UploadID); err != nil && !errors.Is(err, errUploadGone) {
+		log.Warn("Failed to cancel interrupted upload", "key", key, "uploadID", upload.UploadID, "error", err)
+	}
+	if err := s.state.deleteMultipart(s.destination, key); err != nil {
+		log.Error("Failed to remove multipart upload", "key", key, "error", err)
+	}
+}
+
+// partBuffers hands out part-sized buffers, allocating at most n of them so
+// that no more than n parts are held in memory at once
+type partBuffers struct {
+	free chan []byte
+	size int64
+	left int
+}
+
+func newPartBuffers(size int64, n int) *partBuffers {
+	return &partBuffers{free: make(chan []byte, n), size: size, left: n}
+}
+
+// get returns a buffer, waiting for one to be put back if all n are in use.
+// It is only called by the goroutine reading the stream.
+func (b *partBuffers) get(ctx context.Context) ([]byte, error) {
+	select {
+	case buf := <-b.free:
+		return buf, nil
+	default:
+	}
+	if b.left > 0 {
+		b.left--
+		return make([]byte, b.size), nil
+	}
+	select {
+	case buf := <-b.free:
+		return buf, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (b *partBuffers) put(buf []byte) {
+	b.free <- buf[:cap(buf)]
+}
+
+// Keys of each upload's bucket in the multipart bucket of the state database
+var (
+	multipartUploadKey = []byte("upload")
+	multipartPartsKey  = []byte("parts")
+)
+
+// multipart returns the interrupted upload of key to destination and the
+// parts recorded for it, or nil if there is none
+func (s *stateDB) multipart(destination, key string) (*multipartUpload, []multipartPart, error) {
+	var (
+		upload *multipartUpload
+		parts  []multipartPart
+	)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(stateMultipartBucket)
+		if b == nil {
+			return nil
+		}
+		b = b.Bucket(stateKey(destination, key))
+		if b == nil {
+			return nil
+		}
+		upload = &multipartUpload{}
+		if err := json.Unmarshal(b.Get(multipartUploadKey), upload); err != nil {
+			return err
+		}
+		if pb := b.Bucket(multipartPartsKey); pb != nil {
+			return pb.ForEach(func(_, data []byte) error {
+				var part multipartPart
+				if err := json.Unmarshal(data, &part); err != nil {
+					return err
+				}
+				parts = append(parts, part)
+				return nil
+			})
+		}
+		return nil
+	})
+	return upload, parts, err
+}
+
+// startMultipart records a new upload of key to destination, replacing any
+// earlier one
+func (s *stateDB) startMultipart(destination, key string, upload *multipartUpload) error {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(stateMultipartBucket)
+		if err != nil {
+			return err
+		}
+		id := stateKey(destination, key)
+		if b.Bucket(id) != nil {
+			if err := b.DeleteBucket(id); err != nil {
+				return err
+			}
+		}
+		ub, err := b.CreateBucket(id)
+		if err != nil {
+			return err
+		}
+		if _, err := ub.CreateBucket(multipartPartsKey); err != nil {
+			return err
+		}
+		return ub.Put(multipartUploadKey, data)
+	})
+}
+
+// saveMultipartPart records a part of the upload of key to destination
+func (s *stateDB) saveMultipartPart(destination, key string, part multipartPart) error {
+	data, err := json.Marshal(part)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(stateMultipartBucket)
+		if b != nil {
+			b = b.Bucket(stateKey(destination, key))
+		}
+		if b == nil {
+			return errors.New("no multipart upload recorded")
+		}
+		var number [4]byte
+		binary.BigEndian.PutUint32(number[:], uint32(part.Number))
+		return b.Bucket(multipartPartsKey).Put(number[:], data)
+	})
+}
+
+// deleteMultipart forgets the upload of key to destination
+func (s *stateDB) deleteMultipart(destination, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(stateMultipartBucket)
+		if b == nil || b.Bucket(stateKey(destination, key)) == nil {
+			return nil
+		}
+		return b.DeleteBucket(stateKey(destination, key))
+	})
+}
@@ -0,0 +1,234 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testPartSize = 16
+
+// fakeMultipart is an in-memory multipart upload API that can fail a part
+type fakeMultipart struct {
+	mu       sync.Mutex
+	uploads  map[string]map[int][]byte
+	objects  [][]byte
+	nextID   int
+	failPart int   // part number that fails, or zero
+	sent     []int // part numbers uploaded, in order
+}
+
+func newFakeMultipart() *fakeMultipart {
+	return &fakeMultipart{uploads: make(map[string]map[int][]byte)}
+}
+
+func (f *fakeMultipart) put(ctx context.Context, data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects = append(f.objects, bytes.Clone(data))
+	return nil
+}
+
+func (f *fakeMultipart) start(ctx context.Context) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	id := fmt.Sprintf("upload-%d", f.nextID)
+	f.uploads[id] = make(map[int][]byte)
+	return id, nil
+}
+
+func (f *fakeMultipart) listParts(ctx context.Context, uploadID string) (map[int]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	parts, ok := f.uploads[uploadID]
+	if !ok {
+		return nil, errUploadGone
+	}
+	tags := make(map[int]string)
+	for number, data := range parts {
+		tags[number] = fmt.Sprintf("%x", data)
+	}
+	return tags, nil
+}
+
+func (f *fakeMultipart) uploadPart(ctx context.Context, uploadID string, number int, data []byte) (multipartPart, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if number == f.failPart {
+		return multipartPart{}, errors.New("connection lost")
+	}
+	f.uploads[uploadID][number] = bytes.Clone(data)
+	f.sent = append(f.sent, number)
+	return multipartPart{Tag: fmt.Sprintf("%x", data)}, nil
+}
+
+func (f *fakeMultipart) complete(ctx context.Context, uploadID string, parts []multipartPart) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var object []byte
+	for i, p := range parts {
+		if p.Number != i+1 || p.Tag != fmt.Sprintf("%x", f.uploads[uploadID][p.Number]) {
+			return fmt.Errorf("invalid part %d", p.Number)
+		}
+		object = append(object, f.uploads[uploadID][p.Number]...)
+	}
+	f.objects = append(f.objects, object)
+	delete(f.uploads, uploadID)
+	return nil
+}
+
+func (f *fakeMultipart) abort(ctx context.Context, uploadID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.uploads, uploadID)
+	return nil
+}
+
+func newTestMultipartStore(t *testing.T) *multipartStore {
+	t.Helper()
+	state, err := openState(filepath.Join(t.TempDir(), stateFile), false)
+	require.NoError(t, err)
+	t.Cleanup(func() { assert.NoError(t, state.Close()) })
+	return &multipartStore{state: state, destination: "s3:test"}
+}
+
+func uploadParts(t *testing.T, target *fakeMultipart, store *multipartStore, data []byte, concurrency int) error {
+	t.Helper()
+	return resumableUpload(context.Background(), target, store, "sales.bak", bytes.NewReader(data),
+		int64(len(data)), testPartSize, concurrency, newRetryLogger())
+}
+
+func TestResumableUpload_ResumesInterruptedUpload(t *testing.T) {
+	store := newTestMultipartStore(t)
+	data := make([]byte, 10*testPartSize+5)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+
+	target := newFakeMultipart()
+	target.failPart = 7
+	assert.Error(t, uploadParts(t, target, store, data, 1))
+	assert.Equal(t, []int{1, 2, 3, 4, 5, 6}, target.sent)
+
+	upload, parts, err := store.state.multipart(store.destination, "sales.bak")
+	require.NoError(t, err)
+	require.NotNil(t, upload)
+	assert.Len(t, parts, 6)
+
+	// Only the parts the provider does not have are sent again
+	target.failPart, target.sent = 0, nil
+	require.NoError(t, uploadParts(t, target, store, data, 3))
+	sort.Ints(target.sent)
+	assert.Equal(t, []int{7, 8, 9, 10, 11}, target.sent)
+	require.Len(t, target.objects, 1)
+	assert.Equal(t, data, target.objects[0])
+
+	upload, _, err = store.state.multipart(store.destination, "sales.bak")
+	require.NoError(t, err)
+	assert.Nil(t, upload, "finished uploads are forgotten")
+}
+
+func TestResumableUpload_ReplacesChangedParts(t *testing.T) {
+	store := newTestMultipartStore(t)
+	data := bytes.Repeat([]byte("0123456789abcdef"), 6)
+
+	target := newFakeMultipart()
+	target.failPart = 5
+	assert.Error(t, uploadParts(t, target, store, data, 1))
+
+	// A stream that differs from part 3 on, like a re-encrypted one
+	changed := bytes.Clone(data)
+	copy(changed[2*testPartSize:], bytes.Repeat([]byte("x"), 4*testPartSize))
+	target.failPart, target.sent = 0, nil
+	require.NoError(t, uploadParts(t, target, store, changed, 1))
+	assert.Equal(t, []int{3, 4, 5, 6}, target.sent)
+	assert.Equal(t, changed, target.objects[0])
+}
+
+func TestResumableUpload_UploadGone(t *testing.T) {
+	store := newTestMultipartStore(t)
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4)
+
+	target := newFakeMultipart()
+	target.failPart = 3
+	assert.Error(t, uploadParts(t, target, store, data, 1))
+
+	// The provider expired the upload, so it is started again
+	target.uploads = make(map[string]map[int][]byte)
+	target.failPart, target.sent = 0, nil
+	require.NoError(t, uploadParts(t, target, store, data, 1))
+	assert.Equal(t, []int{1, 2, 3, 4}, target.sent)
+	assert.Equal(t, data, target.objects[0])
+}
+
+func TestResumableUpload_SinglePart(t *testing.T) {
+	store := newTestMultipartStore(t)
+	target := newFakeMultipart()
+	require.NoError(t, uploadParts(t, target, store, []byte("small"), 2))
+
+	assert.Empty(t, target.sent)
+	assert.Equal(t, [][]byte{[]byte("small")}, target.objects)
+	assert.Equal(t, 0, target.nextID, "no multipart upload is started")
+}
+
+func TestResumableUpload_ExactlyOnePart(t *testing.T) {
+	store := newTestMultipartStore(t)
+	target := newFakeMultipart()
+	data := bytes.Repeat([]byte("x"), testPartSize)
+	require.NoError(t, uploadParts(t, target, store, data, 2))
+
+	// B2 refuses to finish a large file of a single part
+	assert.Empty(t, target.sent)
+	assert.Equal(t, [][]byte{data}, target.objects)
+	assert.Equal(t, 0, target.nextID, "no multipart upload is started")
+}
+
+func TestMultipartStoreFrom(t *testing.T) {
+	store := newTestMultipartStore(t)
+	ctx := context.Background()
+	assert.Nil(t, multipartStoreFrom(withUploadState(ctx, store.state)), "uploads need a destination name")
+	assert.Nil(t, multipartStoreFrom(withUploadDestination(ctx, "s3:test")), "uploads need a state database")
+
+	ctx = withUploadDestination(withUploadState(ctx, store.state), "s3:test")
+	assert.Equal(t, store, multipartStoreFrom(ctx))
+}
+
+// resumableProbe discards uploads, noting the keys whose upload could be
+// resumed
+type resumableProbe struct {
+	*LocalUploader
+	resumable []string
+}
+
+func (p *resumableProbe) Upload(ctx context.Context, key string, reader io.Reader, size int64) error {
+	if multipartStoreFrom(ctx) != nil {
+		p.resumable = append(p.resumable, key)
+	}
+	_, err := io.Copy(io.Discard, reader)
+	return err
+}
+
+func TestUpload_OnlyLargeFilesResumable(t *testing.T) {
+	local, _ := newTestLocalUploader(t)
+	probe := &resumableProbe{LocalUploader: local}
+	rootDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "small.bak"), []byte("sales data"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "large.bak"), nil, 0644))
+	require.NoError(t, os.Truncate(filepath.Join(rootDir, "large.bak"), resumableSize))
+
+	statePath := filepath.Join(t.TempDir(), stateFile)
+	uploaded := uploadFiles(t, Named(probe, "local:test"), "--state", "--state-file", statePath, rootDir)
+	assert.ElementsMatch(t, []string{"small.bak", "large.bak"}, uploaded)
+	assert.Equal(t, []string{"large.bak"}, probe.resumable)
+}
@@ -5,7 +5,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"os"
 	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -20,10 +19,10 @@ type R2Uploader struct {
 	*S3CompatibleUploader
 }
 
-func NewR2Uploader(bucket string, log logger.Logger) (*R2Uploader, error) {
-	accountID := os.Getenv("CF_ACCOUNT_ID")
-	accessKeyID := os.Getenv("CF_ACCESS_KEY_ID")
-	accessKeySecret := os.Getenv("CF_ACCESS_KEY_SECRET")
+func NewR2Uploader(bucket string, creds Credentials, log logger.Logger) (*R2Uploader, error) {
+	accountID := creds.Get("CF_ACCOUNT_ID")
+	accessKeyID := creds.Get("CF_ACCESS_KEY_ID")
+	accessKeySecret := creds.Get("CF_ACCESS_KEY_SECRET")
 
 	if accountID == "" || accessKeyID == "" || accessKeySecret == "" {
 		return nil, fmt.Errorf("Cloudflare R2 credentials not found in environment variables")
@@ -41,6 +40,8 @@ func NewR2Uploader(bucket string, log logger.Logger) (*R2Uploader, error) {
 		return nil, err
 	}
 
+	// R2 needs path-style addressing, which every request made with the
+	// client uses, including those of multipart uploads
 	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
 		o.BaseEndpoint = aws.String(customEndpoint)
 		o.UsePathStyle = true
@@ -74,11 +75,7 @@ func (u *R2Uploader) Upload(ctx context.Context, key string, reader io.Reader, s
 		ChecksumAlgorithm: types.ChecksumAlgorithmCrc32,
 	}
 
-	// Force path-style addressing for R2
-	_, err := u.Client.PutObject(ctx, input, func(o *s3.Options) {
-		o.UsePathStyle = true
-	})
-	return err
+	return u.upload(ctx, input)
 }
 
 // FileExists overrides the base implementation with R2-specific error handling
@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// downloadChunkSize is the size of each range of a parallel download
+const downloadChunkSize = 32 * 1024 * 1024
+
+// resumeExt is appended to the name of a download's output file for its
+// resumeRecord, which is kept until the download completes
+const resumeExt = ".baxfer-resume"
+
+// resumeRecord identifies the stored file that a download's output file is
+// being written from, so that --resume only appends to a partial file from
+// the same upload of it
+type resumeRecord struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// saveResumeRecord records that the output file name is being downloaded
+func saveResumeRecord(name string, record resumeRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name+resumeExt, data, 0666)
+}
+
+// checkResumeRecord returns a UserError unless the partial output file name
+// was being downloaded from the stored file described by record
+func checkResumeRecord(name string, record resumeRecord) error {
+	data, err := os.ReadFile(name + resumeExt)
+	if errors.Is(err, os.ErrNotExist) {
+		return &UserError{Message: fmt.Sprintf("%s has no record of the download it is part of, so it cannot be resumed; download it again without --resume", name)}
+	}
+	if err != nil {
+		return err
+	}
+
+	var saved resumeRecord
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("invalid download record %s: %w", name+resumeExt, err)
+	}
+	if saved.Key != record.Key || saved.Size != record.Size || !saved.LastModified.Equal(record.LastModified) {
+		return &UserError{Message: fmt.Sprintf("%s was partly downloaded from a different upload than the one now stored as %s, so it cannot be resumed; download it again without --resume", name, record.Key)}
+	}
+	return nil
+}
+
+// rangeDownloader returns uploader as a RangeDownloader, looking through the
+// wrappers added by WithRetry and Named, or nil if its provider cannot
+// download ranges
+func rangeDownloader(uploader Uploader) RangeDownloader {
+	switch u := uploader.(type) {
+	case *retryUploader:
+		if rangeDownloader(u.Uploader) == nil {
+			return nil
+		}
+		return u
+	case *namedUploader:
+		return rangeDownloader(u.Uploader)
+	case RangeDownloader:
+		return u
+	}
+	return nil
+}
+
+// httpRange returns the HTTP Range header value for length bytes from offset,
+// or the rest of the file if length is negative
+func httpRange(offset, length int64) string {
+	if length < 0 {
+		return fmt.Sprintf("bytes=%d-", offset)
+	}
+	return fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+}
+
+// seekRange returns a reader for length bytes of file from offset, or the
+// rest of it if length is negative
+func seekRange(file io.ReadSeeker, offset, length int64) (io.Reader, error) {
+	if offset > 0 {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+	if length >= 0 {
+		return io.LimitReader(file, length), nil
+	}
+	return file, nil
+}
+
+// rangeChunk is one range of a parallel download
+type rangeChunk struct {
+	buf  bytes.Buffer
+	err  error
+	done chan struct{}
+}
+
+// downloadRanges downloads key from offset to size in chunks, up to parallel
+// of them at once, and writes them to writer in order. Only the chunks being
+// downloaded are held in memory, and the writer only ever sees the file from
+// offset up to the first missing byte, so an interrupted download can be
+// resumed from what was written. Each range is paced by bwlimit as it is
+// fetched, so the ranges fetched at once share the limit.
+func downloadRanges(ctx context.Context, ranged RangeDownloader, key string, offset, size, chunkSize int64, parallel int, bwlimit *bandwidthLimiter, writer io.Writer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	chunks := make(chan *rangeChunk, parallel-1)
+	var wg sync.WaitGroup
+	go func() {
+		defer close(chunks)
+		for start := offset; start < size; start += chunkSize {
+			chunk := &rangeChunk{done: make(chan struct{})}
+			select {
+			case chunks <- chunk:
+			case <-ctx.Done():
+				return
+			}
+
+			wg.Add(1)
+			go func(start int64) {
+				defer wg.Done()
+				defer close(chunk.done)
+				chunk.err = ranged.DownloadRange(ctx, key, start, min(chunkSize, size-start), bwlimit.writer(ctx, &chunk.buf))
+			}(start)
+		}
+	}()
+
+	var err error
+	for chunk := range chunks {
+		<-chunk.done
+		if err != nil {
+			continue
+		}
+		if err = chunk.err; err == nil {
+			_, err = writer.Write(chunk.buf.Bytes())
+		}
+		chunk.buf = bytes.Buffer{}
+		if err != nil {
+			cancel()
+		}
+	}
+	wg.Wait()
+	return err
+}
@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+)
+
+func TestHTTPRange(t *testing.T) {
+	assert.Equal(t, "bytes=100-", httpRange(100, -1))
+	assert.Equal(t, "bytes=0-99", httpRange(0, 100))
+}
+
+func TestRangeDownloader(t *testing.T) {
+	local, _ := newTestLocalUploader(t)
+	policy := RetryPolicy{Retries: 2, Backoff: time.Millisecond}
+
+	assert.NotNil(t, rangeDownloader(Named(WithRetry(local, policy, newRetryLogger()), "local:test")))
+	assert.Nil(t, rangeDownloader(WithRetry(new(MockUploader), policy, newRetryLogger())))
+}
+
+// droppingUploader drops the connection part way through its first ranged
+// download, like a flaky link
+type droppingUploader struct {
+	*LocalUploader
+	mu      sync.Mutex
+	dropped bool
+	offsets []int64
+}
+
+func (d *droppingUploader) DownloadRange(ctx context.Context, key string, offset, length int64, writer io.Writer) error {
+	d.mu.Lock()
+	drop := !d.dropped
+	d.dropped = true
+	d.offsets = append(d.offsets, offset)
+	d.mu.Unlock()
+
+	if drop {
+		var buf bytes.Buffer
+		if err := d.LocalUploader.DownloadRange(ctx, key, offset, 4, &buf); err != nil {
+			return err
+		}
+		if _, err := writer.Write(buf.Bytes()); err != nil {
+			return err
+		}
+		return syscall.ECONNRESET
+	}
+	return d.LocalUploader.DownloadRange(ctx, key, offset, length, writer)
+}
+
+func (d *droppingUploader) Download(ctx context.Context, key string, writer io.Writer) error {
+	return d.DownloadRange(ctx, key, 0, -1, writer)
+}
+
+func TestRetryUploader_ContinuesDownload(t *testing.T) {
+	local, _ := newTestLocalUploader(t)
+	ctx := context.Background()
+	require.NoError(t, local.Upload(ctx, "sales.bak", bytes.NewReader([]byte("0123456789")), 10))
+
+	// The retry asks only for the bytes that were not written
+	dropping := &droppingUploader{LocalUploader: local}
+	uploader := WithRetry(dropping, RetryPolicy{Retries: 2, Backoff: time.Millisecond}, newRetryLogger())
+	var buf bytes.Buffer
+	require.NoError(t, uploader.Download(ctx, "sales.bak", &buf))
+	assert.Equal(t, "0123456789", buf.String())
+	assert.Equal(t, []int64{0, 4}, dropping.offsets)
+}
+
+func TestDownloadRanges(t *testing.T) {
+	local, _ := newTestLocalUploader(t)
+	ctx := context.Background()
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64)
+	require.NoError(t, local.Upload(ctx, "sales.bak", bytes.NewReader(data), int64(len(data))))
+
+	var buf bytes.Buffer
+	require.NoError(t, downloadRanges(ctx, local, "sales.bak", 100, int64(len(data)), 48, 4, nil, &buf))
+	assert.Equal(t, data[100:], buf.Bytes())
+}
+
+// failingRanges fails the range starting at failAt
+type failingRanges struct {
+	*LocalUploader
+	failAt int64
+}
+
+func (f *failingRanges) DownloadRange(ctx context.Context, key string, offset, length int64, writer io.Writer) error {
+	if offset == f.failAt {
+		return errors.New("range failed")
+	}
+	return f.LocalUploader.DownloadRange(ctx, key, offset, length, writer)
+}
+
+func TestDownloadRanges_WritesOnlyUpToFailure(t *testing.T) {
+	local, _ := newTestLocalUploader(t)
+	ctx := context.Background()
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64)
+	require.NoError(t, local.Upload(ctx, "sales.bak", bytes.NewReader(data), int64(len(data))))
+
+	// Ranges after the failed one may have been downloaded, but are not written
+	var buf bytes.Buffer
+	ranged := &failingRanges{LocalUploader: local, failAt: 256}
+	err := downloadRanges(ctx, ranged, "sales.bak", 0, int64(len(data)), 64, 4, nil, &buf)
+	assert.EqualError(t, err, "range failed")
+	assert.Equal(t, data[:256], buf.Bytes())
+}
+
+func resumeDownload(t *testing.T, uploader Uploader, output string) error {
+	t.Helper()
+
+	mockLogger := NewMockLogger()
+	mockLogger.On("Info", mock.Anything, mock.Anything).Return()
+	mockLogger.On("Error", mock.Anything, mock.Anything).Return()
+
+	set := flag.NewFlagSet("test", 0)
+	set.String("output", output, "doc")
+	set.Bool("non-interactive", true, "doc")
+	set.Bool("verify", true, "doc")
+	set.Bool("resume", true, "doc")
+	require.NoError(t, set.Parse([]string{"sql/sales.bak"}))
+	return Download(cli.NewContext(&cli.App{}, set, nil), uploader, mockLogger)
+}
+
+// interruptedDownload leaves the partial output file of a download of key
+// that was interrupted after the given data
+func interruptedDownload(t *testing.T, uploader Uploader, key, output, data string) {
+	t.Helper()
+
+	info, err := uploader.GetFileInfo(context.Background(), key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(output, []byte(data), 0644))
+	require.NoError(t, saveResumeRecord(output, resumeRecord{Key: key, Size: info.Size, LastModified: info.LastModified}))
+}
+
+func TestDownload_Resume(t *testing.T) {
+	uploader, _ := uploadWithChecksum(t)
+	output := filepath.Join(t.TempDir(), "restored.bak")
+	interruptedDownload(t, uploader, "sql/sales.bak", output, "sales")
+
+	// The partial file is completed, and verified as a whole
+	require.NoError(t, resumeDownload(t, uploader, output))
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	assert.Equal(t, "sales data", string(content))
+	assert.NoFileExists(t, output+resumeExt)
+
+	// Nothing shows a complete file came from the stored one
+	var userErr *UserError
+	require.ErrorAs(t, resumeDownload(t, uploader, output), &userErr)
+	assert.Contains(t, userErr.Message, "no record of the download")
+}
+
+func TestDownload_ResumeChangedUpload(t *testing.T) {
+	uploader, basePath := uploadWithChecksum(t)
+	output := filepath.Join(t.TempDir(), "restored.bak")
+	interruptedDownload(t, uploader, "sql/sales.bak", output, "sales")
+
+	// The file was uploaded again since the download was interrupted
+	later := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(basePath, "sql", "sales.bak"), later, later))
+
+	var userErr *UserError
+	require.ErrorAs(t, resumeDownload(t, uploader, output), &userErr)
+	assert.Contains(t, userErr.Message, "different upload")
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	assert.Equal(t, "sales", string(content), "the partial file is left as it is")
+}
+
+func TestDownload_ResumeLargerFile(t *testing.T) {
+	uploader, _ := uploadWithChecksum(t)
+	output := filepath.Join(t.TempDir(), "restored.bak")
+	require.NoError(t, os.WriteFile(output, []byte("some other, larger file"), 0644))
+
+	var userErr *UserError
+	require.ErrorAs(t, resumeDownload(t, uploader, output), &userErr)
+	assert.Contains(t, userErr.Message, "not a partial download")
+}
+
+func TestDownload_ResumeNotSupported(t *testing.T) {
+	err := resumeDownload(t, new(MockUploader), filepath.Join(t.TempDir(), "restored.bak"))
+	assert.EqualError(t, err, "--resume is not supported by this provider")
+}
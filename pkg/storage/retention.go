@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Series modes decide which backups are counted together by a retention policy
+const (
+	SeriesByDir  = "dir"  // every file in a directory is one series
+	SeriesByName = "name" // files are also split by database name within a directory
+)
+
+// RetentionPolicy is a grandfather-father-son policy. Within each backup
+// series the newest KeepLast backups are kept, plus the newest backup of
+// each of the last KeepDaily days, KeepWeekly ISO weeks, KeepMonthly months
+// and KeepYearly years that have backups.
+type RetentionPolicy struct {
+	KeepLast    int
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+	KeepYearly  int
+}
+
+// IsZero reports whether the policy keeps nothing, i.e. is not set
+func (p RetentionPolicy) IsZero() bool {
+	return p == RetentionPolicy{}
+}
+
+// storedBackup is a stored file considered by a retention policy
+type storedBackup struct {
+	Key          string
+	LastModified time.Time
+}
+
+// retentionPeriod returns the label of the period a time falls in; backups
+// with the same label share a daily, weekly, monthly or yearly slot
+type retentionPeriod func(t time.Time) string
+
+var (
+	byDay   retentionPeriod = func(t time.Time) string { return t.Format("2006-01-02") }
+	byMonth retentionPeriod = func(t time.Time) string { return t.Format("2006-01") }
+	byYear  retentionPeriod = func(t time.Time) string { return t.Format("2006") }
+	byWeek  retentionPeriod = func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	}
+)
+
+// Retain returns the keys of the backups the policy keeps, each with the rule
+// that kept it. Backups are grouped into series according to seriesMode and
+// the policy is applied to each series separately.
+func (p RetentionPolicy) Retain(backups []storedBackup, seriesMode string) map[string]string {
+	series := make(map[string][]storedBackup)
+	for _, b := range backups {
+		name := seriesName(b.Key, seriesMode)
+		series[name] = append(series[name], b)
+	}
+
+	kept := make(map[string]string)
+	for _, files := range series {
+		// Newest first, so the first backup seen in each period is kept
+		sort.Slice(files, func(i, j int) bool {
+			return files[i].LastModified.After(files[j].LastModified)
+		})
+
+		for i := 0; i < p.KeepLast && i < len(files); i++ {
+			kept[files[i].Key] = "last"
+		}
+		keepPeriods(files, p.KeepDaily, byDay, "daily", kept)
+		keepPeriods(files, p.KeepWeekly, byWeek, "weekly", kept)
+		keepPeriods(files, p.KeepMonthly, byMonth, "monthly", kept)
+		keepPeriods(files, p.KeepYearly, byYear, "yearly", kept)
+	}
+	return kept
+}
+
+// keepPeriods keeps the newest backup in each of the n most recent periods
+// that contain a backup. files must be sorted newest first.
+func keepPeriods(files []storedBackup, n int, period retentionPeriod, rule string, kept map[string]string) {
+	last := ""
+	for _, f := range files {
+		if n <= 0 {
+			return
+		}
+		label := period(f.LastModified.Local())
+		if label == last {
+			continue
+		}
+		last = label
+		n--
+		if _, ok := kept[f.Key]; !ok {
+			kept[f.Key] = rule
+		}
+	}
+}
+
+// backupDatePattern matches the date stamp in backup file names such as
+// sales_20260131.bak or Sales_backup_2026_01_31_020000_123.bak
+var backupDatePattern = regexp.MustCompile(`(19|20)\d{2}[-_.]?\d{2}[-_.]?\d{2}`)
+
+// seriesName returns the series a key belongs to: its directory, followed by
+// the database name when seriesMode is SeriesByName. The database name is the
+// part of the file name before its date stamp, or the whole name without its
+// extension if it has no date stamp.
+func seriesName(key, seriesMode string) string {
+	dir := path.Dir(key)
+	if seriesMode != SeriesByName {
+		return dir
+	}
+
+	base := path.Base(key)
+	name := strings.TrimSuffix(base, path.Ext(base))
+	if loc := backupDatePattern.FindStringIndex(name); loc != nil {
+		name = strings.TrimRight(name[:loc[0]], "-_. ")
+	}
+	return dir + "/" + name
+}
@@ -0,0 +1,256 @@
+package storage
+
+import (
+	"flag"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/urfave/cli/v2"
+)
+
+// dailyBackups returns one backup per day at 02:00 local time, newest first
+func dailyBackups(dir string, newest time.Time, days int) []storedBackup {
+	backups := make([]storedBackup, 0, days)
+	for i := 0; i < days; i++ {
+		t := newest.AddDate(0, 0, -i)
+		backups = append(backups, storedBackup{
+			Key:          fmt.Sprintf("%s/sales_%s.bak", dir, t.Format("20060102")),
+			LastModified: t,
+		})
+	}
+	return backups
+}
+
+func TestRetentionPolicy_Retain(t *testing.T) {
+	// A Sunday, so weeks are easy to count
+	newest := time.Date(2026, 5, 31, 2, 0, 0, 0, time.Local)
+	backups := dailyBackups("sql", newest, 400)
+
+	policy := RetentionPolicy{KeepDaily: 7, KeepWeekly: 4, KeepMonthly: 12}
+	kept := policy.Retain(backups, SeriesByDir)
+
+	// 7 dailies (May 25-31), weeklies from the 3 weeks before (the newest
+	// week's Sunday is already a daily), and the last day of 12 months (May
+	// is already kept)
+	assert.Len(t, kept, 7+3+11)
+	assert.Equal(t, "daily", kept["sql/sales_20260531.bak"])
+	assert.Equal(t, "daily", kept["sql/sales_20260525.bak"])
+	assert.Equal(t, "weekly", kept["sql/sales_20260524.bak"])
+	assert.Equal(t, "weekly", kept["sql/sales_20260510.bak"])
+	assert.NotContains(t, kept, "sql/sales_20260503.bak")
+	assert.Equal(t, "monthly", kept["sql/sales_20260430.bak"])
+	assert.Equal(t, "monthly", kept["sql/sales_20250630.bak"])
+	assert.NotContains(t, kept, "sql/sales_20250531.bak")
+}
+
+func TestRetentionPolicy_KeepLastPerSeries(t *testing.T) {
+	newest := time.Date(2026, 5, 31, 2, 0, 0, 0, time.Local)
+	backups := append(dailyBackups("sql/full", newest, 5), dailyBackups("sql/log", newest, 5)...)
+
+	kept := RetentionPolicy{KeepLast: 2}.Retain(backups, SeriesByDir)
+
+	assert.Len(t, kept, 4)
+	assert.Contains(t, kept, "sql/full/sales_20260531.bak")
+	assert.Contains(t, kept, "sql/full/sales_20260530.bak")
+	assert.Contains(t, kept, "sql/log/sales_20260531.bak")
+	assert.Contains(t, kept, "sql/log/sales_20260530.bak")
+}
+
+func TestSeriesName(t *testing.T) {
+	tests := []struct {
+		key      string
+		mode     string
+		expected string
+	}{
+		{"sql/sales_20260131.bak", SeriesByDir, "sql"},
+		{"sales_20260131.bak", SeriesByDir, "."},
+		{"sql/sales_20260131.bak", SeriesByName, "sql/sales"},
+		{"sql/Sales_backup_2026_01_31_020000_1234567.bak", SeriesByName, "sql/Sales_backup"},
+		{"sql/db2-2026-01-31.bak", SeriesByName, "sql/db2"},
+		{"sql/master.bak", SeriesByName, "sql/master"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key+"/"+tt.mode, func(t *testing.T) {
+			assert.Equal(t, tt.expected, seriesName(tt.key, tt.mode))
+		})
+	}
+}
+
+func TestPrune_RetentionPolicy(t *testing.T) {
+	mockUploader := new(MockUploader)
+	mockLogger := NewMockLogger()
+
+	app := &cli.App{}
+	set := flag.NewFlagSet("test", 0)
+	set.Duration("age", 0, "doc")
+	set.Int("keep-last", 2, "doc")
+	set.String("series", SeriesByName, "doc")
+	ctx := cli.NewContext(app, set, nil)
+
+	now := time.Now()
+	files := map[string]time.Time{
+		"sales_20260103.bak":  now.Add(-24 * time.Hour),
+		"sales_20260102.bak":  now.Add(-48 * time.Hour),
+		"sales_20260101.bak":  now.Add(-72 * time.Hour),
+		"orders_20260101.bak": now.Add(-72 * time.Hour),
+	}
+	keys := make([]string, 0, len(files))
+	for key, modTime := range files {
+		keys = append(keys, key)
+		mockUploader.On("GetFileInfo", mock.Anything, key).Return(&FileInfo{LastModified: modTime}, nil)
+	}
+	mockUploader.On("List", mock.Anything, "").Return(keys, nil)
+	mockUploader.On("Delete", mock.Anything, "sales_20260101.bak").Return(nil)
+	mockLogger.On("Info", mock.Anything, mock.Anything).Return()
+
+	err := Prune(ctx, mockUploader, mockLogger)
+	assert.NoError(t, err)
+
+	// Only the oldest sales backup falls outside its series' last 2
+	mockUploader.AssertExpectations(t)
+	mockUploader.AssertNumberOfCalls(t, "Delete", 1)
+}
+
+func TestPrune_RetentionPolicyWithAge(t *testing.T) {
+	mockUploader := new(MockUploader)
+	mockLogger := NewMockLogger()
+
+	app := &cli.App{}
+	set := flag.NewFlagSet("test", 0)
+	set.Duration("age", 60*time.Hour, "doc")
+	set.Int("keep-last", 1, "doc")
+	ctx := cli.NewContext(app, set, nil)
+
+	now := time.Now()
+	files := map[string]time.Time{
+		"new.bak":    now.Add(-24 * time.Hour),
+		"recent.bak": now.Add(-48 * time.Hour),
+		"old.bak":    now.Add(-72 * time.Hour),
+	}
+	keys := make([]string, 0, len(files))
+	for key, modTime := range files {
+		keys = append(keys, key)
+		mockUploader.On("GetFileInfo", mock.Anything, key).Return(&FileInfo{LastModified: modTime}, nil)
+	}
+	mockUploader.On("List", mock.Anything, "").Return(keys, nil)
+	mockUploader.On("Delete", mock.Anything, "old.bak").Return(nil)
+	mockLogger.On("Info", mock.Anything, mock.Anything).Return()
+
+	err := Prune(ctx, mockUploader, mockLogger)
+	assert.NoError(t, err)
+
+	// recent.bak is not kept by the policy but is newer than --age
+	mockUploader.AssertExpectations(t)
+	mockUploader.AssertNumberOfCalls(t, "Delete", 1)
+}
+
+func TestPrune_MinKeep(t *testing.T) {
+	mockUploader := new(MockUploader)
+	mockLogger := NewMockLogger()
+
+	app := &cli.App{}
+	set := flag.NewFlagSet("test", 0)
+	set.Duration("age", 24*time.Hour, "doc")
+	set.Int("min-keep", 2, "doc")
+	ctx := cli.NewContext(app, set, nil)
+
+	// Backups stopped three days ago, so every file is past --age
+	now := time.Now()
+	files := map[string]time.Time{
+		"full/day3.bak": now.Add(-72 * time.Hour),
+		"full/day4.bak": now.Add(-96 * time.Hour),
+		"full/day5.bak": now.Add(-120 * time.Hour),
+		"log/day5.trn":  now.Add(-120 * time.Hour),
+	}
+	keys := make([]string, 0, len(files))
+	for key, modTime := range files {
+		keys = append(keys, key)
+		mockUploader.On("GetFileInfo", mock.Anything, key).Return(&FileInfo{LastModified: modTime}, nil)
+	}
+	mockUploader.On("List", mock.Anything, "").Return(keys, nil)
+	mockUploader.On("Delete", mock.Anything, "full/day5.bak").Return(nil)
+	mockLogger.On("Info", mock.Anything, mock.Anything).Return()
+
+	err := Prune(ctx, mockUploader, mockLogger)
+	assert.NoError(t, err)
+
+	mockUploader.AssertExpectations(t)
+	mockUploader.AssertNumberOfCalls(t, "Delete", 1)
+	mockLogger.AssertCalled(t, "Info", "Keeping file (retention policy)", []interface{}{"key", "log/day5.trn", "rule", "min-keep"})
+}
+
+func TestPrune_MaxDeleteAborts(t *testing.T) {
+	tests := []struct {
+		maxDelete string
+		aborted   bool
+	}{
+		{"2", true},
+		{"3", false},
+		{"50%", true},
+		{"75%", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.maxDelete, func(t *testing.T) {
+			mockUploader := new(MockUploader)
+			mockLogger := NewMockLogger()
+
+			app := &cli.App{}
+			set := flag.NewFlagSet("test", 0)
+			set.Duration("age", 24*time.Hour, "doc")
+			set.String("max-delete", tt.maxDelete, "doc")
+			ctx := cli.NewContext(app, set, nil)
+
+			// 3 of the 4 files are old enough to prune
+			keys := []string{"a.bak", "b.bak", "c.bak", "new.bak"}
+			mockUploader.On("List", mock.Anything, "").Return(keys, nil)
+			mockUploader.On("GetFileInfo", mock.Anything, "new.bak").Return(&FileInfo{LastModified: time.Now()}, nil)
+			mockUploader.On("GetFileInfo", mock.Anything, mock.Anything).Return(&FileInfo{LastModified: time.Now().Add(-48 * time.Hour)}, nil)
+			mockUploader.On("Delete", mock.Anything, mock.Anything).Return(nil)
+			mockLogger.On("Info", mock.Anything, mock.Anything).Return()
+			mockLogger.On("Error", mock.Anything, mock.Anything).Return()
+
+			err := Prune(ctx, mockUploader, mockLogger)
+			if tt.aborted {
+				assert.ErrorContains(t, err, "Refusing to delete 3 of 4 files")
+				mockUploader.AssertNotCalled(t, "Delete", mock.Anything, mock.Anything)
+			} else {
+				assert.NoError(t, err)
+				mockUploader.AssertNumberOfCalls(t, "Delete", 3)
+			}
+		})
+	}
+}
+
+func TestParseDeleteLimit(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected int
+		wantErr  bool
+	}{
+		{"", -1, false},
+		{"0", 0, false},
+		{"50", 50, false},
+		{"25%", 5, false},
+		{"12.5%", 2, false},
+		{"150%", 0, true},
+		{"-1", 0, true},
+		{"lots", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			limit, err := parseDeleteLimit(tt.value, 20)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, limit)
+		})
+	}
+}
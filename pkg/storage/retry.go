@@ -0,0 +1,199 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"math/rand/v2"
+	"time"
+
+	"github.com/ngns-io/baxfer/pkg/logger"
+	"github.com/urfave/cli/v2"
+)
+
+// maxRetryBackoff caps the delay between attempts, however many retries are
+// allowed
+const maxRetryBackoff = 5 * time.Minute
+
+// RetryPolicy is how requests that fail with a transient error are repeated.
+// The delay before each retry doubles, starting at Backoff, with random
+// jitter so that parallel uploads do not retry in step.
+type RetryPolicy struct {
+	Retries int           // attempts after the first; zero disables retries
+	Backoff time.Duration // delay before the first retry
+}
+
+// RetryPolicyFromFlags returns the policy set by --retries and --retry-backoff
+func RetryPolicyFromFlags(c *cli.Context) RetryPolicy {
+	return RetryPolicy{
+		Retries: c.Int("retries"),
+		Backoff: c.Duration("retry-backoff"),
+	}
+}
+
+// retryable reports whether a request that failed with err on the given
+// attempt, counting from zero, should be made again
+func (p RetryPolicy) retryable(attempt int, err error) bool {
+	return attempt < p.Retries && isTransientError(err)
+}
+
+// delay returns the time to wait after the given attempt: half the backoff
+// for that attempt plus a random part of the other half
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	d := p.Backoff
+	for i := 0; i < attempt && d < maxRetryBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, maxRetryBackoff)
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// wait sleeps before the attempt after the given one, returning early if ctx
+// is canceled
+func (p RetryPolicy) wait(ctx context.Context, attempt int) error {
+	timer := time.NewTimer(p.delay(attempt))
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// do calls fn until it succeeds, fails with a permanent error or runs out of
+// retries, and returns its last error
+func (p RetryPolicy) do(ctx context.Context, log logger.Logger, op, key string, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || !p.retryable(attempt, err) {
+			return err
+		}
+		log.Warn("Retrying after transient error", "operation", op, "key", key,
+			"retry", attempt+1, "retries", p.Retries, "error", err)
+		if err := p.wait(ctx, attempt); err != nil {
+			return err
+		}
+	}
+}
+
+// retryUploader repeats the requests of an uploader that fail with a
+// transient error.
+//
+// Uploads are not repeated here: their reader is usually a stream of
+// compressed or encrypted data that cannot be read a second time, so Upload
+// repeats whole files instead, reopening them from disk.
+type retryUploader struct {
+	Uploader
+	policy RetryPolicy
+	log    logger.Logger
+}
+
+// WithRetry returns an uploader that repeats requests failing with transient
+// errors according to policy
+func WithRetry(uploader Uploader, policy RetryPolicy, log logger.Logger) Uploader {
+	if policy.Retries <= 0 {
+		return uploader
+	}
+	return &retryUploader{Uploader: uploader, policy: policy, log: log}
+}
+
+// Download carries on from the last byte written when the provider can
+// download ranges. Otherwise it is repeated only until data has been written,
+// since the writer cannot be rewound.
+func (r *retryUploader) Download(ctx context.Context, key string, writer io.Writer) error {
+	ranged := rangeDownloader(r.Uploader)
+	counter := &countingWriter{w: writer}
+	return r.policy.do(ctx, r.log, "download", key, func() error {
+		if counter.n > 0 && ranged != nil {
+			return ranged.DownloadRange(ctx, key, counter.n, -1, counter)
+		}
+		err := r.Uploader.Download(ctx, key, counter)
+		if err != nil && counter.n > 0 && ranged == nil {
+			return &partialDownloadError{err: err}
+		}
+		return err
+	})
+}
+
+// DownloadRange carries on from the last byte written. It is only called
+// when rangeDownloader finds that the provider can download ranges.
+func (r *retryUploader) DownloadRange(ctx context.Context, key string, offset, length int64, writer io.Writer) error {
+	ranged := rangeDownloader(r.Uploader)
+	counter := &countingWriter{w: writer}
+	return r.policy.do(ctx, r.log, "download", key, func() error {
+		remaining := length
+		if length >= 0 {
+			if counter.n >= length {
+				return nil
+			}
+			remaining = length - counter.n
+		}
+		return ranged.DownloadRange(ctx, key, offset+counter.n, remaining, counter)
+	})
+}
+
+func (r *retryUploader) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := r.policy.do(ctx, r.log, "list", prefix, func() error {
+		var err error
+		keys, err = r.Uploader.List(ctx, prefix)
+		return err
+	})
+	return keys, err
+}
+
+func (r *retryUploader) Delete(ctx context.Context, key string) error {
+	return r.policy.do(ctx, r.log, "delete", key, func() error {
+		return r.Uploader.Delete(ctx, key)
+	})
+}
+
+func (r *retryUploader) FileExists(ctx context.Context, key string) (bool, error) {
+	var exists bool
+	err := r.policy.do(ctx, r.log, "exists", key, func() error {
+		var err error
+		exists, err = r.Uploader.FileExists(ctx, key)
+		return err
+	})
+	return exists, err
+}
+
+func (r *retryUploader) GetFileInfo(ctx context.Context, key string) (*FileInfo, error) {
+	var info *FileInfo
+	err := r.policy.do(ctx, r.log, "stat", key, func() error {
+		var err error
+		info, err = r.Uploader.GetFileInfo(ctx, key)
+		return err
+	})
+	return info, err
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// partialDownloadError is a download that failed after writing data, which
+// cannot be repeated
+type partialDownloadError struct {
+	err error
+}
+
+func (e *partialDownloadError) Error() string {
+	return e.err.Error()
+}
+
+func (e *partialDownloadError) Unwrap() error {
+	return e.err
+}
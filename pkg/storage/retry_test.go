@@ -0,0 +1,186 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsTransientError(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		transient bool
+	}{
+		{"connection reset", fmt.Errorf("write: %w", syscall.ECONNRESET), true},
+		{"sftp connection lost", sftp.ErrSSHFxConnectionLost, true},
+		{"unexpected EOF", io.ErrUnexpectedEOF, true},
+		{"deadline", context.DeadlineExceeded, true},
+		{"azure throttled", &azcore.ResponseError{StatusCode: 429}, true},
+		{"gcs unavailable", &gcsError{StatusCode: 503}, true},
+		{"webdav not found", &webdavError{StatusCode: 404}, false},
+		{"gcs forbidden", &gcsError{StatusCode: 403}, false},
+		{"ftp service unavailable", &textproto.Error{Code: 421, Msg: "closing"}, true},
+		{"ftp file unavailable", &textproto.Error{Code: 550, Msg: "no such file"}, false},
+		{"timeout message", errors.New("b2: request timed out"), true},
+		{"canceled", context.Canceled, false},
+		{"other", errors.New("invalid key"), false},
+		{"partial download", &partialDownloadError{err: io.ErrUnexpectedEOF}, false},
+		{"fan-out transient", &DestinationError{Failed: map[string]error{"a": io.EOF, "b": &gcsError{StatusCode: 500}}}, true},
+		{"fan-out mixed", &DestinationError{Failed: map[string]error{"a": io.EOF, "b": &gcsError{StatusCode: 404}}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.transient, isTransientError(tt.err))
+		})
+	}
+}
+
+func TestRetryPolicy_Delay(t *testing.T) {
+	p := RetryPolicy{Retries: 10, Backoff: time.Second}
+	for attempt, base := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		d := p.delay(attempt)
+		assert.GreaterOrEqual(t, d, base/2)
+		assert.LessOrEqual(t, d, base)
+	}
+	assert.LessOrEqual(t, p.delay(30), maxRetryBackoff)
+}
+
+func newRetryLogger() *MockLogger {
+	mockLogger := NewMockLogger()
+	mockLogger.On("Info", mock.Anything, mock.Anything).Return()
+	mockLogger.On("Warn", mock.Anything, mock.Anything).Return()
+	mockLogger.On("Error", mock.Anything, mock.Anything).Return()
+	return mockLogger
+}
+
+func TestRetryUploader(t *testing.T) {
+	ctx := context.Background()
+	policy := RetryPolicy{Retries: 2, Backoff: time.Millisecond}
+
+	mockUploader := new(MockUploader)
+	mockUploader.On("FileExists", mock.Anything, "a.bak").Return(false, io.ErrUnexpectedEOF).Twice()
+	mockUploader.On("FileExists", mock.Anything, "a.bak").Return(true, nil).Once()
+	mockUploader.On("GetFileInfo", mock.Anything, "b.bak").Return((*FileInfo)(nil), &gcsError{StatusCode: 404}).Once()
+	mockUploader.On("Delete", mock.Anything, "c.bak").Return(syscall.ECONNRESET).Times(3)
+	uploader := WithRetry(mockUploader, policy, newRetryLogger())
+
+	exists, err := uploader.FileExists(ctx, "a.bak")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	// Permanent errors are returned at once, and retries run out
+	_, err = uploader.GetFileInfo(ctx, "b.bak")
+	assert.Error(t, err)
+	assert.ErrorIs(t, uploader.Delete(ctx, "c.bak"), syscall.ECONNRESET)
+	mockUploader.AssertExpectations(t)
+
+	assert.Same(t, mockUploader, WithRetry(mockUploader, RetryPolicy{}, newRetryLogger()))
+}
+
+func TestRetryUploader_PartialDownload(t *testing.T) {
+	mockUploader := new(MockUploader)
+	mockUploader.On("Download", mock.Anything, "a.bak", mock.Anything).Run(func(args mock.Arguments) {
+		_, err := args.Get(2).(io.Writer).Write([]byte("part"))
+		require.NoError(t, err)
+	}).Return(io.ErrUnexpectedEOF).Once()
+	uploader := WithRetry(mockUploader, RetryPolicy{Retries: 3, Backoff: time.Millisecond}, newRetryLogger())
+
+	// What was written cannot be taken back, so the download is not repeated
+	var buf bytes.Buffer
+	err := uploader.Download(context.Background(), "a.bak", &buf)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.Equal(t, "part", buf.String())
+	mockUploader.AssertExpectations(t)
+}
+
+// flakyUploader fails its first uploads after reading part of the stream,
+// like a connection dropped mid-transfer
+type flakyUploader struct {
+	Uploader
+	mu       sync.Mutex
+	failures int
+	attempts int
+}
+
+func (f *flakyUploader) Upload(ctx context.Context, key string, reader io.Reader, size int64) error {
+	f.mu.Lock()
+	f.attempts++
+	fail := f.attempts <= f.failures
+	f.mu.Unlock()
+
+	if fail {
+		if _, err := io.CopyN(io.Discard, reader, 4); err != nil {
+			return err
+		}
+		return fmt.Errorf("write: %w", syscall.ECONNRESET)
+	}
+	return f.Uploader.Upload(ctx, key, reader, size)
+}
+
+func TestUpload_RetriesWholeFile(t *testing.T) {
+	local, basePath := newTestLocalUploader(t)
+	rootDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "sales.bak"), []byte("sales data"), 0644))
+
+	flaky := &flakyUploader{Uploader: local, failures: 2}
+	require.NoError(t, Upload(newUploadContext(t, io.Discard, "--checksum", "--retries", "2", "--compress", CompressGzip, rootDir), flaky, newRetryLogger()))
+	assert.Equal(t, 4, flaky.attempts, "two failures, the file and its checksum")
+
+	// The compressed stream was rebuilt from the file for the last attempt
+	result, _, err := verifyKey(context.Background(), local, "sales.bak.gz")
+	require.NoError(t, err)
+	assert.Equal(t, verifyOK, result)
+	assert.FileExists(t, filepath.Join(basePath, "sales.bak.gz"))
+}
+
+func TestUpload_RetriesRunOut(t *testing.T) {
+	local, _ := newTestLocalUploader(t)
+	rootDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "sales.bak"), []byte("sales data"), 0644))
+
+	flaky := &flakyUploader{Uploader: local, failures: 5}
+	err := Upload(newUploadContext(t, io.Discard, "--checksum", "--retries", "1", "--compress", CompressNone, rootDir), flaky, newRetryLogger())
+	assert.ErrorIs(t, err, syscall.ECONNRESET)
+	assert.Equal(t, 2, flaky.attempts)
+}
+
+func TestUpload_RetriesFailedDestinationsOnly(t *testing.T) {
+	steady, _ := newTestLocalUploader(t)
+	local, _ := newTestLocalUploader(t)
+	rootDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "sales.bak"), []byte("sales data"), 0644))
+
+	counted := &flakyUploader{Uploader: steady}
+	flaky := &flakyUploader{Uploader: local, failures: 1}
+	multi := newTestMultiUploader(t,
+		Destination{Name: "steady", Uploader: counted},
+		Destination{Name: "flaky", Uploader: flaky},
+	)
+	require.NoError(t, Upload(newUploadContext(t, io.Discard, "--checksum", "--retries", "3", "--compress", CompressNone, rootDir), multi, newRetryLogger()))
+
+	// Counts include each destination's checksum upload
+	assert.Equal(t, 2, counted.attempts)
+	assert.Equal(t, 3, flaky.attempts)
+	for _, u := range []Uploader{steady, local} {
+		result, _, err := verifyKey(context.Background(), u, "sales.bak")
+		require.NoError(t, err)
+		assert.Equal(t, verifyOK, result)
+	}
+}
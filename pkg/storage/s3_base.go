@@ -1,15 +1,22 @@
 package storage
 
 import (
+	"bytes"
 	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"strings"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
 	"github.com/ngns-io/baxfer/pkg/logger"
 )
 
@@ -38,11 +45,38 @@ func NewS3CompatibleUploader(client *s3.Client, bucket, providerName string, log
 	}
 }
 
+// upload sends input with the multipart uploader or, when the upload is to
+// be resumable, as a multipart upload that a later run can resume if it is
+// interrupted
+func (u *S3CompatibleUploader) upload(ctx context.Context, input *s3.PutObjectInput) error {
+	input.Metadata = uploadMetadataFrom(ctx)
+	store := multipartStoreFrom(ctx)
+	if store == nil {
+		_, err := u.Uploader.Upload(ctx, input)
+		return err
+	}
+
+	size := int64(-1)
+	if input.ContentLength != nil && *input.ContentLength >= 0 {
+		size = *input.ContentLength
+	}
+	target := &s3Multipart{uploader: u, input: input}
+	return resumableUpload(ctx, target, store, *input.Key, input.Body, size, u.Uploader.PartSize, u.Uploader.Concurrency, u.Log)
+}
+
 func (u *S3CompatibleUploader) Download(ctx context.Context, key string, writer io.Writer) error {
-	output, err := u.Client.GetObject(ctx, &s3.GetObjectInput{
+	return u.DownloadRange(ctx, key, 0, -1, writer)
+}
+
+func (u *S3CompatibleUploader) DownloadRange(ctx context.Context, key string, offset, length int64, writer io.Writer) error {
+	input := &s3.GetObjectInput{
 		Bucket: &u.Bucket,
 		Key:    &key,
-	})
+	}
+	if offset > 0 || length >= 0 {
+		input.Range = aws.String(httpRange(offset, length))
+	}
+	output, err := u.Client.GetObject(ctx, input)
 	if err != nil {
 		return formatDownloadError(u.ProviderName, key, err)
 	}
@@ -108,10 +142,14 @@ func (u *S3CompatibleUploader) FileExists(ctx context.Context, key string) (bool
 	return true, nil
 }
 
+// storesMetadata marks S3-compatible providers as keeping user metadata
+func (u *S3CompatibleUploader) storesMetadata() {}
+
 func (u *S3CompatibleUploader) GetFileInfo(ctx context.Context, key string) (*FileInfo, error) {
 	output, err := u.Client.HeadObject(ctx, &s3.HeadObjectInput{
-		Bucket: &u.Bucket,
-		Key:    &key,
+		Bucket:       &u.Bucket,
+		Key:          &key,
+		ChecksumMode: types.ChecksumModeEnabled,
 	})
 	if err != nil {
 		return nil, err
@@ -124,5 +162,143 @@ func (u *S3CompatibleUploader) GetFileInfo(ctx context.Context, key string) (*Fi
 	return &FileInfo{
 		LastModified: *output.LastModified,
 		Size:         *output.ContentLength,
+		Metadata:     output.Metadata,
+		Checksums:    s3Checksums(output),
 	}, nil
 }
+
+// s3Checksums returns the checksums S3 computed for an object: the CRC32 of
+// the whole object, which multipart uploads only have if it was sent with
+// them, and the MD5, which is the ETag of objects uploaded in one request
+// unless they are encrypted with KMS or a key of the customer's
+func s3Checksums(output *s3.HeadObjectOutput) map[string]string {
+	checksums := make(map[string]string)
+	etag := strings.ToLower(strings.Trim(aws.ToString(output.ETag), `"`))
+	multipart := strings.Contains(etag, "-")
+
+	if output.ChecksumType == types.ChecksumTypeFullObject || (output.ChecksumType == "" && !multipart) {
+		if sum, err := base64.StdEncoding.DecodeString(aws.ToString(output.ChecksumCRC32)); err == nil && len(sum) == crc32.Size {
+			checksums[ChecksumCRC32] = hex.EncodeToString(sum)
+		}
+	}
+
+	kms := output.ServerSideEncryption == types.ServerSideEncryptionAwsKms ||
+		output.ServerSideEncryption == types.ServerSideEncryptionAwsKmsDsse
+	if _, err := hex.DecodeString(etag); err == nil && len(etag) == md5.Size*2 && !kms && output.SSECustomerAlgorithm == nil {
+		checksums[ChecksumMD5] = etag
+	}
+	return checksums
+}
+
+// s3Multipart is the multipart upload API of an S3-compatible provider, for
+// the key and settings of input
+type s3Multipart struct {
+	uploader *S3CompatibleUploader
+	input    *s3.PutObjectInput
+}
+
+func (m *s3Multipart) put(ctx context.Context, data []byte) error {
+	input := *m.input
+	input.Body = bytes.NewReader(data)
+	input.ContentLength = aws.Int64(int64(len(data)))
+	_, err := m.uploader.Client.PutObject(ctx, &input)
+	return err
+}
+
+func (m *s3Multipart) start(ctx context.Context) (string, error) {
+	output, err := m.uploader.Client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:            m.input.Bucket,
+		Key:               m.input.Key,
+		ChecksumAlgorithm: m.input.ChecksumAlgorithm,
+		Metadata:          m.input.Metadata,
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(output.UploadId), nil
+}
+
+func (m *s3Multipart) listParts(ctx context.Context, uploadID string) (map[int]string, error) {
+	tags := make(map[int]string)
+	paginator := s3.NewListPartsPaginator(m.uploader.Client, &s3.ListPartsInput{
+		Bucket:   m.input.Bucket,
+		Key:      m.input.Key,
+		UploadId: &uploadID,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			if isNoSuchUploadError(err) {
+				return nil, errUploadGone
+			}
+			return nil, err
+		}
+		for _, part := range page.Parts {
+			tags[int(aws.ToInt32(part.PartNumber))] = aws.ToString(part.ETag)
+		}
+	}
+	return tags, nil
+}
+
+func (m *s3Multipart) uploadPart(ctx context.Context, uploadID string, number int, data []byte) (multipartPart, error) {
+	output, err := m.uploader.Client.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:            m.input.Bucket,
+		Key:               m.input.Key,
+		UploadId:          &uploadID,
+		PartNumber:        aws.Int32(int32(number)),
+		Body:              bytes.NewReader(data),
+		ContentLength:     aws.Int64(int64(len(data))),
+		ChecksumAlgorithm: m.input.ChecksumAlgorithm,
+	})
+	if err != nil {
+		return multipartPart{}, err
+	}
+	return multipartPart{Tag: aws.ToString(output.ETag), Checksum: aws.ToString(output.ChecksumCRC32)}, nil
+}
+
+func (m *s3Multipart) complete(ctx context.Context, uploadID string, parts []multipartPart) error {
+	completed := make([]types.CompletedPart, 0, len(parts))
+	for _, p := range parts {
+		part := types.CompletedPart{
+			ETag:       aws.String(p.Tag),
+			PartNumber: aws.Int32(int32(p.Number)),
+		}
+		if p.Checksum != "" {
+			part.ChecksumCRC32 = aws.String(p.Checksum)
+		}
+		completed = append(completed, part)
+	}
+
+	_, err := m.uploader.Client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          m.input.Bucket,
+		Key:             m.input.Key,
+		UploadId:        &uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+	return err
+}
+
+func (m *s3Multipart) abort(ctx context.Context, uploadID string) error {
+	_, err := m.uploader.Client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   m.input.Bucket,
+		Key:      m.input.Key,
+		UploadId: &uploadID,
+	})
+	if isNoSuchUploadError(err) {
+		return errUploadGone
+	}
+	return err
+}
+
+// isNoSuchUploadError reports whether an error means that a multipart upload
+// was completed, aborted or expired
+func isNoSuchUploadError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var noSuchUpload *types.NoSuchUpload
+	var apiErr smithy.APIError
+	return errors.As(err, &noSuchUpload) ||
+		(errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchUpload") ||
+		isNotFoundError(err)
+}
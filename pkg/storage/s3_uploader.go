@@ -3,7 +3,6 @@ package storage
 import (
 	"context"
 	"io"
-	"os"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -16,18 +15,17 @@ type S3Uploader struct {
 	*S3CompatibleUploader
 }
 
-func NewS3Uploader(region, bucket string, log logger.Logger) (*S3Uploader, error) {
+func NewS3Uploader(region, bucket string, creds Credentials, log logger.Logger) (*S3Uploader, error) {
 	// Use provided region, or AWS_REGION env var, or default to us-east-1
 	if region == "" {
-		region = os.Getenv("AWS_REGION")
+		region = creds.Get("AWS_REGION")
 		if region == "" {
 			region = "us-east-1"
 		}
 	}
 
-	cfg, err := config.LoadDefaultConfig(context.Background(),
-		config.WithRegion(region),
-	)
+	opts := append(creds.awsOptions(), config.WithRegion(region))
+	cfg, err := config.LoadDefaultConfig(context.Background(), opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -54,12 +52,11 @@ func NewS3Uploader(region, bucket string, log logger.Logger) (*S3Uploader, error
 }
 
 func (u *S3Uploader) Upload(ctx context.Context, key string, reader io.Reader, size int64) error {
-	_, err := u.Uploader.Upload(ctx, &s3.PutObjectInput{
+	return u.upload(ctx, &s3.PutObjectInput{
 		Bucket:            &u.Bucket,
 		Key:               &key,
 		Body:              reader,
 		ContentLength:     aws.Int64(size),
 		ChecksumAlgorithm: types.ChecksumAlgorithmCrc32,
 	})
-	return err
 }
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/ngns-io/baxfer/pkg/logger"
+)
+
+// S3CompatConfig holds the connection settings for a generic S3-compatible
+// endpoint such as MinIO, Wasabi or Ceph RGW.
+type S3CompatConfig struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	PathStyle bool
+	CABundle  string // optional PEM file with additional trusted CAs
+}
+
+// GenericS3Uploader uploads to any S3-compatible endpoint (the s3compat provider)
+type GenericS3Uploader struct {
+	*S3CompatibleUploader
+}
+
+func NewGenericS3Uploader(cfg S3CompatConfig, creds Credentials, log logger.Logger) (*GenericS3Uploader, error) {
+	if cfg.Endpoint == "" {
+		return nil, fmt.Errorf("no endpoint provided for S3-compatible storage")
+	}
+
+	// Most S3-compatible servers ignore the region, but requests still have to be signed for one
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+
+	opts := []func(*config.LoadOptions) error{
+		config.WithRegion(cfg.Region),
+		// Only send and validate checksums when the operation requires them;
+		// many S3-compatible servers reject the newer flexible checksum headers
+		config.WithRequestChecksumCalculation(aws.RequestChecksumCalculationWhenRequired),
+		config.WithResponseChecksumValidation(aws.ResponseChecksumValidationWhenRequired),
+	}
+
+	// Fall back to the AWS credentials given, then the default AWS credential
+	// chain, when no keys are given
+	opts = append(opts, creds.awsOptions()...)
+	if cfg.AccessKey != "" || cfg.SecretKey != "" {
+		if cfg.AccessKey == "" || cfg.SecretKey == "" {
+			return nil, fmt.Errorf("both access key and secret key are required for S3-compatible storage")
+		}
+		opts = append(opts, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
+			cfg.AccessKey, cfg.SecretKey, "",
+		)))
+	}
+
+	if cfg.CABundle != "" {
+		caBundle, err := os.Open(cfg.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA bundle: %w", err)
+		}
+		defer caBundle.Close()
+		opts = append(opts, config.WithCustomCABundle(caBundle))
+	}
+
+	awsCfg, err := config.LoadDefaultConfig(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		o.BaseEndpoint = aws.String(cfg.Endpoint)
+		o.UsePathStyle = cfg.PathStyle
+	})
+
+	uploader := &GenericS3Uploader{
+		S3CompatibleUploader: NewS3CompatibleUploader(
+			client,
+			cfg.Bucket,
+			"s3compat",
+			log,
+			100*1024*1024, // 100MB part size
+			5,             // concurrency
+		),
+	}
+
+	log.Info("Initialized storage provider",
+		"provider", "S3-compatible",
+		"endpoint", cfg.Endpoint,
+		"region", cfg.Region,
+		"pathStyle", cfg.PathStyle,
+		"bucket", cfg.Bucket)
+
+	return uploader, nil
+}
+
+func (u *GenericS3Uploader) Upload(ctx context.Context, key string, reader io.Reader, size int64) error {
+	input := &s3.PutObjectInput{
+		Bucket:        &u.Bucket,
+		Key:           &key,
+		Body:          reader,
+		ContentLength: aws.Int64(size),
+	}
+
+	return u.upload(ctx, input)
+}
@@ -8,6 +8,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ngns-io/baxfer/pkg/logger"
@@ -15,19 +16,25 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
+// SFTPUploader stores files on an SFTP server. A dropped connection is
+// re-established by the next request, so retries can succeed.
 type SFTPUploader struct {
+	addr     string
+	config   *ssh.ClientConfig
+	basePath string
+	log      logger.Logger
+
+	mu        sync.Mutex // guards the clients while reconnecting
 	client    *sftp.Client
 	sshClient *ssh.Client
-	basePath  string
-	log       logger.Logger
 }
 
-func NewSFTPUploader(host string, port int, username, basePath string, log logger.Logger) (*SFTPUploader, error) {
-	// Get authentication method from environment
+func NewSFTPUploader(host string, port int, username, basePath string, creds Credentials, log logger.Logger) (*SFTPUploader, error) {
+	// Get authentication method from the credentials or environment
 	var authMethod ssh.AuthMethod
 
-	privateKeyPath := os.Getenv("SFTP_PRIVATE_KEY")
-	password := os.Getenv("SFTP_PASSWORD")
+	privateKeyPath := creds.Get("SFTP_PRIVATE_KEY")
+	password := creds.Get("SFTP_PASSWORD")
 
 	if privateKeyPath != "" {
 		key, err := os.ReadFile(privateKeyPath)
@@ -56,35 +63,26 @@ func NewSFTPUploader(host string, port int, username, basePath string, log logge
 		Timeout:         30 * time.Second,
 	}
 
-	// Connect to SSH server
-	sshClient, err := ssh.Dial("tcp", fmt.Sprintf("%s:%d", host, port), config)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to SSH server: %w", err)
+	uploader := &SFTPUploader{
+		addr:     fmt.Sprintf("%s:%d", host, port),
+		config:   config,
+		basePath: basePath,
+		log:      log,
 	}
-
-	// Create SFTP client
-	sftpClient, err := sftp.NewClient(sshClient)
+	sftpClient, err := uploader.connect()
 	if err != nil {
-		sshClient.Close()
-		return nil, fmt.Errorf("failed to create SFTP client: %w", err)
+		return nil, err
 	}
 
 	// Create base directory if it doesn't exist
 	if err := sftpClient.MkdirAll(basePath); err != nil {
-		cleanupErr := errors.Join(sftpClient.Close(), sshClient.Close())
+		cleanupErr := uploader.Close()
 		if cleanupErr != nil {
 			return nil, errors.Join(fmt.Errorf("failed to create base directory: %w", err), cleanupErr)
 		}
 		return nil, fmt.Errorf("failed to create base directory: %w", err)
 	}
 
-	uploader := &SFTPUploader{
-		client:    sftpClient,
-		sshClient: sshClient,
-		basePath:  basePath,
-		log:       log,
-	}
-
 	log.Info("Initialized storage provider",
 		"provider", "SFTP",
 		"host", host,
@@ -95,21 +93,75 @@ func NewSFTPUploader(host string, port int, username, basePath string, log logge
 	return uploader, nil
 }
 
-func (u *SFTPUploader) Upload(ctx context.Context, key string, reader io.Reader, size int64) error {
+// connect returns the SFTP client, connecting to the server if there is no
+// open connection
+func (u *SFTPUploader) connect() (*sftp.Client, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.client != nil {
+		return u.client, nil
+	}
+
+	// Connect to SSH server
+	sshClient, err := ssh.Dial("tcp", u.addr, u.config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to SSH server: %w", err)
+	}
+
+	// Create SFTP client
+	sftpClient, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, fmt.Errorf("failed to create SFTP client: %w", err)
+	}
+
+	u.client, u.sshClient = sftpClient, sshClient
+	return sftpClient, nil
+}
+
+// checkConnection closes client if err shows its connection was dropped, so
+// the next request reconnects
+func (u *SFTPUploader) checkConnection(client *sftp.Client, err error) {
+	if err == nil || !isConnectionError(err) {
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	// Another request may already have replaced the connection
+	if u.client != client {
+		return
+	}
+	u.log.Warn("SFTP connection lost, reconnecting on the next request", "addr", u.addr, "error", err)
+	if closeErr := errors.Join(u.client.Close(), u.sshClient.Close()); closeErr != nil {
+		u.log.Debug("Error closing lost SFTP connection", "error", closeErr)
+	}
+	u.client, u.sshClient = nil, nil
+}
+
+func (u *SFTPUploader) Upload(ctx context.Context, key string, reader io.Reader, size int64) (err error) {
 	if err := ctx.Err(); err != nil {
 		return err
 	}
 
+	client, err := u.connect()
+	if err != nil {
+		return err
+	}
+	defer func() { u.checkConnection(client, err) }()
+
 	fullPath := filepath.Join(u.basePath, key)
 	dir := filepath.Dir(fullPath)
 
 	// Ensure directory exists
-	if err := u.client.MkdirAll(dir); err != nil {
+	if err := client.MkdirAll(dir); err != nil {
 		return fmt.Errorf("failed to create directory structure: %w", err)
 	}
 
 	// Create remote file
-	dstFile, err := u.client.Create(fullPath)
+	dstFile, err := client.Create(fullPath)
 	if err != nil {
 		return fmt.Errorf("failed to create remote file: %w", err)
 	}
@@ -121,13 +173,23 @@ func (u *SFTPUploader) Upload(ctx context.Context, key string, reader io.Reader,
 }
 
 func (u *SFTPUploader) Download(ctx context.Context, key string, writer io.Writer) error {
+	return u.DownloadRange(ctx, key, 0, -1, writer)
+}
+
+func (u *SFTPUploader) DownloadRange(ctx context.Context, key string, offset, length int64, writer io.Writer) (err error) {
 	if err := ctx.Err(); err != nil {
 		return err
 	}
 
+	client, err := u.connect()
+	if err != nil {
+		return formatSFTPError(key, err)
+	}
+	defer func() { u.checkConnection(client, err) }()
+
 	fullPath := filepath.Join(u.basePath, key)
 
-	srcFile, err := u.client.Open(fullPath)
+	srcFile, err := client.Open(fullPath)
 	if err != nil {
 		// Log the original error for debugging
 		u.log.Error("Failed to open remote file",
@@ -151,7 +213,11 @@ func (u *SFTPUploader) Download(ctx context.Context, key string, writer io.Write
 	}
 	defer srcFile.Close()
 
-	_, err = io.Copy(writer, srcFile)
+	reader, err := seekRange(srcFile, offset, length)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, reader)
 	if err != nil {
 		u.log.Error("Failed to copy file content",
 			"path", fullPath,
@@ -166,15 +232,20 @@ func (u *SFTPUploader) Download(ctx context.Context, key string, writer io.Write
 	return nil
 }
 
-func (u *SFTPUploader) List(ctx context.Context, prefix string) ([]string, error) {
+func (u *SFTPUploader) List(ctx context.Context, prefix string) (keys []string, err error) {
 	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
 
+	client, err := u.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { u.checkConnection(client, err) }()
+
 	searchPath := filepath.Join(u.basePath, prefix)
-	var keys []string
 
-	walker := u.client.Walk(searchPath)
+	walker := client.Walk(searchPath)
 	for walker.Step() {
 		// Check for context cancellation during walk
 		if err := ctx.Err(); err != nil {
@@ -198,22 +269,34 @@ func (u *SFTPUploader) List(ctx context.Context, prefix string) ([]string, error
 	return keys, nil
 }
 
-func (u *SFTPUploader) Delete(ctx context.Context, key string) error {
+func (u *SFTPUploader) Delete(ctx context.Context, key string) (err error) {
 	if err := ctx.Err(); err != nil {
 		return err
 	}
 
+	client, err := u.connect()
+	if err != nil {
+		return err
+	}
+	defer func() { u.checkConnection(client, err) }()
+
 	fullPath := filepath.Join(u.basePath, key)
-	return u.client.Remove(fullPath)
+	return client.Remove(fullPath)
 }
 
-func (u *SFTPUploader) FileExists(ctx context.Context, key string) (bool, error) {
+func (u *SFTPUploader) FileExists(ctx context.Context, key string) (exists bool, err error) {
 	if err := ctx.Err(); err != nil {
 		return false, err
 	}
 
+	client, err := u.connect()
+	if err != nil {
+		return false, err
+	}
+	defer func() { u.checkConnection(client, err) }()
+
 	fullPath := filepath.Join(u.basePath, key)
-	_, err := u.client.Stat(fullPath)
+	_, err = client.Stat(fullPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return false, nil
@@ -223,13 +306,19 @@ func (u *SFTPUploader) FileExists(ctx context.Context, key string) (bool, error)
 	return true, nil
 }
 
-func (u *SFTPUploader) GetFileInfo(ctx context.Context, key string) (*FileInfo, error) {
+func (u *SFTPUploader) GetFileInfo(ctx context.Context, key string) (info *FileInfo, err error) {
 	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
 
+	client, err := u.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { u.checkConnection(client, err) }()
+
 	fullPath := filepath.Join(u.basePath, key)
-	stat, err := u.client.Stat(fullPath)
+	stat, err := client.Stat(fullPath)
 	if err != nil {
 		return nil, err
 	}
@@ -241,5 +330,13 @@ func (u *SFTPUploader) GetFileInfo(ctx context.Context, key string) (*FileInfo,
 }
 
 func (u *SFTPUploader) Close() error {
-	return errors.Join(u.client.Close(), u.sshClient.Close())
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.client == nil {
+		return nil
+	}
+	err := errors.Join(u.client.Close(), u.sshClient.Close())
+	u.client, u.sshClient = nil, nil
+	return err
 }
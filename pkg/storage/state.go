@@ -0,0 +1,292 @@
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/ngns-io/baxfer/pkg/logger"
+	"github.com/urfave/cli/v2"
+	bolt "go.etcd.io/bbolt"
+)
+
+// stateFile is the name of the state database in its default directory
+const stateFile = "baxfer-state.db"
+
+// Buckets of the state database
+var (
+	stateUploadsBucket   = []byte("uploads")   // latest upload of each key, by destination
+	stateHistoryBucket   = []byte("history")   // every upload, in order
+	stateMultipartBucket = []byte("multipart") // interrupted multipart uploads, by destination
+)
+
+// stateLockTimeout is how long to wait for another baxfer process that has
+// the state database open
+const stateLockTimeout = 5 * time.Second
+
+// UploadRecord is an upload recorded in the state database
+type UploadRecord struct {
+	UploadedAt   time.Time `json:"uploaded_at"`
+	Destination  string    `json:"destination"`
+	Key          string    `json:"key"`
+	Path         string    `json:"path"`
+	Size         int64     `json:"size"`
+	ModTime      time.Time `json:"mod_time"`
+	SHA256       string    `json:"sha256,omitempty"`        // the file as stored
+	SourceSHA256 string    `json:"source_sha256,omitempty"` // the local file, when compressed or encrypted
+}
+
+// stateDB is the local state database. It records what was uploaded to each
+// destination, so unchanged files can be skipped without asking the
+// provider, and keeps the upload history shown by baxfer history.
+type stateDB struct {
+	db *bolt.DB
+}
+
+// defaultStatePath returns the state database used when --state-file is not
+// given: %ProgramData%\baxfer\baxfer-state.db on Windows and
+// ~/.local/state/baxfer/baxfer-state.db elsewhere
+func defaultStatePath() (string, error) {
+	if runtime.GOOS == "windows" {
+		programData := os.Getenv("ProgramData")
+		if programData == "" {
+			programData = `C:\ProgramData`
+		}
+		return filepath.Join(programData, "baxfer", stateFile), nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("no default state database: %w; set --state-file", err)
+	}
+	return filepath.Join(home, ".local", "state", "baxfer", stateFile), nil
+}
+
+// statePath returns the path of the state database: --state-file, or the
+// default
+func statePath(c *cli.Context) (string, error) {
+	if path := c.String("state-file"); path != "" {
+		return path, nil
+	}
+	return defaultStatePath()
+}
+
+// stateFileFor returns the path of the state database for a run, or "" if
+// --state is not set. When existing is set, as for a dry run, a state
+// database that does not exist yet is not used either, since using it would
+// create it.
+func stateFileFor(c *cli.Context, existing bool) (string, error) {
+	if !c.Bool("state") {
+		return "", nil
+	}
+	path, err := statePath(c)
+	if err != nil || !existing {
+		return path, err
+	}
+	if _, err := os.Stat(path); err != nil {
+		return "", nil
+	}
+	return path, nil
+}
+
+// openPruneState opens the state database for Prune to remove the files it
+// deletes from, or returns nil if --state is not set or it does not exist
+func openPruneState(c *cli.Context, log logger.Logger) (*stateDB, error) {
+	path, err := stateFileFor(c, true)
+	if err != nil {
+		return nil, cli.Exit(err.Error(), 1)
+	}
+	if path == "" {
+		return nil, nil
+	}
+	state, err := openState(path, false)
+	if err != nil {
+		// The files are checked against storage on the next upload anyway
+		log.Error("Failed to open state database", "path", path, "error", err)
+		return nil, nil
+	}
+	return state, nil
+}
+
+// openState opens the state database at path. Unless readOnly, it and its
+// directory are created if they do not exist.
+func openState(path string, readOnly bool) (*stateDB, error) {
+	if !readOnly {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, fmt.Errorf("failed to create state database directory: %w", err)
+		}
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: stateLockTimeout, ReadOnly: readOnly})
+	if err != nil {
+		if errors.Is(err, bolt.ErrTimeout) {
+			return nil, fmt.Errorf("state database %s is in use by another baxfer process", path)
+		}
+		return nil, fmt.Errorf("failed to open state database %s: %w", path, err)
+	}
+	return &stateDB{db: db}, nil
+}
+
+func (s *stateDB) Close() error {
+	return s.db.Close()
+}
+
+func stateKey(destination, key string) []byte {
+	return []byte(destination + "\x00" + key)
+}
+
+// lookup returns the latest upload of key to destination, or nil if none is
+// recorded
+func (s *stateDB) lookup(destination, key string) (*UploadRecord, error) {
+	var record *UploadRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(stateUploadsBucket)
+		if b == nil {
+			return nil
+		}
+		data := b.Get(stateKey(destination, key))
+		if data == nil {
+			return nil
+		}
+		record = &UploadRecord{}
+		return json.Unmarshal(data, record)
+	})
+	return record, err
+}
+
+// record stores an upload as the latest for its key and appends it to the
+// history
+func (s *stateDB) record(record UploadRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		uploads, err := tx.CreateBucketIfNotExists(stateUploadsBucket)
+		if err != nil {
+			return err
+		}
+		if err := uploads.Put(stateKey(record.Destination, record.Key), data); err != nil {
+			return err
+		}
+
+		history, err := tx.CreateBucketIfNotExists(stateHistoryBucket)
+		if err != nil {
+			return err
+		}
+		seq, err := history.NextSequence()
+		if err != nil {
+			return err
+		}
+		var id [8]byte
+		binary.BigEndian.PutUint64(id[:], seq)
+		return history.Put(id[:], data)
+	})
+}
+
+// forget removes the latest upload of key to destination, so the file is
+// checked against storage the next time it is uploaded. The history is kept.
+func (s *stateDB) forget(destination, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(stateUploadsBucket)
+		if b == nil {
+			return nil
+		}
+		return b.Delete(stateKey(destination, key))
+	})
+}
+
+// history calls fn for each recorded upload, oldest first
+func (s *stateDB) history(fn func(UploadRecord) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(stateHistoryBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(_, data []byte) error {
+			var record UploadRecord
+			if err := json.Unmarshal(data, &record); err != nil {
+				return err
+			}
+			return fn(record)
+		})
+	})
+}
+
+// unchanged reports whether the state database shows that the local file was
+// already uploaded to key on destination as it is now. Anything else,
+// including a missing record, is left to the provider to decide.
+func (s *stateDB) unchanged(destination, key string, local localFile, compare string, log logger.Logger) bool {
+	if s == nil || destination == "" {
+		return false
+	}
+
+	record, err := s.lookup(destination, key)
+	if err != nil {
+		log.Error("Failed to read state database", "key", key, "error", err)
+		return false
+	}
+	if record == nil || record.Size != local.info.Size() || !record.ModTime.Equal(local.info.ModTime()) {
+		return false
+	}
+	if local.checksum && record.SHA256 == "" {
+		return false // uploaded without --checksum, so storage is asked
+	}
+
+	if compare == CompareChecksum {
+		sum := record.SHA256
+		if local.transformed {
+			sum = record.SourceSHA256
+		}
+		return sum != "" && sum == local.sum
+	}
+	return true
+}
+
+// namedUploader is an uploader with the name its uploads are recorded under
+// in the state database
+type namedUploader struct {
+	Uploader
+	name string
+}
+
+// Named returns an uploader whose uploads are recorded in the state database
+// under name, which should identify where the uploader stores files
+func Named(uploader Uploader, name string) Uploader {
+	return &namedUploader{Uploader: uploader, name: name}
+}
+
+// Upload records multipart uploads under the uploader's name, so that an
+// interrupted upload can be resumed
+func (n *namedUploader) Upload(ctx context.Context, key string, reader io.Reader, size int64) error {
+	return n.Uploader.Upload(withUploadDestination(ctx, n.name), key, reader, size)
+}
+
+// stateName returns the name an uploader's uploads are recorded under, or ""
+// if they are not recorded
+func stateName(uploader Uploader) string {
+	if n, ok := uploader.(*namedUploader); ok {
+		return n.name
+	}
+	return ""
+}
+
+// destinationUploaders returns the uploaders a file sent to uploader reaches
+func destinationUploaders(uploader Uploader) []Uploader {
+	multi, ok := uploader.(*MultiUploader)
+	if !ok {
+		return []Uploader{uploader}
+	}
+	uploaders := make([]Uploader, 0, len(multi.Destinations()))
+	for _, d := range multi.Destinations() {
+		uploaders = append(uploaders, d.Uploader)
+	}
+	return uploaders
+}
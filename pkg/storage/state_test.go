@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+)
+
+func TestUpload_StateSkipsStorageChecks(t *testing.T) {
+	local, _ := newTestLocalUploader(t)
+	rootDir := t.TempDir()
+	backup := filepath.Join(rootDir, "sales.bak")
+	require.NoError(t, os.WriteFile(backup, []byte("sales data"), 0644))
+	statePath := filepath.Join(t.TempDir(), stateFile)
+
+	uploaded := uploadFiles(t, Named(local, "local:test"), "--checksum", "--state", "--state-file", statePath, rootDir)
+	assert.Equal(t, []string{"sales.bak"}, uploaded)
+
+	// The unchanged file is skipped without asking storage anything; the
+	// mock fails the test if it is asked
+	mockUploader := new(MockUploader)
+	uploaded = uploadFiles(t, Named(mockUploader, "local:test"), "--checksum", "--state", "--state-file", statePath, rootDir)
+	assert.Empty(t, uploaded)
+	mockUploader.AssertExpectations(t)
+
+	// With --state-check, storage is only asked whether it still exists
+	mockUploader.On("FileExists", mock.Anything, "sales.bak").Return(true, nil)
+	uploaded = uploadFiles(t, Named(mockUploader, "local:test"), "--checksum", "--state", "--state-check", "--state-file", statePath, rootDir)
+	assert.Empty(t, uploaded)
+	mockUploader.AssertExpectations(t)
+
+	// A changed file is checked against storage as usual
+	later := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(backup, later, later))
+	uploaded = uploadFiles(t, Named(local, "local:test"), "--checksum", "--state", "--state-file", statePath, rootDir)
+	assert.Equal(t, []string{"sales.bak"}, uploaded)
+}
+
+func TestUpload_StateChecksStoredCopyExists(t *testing.T) {
+	local, _ := newTestLocalUploader(t)
+	rootDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "sales.bak"), []byte("sales data"), 0644))
+	statePath := filepath.Join(t.TempDir(), stateFile)
+
+	uploaded := uploadFiles(t, Named(local, "local:test"), "--state", "--state-file", statePath, rootDir)
+	assert.Equal(t, []string{"sales.bak"}, uploaded)
+
+	// Deleted by something other than prune, so the record is out of date
+	require.NoError(t, local.Delete(context.Background(), "sales.bak"))
+	uploaded = uploadFiles(t, Named(local, "local:test"), "--state", "--state-file", statePath, rootDir)
+	assert.Empty(t, uploaded, "only --state-check looks for recorded files in storage")
+	uploaded = uploadFiles(t, Named(local, "local:test"), "--state", "--state-check", "--state-file", statePath, rootDir)
+	assert.Equal(t, []string{"sales.bak"}, uploaded)
+}
+
+func TestPrune_ForgetsDeletedFiles(t *testing.T) {
+	local, _ := newTestLocalUploader(t)
+	rootDir := t.TempDir()
+	backup := filepath.Join(rootDir, "sales.bak")
+	require.NoError(t, os.WriteFile(backup, []byte("sales data"), 0644))
+	statePath := filepath.Join(t.TempDir(), stateFile)
+	uploader := Named(local, "local:test")
+	uploadFiles(t, uploader, "--state", "--state-file", statePath, rootDir)
+
+	mockLogger := NewMockLogger()
+	mockLogger.On("Info", mock.Anything, mock.Anything).Return()
+	set := flag.NewFlagSet("test", 0)
+	set.Duration("age", time.Nanosecond, "doc")
+	set.Bool("state", true, "doc")
+	set.String("state-file", statePath, "doc")
+	require.NoError(t, Prune(cli.NewContext(&cli.App{}, set, nil), uploader, mockLogger))
+
+	state, err := openState(statePath, true)
+	require.NoError(t, err)
+	defer state.Close()
+	record, err := state.lookup("local:test", "sales.bak")
+	require.NoError(t, err)
+	assert.Nil(t, record)
+}
+
+func TestStatePath(t *testing.T) {
+	set := flag.NewFlagSet("test", 0)
+	set.Bool("state", false, "doc")
+	set.String("state-file", "", "doc")
+	c := cli.NewContext(&cli.App{}, set, nil)
+
+	path, err := stateFileFor(c, false)
+	require.NoError(t, err)
+	assert.Empty(t, path, "the state database is only used with --state")
+
+	require.NoError(t, set.Set("state", "true"))
+	path, err = stateFileFor(c, false)
+	require.NoError(t, err)
+	assert.True(t, filepath.IsAbs(path), path)
+	assert.Equal(t, stateFile, filepath.Base(path))
+
+	require.NoError(t, set.Set("state-file", "/var/lib/baxfer/state.db"))
+	path, err = stateFileFor(c, false)
+	require.NoError(t, err)
+	assert.Equal(t, "/var/lib/baxfer/state.db", path)
+}
+
+func TestUpload_StateIsPerDestination(t *testing.T) {
+	first, _ := newTestLocalUploader(t)
+	second, _ := newTestLocalUploader(t)
+	rootDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "sales.bak"), []byte("sales data"), 0644))
+	statePath := filepath.Join(t.TempDir(), stateFile)
+
+	uploadFiles(t, Named(first, "local:first"), "--checksum", "--state", "--state-file", statePath, rootDir)
+
+	// Nothing is recorded for the second destination, so it gets the file
+	multi := newTestMultiUploader(t,
+		Destination{Name: "first", Uploader: Named(first, "local:first")},
+		Destination{Name: "second", Uploader: Named(second, "local:second")},
+	)
+	uploaded := uploadFiles(t, multi, "--checksum", "--state", "--state-file", statePath, rootDir)
+	assert.Equal(t, []string{"sales.bak"}, uploaded)
+
+	keys, err := second.List(context.Background(), "")
+	require.NoError(t, err)
+	assert.Contains(t, keys, "sales.bak")
+}
+
+func TestUpload_DryRunDoesNotCreateState(t *testing.T) {
+	local, _ := newTestLocalUploader(t)
+	rootDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "sales.bak"), []byte("sales data"), 0644))
+	statePath := filepath.Join(t.TempDir(), stateFile)
+
+	mockLogger := NewMockLogger()
+	mockLogger.On("Info", mock.Anything, mock.Anything).Return()
+
+	c := newUploadContext(t, io.Discard, "--dry-run", "--state", "--state-file", statePath, rootDir)
+	require.NoError(t, Upload(c, Named(local, "local:test"), mockLogger))
+	assert.NoFileExists(t, statePath)
+}
+
+func TestHistory(t *testing.T) {
+	local, _ := newTestLocalUploader(t)
+	rootDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "sales.bak"), []byte("sales data"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "hr.bak"), []byte("hr data"), 0644))
+	statePath := filepath.Join(t.TempDir(), stateFile)
+	uploadFiles(t, Named(local, "local:test"), "--checksum", "--state", "--state-file", statePath, rootDir)
+
+	mockLogger := NewMockLogger()
+	set := flag.NewFlagSet("test", 0)
+	set.String("state-file", statePath, "doc")
+	set.String("format", "json", "doc")
+	set.String("prefix", "sales", "doc")
+	var out bytes.Buffer
+	require.NoError(t, History(cli.NewContext(&cli.App{Writer: &out}, set, nil), mockLogger))
+
+	var records []UploadRecord
+	require.NoError(t, json.Unmarshal(out.Bytes(), &records))
+	require.Len(t, records, 1)
+	assert.Equal(t, "local:test", records[0].Destination)
+	assert.Equal(t, "sales.bak", records[0].Key)
+	assert.Equal(t, filepath.Join(rootDir, "sales.bak"), records[0].Path)
+	assert.Equal(t, int64(len("sales data")), records[0].Size)
+	assert.Len(t, records[0].SHA256, 64)
+}
+
+func TestHistory_NoStateDatabase(t *testing.T) {
+	set := flag.NewFlagSet("test", 0)
+	set.String("state-file", filepath.Join(t.TempDir(), stateFile), "doc")
+	set.String("format", "table", "doc")
+	err := History(cli.NewContext(&cli.App{}, set, nil), NewMockLogger())
+	assert.ErrorContains(t, err, "No state database")
+}
@@ -1,67 +1,30 @@
 package storage
 
 import (
-	"archive/zip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"filippo.io/age"
 	"github.com/ngns-io/baxfer/pkg/logger"
 	"github.com/schollz/progressbar/v3"
 	"github.com/urfave/cli/v2"
+	"github.com/vbauerster/mpb/v8"
+	"github.com/vbauerster/mpb/v8/decor"
 )
 
-// isCompressedFile returns true if the file extension indicates an already-compressed format.
-func isCompressedFile(filename string) bool {
-	switch strings.ToLower(filepath.Ext(filename)) {
-	case ".gz", ".gzip", ".zip", ".bz2", ".xz", ".lz", ".lz4", ".zst", ".zstd",
-		".7z", ".rar", ".cab", ".lzma", ".br",
-		".jpg", ".jpeg", ".png", ".gif", ".webp", ".avif",
-		".mp3", ".mp4", ".mkv", ".avi", ".mov", ".flac", ".ogg", ".aac",
-		".woff", ".woff2":
-		return true
-	}
-	return false
-}
-
-// streamingZipCompress pipes zip compression directly to the returned reader,
-// avoiding buffering the entire archive in memory.
-func streamingZipCompress(file *os.File, filename string) io.Reader {
-	pr, pw := io.Pipe()
-
-	go func() {
-		zw := zip.NewWriter(pw)
-
-		header := &zip.FileHeader{
-			Name:   filepath.Base(filename),
-			Method: zip.Deflate,
-		}
-
-		writer, err := zw.CreateHeader(header)
-		if err != nil {
-			pw.CloseWithError(err)
-			return
-		}
-
-		if _, err := io.Copy(writer, file); err != nil {
-			pw.CloseWithError(err)
-			return
-		}
-
-		if err := zw.Close(); err != nil {
-			pw.CloseWithError(err)
-			return
-		}
-
-		pw.Close()
-	}()
-
-	return pr
-}
-
 type Uploader interface {
 	Upload(ctx context.Context, key string, reader io.Reader, size int64) error
 	Download(ctx context.Context, key string, writer io.Writer) error
@@ -71,6 +34,14 @@ type Uploader interface {
 	GetFileInfo(ctx context.Context, key string) (*FileInfo, error)
 }
 
+// RangeDownloader is implemented by uploaders that can download part of a
+// stored file, for resuming and parallel downloads
+type RangeDownloader interface {
+	// DownloadRange writes length bytes of key starting at offset, or the
+	// rest of it if length is negative
+	DownloadRange(ctx context.Context, key string, offset, length int64, writer io.Writer) error
+}
+
 func constructKey(rootDir, keyPrefix, path string) (string, error) {
 	// Get the relative path
 	relPath, err := filepath.Rel(rootDir, path)
@@ -90,95 +61,608 @@ func constructKey(rootDir, keyPrefix, path string) (string, error) {
 	return key, nil
 }
 
+// uploadTask is a backup file found by the walker, waiting for a worker
+type uploadTask struct {
+	path string
+	info os.FileInfo
+	key  string // key before any compression extension
+}
+
+// uploadRun holds the settings and shared state of one Upload call
+type uploadRun struct {
+	c        *cli.Context
+	uploader Uploader
+	log      logger.Logger
+	compress string // CompressNone when files are uploaded as they are
+	level    int    // compression level, zero for the format's default
+	dryRun   bool
+	progress *mpb.Progress // nil in non-interactive mode
+
+	recipients []age.Recipient // set when encrypting
+	checksum   bool            // store a SHA-256 of each uploaded file
+	compare    string          // how stored files are checked for changes
+	state      *stateDB        // nil when no state database is used
+	stateCheck bool            // look for recorded uploads in storage too
+	retry      RetryPolicy     // how failed uploads are repeated
+
+	continueOnError bool              // record failed files and carry on with the rest
+	bwlimit         *bandwidthLimiter // nil when transfers are not limited
+
+	mu      sync.Mutex // guards planned, stats and dry-run output
+	planned int
+	stats   uploadStats
+}
+
+// uploadStats counts what happened to each file, for the summary at the end
+// of a run
+type uploadStats struct {
+	uploaded int
+	skipped  int
+	bytes    int64 // size of the uploaded files before compression
+	failures []uploadFailure
+}
+
+// uploadFailure is a file that could not be uploaded
+type uploadFailure struct {
+	path string
+	err  error
+}
+
+// stdinName stands for standard input in the summary and upload history
+const stdinName = "<stdin>"
+
+// Upload walks the root directory and uploads each backup file that is not
+// already in storage. The walk feeds a pool of --parallel workers, which check
+// each file against storage and upload it; the first failure stops the run.
+// With --stdin, standard input is uploaded to --key instead.
 func Upload(c *cli.Context, uploader Uploader, log logger.Logger) error {
 	rootDir := c.Args().First()
-	if rootDir == "" {
+	stdin := c.Bool("stdin")
+	switch {
+	case stdin && c.String("key") == "":
+		return cli.Exit("--stdin needs --key to name the uploaded file", 1)
+	case stdin && rootDir != "":
+		return cli.Exit("--stdin uploads standard input, so no root directory can be given", 1)
+	case !stdin && c.String("key") != "":
+		return cli.Exit("--key is only used with --stdin", 1)
+	case !stdin && rootDir == "":
 		return cli.Exit("No root directory specified", 1)
 	}
 
-	compress := c.Bool("compress")
 	keyPrefix := c.String("keyprefix")
 	backupExt := c.String("backupext")
-	nonInteractive := c.Bool("non-interactive")
+	parallel := c.Int("parallel")
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	start := time.Now()
+	ctx, cancel := context.WithCancel(c.Context)
+	defer cancel()
+
+	run := &uploadRun{
+		c:        c,
+		uploader: uploader,
+		log:      log,
+		level:    c.Int("compress-level"),
+		dryRun:   c.Bool("dry-run"),
+		checksum: c.Bool("checksum"),
+		retry:    RetryPolicyFromFlags(c),
+
+		stateCheck: c.Bool("state-check"),
+
+		continueOnError: c.Bool("continue-on-error"),
+	}
+	compress, err := parseCompression(c.String("compress"))
+	if err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+	if err := validateCompressionLevel(compress, run.level); err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+	run.compress = compress
+
+	if run.compare, err = parseCompare(c.String("compare")); err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+	if run.compare == CompareChecksum && !run.checksum {
+		return cli.Exit("--compare=checksum needs the checksums stored by --checksum", 1)
+	}
+	// The stored copy of a compressed or encrypted file has a different size,
+	// so the original's is only known from its checksum record
+	if run.compare == CompareSize && !run.checksum && (compress != CompressNone || c.Bool("encrypt")) {
+		return cli.Exit("--compare=size needs the sizes stored by --checksum to compare compressed or encrypted files", 1)
+	}
+	if run.bwlimit, err = newBandwidthLimiter(c.String("bwlimit")); err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+
+	if c.Bool("encrypt") {
+		recipients, err := loadRecipients(c.StringSlice("recipient"), c.String("recipients-file"), c.String("passphrase-file"))
+		if err != nil {
+			return cli.Exit(err.Error(), 1)
+		}
+		run.recipients = recipients
+	}
+	stateDBPath, err := stateFileFor(c, run.dryRun)
+	if err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+	if stateDBPath != "" {
+		// A dry run only reads the state database, and never creates it
+		state, err := openState(stateDBPath, run.dryRun)
+		if err != nil {
+			// Storage is checked directly instead, as without a state database
+			log.Error("Failed to open state database", "path", stateDBPath, "error", err)
+		} else {
+			defer state.Close()
+			run.state = state
+		}
+	}
+	if !c.Bool("non-interactive") && !run.dryRun {
+		run.progress = mpb.NewWithContext(ctx, mpb.WithOutput(outputWriter(c)), mpb.WithWidth(40))
+	}
 
-	return filepath.Walk(rootDir, func(path string, info os.FileInfo, err error) error {
-		// Check for context cancellation
+	if stdin {
+		key := strings.TrimPrefix(path.Join(keyPrefix, c.String("key")), "/")
+		return run.finish(start, run.uploadStream(ctx, inputReader(c), key))
+	}
+
+	tasks := make(chan uploadTask)
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for task := range tasks {
+				err := run.uploadFile(ctx, task)
+				if err == nil {
+					continue
+				}
+				// Files interrupted by an earlier failure are not counted
+				if ctx.Err() == nil {
+					run.fail(task.path, err)
+				}
+				if !run.continueOnError {
+					errOnce.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+
+	walkErr := filepath.Walk(rootDir, func(path string, info os.FileInfo, err error) error {
+		// Check for cancellation, by the caller or a failed upload
 		select {
-		case <-c.Context.Done():
-			return c.Context.Err()
+		case <-ctx.Done():
+			return ctx.Err()
 		default:
 		}
 
+		// Failures are recorded for the summary whether or not the run stops
 		if err != nil {
-			return err
+			log.Error("Error walking directory", "path", path, "error", err)
+			run.fail(path, err)
+			if !run.continueOnError {
+				return err
+			}
+			// An unreadable directory is skipped along with its contents
+			return nil
 		}
 
 		if info.IsDir() || filepath.Ext(path) != backupExt {
 			return nil
 		}
 
-		originalKey, err := constructKey(rootDir, keyPrefix, path)
+		key, err := constructKey(rootDir, keyPrefix, path)
 		if err != nil {
 			log.Error("Error constructing key", "path", path, "error", err)
-			return err
+			run.fail(path, err)
+			if !run.continueOnError {
+				return err
+			}
+			return nil
 		}
 
-		shouldCompress := compress && !isCompressedFile(path)
-		compressedKey := strings.TrimSuffix(originalKey, filepath.Ext(originalKey)) + ".zip"
-		uploadKey := originalKey
-		if shouldCompress {
-			uploadKey = compressedKey
+		select {
+		case tasks <- uploadTask{path: path, info: info, key: key}:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
 		}
+	})
+	close(tasks)
+	wg.Wait()
+	if firstErr == nil {
+		firstErr = walkErr
+	}
+	return run.finish(start, firstErr)
+}
 
-		eligible, err := fileUploadEligible(c.Context, uploader, uploadKey, info, shouldCompress, log)
-		if err != nil {
-			log.Error("Error checking file eligibility", "file", path, "error", err)
-			return err
-		}
+// finish waits for the progress display, prints the summary of a run started
+// at start, and returns its error: err if the run stopped early, or an exit
+// error if any files failed
+func (r *uploadRun) finish(start time.Time, err error) error {
+	if r.progress != nil {
+		r.progress.Wait()
+	}
 
-		if !eligible {
-			log.Info("Skipping file (already uploaded or not modified)", "file", path)
-			return nil
-		}
+	// A run interrupted by the caller has nothing meaningful to summarize
+	if !r.dryRun && r.c.Context.Err() == nil {
+		r.report(time.Since(start))
+	}
+
+	if err != nil {
+		return err
+	}
 
-		file, err := os.Open(path)
+	if r.dryRun {
+		fmt.Fprintf(outputWriter(r.c), "dry run: %d file(s) would be uploaded\n", r.planned)
+	}
+	if failed := len(r.stats.failures); failed > 0 {
+		return cli.Exit(fmt.Sprintf("%d file(s) failed to upload", failed), 1)
+	}
+	return nil
+}
+
+// fail records a file that could not be uploaded
+func (r *uploadRun) fail(path string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats.failures = append(r.stats.failures, uploadFailure{path: path, err: err})
+}
+
+// report prints and logs the summary of a run: each file that failed, then
+// the number of files uploaded, skipped and failed
+func (r *uploadRun) report(duration time.Duration) {
+	stats := r.stats
+	out := outputWriter(r.c)
+	for _, f := range stats.failures {
+		fmt.Fprintf(out, "FAILED   %s (%v)\n", f.path, f.err)
+	}
+	fmt.Fprintf(out, "uploaded %d file(s) (%s), %d skipped, %d failed in %s\n",
+		stats.uploaded, formatSize(stats.bytes), stats.skipped, len(stats.failures), duration.Round(time.Millisecond))
+	r.log.Info("Upload summary", "uploaded", stats.uploaded, "skipped", stats.skipped,
+		"failed", len(stats.failures), "bytes", stats.bytes, "duration", duration)
+}
+
+// uploadFile checks a file against storage and uploads it if needed
+func (r *uploadRun) uploadFile(ctx context.Context, task uploadTask) error {
+	path, info, log := task.path, task.info, r.log
+
+	compressing := r.compress != CompressNone
+	shouldCompress := compressing && !isCompressedFile(path)
+	encrypt := len(r.recipients) > 0
+	uploadKey := task.key
+	if shouldCompress {
+		uploadKey = compressedKey(task.key, r.compress)
+	}
+	if encrypt {
+		uploadKey += encryptedExt
+	}
+
+	// Stored sizes only match the local file when it is uploaded unchanged
+	local := localFile{info: info, transformed: shouldCompress || encrypt, checksum: r.checksum}
+	if r.compare == CompareChecksum {
+		sum, err := hashFile(path)
 		if err != nil {
-			log.Error("Failed to open file", "file", path, "error", err)
+			log.Error("Failed to hash file", "file", path, "error", err)
 			return err
 		}
-		defer file.Close()
+		local.sum = sum
+	}
+	target, err := eligibleUploader(ctx, r.uploader, uploadKey, local, r.compare, r.state, r.stateCheck, log)
+	if err != nil {
+		log.Error("Error checking file eligibility", "file", path, "error", err)
+		return err
+	}
 
-		var reader io.Reader
-		var uploadSize int64
+	if target == nil {
+		log.Info("Skipping file (already uploaded or not modified)", "file", path)
+		r.mu.Lock()
+		r.stats.skipped++
+		r.mu.Unlock()
+		return nil
+	}
 
-		if shouldCompress {
-			reader = streamingZipCompress(file, path)
-			uploadSize = -1 // Unknown compressed size
-		} else {
-			if compress && isCompressedFile(path) {
-				log.Info("Skipping compression for already-compressed file", "file", path)
+	if r.dryRun {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.planned++
+		reportPlannedUpload(r.c, target, path, uploadKey, log)
+		return nil
+	}
+
+	metadata, err := r.uploadMetadata(target, path, local)
+	if err != nil {
+		log.Error("Failed to hash file", "file", path, "error", err)
+		return err
+	}
+	ctx = withUploadMetadata(ctx, metadata)
+	// Only large files are worth resuming if the upload is interrupted
+	if info.Size() >= resumableSize {
+		ctx = withUploadState(ctx, r.state)
+	}
+
+	// Each attempt reopens the file, since a failed upload may have used up
+	// part of its compressed or encrypted stream. When a fan-out upload fails
+	// for some destinations, only those are tried again.
+	for attempt := 0; ; attempt++ {
+		record, err := r.sendFile(ctx, target, path, info, uploadKey, shouldCompress, encrypt)
+		done, failed := splitDestinations(target, err, log)
+		if done != nil {
+			if err := r.finishUpload(ctx, done, path, info.Size(), info.ModTime(), uploadKey, record); err != nil {
+				return err
 			}
-			reader = file
-			uploadSize = info.Size()
 		}
-
-		if !nonInteractive {
-			bar := progressbar.DefaultBytes(
-				uploadSize,
-				"Uploading "+filepath.Base(path),
-			)
-			reader = io.TeeReader(reader, bar)
+		if err == nil {
+			break
 		}
 
-		err = uploader.Upload(c.Context, uploadKey, reader, uploadSize)
-		if err != nil {
+		if !r.retry.retryable(attempt, err) {
 			log.Error("Failed to upload file", "file", path, "error", err)
 			return err
 		}
+		log.Warn("Retrying upload after transient error", "file", path,
+			"retry", attempt+1, "retries", r.retry.Retries, "error", err)
+		if err := r.retry.wait(ctx, attempt); err != nil {
+			return err
+		}
+		target = failed
+	}
+
+	log.Info("File uploaded successfully", "file", path, "key", uploadKey)
+	r.mu.Lock()
+	r.stats.uploaded++
+	r.stats.bytes += info.Size()
+	r.mu.Unlock()
+	return nil
+}
 
-		log.Info("File uploaded successfully", "file", path, "key", uploadKey)
+// uploadStream uploads input to key in a single attempt, since a stream
+// cannot be read a second time. It is not checked against storage first.
+func (r *uploadRun) uploadStream(ctx context.Context, input io.Reader, key string) error {
+	log := r.log
+	compress := r.compress != CompressNone && !isCompressedFile(key)
+	encrypt := len(r.recipients) > 0
+	uploadKey := key
+	if compress {
+		uploadKey = compressedKey(key, r.compress)
+	}
+	if encrypt {
+		uploadKey += encryptedExt
+	}
+
+	if r.dryRun {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.planned++
+		reportPlannedUpload(r.c, r.uploader, stdinName, uploadKey, log)
 		return nil
-	})
+	}
+
+	counter := &countingWriter{w: io.Discard}
+	started := time.Now()
+	record, err := r.send(ctx, r.uploader, io.TeeReader(input, counter), -1, path.Base(key), uploadKey, compress, encrypt)
+	if done, _ := splitDestinations(r.uploader, err, log); done != nil {
+		if err := r.finishUpload(ctx, done, stdinName, counter.n, started, uploadKey, record); err != nil {
+			r.fail(stdinName, err)
+			return err
+		}
+	}
+	if err != nil {
+		log.Error("Failed to upload standard input", "key", uploadKey, "error", err)
+		if ctx.Err() == nil {
+			r.fail(stdinName, err)
+		}
+		return err
+	}
+
+	log.Info("Standard input uploaded successfully", "key", uploadKey, "size", counter.n)
+	r.mu.Lock()
+	r.stats.uploaded++
+	r.stats.bytes += counter.n
+	r.mu.Unlock()
+	return nil
+}
+
+// uploadMetadata returns the metadata to store with a file uploaded to target:
+// its checksum, with --checksum, if any destination keeps metadata
+func (r *uploadRun) uploadMetadata(target Uploader, path string, local localFile) (map[string]string, error) {
+	if !r.checksum || !slices.ContainsFunc(destinationUploaders(target), storesMetadata) {
+		return nil, nil
+	}
+	sum := local.sum
+	if sum == "" {
+		var err error
+		if sum, err = hashFile(path); err != nil {
+			return nil, err
+		}
+	}
+	return checksumMetadata(sum, local.info.Size(), local.transformed), nil
+}
+
+// sendFile makes one attempt at uploading a file to target, and returns its
+// checksums if they are stored
+func (r *uploadRun) sendFile(ctx context.Context, target Uploader, path string, info os.FileInfo, key string, compress, encrypt bool) (*checksumRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		r.log.Error("Failed to open file", "file", path, "error", err)
+		return nil, err
+	}
+	defer file.Close()
+	return r.send(ctx, target, file, info.Size(), filepath.Base(path), key, compress, encrypt)
+}
+
+// send makes one attempt at uploading source, the contents of the local file
+// name, to target. size is the length of source, or -1 if it is unknown.
+func (r *uploadRun) send(ctx context.Context, target Uploader, source io.Reader, size int64, name, key string, compress, encrypt bool) (*checksumRecord, error) {
+	// Hash the data as stored, so it can be verified without decrypting, and
+	// the local file as read, so --compare can check it for changes
+	var hashes checksumHashes
+	var sourceHasher hash.Hash
+	var sourceCounter *countingWriter
+	if r.checksum {
+		hashes = newChecksumHashes()
+		if compress || encrypt {
+			sourceHasher = sha256.New()
+			sourceCounter = &countingWriter{w: sourceHasher}
+			source = io.TeeReader(source, sourceCounter)
+		}
+	}
+
+	var reader io.Reader
+	var uploadSize int64
+	var err error
+
+	if compress {
+		reader = streamingCompress(source, name, r.compress, r.level)
+		uploadSize = -1 // Unknown compressed size
+	} else {
+		if r.compress != CompressNone {
+			r.log.Info("Skipping compression for already-compressed file", "file", name)
+		}
+		reader = source
+		uploadSize = size
+	}
+
+	// Encrypt last, since ciphertext does not compress
+	if encrypt {
+		reader = streamingEncrypt(reader, r.recipients)
+		uploadSize = -1
+	}
+
+	if hashes != nil {
+		reader = io.TeeReader(reader, hashes)
+	}
+	// A fan-out paces the copy sent to each destination instead
+	if _, fanout := target.(*MultiUploader); fanout {
+		ctx = withBandwidthLimit(ctx, r.bwlimit)
+	} else {
+		reader = r.bwlimit.reader(ctx, reader)
+	}
+
+	if r.progress != nil {
+		bar := r.addBar(name, uploadSize)
+		completed := false
+		defer func() {
+			if completed {
+				// Fills in the total for compressed uploads of unknown size
+				bar.SetTotal(-1, true)
+			} else {
+				bar.Abort(true)
+			}
+		}()
+
+		proxy := bar.ProxyReader(reader)
+		defer proxy.Close()
+		reader = proxy
+
+		err = target.Upload(ctx, key, reader, uploadSize)
+		completed = err == nil
+	} else {
+		err = target.Upload(ctx, key, reader, uploadSize)
+	}
+	if hashes == nil {
+		return nil, err
+	}
+
+	record := hashes.record()
+	if sourceHasher != nil {
+		record.SourceSum = hex.EncodeToString(sourceHasher.Sum(nil))
+		record.SourceSize = sourceCounter.n
+		record.SourceName = name
+	}
+	return record, err
+}
+
+// finishUpload checks or stores the checksums of a file uploaded to target,
+// and records the upload in the state database. Destinations that keep
+// metadata already have the file's checksum, and are checked against it and
+// their own checksums; the others, and those whose metadata could not hold
+// the checksum of a compressed, encrypted or streamed file, get a checksum
+// object.
+func (r *uploadRun) finishUpload(ctx context.Context, target Uploader, path string, size int64, modTime time.Time, key string, record *checksumRecord) error {
+	uploaded := UploadRecord{
+		UploadedAt: time.Now().UTC(),
+		Key:        key,
+		Path:       path,
+		Size:       size,
+		ModTime:    modTime,
+	}
+	if record != nil {
+		for _, u := range destinationUploaders(target) {
+			if storesMetadata(u) {
+				var covered bool
+				err := r.retry.do(ctx, r.log, "check", key, func() (err error) {
+					covered, err = checkStored(ctx, u, key, *record)
+					return err
+				})
+				if err != nil {
+					r.log.Error("Failed to check stored file", "file", path, "key", key, "error", err)
+					return err
+				}
+				if covered {
+					continue
+				}
+			}
+			err := r.retry.do(ctx, r.log, "upload", checksumKey(key), func() error {
+				return storeChecksum(ctx, u, key, *record)
+			})
+			if err != nil {
+				r.log.Error("Failed to store checksum", "file", path, "key", checksumKey(key), "error", err)
+				return err
+			}
+		}
+		uploaded.SHA256 = record.Sum
+		uploaded.SourceSHA256 = record.SourceSum
+	}
+
+	r.recordUpload(target, uploaded)
+	return nil
+}
+
+// recordUpload records an upload in the state database for each destination
+// it reached. The upload has succeeded either way, so a failure to record it
+// is only logged; the file is checked against storage on the next run.
+func (r *uploadRun) recordUpload(target Uploader, record UploadRecord) {
+	if r.state == nil {
+		return
+	}
+	for _, u := range destinationUploaders(target) {
+		record.Destination = stateName(u)
+		if record.Destination == "" {
+			continue
+		}
+		if err := r.state.record(record); err != nil {
+			r.log.Error("Failed to record upload in state database", "key", record.Key, "error", err)
+		}
+	}
+}
+
+// addBar adds a progress bar for one file to the multi-bar display. Bars are
+// removed once their upload finishes, so only files in flight are shown.
+func (r *uploadRun) addBar(name string, size int64) *mpb.Bar {
+	total := size
+	if total < 0 {
+		total = 0 // grows as data is read
+	}
+	return r.progress.AddBar(total,
+		mpb.BarRemoveOnComplete(),
+		mpb.PrependDecorators(
+			decor.Name("Uploading "+name, decor.WC{C: decor.DindentRight | decor.DextraSpace}),
+			decor.CountersKibiByte("% .1f / % .1f"),
+		),
+		mpb.AppendDecorators(
+			decor.AverageSpeed(decor.SizeB1024(0), "% .1f"),
+		),
+	)
 }
 
 func Download(c *cli.Context, uploader Uploader, log logger.Logger) error {
@@ -187,47 +671,326 @@ func Download(c *cli.Context, uploader Uploader, log logger.Logger) error {
 		return cli.Exit("No key specified", 1)
 	}
 
-	outFile := filepath.Base(key)
-	if c.String("output") != "" {
-		outFile = c.String("output")
+	// Encrypted files are decrypted when an identity or passphrase is given,
+	// and saved as they are otherwise
+	var identities []age.Identity
+	decrypt := isEncryptedKey(key) && (c.String("identity") != "" || c.String("passphrase-file") != "")
+	if decrypt {
+		var err error
+		identities, err = loadIdentities(c.String("identity"), c.String("passphrase-file"))
+		if err != nil {
+			return &UserError{Message: err.Error(), Cause: err}
+		}
+	} else if isEncryptedKey(key) {
+		log.Info("File is encrypted; saving without decrypting (use --identity or --passphrase-file to decrypt)", "key", key)
+	}
+
+	// Compressed files are decompressed with --decompress, once decrypted
+	format := CompressNone
+	if c.Bool("decompress") && (decrypt || !isEncryptedKey(key)) {
+		format = compressionFromKey(strings.TrimSuffix(key, encryptedExt))
 	}
 
-	file, err := os.Create(outFile)
+	storedName := filepath.Base(key)
+	if decrypt {
+		storedName = strings.TrimSuffix(storedName, encryptedExt)
+	}
+
+	// Resuming and parallel downloads request byte ranges of the stored file
+	resume := c.Bool("resume")
+	parallel := max(c.Int("parallel"), 1)
+	if resume && (decrypt || format != CompressNone) {
+		return cli.Exit("--resume appends to the file as stored, so it cannot be used with --decompress or decryption", 1)
+	}
+	bwlimit, err := newBandwidthLimiter(c.String("bwlimit"))
 	if err != nil {
-		log.Error("Failed to create output file", "file", outFile, "error", err)
-		return err
+		return cli.Exit(err.Error(), 1)
 	}
-	defer file.Close()
 
-	nonInteractive := c.Bool("non-interactive")
-	var writer io.Writer = file
+	ranged := rangeDownloader(uploader)
+	if ranged == nil {
+		if resume {
+			return cli.Exit("--resume is not supported by this provider", 1)
+		}
+		if parallel > 1 {
+			log.Info("Provider cannot download byte ranges; downloading in one stream", "key", key)
+			parallel = 1
+		}
+	}
 
-	if !nonInteractive {
+	// Downloads of the file as stored can be resumed, so they record which
+	// upload of it they are from
+	resumable := ranged != nil && !decrypt && format == CompressNone
+	size := int64(-1)
+	var stored resumeRecord
+	if resumable || parallel > 1 {
+		info, err := uploader.GetFileInfo(c.Context, key)
+		if err != nil {
+			log.Error("Failed to get file info", "key", key, "error", err)
+			if isNotFoundError(err) {
+				return &UserError{Message: fmt.Sprintf("File not found: %s", key), Cause: err}
+			}
+			return err
+		}
+		size = info.Size
+		stored = resumeRecord{Key: key, Size: info.Size, LastModified: info.LastModified}
+	}
+
+	// With --resume, a partial output file is appended to
+	var offset int64
+	if resume {
+		name := storedName
+		if c.String("output") != "" {
+			name = c.String("output")
+		}
+		if fi, err := os.Stat(name); err == nil {
+			offset = fi.Size()
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if offset > size {
+			return &UserError{Message: fmt.Sprintf("%s is larger than %s, so it is not a partial download of it", name, key)}
+		}
+		if offset > 0 {
+			if err := checkResumeRecord(name, stored); err != nil {
+				return err
+			}
+			log.Info("Resuming download", "key", key, "file", name, "offset", offset, "size", size)
+		}
+	}
+
+	outFile := ""
+	var file *os.File
+	defer func() {
+		if file != nil {
+			file.Close()
+		}
+	}()
+
+	// create opens the output file, named after the restored file unless
+	// --output is given
+	create := func(name string) (io.Writer, error) {
+		outFile = name
+		if c.String("output") != "" {
+			outFile = c.String("output")
+		}
+
+		var err error
+		if resume {
+			file, err = os.OpenFile(outFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+		} else {
+			file, err = os.Create(outFile)
+		}
+		if err != nil {
+			log.Error("Failed to create output file", "file", outFile, "error", err)
+			return nil, err
+		}
+
+		if c.Bool("non-interactive") {
+			return file, nil
+		}
+		total := int64(-1)
+		if size >= 0 {
+			total = size - offset
+		}
 		bar := progressbar.DefaultBytes(
-			-1,
+			total,
 			"Downloading "+filepath.Base(key),
 		)
-		writer = io.MultiWriter(file, bar)
+		return io.MultiWriter(file, bar), nil
+	}
+
+	// With --verify, the data is hashed as stored, before any decrypting or
+	// decompressing, and compared with the checksums stored on upload
+	var hashes checksumHashes
+	if c.Bool("verify") {
+		hashes = newChecksumHashes()
+	}
+	download := func(w io.Writer) error {
+		if hashes != nil {
+			w = io.MultiWriter(w, hashes)
+		}
+		switch {
+		case size >= 0 && offset >= size:
+			log.Info("File already downloaded", "key", key)
+			return nil
+		case parallel > 1 && size-offset > downloadChunkSize:
+			return downloadRanges(c.Context, ranged, key, offset, size, downloadChunkSize, parallel, bwlimit, w)
+		case offset > 0:
+			return ranged.DownloadRange(c.Context, key, offset, -1, bwlimit.writer(c.Context, w))
+		default:
+			return uploader.Download(c.Context, key, bwlimit.writer(c.Context, w))
+		}
 	}
 
-	err = uploader.Download(c.Context, key, writer)
+	if !decrypt && format == CompressNone {
+		var writer io.Writer
+		writer, err = create(storedName)
+		if err != nil {
+			return err
+		}
+		if resumable {
+			if err := saveResumeRecord(outFile, stored); err != nil {
+				// The download goes on, but cannot be resumed if it is interrupted
+				log.Warn("Failed to record download for resuming", "file", outFile, "error", err)
+			}
+		}
+		// The checksum covers the part downloaded before
+		if hashes != nil && offset > 0 {
+			if err := hashPrefix(hashes, outFile, offset); err != nil {
+				log.Error("Failed to read partial download", "file", outFile, "error", err)
+				return err
+			}
+		}
+		err = download(writer)
+		if err == nil && resumable {
+			if err := os.Remove(outFile + resumeExt); err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Warn("Failed to remove download record", "file", outFile+resumeExt, "error", err)
+			}
+		}
+	} else {
+		err = downloadRestored(download, func(r io.Reader) error {
+			return restoreDownload(r, key, storedName, identities, format, create)
+		})
+	}
 	if err != nil {
 		log.Error("Failed to download file", "key", key, "error", err)
 		return err
 	}
 
+	if hashes != nil {
+		if err := checkDownload(c.Context, uploader, key, hashes.record()); err != nil {
+			log.Error("Failed to verify downloaded file", "key", key, "file", outFile, "error", err)
+			return err
+		}
+		log.Info("Checksum verified", "key", key)
+	}
+
 	log.Info("File downloaded successfully", "file", outFile)
 	return nil
 }
 
+// hashPrefix adds the first n bytes of the file at path to h
+func hashPrefix(h io.Writer, path string, n int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.CopyN(h, f, n)
+	return err
+}
+
+// downloadRestored runs download and passes the downloaded data to restore as
+// it streams in, for decrypting or decompressing on the way to the output file
+func downloadRestored(download func(io.Writer) error, restore func(io.Reader) error) error {
+	pr, pw := io.Pipe()
+
+	restoreErr := make(chan error, 1)
+	go func() {
+		err := restore(pr)
+		if err == nil {
+			// Drain anything after the restored data, such as the central
+			// directory of a zip archive, so the download completes
+			_, err = io.Copy(io.Discard, pr)
+		}
+		// Stop the download if restoring fails part way through
+		pr.CloseWithError(err)
+		restoreErr <- err
+	}()
+
+	err := download(pw)
+	pw.CloseWithError(err)
+
+	resErr := <-restoreErr
+	// A failed download also ends the restore; report the download error
+	if err != nil && (resErr == nil || errors.Is(resErr, err)) {
+		return err
+	}
+	return resErr
+}
+
+// restoreDownload decrypts and decompresses a downloaded key as configured,
+// writing the restored file to the writer returned by create. The file is
+// named after storedName, or the original name recorded by the compression
+// format.
+func restoreDownload(r io.Reader, key, storedName string, identities []age.Identity, format string, create func(name string) (io.Writer, error)) error {
+	if identities != nil {
+		plaintext, err := decryptReader(r, identities)
+		if err != nil {
+			return decryptFailure(key, err)
+		}
+		r = plaintext
+	}
+
+	name := storedName
+	if format != CompressNone {
+		decompressed, original, err := decompressReader(r, format)
+		if err != nil {
+			return restoreFailure(key, err)
+		}
+		defer decompressed.Close()
+		r = decompressed
+
+		name = strings.TrimSuffix(storedName, filepath.Ext(storedName))
+		// Only the base name is used, so an archive cannot write elsewhere
+		if base := filepath.Base(filepath.FromSlash(original)); original != "" && base != "." && base != ".." && base != string(filepath.Separator) {
+			name = base
+		}
+	}
+
+	writer, err := create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(writer, r); err != nil {
+		return restoreFailure(key, err)
+	}
+	return nil
+}
+
+// restoreFailure returns the error reported for a key that failed to decrypt
+// or decompress
+func restoreFailure(key string, err error) error {
+	var decErr *decryptError
+	if errors.As(err, &decErr) {
+		return decryptFailure(key, decErr.err)
+	}
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		// Writing the output file failed
+		return err
+	}
+	return &UserError{Message: fmt.Sprintf("Failed to decompress file: %s (%v)", key, err), Cause: err}
+}
+
 func Prune(c *cli.Context, uploader Uploader, log logger.Logger) error {
 	prefix := c.String("keyprefix")
 	age := c.Duration("age")
-	if age == 0 {
-		return cli.Exit("No age specified for pruning", 1)
+	policy := RetentionPolicy{
+		KeepLast:    c.Int("keep-last"),
+		KeepDaily:   c.Int("keep-daily"),
+		KeepWeekly:  c.Int("keep-weekly"),
+		KeepMonthly: c.Int("keep-monthly"),
+		KeepYearly:  c.Int("keep-yearly"),
+	}
+	if age == 0 && policy.IsZero() {
+		return cli.Exit("No age or retention policy specified for pruning", 1)
 	}
 
-	cutoff := time.Now().Add(-age)
+	seriesMode := c.String("series")
+	switch seriesMode {
+	case "", SeriesByDir, SeriesByName:
+	default:
+		return cli.Exit(fmt.Sprintf("Invalid series %q: must be dir or name", seriesMode), 1)
+	}
+
+	minKeep := c.Int("min-keep")
+	if minKeep < 0 {
+		return cli.Exit("--min-keep cannot be negative", 1)
+	}
+	maxDelete := c.String("max-delete")
+	dryRun := c.Bool("dry-run")
 
 	files, err := uploader.List(c.Context, prefix)
 	if err != nil {
@@ -235,27 +998,260 @@ func Prune(c *cli.Context, uploader Uploader, log logger.Logger) error {
 		return err
 	}
 
+	// Checksums are deleted with the files they belong to, not pruned on
+	// their own
+	checksums := make(map[string]bool)
+	backupKeys := files[:0]
+	for _, key := range files {
+		if isChecksumKey(key) {
+			checksums[key] = true
+		} else {
+			backupKeys = append(backupKeys, key)
+		}
+	}
+	files = backupKeys
+
+	limit, err := parseDeleteLimit(maxDelete, len(files))
+	if err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+
+	backups := make([]storedBackup, 0, len(files))
 	for _, key := range files {
 		info, err := uploader.GetFileInfo(c.Context, key)
 		if err != nil {
 			log.Error("Failed to get file info", "key", key, "error", err)
 			continue
 		}
+		backups = append(backups, storedBackup{Key: key, LastModified: info.LastModified})
+	}
 
-		if info.LastModified.Before(cutoff) {
-			err = uploader.Delete(c.Context, key)
-			if err != nil {
-				log.Error("Failed to delete file", "key", key, "error", err)
-			} else {
-				log.Info("Deleted old file", "key", key)
-			}
+	// With a policy, files are only deleted if no rule keeps them; --age then
+	// limits deletion to files older than the cutoff
+	kept := make(map[string]string)
+	if !policy.IsZero() {
+		kept = policy.Retain(backups, seriesMode)
+	}
+	// The newest files of each series survive whatever the age or policy, so
+	// a job that stops producing backups never loses its last copies
+	for key := range (RetentionPolicy{KeepLast: minKeep}).Retain(backups, seriesMode) {
+		if _, ok := kept[key]; !ok {
+			kept[key] = "min-keep"
+		}
+	}
+	cutoff := time.Now().Add(-age)
+
+	var doomed []storedBackup
+	for _, b := range backups {
+		if age > 0 && !b.LastModified.Before(cutoff) {
+			continue
+		}
+		if rule, ok := kept[b.Key]; ok {
+			log.Info("Keeping file (retention policy)", "key", b.Key, "rule", rule)
+			continue
+		}
+		doomed = append(doomed, b)
+	}
+
+	if dryRun {
+		for _, b := range doomed {
+			fmt.Fprintf(outputWriter(c), "would delete %s (last modified %s)\n", b.Key, b.LastModified.Format(time.RFC3339))
+			log.Info("Dry run: would delete old file", "key", b.Key, "lastModified", b.LastModified)
 		}
+		fmt.Fprintf(outputWriter(c), "dry run: %d file(s) would be deleted\n", len(doomed))
 	}
 
+	if limit >= 0 && len(doomed) > limit {
+		log.Error("Prune aborted: too many files to delete",
+			"prefix", prefix, "toDelete", len(doomed), "total", len(files), "maxDelete", maxDelete)
+		return cli.Exit(fmt.Sprintf("Refusing to delete %d of %d files under %q (--max-delete %s); nothing was deleted",
+			len(doomed), len(files), prefix, maxDelete), 1)
+	}
+	if dryRun {
+		return nil
+	}
+
+	state, err := openPruneState(c, log)
+	if err != nil {
+		return err
+	}
+	if state != nil {
+		defer state.Close()
+	}
+
+	for _, b := range doomed {
+		err = uploader.Delete(c.Context, b.Key)
+		if err != nil {
+			log.Error("Failed to delete file", "key", b.Key, "error", err)
+			continue
+		}
+		log.Info("Deleted old file", "key", b.Key)
+
+		// The file would be skipped as uploaded if it came back unchanged
+		if destination := stateName(uploader); state != nil && destination != "" {
+			if err := state.forget(destination, b.Key); err != nil {
+				log.Error("Failed to remove file from state database", "key", b.Key, "error", err)
+			}
+		}
+
+		if checksums[checksumKey(b.Key)] {
+			if err := uploader.Delete(c.Context, checksumKey(b.Key)); err != nil {
+				log.Error("Failed to delete checksum", "key", checksumKey(b.Key), "error", err)
+			}
+		}
+	}
 	return nil
 }
 
-func fileUploadEligible(ctx context.Context, uploader Uploader, key string, info os.FileInfo, compressed bool, log logger.Logger) (bool, error) {
+// parseDeleteLimit returns the most files a prune may delete out of total, or
+// -1 for no limit. The limit is either a count ("50") or a percentage of the
+// files under the prefix ("25%").
+func parseDeleteLimit(value string, total int) (int, error) {
+	if value == "" {
+		return -1, nil
+	}
+
+	if percent, ok := strings.CutSuffix(value, "%"); ok {
+		p, err := strconv.ParseFloat(percent, 64)
+		if err != nil || p < 0 || p > 100 {
+			return 0, fmt.Errorf("invalid --max-delete %q: percentage must be between 0%% and 100%%", value)
+		}
+		return int(float64(total) * p / 100), nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid --max-delete %q: must be a count such as 50 or a percentage such as 25%%", value)
+	}
+	return n, nil
+}
+
+// inputReader returns where --stdin uploads are read from
+func inputReader(c *cli.Context) io.Reader {
+	if c.App != nil && c.App.Reader != nil {
+		return c.App.Reader
+	}
+	return os.Stdin
+}
+
+// outputWriter returns where command output such as listings and dry-run
+// reports is written
+func outputWriter(c *cli.Context) io.Writer {
+	if c.App != nil && c.App.Writer != nil {
+		return c.App.Writer
+	}
+	return os.Stdout
+}
+
+// splitDestinations divides the destinations of an upload that failed with
+// err into those that received the file and those to try again, either of
+// which may be nil. Only a fan-out upload can partly succeed.
+func splitDestinations(target Uploader, err error, log logger.Logger) (done, failed Uploader) {
+	if err == nil {
+		return target, nil
+	}
+	multi, ok := target.(*MultiUploader)
+	var destErr *DestinationError
+	if !ok || !errors.As(err, &destErr) {
+		return nil, target
+	}
+
+	var succeeded, remaining []Destination
+	for _, d := range multi.Destinations() {
+		if _, ok := destErr.Failed[d.Name]; ok {
+			remaining = append(remaining, d)
+		} else {
+			succeeded = append(succeeded, d)
+		}
+	}
+	// Both are subsets of a valid fan-out, so need no checking
+	if len(succeeded) > 0 {
+		done = &MultiUploader{destinations: succeeded, log: log}
+	}
+	if len(remaining) > 0 {
+		failed = &MultiUploader{destinations: remaining, log: log}
+	}
+	return done, failed
+}
+
+// reportPlannedUpload reports a file that a dry run would have uploaded,
+// along with the destinations it would go to for a fan-out upload
+func reportPlannedUpload(c *cli.Context, target Uploader, path, key string, log logger.Logger) {
+	multi, ok := target.(*MultiUploader)
+	if !ok {
+		fmt.Fprintf(outputWriter(c), "would upload %s -> %s\n", path, key)
+		log.Info("Dry run: would upload file", "file", path, "key", key)
+		return
+	}
+
+	names := make([]string, 0, len(multi.Destinations()))
+	for _, d := range multi.Destinations() {
+		names = append(names, d.Name)
+	}
+	fmt.Fprintf(outputWriter(c), "would upload %s -> %s (%s)\n", path, key, strings.Join(names, ", "))
+	log.Info("Dry run: would upload file", "file", path, "key", key, "destinations", names)
+}
+
+// eligibleUploader returns the uploader the file should be sent to, or nil if
+// it is already up to date. For a fan-out upload each destination is checked
+// separately, and only those missing the current file are returned.
+func eligibleUploader(ctx context.Context, uploader Uploader, key string, local localFile, compare string, state *stateDB, stateCheck bool, log logger.Logger) (Uploader, error) {
+	multi, ok := uploader.(*MultiUploader)
+	if !ok {
+		eligible, err := destinationEligible(ctx, uploader, key, local, compare, state, stateCheck, log)
+		if err != nil || !eligible {
+			return nil, err
+		}
+		return uploader, nil
+	}
+
+	var pending []Destination
+	for _, d := range multi.Destinations() {
+		eligible, err := destinationEligible(ctx, d.Uploader, key, local, compare, state, stateCheck, log)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", d.Name, err)
+		}
+		if eligible {
+			pending = append(pending, d)
+		} else {
+			log.Info("Skipping destination (already uploaded or not modified)", "destination", d.Name, "key", key)
+		}
+	}
+
+	switch len(pending) {
+	case 0:
+		return nil, nil
+	case len(multi.Destinations()):
+		return multi, nil
+	default:
+		return NewMultiUploader(pending, log)
+	}
+}
+
+// destinationEligible reports whether a local file should be uploaded to key
+// on one destination. When the state database shows the file was uploaded
+// there unchanged, storage is not asked at all, unless stateCheck is set to
+// look for stored copies deleted by something other than prune.
+func destinationEligible(ctx context.Context, uploader Uploader, key string, local localFile, compare string, state *stateDB, stateCheck bool, log logger.Logger) (bool, error) {
+	if !state.unchanged(stateName(uploader), key, local, compare, log) {
+		return uploadEligible(ctx, uploader, key, local, compare, log)
+	}
+	if !stateCheck {
+		return false, nil
+	}
+
+	exists, err := uploader.FileExists(ctx, key)
+	if err != nil {
+		log.Error("Error checking if file exists", "key", key, "error", err)
+		return false, err
+	}
+	if !exists {
+		log.Info("Recorded upload is missing from storage", "key", key)
+	}
+	return !exists, nil
+}
+
+func fileUploadEligible(ctx context.Context, uploader Uploader, key string, info os.FileInfo, transformed bool, log logger.Logger) (bool, error) {
 	exists, err := uploader.FileExists(ctx, key)
 	if err != nil {
 		log.Error("Error checking if file exists", "key", key, "error", err)
@@ -277,9 +1273,9 @@ func fileUploadEligible(ctx context.Context, uploader Uploader, key string, info
 		return true, nil
 	}
 
-	// Skip size comparison when compression is enabled since local (uncompressed)
-	// and remote (compressed) sizes will naturally differ
-	if !compressed && info.Size() != remoteInfo.Size {
+	// Skip size comparison when compression or encryption is enabled since
+	// local (plain) and remote (compressed or encrypted) sizes will naturally differ
+	if !transformed && info.Size() != remoteInfo.Size {
 		log.Info("File sizes differ", "key", key, "local_size", info.Size(), "remote_size", remoteInfo.Size)
 		return true, nil
 	}
@@ -3,17 +3,23 @@ package storage
 import (
 	"archive/zip"
 	"bytes"
+	"compress/gzip"
 	"context"
 	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 	"github.com/urfave/cli/v2"
 )
 
@@ -371,6 +377,286 @@ func TestPrune(t *testing.T) {
 	mockLogger.AssertExpectations(t)
 }
 
+func TestPrune_DryRun(t *testing.T) {
+	mockUploader := new(MockUploader)
+	mockLogger := NewMockLogger()
+
+	var out bytes.Buffer
+	app := &cli.App{Writer: &out}
+	set := flag.NewFlagSet("test", 0)
+	set.String("age", "24h", "doc")
+	set.Bool("dry-run", true, "doc")
+	ctx := cli.NewContext(app, set, nil)
+	ctx.Set("age", "24h")
+
+	mockUploader.On("List", mock.Anything, "").Return([]string{"old.bak", "new.bak"}, nil)
+	mockUploader.On("GetFileInfo", mock.Anything, "old.bak").Return(&FileInfo{LastModified: time.Now().Add(-48 * time.Hour)}, nil)
+	mockUploader.On("GetFileInfo", mock.Anything, "new.bak").Return(&FileInfo{LastModified: time.Now()}, nil)
+	mockLogger.On("Info", mock.Anything, mock.Anything).Return()
+
+	err := Prune(ctx, mockUploader, mockLogger)
+	assert.NoError(t, err)
+
+	assert.Contains(t, out.String(), "would delete old.bak")
+	assert.NotContains(t, out.String(), "new.bak")
+	assert.Contains(t, out.String(), "1 file(s) would be deleted")
+	mockUploader.AssertNotCalled(t, "Delete", mock.Anything, mock.Anything)
+}
+
+func TestUpload_DryRun(t *testing.T) {
+	tempDir := t.TempDir()
+	err := os.WriteFile(filepath.Join(tempDir, "new.bak"), []byte("new data"), 0644)
+	assert.NoError(t, err)
+	err = os.WriteFile(filepath.Join(tempDir, "current.bak"), []byte("current"), 0644)
+	assert.NoError(t, err)
+
+	mockUploader := new(MockUploader)
+	mockLogger := NewMockLogger()
+
+	mockUploader.On("FileExists", mock.Anything, "new.bak").Return(false, nil)
+	mockUploader.On("FileExists", mock.Anything, "current.bak").Return(true, nil)
+	mockUploader.On("GetFileInfo", mock.Anything, "current.bak").Return(&FileInfo{LastModified: time.Now().Add(time.Hour), Size: 7}, nil)
+	mockLogger.On("Info", mock.Anything, mock.Anything).Return()
+
+	var out bytes.Buffer
+	err = Upload(newUploadContext(t, &out, "--dry-run", tempDir), mockUploader, mockLogger)
+	assert.NoError(t, err)
+
+	assert.Contains(t, out.String(), "-> new.bak")
+	assert.NotContains(t, out.String(), "-> current.bak")
+	assert.Contains(t, out.String(), "1 file(s) would be uploaded")
+	mockUploader.AssertNotCalled(t, "Upload", mock.Anything, mock.Anything, mock.Anything)
+}
+
+// slowUploader records how many uploads run at once
+type slowUploader struct {
+	*LocalUploader
+	mu          sync.Mutex
+	inFlight    int
+	maxInFlight int
+	failKey     string
+}
+
+func (u *slowUploader) Upload(ctx context.Context, key string, reader io.Reader, size int64) error {
+	u.mu.Lock()
+	u.inFlight++
+	u.maxInFlight = max(u.maxInFlight, u.inFlight)
+	u.mu.Unlock()
+	defer func() {
+		u.mu.Lock()
+		u.inFlight--
+		u.mu.Unlock()
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	if key == u.failKey {
+		return errors.New("upload rejected")
+	}
+	return u.LocalUploader.Upload(ctx, key, reader, size)
+}
+
+// newUploadContext returns a context for Upload with the upload command's
+// flags, parsed from args, which end with the root directory. Output goes to
+// out.
+func newUploadContext(t *testing.T, out io.Writer, args ...string) *cli.Context {
+	t.Helper()
+
+	set := flag.NewFlagSet("test", 0)
+	set.Bool("non-interactive", true, "doc")
+	set.String("keyprefix", "", "doc")
+	set.String("backupext", ".bak", "doc")
+	set.String("compress", "", "doc")
+	set.Int("compress-level", 0, "doc")
+	set.Int("parallel", 1, "doc")
+	set.Bool("dry-run", false, "doc")
+	set.Bool("continue-on-error", false, "doc")
+	set.Bool("stdin", false, "doc")
+	set.String("key", "", "doc")
+	set.Bool("checksum", false, "doc")
+	set.String("compare", "", "doc")
+	set.Bool("state", false, "doc")
+	set.String("state-file", "", "doc")
+	set.Bool("state-check", false, "doc")
+	set.Bool("encrypt", false, "doc")
+	set.Var(cli.NewStringSlice(), "recipient", "doc")
+	set.String("recipients-file", "", "doc")
+	set.String("passphrase-file", "", "doc")
+	set.Int("retries", 0, "doc")
+	set.Duration("retry-backoff", time.Millisecond, "doc")
+	require.NoError(t, set.Parse(args))
+	return cli.NewContext(&cli.App{Writer: out}, set, nil)
+}
+
+// uploadFiles uploads with the flags in args, which end with the root
+// directory, and returns the names of the files that were uploaded
+func uploadFiles(t *testing.T, uploader Uploader, args ...string) []string {
+	t.Helper()
+
+	var uploaded []string
+	mockLogger := NewMockLogger()
+	mockLogger.On("Info", "File uploaded successfully", mock.Anything).Run(func(args mock.Arguments) {
+		uploaded = append(uploaded, filepath.Base(args.Get(1).([]interface{})[1].(string)))
+	}).Return()
+	mockLogger.On("Info", mock.Anything, mock.Anything).Return()
+
+	require.NoError(t, Upload(newUploadContext(t, io.Discard, args...), uploader, mockLogger))
+	return uploaded
+}
+
+func TestUpload_Parallel(t *testing.T) {
+	rootDir := t.TempDir()
+	for i := 0; i < 12; i++ {
+		name := filepath.Join(rootDir, fmt.Sprintf("log%02d.trn", i))
+		assert.NoError(t, os.WriteFile(name, []byte(strings.Repeat("x", 1000*i)), 0644))
+	}
+
+	local, basePath := newTestLocalUploader(t)
+	uploader := &slowUploader{LocalUploader: local}
+	mockLogger := NewMockLogger()
+	mockLogger.On("Info", mock.Anything, mock.Anything).Return()
+
+	var out bytes.Buffer
+	err := Upload(newUploadContext(t, &out, "--backupext", ".trn", "--parallel", "4", "--non-interactive=false", rootDir), uploader, mockLogger)
+	assert.NoError(t, err)
+
+	for i := 0; i < 12; i++ {
+		assert.FileExists(t, filepath.Join(basePath, fmt.Sprintf("log%02d.trn", i)))
+	}
+	assert.Equal(t, 4, uploader.maxInFlight)
+}
+
+func TestUpload_ParallelStopsOnError(t *testing.T) {
+	rootDir := t.TempDir()
+	for i := 0; i < 12; i++ {
+		name := filepath.Join(rootDir, fmt.Sprintf("log%02d.trn", i))
+		assert.NoError(t, os.WriteFile(name, []byte("log data"), 0644))
+	}
+
+	local, basePath := newTestLocalUploader(t)
+	uploader := &slowUploader{LocalUploader: local, failKey: "log01.trn"}
+	mockLogger := NewMockLogger()
+	mockLogger.On("Info", mock.Anything, mock.Anything).Return()
+	mockLogger.On("Error", mock.Anything, mock.Anything).Return()
+
+	var out bytes.Buffer
+	err := Upload(newUploadContext(t, &out, "--backupext", ".trn", "--parallel", "2", "--non-interactive=false", rootDir), uploader, mockLogger)
+	assert.EqualError(t, err, "upload rejected")
+
+	// Files still queued when the upload failed are not uploaded
+	assert.NoFileExists(t, filepath.Join(basePath, "log11.trn"))
+}
+
+func TestUpload_ContinueOnError(t *testing.T) {
+	rootDir := t.TempDir()
+	for i := 0; i < 12; i++ {
+		name := filepath.Join(rootDir, fmt.Sprintf("log%02d.trn", i))
+		assert.NoError(t, os.WriteFile(name, []byte("log data"), 0644))
+	}
+
+	local, basePath := newTestLocalUploader(t)
+	uploader := &slowUploader{LocalUploader: local, failKey: "log01.trn"}
+	mockLogger := NewMockLogger()
+	mockLogger.On("Info", mock.Anything, mock.Anything).Return()
+	mockLogger.On("Error", mock.Anything, mock.Anything).Return()
+
+	var out bytes.Buffer
+	c := newUploadContext(t, &out, "--backupext", ".trn", "--parallel", "2", "--non-interactive=false", "--continue-on-error", rootDir)
+	err := Upload(c, uploader, mockLogger)
+
+	var exitErr cli.ExitCoder
+	if assert.ErrorAs(t, err, &exitErr) {
+		assert.Equal(t, 1, exitErr.ExitCode())
+	}
+	assert.EqualError(t, err, "1 file(s) failed to upload")
+
+	// The walk went on past the failed file
+	assert.NoFileExists(t, filepath.Join(basePath, "log01.trn"))
+	assert.FileExists(t, filepath.Join(basePath, "log11.trn"))
+	assert.Contains(t, out.String(), "FAILED")
+	assert.Contains(t, out.String(), "log01.trn (upload rejected)")
+	assert.Contains(t, out.String(), "uploaded 11 file(s)")
+	assert.Contains(t, out.String(), "1 failed")
+}
+
+func TestUpload_WalkErrorCounted(t *testing.T) {
+	uploader, _ := newTestLocalUploader(t)
+	mockLogger := NewMockLogger()
+	mockLogger.On("Info", mock.Anything, mock.Anything).Return()
+	mockLogger.On("Error", mock.Anything, mock.Anything).Return()
+
+	// The run stops at the error, which is still in the summary
+	var out bytes.Buffer
+	missing := filepath.Join(t.TempDir(), "missing")
+	err := Upload(newUploadContext(t, &out, missing), uploader, mockLogger)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	assert.Contains(t, out.String(), "FAILED   "+missing)
+	assert.Contains(t, out.String(), "1 failed")
+}
+
+func newStdinUploadContext(t *testing.T, input string, out io.Writer, args ...string) *cli.Context {
+	t.Helper()
+	c := newUploadContext(t, out, append([]string{"--stdin", "--checksum"}, args...)...)
+	c.App.Reader = strings.NewReader(input)
+	return c
+}
+
+func TestUpload_Stdin(t *testing.T) {
+	uploader, basePath := newTestLocalUploader(t)
+	mockLogger := NewMockLogger()
+	mockLogger.On("Info", mock.Anything, mock.Anything).Return()
+
+	var out bytes.Buffer
+	c := newStdinUploadContext(t, "pg_dump output", &out, "--keyprefix", "db/", "--key", "prod.sql")
+	assert.NoError(t, Upload(c, uploader, mockLogger))
+
+	data, err := os.ReadFile(filepath.Join(basePath, "db", "prod.sql"))
+	assert.NoError(t, err)
+	assert.Equal(t, "pg_dump output", string(data))
+	assert.FileExists(t, filepath.Join(basePath, "db", "prod.sql.sha256"))
+	assert.Contains(t, out.String(), "uploaded 1 file(s) (14 B)")
+}
+
+func TestUpload_StdinCompressed(t *testing.T) {
+	uploader, basePath := newTestLocalUploader(t)
+	mockLogger := NewMockLogger()
+	mockLogger.On("Info", mock.Anything, mock.Anything).Return()
+
+	c := newStdinUploadContext(t, "pg_dump output", io.Discard, "--compress", "gzip", "--key", "prod.sql")
+	assert.NoError(t, Upload(c, uploader, mockLogger))
+
+	file, err := os.Open(filepath.Join(basePath, "prod.sql.gz"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if assert.NoError(t, err) {
+		data, err := io.ReadAll(gz)
+		assert.NoError(t, err)
+		assert.Equal(t, "pg_dump output", string(data))
+	}
+
+	// The checksum names and sizes the stream as read, for --decompress
+	content, err := os.ReadFile(filepath.Join(basePath, "prod.sql.gz.sha256"))
+	assert.NoError(t, err)
+	record, err := parseChecksum(string(content), "prod.sql.gz")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "prod.sql", record.SourceName)
+		assert.Equal(t, int64(14), record.SourceSize)
+	}
+}
+
+func TestUpload_StdinNeedsKey(t *testing.T) {
+	uploader, _ := newTestLocalUploader(t)
+	mockLogger := NewMockLogger()
+
+	err := Upload(newStdinUploadContext(t, "data", io.Discard), uploader, mockLogger)
+	assert.EqualError(t, err, "--stdin needs --key to name the uploaded file")
+
+	err = Upload(newStdinUploadContext(t, "data", io.Discard, "--key", "prod.sql", "/var/backups"), uploader, mockLogger)
+	assert.EqualError(t, err, "--stdin uploads standard input, so no root directory can be given")
+}
+
 // mockFileInfo is a mock implementation of os.FileInfo for testing
 type mockFileInfo struct {
 	name    string
@@ -502,3 +788,117 @@ func TestPrune_DeleteError(t *testing.T) {
 
 	mockUploader.AssertExpectations(t)
 }
+
+func TestNewGenericS3Uploader(t *testing.T) {
+	mockLogger := NewMockLogger()
+	mockLogger.On("Info", mock.Anything, mock.Anything).Return()
+
+	uploader, err := NewGenericS3Uploader(S3CompatConfig{
+		Endpoint:  "http://localhost:9000",
+		Bucket:    "backups",
+		AccessKey: "minioadmin",
+		SecretKey: "minioadmin",
+		PathStyle: true,
+	}, nil, mockLogger)
+	assert.NoError(t, err)
+
+	opts := uploader.Client.Options()
+	assert.Equal(t, "http://localhost:9000", *opts.BaseEndpoint)
+	assert.True(t, opts.UsePathStyle)
+	assert.Equal(t, "us-east-1", opts.Region)
+	assert.Equal(t, "s3compat", uploader.ProviderName)
+	assert.Equal(t, "backups", uploader.Bucket)
+}
+
+func TestNewGenericS3Uploader_InvalidConfig(t *testing.T) {
+	tempDir := t.TempDir()
+	badBundle := filepath.Join(tempDir, "ca.pem")
+	err := os.WriteFile(badBundle, []byte("not a certificate"), 0644)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name string
+		cfg  S3CompatConfig
+	}{
+		{"Missing endpoint", S3CompatConfig{Bucket: "backups"}},
+		{"Access key without secret", S3CompatConfig{Endpoint: "http://localhost:9000", AccessKey: "key"}},
+		{"Missing CA bundle", S3CompatConfig{Endpoint: "http://localhost:9000", CABundle: filepath.Join(tempDir, "missing.pem")}},
+		{"Invalid CA bundle", S3CompatConfig{Endpoint: "http://localhost:9000", CABundle: badBundle}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uploader, err := NewGenericS3Uploader(tt.cfg, nil, NewMockLogger())
+			assert.Error(t, err)
+			assert.Nil(t, uploader)
+		})
+	}
+}
+
+func TestNewAzureUploader(t *testing.T) {
+	// Well-known Azurite development account
+	azuriteConnStr := "DefaultEndpointsProtocol=http;AccountName=devstoreaccount1;" +
+		"AccountKey=Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw==;" +
+		"BlobEndpoint=http://127.0.0.1:10000/devstoreaccount1;"
+
+	tests := []struct {
+		name        string
+		env         map[string]string
+		expectedURL string
+		expectErr   bool
+	}{
+		{
+			name:      "No credentials",
+			env:       map[string]string{},
+			expectErr: true,
+		},
+		{
+			name:      "Account without key",
+			env:       map[string]string{"AZURE_STORAGE_ACCOUNT": "myaccount"},
+			expectErr: true,
+		},
+		{
+			name:        "Connection string",
+			env:         map[string]string{"AZURE_STORAGE_CONNECTION_STRING": azuriteConnStr},
+			expectedURL: "http://127.0.0.1:10000/devstoreaccount1/",
+		},
+		{
+			name: "Account and key",
+			env: map[string]string{
+				"AZURE_STORAGE_ACCOUNT": "myaccount",
+				"AZURE_STORAGE_KEY":     "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw==",
+			},
+			expectedURL: "https://myaccount.blob.core.windows.net/",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"AZURE_STORAGE_CONNECTION_STRING", "AZURE_STORAGE_ACCOUNT", "AZURE_STORAGE_KEY"} {
+				t.Setenv(name, tt.env[name])
+			}
+
+			mockLogger := NewMockLogger()
+			mockLogger.On("Info", mock.Anything, mock.Anything).Return()
+
+			uploader, err := NewAzureUploader("backups", nil, mockLogger)
+			if tt.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedURL, uploader.client.URL())
+		})
+	}
+}
+
+func TestIsNotFoundError_Azure(t *testing.T) {
+	assert.True(t, isNotFoundError(&azcore.ResponseError{StatusCode: 404, ErrorCode: "BlobNotFound"}))
+	assert.False(t, isNotFoundError(&azcore.ResponseError{StatusCode: 500, ErrorCode: "InternalError"}))
+	assert.True(t, isAccessDeniedError(&azcore.ResponseError{StatusCode: 403, ErrorCode: "AuthorizationPermissionMismatch"}))
+
+	err := formatDownloadError("azure", "db.bak", &azcore.ResponseError{StatusCode: 403, ErrorCode: "AuthenticationFailed"})
+	var userErr *UserError
+	assert.True(t, errors.As(err, &userErr))
+	assert.Contains(t, userErr.Message, "Invalid Azure credentials")
+}
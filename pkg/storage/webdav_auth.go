@@ -0,0 +1,184 @@
+package storage
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// webdavAuth holds the authentication scheme negotiated with a WebDAV server.
+// The zero value sends no credentials.
+type webdavAuth struct {
+	scheme string // "", "basic" or "digest"
+
+	// digest challenge parameters (RFC 7616)
+	realm     string
+	nonce     string
+	opaque    string
+	algorithm string
+	qop       string
+	nc        uint32
+}
+
+// update records the strongest supported challenge from WWW-Authenticate
+// headers, preferring digest over basic. It reports whether a usable challenge
+// was found.
+func (a *webdavAuth) update(challenges []string) bool {
+	basic := false
+	for _, challenge := range challenges {
+		scheme, params, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+		switch strings.ToLower(scheme) {
+		case "digest":
+			if a.setDigest(parseAuthParams(params)) {
+				return true
+			}
+		case "basic":
+			basic = true
+		}
+	}
+
+	if basic {
+		*a = webdavAuth{scheme: "basic"}
+	}
+	return basic
+}
+
+func (a *webdavAuth) setDigest(params map[string]string) bool {
+	algorithm := strings.ToUpper(params["algorithm"])
+	switch algorithm {
+	case "", "MD5", "MD5-SESS", "SHA-256", "SHA-256-SESS":
+	default:
+		return false
+	}
+
+	// Only qop=auth is supported; auth-int would need the body hashed up front
+	qop := ""
+	if offered, ok := params["qop"]; ok {
+		for _, q := range strings.Split(offered, ",") {
+			if strings.TrimSpace(q) == "auth" {
+				qop = "auth"
+			}
+		}
+		if qop == "" {
+			return false
+		}
+	}
+
+	*a = webdavAuth{
+		scheme:    "digest",
+		realm:     params["realm"],
+		nonce:     params["nonce"],
+		opaque:    params["opaque"],
+		algorithm: params["algorithm"],
+		qop:       qop,
+	}
+	return true
+}
+
+// header returns the Authorization header for a request, or "" when no
+// scheme has been negotiated yet
+func (a *webdavAuth) header(method, uri, username, password string) string {
+	switch a.scheme {
+	case "basic":
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+	case "digest":
+		return a.digest(method, uri, username, password)
+	default:
+		return ""
+	}
+}
+
+func (a *webdavAuth) digest(method, uri, username, password string) string {
+	newHash := md5.New
+	algorithm := strings.ToUpper(a.algorithm)
+	if strings.HasPrefix(algorithm, "SHA-256") {
+		newHash = sha256.New
+	}
+	h := func(s string) string {
+		return hashHex(newHash, s)
+	}
+
+	a.nc++
+	nc := fmt.Sprintf("%08x", a.nc)
+	cnonce := newCnonce()
+
+	ha1 := h(username + ":" + a.realm + ":" + password)
+	if strings.HasSuffix(algorithm, "-SESS") {
+		ha1 = h(ha1 + ":" + a.nonce + ":" + cnonce)
+	}
+	ha2 := h(method + ":" + uri)
+
+	var response string
+	if a.qop != "" {
+		response = h(strings.Join([]string{ha1, a.nonce, nc, cnonce, a.qop, ha2}, ":"))
+	} else {
+		response = h(ha1 + ":" + a.nonce + ":" + ha2)
+	}
+
+	fields := []string{
+		fmt.Sprintf("username=%q", username),
+		fmt.Sprintf("realm=%q", a.realm),
+		fmt.Sprintf("nonce=%q", a.nonce),
+		fmt.Sprintf("uri=%q", uri),
+		fmt.Sprintf("response=%q", response),
+	}
+	if a.algorithm != "" {
+		fields = append(fields, "algorithm="+a.algorithm)
+	}
+	if a.opaque != "" {
+		fields = append(fields, fmt.Sprintf("opaque=%q", a.opaque))
+	}
+	if a.qop != "" {
+		fields = append(fields, "qop="+a.qop, "nc="+nc, fmt.Sprintf("cnonce=%q", cnonce))
+	}
+	return "Digest " + strings.Join(fields, ", ")
+}
+
+// parseAuthParams parses the comma separated name=value pairs of a challenge,
+// where values may be quoted strings
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		name, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			return params
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		rest = strings.TrimLeft(rest, " \t")
+
+		var value strings.Builder
+		if strings.HasPrefix(rest, `"`) {
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				value.WriteByte(rest[i])
+			}
+			s = rest[min(i+1, len(rest)):]
+		} else {
+			token, remainder, _ := strings.Cut(rest, ",")
+			value.WriteString(strings.TrimSpace(token))
+			s = remainder
+		}
+		params[name] = value.String()
+	}
+}
+
+func hashHex(newHash func() hash.Hash, s string) string {
+	hasher := newHash()
+	hasher.Write([]byte(s))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+func newCnonce() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,469 @@
+package storage
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ngns-io/baxfer/pkg/logger"
+)
+
+// webdavPropfindBody requests only the properties baxfer needs
+const webdavPropfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:"><d:prop><d:resourcetype/><d:getcontentlength/><d:getlastmodified/></d:prop></d:propfind>`
+
+// WebDAVUploader stores files on a WebDAV share such as Nextcloud, ownCloud or
+// Apache mod_dav. The authentication scheme (basic or digest) is taken from the
+// server's first challenge and reused for every later request.
+type WebDAVUploader struct {
+	httpClient *http.Client
+	baseURL    *url.URL
+	username   string
+	password   string
+	log        logger.Logger
+
+	mu          sync.Mutex
+	auth        webdavAuth
+	collections map[string]bool // collections known to exist
+}
+
+// webdavError is returned for any non-success response from the server
+type webdavError struct {
+	Method     string
+	Path       string
+	StatusCode int
+}
+
+func (e *webdavError) Error() string {
+	return fmt.Sprintf("webdav: %s %s: status code %d (%s)", e.Method, e.Path, e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// webdavEntry is a file or collection returned by PROPFIND
+type webdavEntry struct {
+	Path         string // unescaped URL path
+	IsDir        bool
+	Size         int64
+	LastModified time.Time
+}
+
+func NewWebDAVUploader(rawURL, username string, creds Credentials, log logger.Logger) (*WebDAVUploader, error) {
+	if rawURL == "" {
+		return nil, fmt.Errorf("no URL provided for WebDAV storage")
+	}
+
+	baseURL, err := url.Parse(rawURL)
+	if err != nil || baseURL.Host == "" || (baseURL.Scheme != "http" && baseURL.Scheme != "https") {
+		return nil, fmt.Errorf("invalid WebDAV URL: %s", rawURL)
+	}
+
+	password := creds.Get("WEBDAV_PASSWORD")
+
+	// Credentials embedded in the URL are used when not given separately, but
+	// never sent or logged as part of it
+	if baseURL.User != nil {
+		if username == "" {
+			username = baseURL.User.Username()
+		}
+		if p, ok := baseURL.User.Password(); ok && password == "" {
+			password = p
+		}
+		baseURL.User = nil
+	}
+
+	// Keys are resolved beneath the URL, so treat it as a collection
+	if !strings.HasSuffix(baseURL.Path, "/") {
+		baseURL.Path += "/"
+	}
+	baseURL.RawPath = ""
+
+	uploader := &WebDAVUploader{
+		httpClient:  &http.Client{},
+		baseURL:     baseURL,
+		username:    username,
+		password:    password,
+		log:         log,
+		collections: make(map[string]bool),
+	}
+
+	// Checks the connection and credentials up front, and creates the base
+	// collection if it doesn't exist
+	ctx := context.Background()
+	if _, err := uploader.propfind(ctx, baseURL, "0"); err != nil {
+		if !isNotFoundError(err) {
+			return nil, fmt.Errorf("failed to connect to WebDAV server: %w", err)
+		}
+		if err := uploader.mkcol(ctx, baseURL); err != nil {
+			return nil, fmt.Errorf("failed to create base collection: %w", err)
+		}
+	}
+
+	log.Info("Initialized storage provider",
+		"provider", "WebDAV",
+		"url", baseURL.String(),
+		"username", username)
+
+	return uploader, nil
+}
+
+// keyURL returns the URL of key beneath the base collection
+func (u *WebDAVUploader) keyURL(key string) *url.URL {
+	target := *u.baseURL
+	target.Path = u.baseURL.Path + strings.TrimPrefix(key, "/")
+	return &target
+}
+
+// do sends the request, answering an authentication challenge if the server
+// returns one, and converts non-2xx responses into a webdavError. The caller
+// must close the body of a returned response.
+func (u *WebDAVUploader) do(req *http.Request, okStatus ...int) (*http.Response, error) {
+	u.authorize(req)
+	resp, err := u.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized && u.challenged(resp) {
+		if retry, ok := rewindRequest(req); ok {
+			resp.Body.Close()
+			u.authorize(retry)
+			resp, err = u.httpClient.Do(retry)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	for _, status := range okStatus {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+
+	resp.Body.Close()
+	return nil, &webdavError{Method: req.Method, Path: req.URL.Path, StatusCode: resp.StatusCode}
+}
+
+// authorize adds credentials for the negotiated scheme. Nothing is sent until
+// the server has challenged, so a password is never sent as basic auth to a
+// server that expects digest.
+func (u *WebDAVUploader) authorize(req *http.Request) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if header := u.auth.header(req.Method, req.URL.RequestURI(), u.username, u.password); header != "" {
+		req.Header.Set("Authorization", header)
+	}
+}
+
+// challenged records the challenge from a 401 response and reports whether
+// the request is worth retrying with credentials
+func (u *WebDAVUploader) challenged(resp *http.Response) bool {
+	if u.username == "" && u.password == "" {
+		return false
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.auth.update(resp.Header.Values("WWW-Authenticate"))
+}
+
+// rewindRequest returns a copy of req that can be sent again, if its body has
+// not been consumed
+func rewindRequest(req *http.Request) (*http.Request, bool) {
+	retry := req.Clone(req.Context())
+	if req.Body == nil || req.Body == http.NoBody {
+		return retry, true
+	}
+	if req.GetBody == nil {
+		return nil, false
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, false
+	}
+	retry.Body = body
+	return retry, true
+}
+
+// streamBody wraps an upload stream so a PUT rejected before any of the body
+// was sent (an auth challenge answered to Expect: 100-continue) can be resent
+// from the same stream
+type streamBody struct {
+	reader io.Reader
+	read   bool
+}
+
+func (b *streamBody) Read(p []byte) (int, error) {
+	b.read = true
+	return b.reader.Read(p)
+}
+
+func (b *streamBody) getBody() (io.ReadCloser, error) {
+	if b.read {
+		return nil, errors.New("upload stream already consumed")
+	}
+	return io.NopCloser(b), nil
+}
+
+func (u *WebDAVUploader) Upload(ctx context.Context, key string, reader io.Reader, size int64) error {
+	if err := u.mkcolAll(ctx, path.Dir(key)); err != nil {
+		return fmt.Errorf("failed to create directory structure: %w", err)
+	}
+
+	body := &streamBody{reader: reader}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.keyURL(key).String(), body)
+	if err != nil {
+		return err
+	}
+	if size >= 0 {
+		req.ContentLength = size
+	}
+	req.GetBody = body.getBody
+	req.Header.Set("Content-Type", "application/octet-stream")
+	// Lets the server reject the request before the backup is streamed
+	req.Header.Set("Expect", "100-continue")
+
+	resp, err := u.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// mkcolAll creates dir and any missing parent collections beneath the base URL
+func (u *WebDAVUploader) mkcolAll(ctx context.Context, dir string) error {
+	if dir == "." || dir == "" {
+		return nil
+	}
+
+	parts := strings.Split(strings.Trim(dir, "/"), "/")
+	for i := range parts {
+		collection := strings.Join(parts[:i+1], "/") + "/"
+
+		u.mu.Lock()
+		known := u.collections[collection]
+		u.mu.Unlock()
+		if known {
+			continue
+		}
+
+		if err := u.mkcol(ctx, u.keyURL(collection)); err != nil {
+			return err
+		}
+
+		u.mu.Lock()
+		u.collections[collection] = true
+		u.mu.Unlock()
+	}
+	return nil
+}
+
+func (u *WebDAVUploader) mkcol(ctx context.Context, target *url.URL) error {
+	req, err := http.NewRequestWithContext(ctx, "MKCOL", target.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	// 405 Method Not Allowed means the collection already exists
+	resp, err := u.do(req, http.StatusMethodNotAllowed)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (u *WebDAVUploader) Download(ctx context.Context, key string, writer io.Writer) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.keyURL(key).String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := u.do(req)
+	if err != nil {
+		return formatDownloadError("webdav", key, err)
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(writer, resp.Body)
+	if err != nil {
+		return &UserError{
+			Message: fmt.Sprintf("Error reading file content: %s", key),
+			Cause:   err,
+		}
+	}
+	return nil
+}
+
+func (u *WebDAVUploader) List(ctx context.Context, prefix string) ([]string, error) {
+	// Prefixes are matched as strings like object storage keys, so start from
+	// the collection portion and filter the rest
+	dir := ""
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = prefix[:i+1]
+	}
+
+	var keys []string
+	err := u.walk(ctx, dir, prefix, &keys)
+	if err != nil {
+		// Nothing has been stored under this prefix yet
+		if isNotFoundError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return keys, nil
+}
+
+// walk lists the collection dir one level at a time, since many servers
+// refuse PROPFIND with Depth: infinity
+func (u *WebDAVUploader) walk(ctx context.Context, dir, prefix string, keys *[]string) error {
+	dirURL := u.keyURL(dir)
+	entries, err := u.propfind(ctx, dirURL, "1")
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		key, ok := strings.CutPrefix(entry.Path, u.baseURL.Path)
+		if !ok || strings.TrimSuffix(entry.Path, "/") == strings.TrimSuffix(dirURL.Path, "/") {
+			continue
+		}
+
+		if entry.IsDir {
+			key = strings.TrimSuffix(key, "/") + "/"
+			// Only descend into collections that can contain matching keys
+			if strings.HasPrefix(key, prefix) || strings.HasPrefix(prefix, key) {
+				if err := u.walk(ctx, key, prefix, keys); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if strings.HasPrefix(key, prefix) {
+			*keys = append(*keys, key)
+		}
+	}
+	return nil
+}
+
+func (u *WebDAVUploader) Delete(ctx context.Context, key string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, u.keyURL(key).String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := u.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (u *WebDAVUploader) FileExists(ctx context.Context, key string) (bool, error) {
+	_, err := u.GetFileInfo(ctx, key)
+	if err != nil {
+		if isNotFoundError(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (u *WebDAVUploader) GetFileInfo(ctx context.Context, key string) (*FileInfo, error) {
+	entries, err := u.propfind(ctx, u.keyURL(key), "0")
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("incomplete PROPFIND response from WebDAV server for key: %s", key)
+	}
+
+	entry := entries[0]
+	if entry.IsDir {
+		return nil, fmt.Errorf("key is a WebDAV collection, not a file: %s", key)
+	}
+
+	return &FileInfo{
+		LastModified: entry.LastModified,
+		Size:         entry.Size,
+	}, nil
+}
+
+// propfind returns the properties of target and, with depth "1", its members
+func (u *WebDAVUploader) propfind(ctx context.Context, target *url.URL, depth string) ([]webdavEntry, error) {
+	req, err := http.NewRequestWithContext(ctx, "PROPFIND", target.String(), strings.NewReader(webdavPropfindBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	req.Header.Set("Depth", depth)
+
+	resp, err := u.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var multistatus struct {
+		Responses []struct {
+			Href      string `xml:"DAV: href"`
+			Propstats []struct {
+				Status string `xml:"DAV: status"`
+				Prop   struct {
+					ResourceType struct {
+						Collection *struct{} `xml:"DAV: collection"`
+					} `xml:"DAV: resourcetype"`
+					ContentLength string `xml:"DAV: getcontentlength"`
+					LastModified  string `xml:"DAV: getlastmodified"`
+				} `xml:"DAV: prop"`
+			} `xml:"DAV: propstat"`
+		} `xml:"DAV: response"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&multistatus); err != nil {
+		return nil, fmt.Errorf("invalid PROPFIND response from WebDAV server: %w", err)
+	}
+
+	entries := make([]webdavEntry, 0, len(multistatus.Responses))
+	for _, r := range multistatus.Responses {
+		href, err := url.Parse(strings.TrimSpace(r.Href))
+		if err != nil {
+			return nil, fmt.Errorf("invalid href in PROPFIND response: %s", r.Href)
+		}
+
+		entry := webdavEntry{Path: href.Path}
+		for _, ps := range r.Propstats {
+			// Properties the server doesn't have are reported under a 404 propstat
+			if !strings.Contains(ps.Status, " 200 ") {
+				continue
+			}
+			if ps.Prop.ResourceType.Collection != nil {
+				entry.IsDir = true
+			}
+			if size, err := strconv.ParseInt(ps.Prop.ContentLength, 10, 64); err == nil {
+				entry.Size = size
+			}
+			if modTime, err := http.ParseTime(ps.Prop.LastModified); err == nil {
+				entry.LastModified = modTime
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
@@ -0,0 +1,209 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/webdav"
+)
+
+func newWebDAVHandler() http.Handler {
+	return &webdav.Handler{
+		FileSystem: webdav.NewMemFS(),
+		LockSystem: webdav.NewMemLS(),
+	}
+}
+
+// basicAuthHandler requires basic authentication in front of next
+func basicAuthHandler(user, pass string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		if !ok || u != user || p != pass {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// digestAuthHandler requires MD5 digest authentication with qop=auth in front
+// of next. The nonce changes after every authenticated request, so each
+// request is first rejected and then retried with the new challenge.
+type digestAuthHandler struct {
+	user, pass string
+	next       http.Handler
+
+	mu     sync.Mutex
+	nonce  int
+	issued int
+}
+
+func (d *digestAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	nonce := fmt.Sprintf("nonce-%d", d.nonce)
+	valid := d.valid(r, nonce)
+	if valid {
+		d.nonce++
+	} else {
+		d.issued++
+	}
+	d.mu.Unlock()
+
+	if !valid {
+		w.Header().Set("WWW-Authenticate",
+			fmt.Sprintf(`Digest realm="test", nonce="%s", qop="auth", algorithm=MD5, opaque="xyz"`, nonce))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	d.next.ServeHTTP(w, r)
+}
+
+func (d *digestAuthHandler) valid(r *http.Request, nonce string) bool {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Digest ") {
+		return false
+	}
+	params := parseAuthParams(strings.TrimPrefix(header, "Digest "))
+
+	md5hex := func(s string) string {
+		sum := md5.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	ha1 := md5hex(d.user + ":test:" + d.pass)
+	ha2 := md5hex(r.Method + ":" + r.URL.RequestURI())
+	expected := md5hex(ha1 + ":" + nonce + ":" + params["nc"] + ":" + params["cnonce"] + ":auth:" + ha2)
+
+	return params["username"] == d.user &&
+		params["nonce"] == nonce &&
+		params["opaque"] == "xyz" &&
+		params["uri"] == r.URL.RequestURI() &&
+		params["response"] == expected
+}
+
+func newTestWebDAVUploader(t *testing.T, handler http.Handler, user, pass string) (*WebDAVUploader, error) {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	t.Setenv("WEBDAV_PASSWORD", pass)
+
+	mockLogger := NewMockLogger()
+	mockLogger.On("Info", mock.Anything, mock.Anything).Return()
+
+	return NewWebDAVUploader(server.URL+"/backups", user, nil, mockLogger)
+}
+
+func TestWebDAVUploader_RoundTrip(t *testing.T) {
+	uploader, err := newTestWebDAVUploader(t, basicAuthHandler("backup", "secret", newWebDAVHandler()), "backup", "secret")
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	data := []byte("webdav backup data")
+	err = uploader.Upload(ctx, "db/2024 full.bak", bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+
+	exists, err := uploader.FileExists(ctx, "db/2024 full.bak")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	info, err := uploader.GetFileInfo(ctx, "db/2024 full.bak")
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), info.Size)
+	assert.False(t, info.LastModified.IsZero())
+
+	var buf bytes.Buffer
+	err = uploader.Download(ctx, "db/2024 full.bak", &buf)
+	assert.NoError(t, err)
+	assert.Equal(t, data, buf.Bytes())
+
+	err = uploader.Delete(ctx, "db/2024 full.bak")
+	assert.NoError(t, err)
+
+	exists, err = uploader.FileExists(ctx, "db/2024 full.bak")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestWebDAVUploader_DigestAuth(t *testing.T) {
+	digest := &digestAuthHandler{user: "backup", pass: "secret", next: newWebDAVHandler()}
+	uploader, err := newTestWebDAVUploader(t, digest, "backup", "secret")
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	// A stream that can't be rewound must still survive the re-challenge,
+	// since the body is held back until the server accepts the request
+	data := strings.Repeat("digest protected data ", 1000)
+	err = uploader.Upload(ctx, "db/full.bak", io.MultiReader(strings.NewReader(data)), -1)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	err = uploader.Download(ctx, "db/full.bak", &buf)
+	require.NoError(t, err)
+	assert.Equal(t, data, buf.String())
+	assert.Greater(t, digest.issued, 2, "requests should have been re-challenged")
+}
+
+func TestWebDAVUploader_InvalidCredentials(t *testing.T) {
+	_, err := newTestWebDAVUploader(t, basicAuthHandler("backup", "secret", newWebDAVHandler()), "backup", "wrong")
+	require.Error(t, err)
+
+	var davErr *webdavError
+	require.True(t, errors.As(err, &davErr))
+	assert.Equal(t, http.StatusUnauthorized, davErr.StatusCode)
+}
+
+func TestWebDAVUploader_List(t *testing.T) {
+	uploader, err := newTestWebDAVUploader(t, newWebDAVHandler(), "", "")
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	for _, key := range []string{"a/one.bak", "a/two.bak", "a/deep/five.bak", "ab/three.bak", "b/four.bak"} {
+		err := uploader.Upload(ctx, key, strings.NewReader(key), int64(len(key)))
+		require.NoError(t, err)
+	}
+
+	tests := []struct {
+		prefix   string
+		expected []string
+	}{
+		{"", []string{"a/one.bak", "a/two.bak", "a/deep/five.bak", "ab/three.bak", "b/four.bak"}},
+		{"a", []string{"a/one.bak", "a/two.bak", "a/deep/five.bak", "ab/three.bak"}},
+		{"a/", []string{"a/one.bak", "a/two.bak", "a/deep/five.bak"}},
+		{"a/t", []string{"a/two.bak"}},
+		{"missing/", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run("prefix="+tt.prefix, func(t *testing.T) {
+			keys, err := uploader.List(ctx, tt.prefix)
+			assert.NoError(t, err)
+			assert.ElementsMatch(t, tt.expected, keys)
+		})
+	}
+}
+
+func TestWebDAVUploader_DownloadNotFound(t *testing.T) {
+	uploader, err := newTestWebDAVUploader(t, newWebDAVHandler(), "", "")
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	err = uploader.Download(context.Background(), "missing.bak", &buf)
+
+	var userErr *UserError
+	require.True(t, errors.As(err, &userErr))
+	assert.Equal(t, "File not found: missing.bak", userErr.Message)
+}
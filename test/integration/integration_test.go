@@ -28,31 +28,85 @@ func getProviderConfigs() []providerConfig {
 		{
 			name: "S3",
 			uploader: func(log logger.Logger) (storage.Uploader, error) {
-				return storage.NewS3Uploader(os.Getenv("AWS_REGION"), os.Getenv("AWS_BUCKET"), log)
+				return storage.NewS3Uploader(os.Getenv("AWS_REGION"), os.Getenv("AWS_BUCKET"), nil, log)
 			},
 			requiredEnvVars: []string{"AWS_REGION", "AWS_BUCKET", "AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY"},
 		},
 		{
 			name: "B2",
 			uploader: func(log logger.Logger) (storage.Uploader, error) {
-				return storage.NewB2Uploader(os.Getenv("B2_BUCKET"), log)
+				return storage.NewB2Uploader(os.Getenv("B2_BUCKET"), nil, log)
 			},
 			requiredEnvVars: []string{"B2_BUCKET", "B2_KEY_ID", "B2_APP_KEY"},
 		},
 		{
 			name: "B2S3",
 			uploader: func(log logger.Logger) (storage.Uploader, error) {
-				return storage.NewB2S3Uploader(os.Getenv("AWS_REGION"), os.Getenv("B2_BUCKET"), log)
+				return storage.NewB2S3Uploader(os.Getenv("AWS_REGION"), os.Getenv("B2_BUCKET"), nil, log)
 			},
 			requiredEnvVars: []string{"AWS_REGION", "B2_BUCKET", "B2_KEY_ID", "B2_APP_KEY"},
 		},
 		{
 			name: "R2",
 			uploader: func(log logger.Logger) (storage.Uploader, error) {
-				return storage.NewR2Uploader(os.Getenv("R2_BUCKET"), log)
+				return storage.NewR2Uploader(os.Getenv("R2_BUCKET"), nil, log)
 			},
 			requiredEnvVars: []string{"R2_BUCKET", "CF_ACCOUNT_ID", "CF_ACCESS_KEY_ID", "CF_ACCESS_KEY_SECRET"},
 		},
+		{
+			name: "S3Compat",
+			uploader: func(log logger.Logger) (storage.Uploader, error) {
+				return storage.NewGenericS3Uploader(storage.S3CompatConfig{
+					Endpoint:  os.Getenv("S3COMPAT_ENDPOINT"),
+					Region:    os.Getenv("S3COMPAT_REGION"),
+					Bucket:    os.Getenv("S3COMPAT_BUCKET"),
+					AccessKey: os.Getenv("S3COMPAT_ACCESS_KEY"),
+					SecretKey: os.Getenv("S3COMPAT_SECRET_KEY"),
+					PathStyle: os.Getenv("S3COMPAT_PATH_STYLE") == "true",
+					CABundle:  os.Getenv("S3COMPAT_CA_BUNDLE"),
+				}, nil, log)
+			},
+			requiredEnvVars: []string{"S3COMPAT_ENDPOINT", "S3COMPAT_BUCKET", "S3COMPAT_ACCESS_KEY", "S3COMPAT_SECRET_KEY"},
+		},
+		{
+			name: "Azure",
+			uploader: func(log logger.Logger) (storage.Uploader, error) {
+				return storage.NewAzureUploader(os.Getenv("AZURE_CONTAINER"), nil, log)
+			},
+			requiredEnvVars: []string{"AZURE_CONTAINER"},
+		},
+		{
+			name: "GCS",
+			uploader: func(log logger.Logger) (storage.Uploader, error) {
+				return storage.NewGCSUploader(os.Getenv("GCS_BUCKET"), os.Getenv("GCS_ENDPOINT"), nil, log)
+			},
+			requiredEnvVars: []string{"GCS_BUCKET"},
+		},
+		{
+			name: "WebDAV",
+			uploader: func(log logger.Logger) (storage.Uploader, error) {
+				return storage.NewWebDAVUploader(os.Getenv("WEBDAV_URL"), os.Getenv("WEBDAV_USER"), nil, log)
+			},
+			requiredEnvVars: []string{"WEBDAV_URL"},
+		},
+		{
+			name: "FTP",
+			uploader: func(log logger.Logger) (storage.Uploader, error) {
+				port := 0
+				if portStr := os.Getenv("FTP_PORT"); portStr != "" {
+					fmt.Sscanf(portStr, "%d", &port)
+				}
+				return storage.NewFTPUploader(storage.FTPConfig{
+					Host:               os.Getenv("FTP_HOST"),
+					Port:               port,
+					Username:           os.Getenv("FTP_USER"),
+					BasePath:           os.Getenv("FTP_PATH"),
+					TLSMode:            os.Getenv("FTP_TLS"),
+					InsecureSkipVerify: os.Getenv("FTP_INSECURE") == "true",
+				}, nil, log)
+			},
+			requiredEnvVars: []string{"FTP_HOST", "FTP_USER", "FTP_PASSWORD"},
+		},
 		{
 			name: "SFTP",
 			uploader: func(log logger.Logger) (storage.Uploader, error) {
@@ -65,11 +119,19 @@ func getProviderConfigs() []providerConfig {
 					port,
 					os.Getenv("SFTP_USER"),
 					os.Getenv("SFTP_PATH"),
+					nil,
 					log,
 				)
 			},
 			requiredEnvVars: []string{"SFTP_HOST", "SFTP_USER", "SFTP_PATH"},
 		},
+		{
+			name: "Local",
+			uploader: func(log logger.Logger) (storage.Uploader, error) {
+				return storage.NewLocalUploader(os.Getenv("LOCAL_PATH"), log)
+			},
+			requiredEnvVars: []string{"LOCAL_PATH"},
+		},
 	}
 }
 
@@ -93,6 +155,19 @@ func skipIfMissingEnvVars(t *testing.T, provider providerConfig) {
 		}
 	}
 
+	if provider.name == "Azure" {
+		if os.Getenv("AZURE_STORAGE_CONNECTION_STRING") == "" &&
+			(os.Getenv("AZURE_STORAGE_ACCOUNT") == "" || os.Getenv("AZURE_STORAGE_KEY") == "") {
+			t.Skip("Skipping Azure tests: neither AZURE_STORAGE_CONNECTION_STRING nor AZURE_STORAGE_ACCOUNT/AZURE_STORAGE_KEY is set")
+		}
+	}
+
+	if provider.name == "GCS" {
+		if os.Getenv("GOOGLE_APPLICATION_CREDENTIALS") == "" && os.Getenv("GCS_ENDPOINT") == "" {
+			t.Skip("Skipping GCS tests: neither GOOGLE_APPLICATION_CREDENTIALS nor GCS_ENDPOINT is set")
+		}
+	}
+
 	if provider.name == "SFTP" {
 		if os.Getenv("SFTP_PRIVATE_KEY") == "" && os.Getenv("SFTP_PASSWORD") == "" {
 			t.Skip("Skipping SFTP tests: neither SFTP_PRIVATE_KEY nor SFTP_PASSWORD is set")